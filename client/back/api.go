@@ -0,0 +1,982 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =================================================
+//  REST API v1
+//
+//  Resources under /api/v1, with the acting user in
+//  the path: /users/{user}/contacts,
+//  /users/{user}/conversations/{contact}/messages
+//  and so on. Reads are GETs with no body, writes
+//  use POST, PUT or DELETE and answer 201, 202 or
+//  204. Errors use the JSON body of REQUEST
+//  VALIDATION. API_ROUTES registers the handlers
+//  and generates the OpenAPI document served on
+//  /api/v1/openapi.json (or printed by -openapi).
+//  The routes of client.go stay for older clients.
+// =================================================
+
+const API_PREFIX = "/api/v1"
+
+// JSON objects of /api/v1 request bodies, IDs come from the path
+type ProfileUpdate struct {
+	Firstname string
+	Lastname  string
+	Descr     string
+}
+
+type PasswordChange struct {
+	OldPassword string
+	NewPassword string
+}
+
+type PasswordConfirmation struct {
+	Password string
+}
+
+type Discoverability struct {
+	Discoverable *bool
+}
+
+type NewContactRequest struct {
+	ContactId int
+	RequestId string // optional, see requestId
+}
+
+type ContactAnswer struct {
+	Response string // "accepted", "declined" or "blocked"
+}
+
+type NewMessage struct {
+	Message        string
+	Encrypted      bool // Message is an envelope
+	Timestamp      string
+	Attachment     string // hash of an uploaded blob
+	AttachmentName string
+	ReplyToId      string // HLC of the quoted message
+	RequestId      string // optional, see requestId
+}
+
+type MessageText struct {
+	Message   string
+	Encrypted bool // Message is an envelope, as the edited message was
+	ContactId int  // recipient, to have the gateway seal the text, see END-TO-END ENCRYPTION
+}
+
+type PublicKey struct {
+	PublicKey string // base64 X25519 key
+}
+
+// JSON object, ID of a registered public key
+type RegisteredKey struct {
+	KeyId string
+}
+
+type NewReport struct {
+	Reason string
+}
+
+type NewUpload struct {
+	Size int64
+}
+
+// JSON object, status of a contact after a request or an answer
+type ContactStatus struct {
+	Status string
+}
+
+// JSON object, whether the user is idle
+type PresenceStatus struct {
+	Away bool
+}
+
+// JSON object, whether the user is typing
+type TypingStatus struct {
+	Typing bool
+}
+
+// Parameter of a route, in the path or the query string
+type apiParam struct {
+	name        string
+	kind        string // JSON schema type, "integer", "string" or "boolean"
+	description string
+}
+
+type apiRoute struct {
+	method   string
+	path     string // under API_PREFIX, with {name} path parameters
+	tag      string
+	summary  string
+	handler  http.HandlerFunc
+	query    []apiParam
+	body     any // zero value of the request body, nil for none
+	status   int // on success
+	response any // zero value of the response body, nil for none
+}
+
+// Path parameters, every route names them the same way
+var API_PATH_PARAMS = map[string]apiParam{
+	"user":    {"user", "integer", "the acting user"},
+	"contact": {"contact", "integer", "the other user"},
+	"blocked": {"blocked", "integer", "the blocked user"},
+	"hlc":     {"hlc", "string", "HLC stamp of a message, as returned with it"},
+	"pending": {"pending", "string", "pending ID returned when the message was queued"},
+	"upload":  {"upload", "string", "upload ID returned when the upload began"},
+	"hash":    {"hash", "string", "hash of the attachment"},
+	"emoji":   {"emoji", "string", "the reaction, URL encoded"},
+	"device":  {"device", "string", "device ID returned at login"},
+}
+
+var API_ROUTES = []apiRoute{
+	// users
+	{method: http.MethodPost, path: "/users", tag: "users", summary: "Create an account",
+		handler: apiCreateUser, body: CreateAccountMessage{}, status: http.StatusCreated, response: UserProfile{}},
+	{method: http.MethodPost, path: "/sessions", tag: "users", summary: "Log in with email and password",
+		handler: Login, body: LoginMessage{}, status: http.StatusOK, response: LoginResult{}},
+	{method: http.MethodPut, path: "/users/{user}", tag: "users", summary: "Replace the profile",
+		handler: apiUpdateProfile, body: ProfileUpdate{}, status: http.StatusOK, response: UserProfile{}},
+	{method: http.MethodDelete, path: "/users/{user}", tag: "users", summary: "Delete the account, the password confirms it",
+		handler: apiDeleteUser, body: PasswordConfirmation{}, status: http.StatusNoContent},
+	{method: http.MethodPut, path: "/users/{user}/password", tag: "users", summary: "Change the password",
+		handler: apiChangePassword, body: PasswordChange{}, status: http.StatusNoContent},
+	{method: http.MethodPut, path: "/users/{user}/discoverable", tag: "users", summary: "Show or hide the user in the directory",
+		handler: apiSetDiscoverable, body: Discoverability{}, status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/users/{user}/directory", tag: "users", summary: "Search other users, one page at a time",
+		handler: apiSearchUsers, status: http.StatusOK, response: Directory{},
+		query: []apiParam{
+			{"q", "string", "prefix of a name or email, empty for everyone"},
+			{"limit", "integer", "users per page"},
+			{"after", "integer", "Next of the previous page"},
+		}},
+	{method: http.MethodGet, path: "/users/{user}/devices", tag: "users", summary: "List the devices the user logged in from",
+		handler: apiGetDevices, status: http.StatusOK, response: []DeviceInfo{}},
+	{method: http.MethodDelete, path: "/users/{user}/devices/{device}", tag: "users", summary: "Revoke a device",
+		handler: apiRevokeDevice, status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/users/{user}/devices/{device}/changes", tag: "users", summary: "Messages and contacts changed after a cursor, acknowledging it",
+		handler: apiSyncDevice, status: http.StatusOK, response: SyncResult{},
+		query: []apiParam{
+			{"cursor", "integer", "Cursor of the previous sync, or of the login"},
+			{"limit", "integer", "changes at most"},
+		}},
+
+	// contacts
+	{method: http.MethodGet, path: "/users/{user}/contacts", tag: "contacts", summary: "List accepted contacts",
+		handler: apiGetContacts, status: http.StatusOK, response: []UserProfile{}},
+	{method: http.MethodGet, path: "/users/{user}/contact-requests", tag: "contacts", summary: "List contact requests waiting for an answer",
+		handler: apiGetContactRequests, status: http.StatusOK, response: []UserProfile{}},
+	{method: http.MethodPost, path: "/users/{user}/contact-requests", tag: "contacts", summary: "Send a contact request",
+		handler: apiSendContactRequest, body: NewContactRequest{}, status: http.StatusCreated, response: ContactStatus{}},
+	{method: http.MethodPut, path: "/users/{user}/contact-requests/{contact}", tag: "contacts", summary: "Answer a contact request",
+		handler: apiRespondContactRequest, body: ContactAnswer{}, status: http.StatusOK, response: ContactStatus{}},
+	{method: http.MethodGet, path: "/users/{user}/blocks", tag: "contacts", summary: "List blocked users",
+		handler: apiGetBlockedUsers, status: http.StatusOK, response: []UserProfile{}},
+	{method: http.MethodPut, path: "/users/{user}/blocks/{blocked}", tag: "contacts", summary: "Block a user",
+		handler: apiBlockUser, status: http.StatusNoContent},
+	{method: http.MethodDelete, path: "/users/{user}/blocks/{blocked}", tag: "contacts", summary: "Unblock a user",
+		handler: apiUnblockUser, status: http.StatusNoContent},
+
+	// conversations
+	{method: http.MethodGet, path: "/users/{user}/conversations/{contact}/messages", tag: "conversations", summary: "List the messages of a conversation",
+		handler: apiGetMessages, status: http.StatusOK, response: []ChatMessage{}},
+	{method: http.MethodPost, path: "/users/{user}/conversations/{contact}/messages", tag: "conversations", summary: "Queue a message for delivery",
+		handler: apiSendMessage, body: NewMessage{}, status: http.StatusAccepted, response: PendingMessage{},
+		query: []apiParam{{"wait", "boolean", "wait for the delivery: 200 once sent, the leader's error if refused"}}},
+	{method: http.MethodGet, path: "/users/{user}/outbox", tag: "conversations", summary: "Status of the user's queued messages",
+		handler: apiGetUserOutbox, status: http.StatusOK, response: []OutboxEntry{}},
+	{method: http.MethodGet, path: "/outbox/{pending}", tag: "conversations", summary: "Status of a queued message",
+		handler: apiGetOutboxEntry, status: http.StatusOK, response: OutboxEntry{}},
+
+	// messages
+	{method: http.MethodPut, path: "/users/{user}/messages/{hlc}", tag: "messages", summary: "Edit a sent message",
+		handler: apiEditMessage, body: MessageText{}, status: http.StatusNoContent},
+	{method: http.MethodDelete, path: "/users/{user}/messages/{hlc}", tag: "messages", summary: "Delete a sent message",
+		handler: apiDeleteMessage, status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/users/{user}/messages/{hlc}/history", tag: "messages", summary: "Earlier texts of an edited message",
+		handler: apiGetMessageHistory, status: http.StatusOK, response: []MessageVersion{}},
+	{method: http.MethodPost, path: "/users/{user}/messages/{hlc}/reports", tag: "messages", summary: "Report a message to the moderators",
+		handler: apiReportMessage, body: NewReport{}, status: http.StatusCreated},
+	{method: http.MethodPut, path: "/users/{user}/messages/{hlc}/reactions/{emoji}", tag: "messages", summary: "React to a message",
+		handler: apiAddReaction, status: http.StatusNoContent},
+	{method: http.MethodDelete, path: "/users/{user}/messages/{hlc}/reactions/{emoji}", tag: "messages", summary: "Remove a reaction",
+		handler: apiRemoveReaction, status: http.StatusNoContent},
+
+	// encryption
+	{method: http.MethodPut, path: "/users/{user}/public-key", tag: "encryption", summary: "Register or replace the user's X25519 public key",
+		handler: apiRegisterPublicKey, body: PublicKey{}, status: http.StatusOK, response: RegisteredKey{}},
+	{method: http.MethodGet, path: "/users/{user}/contacts/{contact}/public-key", tag: "encryption", summary: "Public key to encrypt messages to a contact",
+		handler: apiGetPublicKey, status: http.StatusOK, response: PublicKeyInfo{}},
+
+	// presence
+	{method: http.MethodPut, path: "/users/{user}/presence", tag: "presence", summary: "Heartbeat of a logged-in user, every few seconds",
+		handler: apiHeartbeat, body: PresenceStatus{}, status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/users/{user}/presence", tag: "presence", summary: "Presence of every contact, and whether they are typing to the user",
+		handler: apiGetPresence, status: http.StatusOK, response: []PresenceInfo{}},
+	{method: http.MethodGet, path: "/users/{user}/contacts/{contact}/presence", tag: "presence", summary: "Presence of a contact",
+		handler: apiGetContactPresence, status: http.StatusOK, response: PresenceInfo{}},
+	{method: http.MethodPut, path: "/users/{user}/conversations/{contact}/typing", tag: "presence", summary: "Start or stop typing to a contact, typing stops by itself after a few seconds",
+		handler: apiSetTyping, body: TypingStatus{}, status: http.StatusNoContent},
+
+	// attachments
+	{method: http.MethodPost, path: "/users/{user}/uploads", tag: "attachments", summary: "Begin an upload",
+		handler: apiBeginUpload, body: NewUpload{}, status: http.StatusCreated, response: UploadSession{}},
+	{method: http.MethodPost, path: "/uploads/{upload}/chunks", tag: "attachments", summary: "Upload the next chunk, the body is the raw bytes",
+		handler: apiUploadChunk, body: []byte{}, status: http.StatusOK, response: UploadSession{},
+		query: []apiParam{{"offset", "integer", "position of the chunk in the file"}}},
+	{method: http.MethodPost, path: "/uploads/{upload}/finish", tag: "attachments", summary: "Check and store a complete upload",
+		handler: apiFinishUpload, status: http.StatusOK, response: BlobInfo{}},
+	{method: http.MethodGet, path: "/users/{user}/attachments/{hash}", tag: "attachments", summary: "Download an attachment, with Range support",
+		handler: apiDownloadAttachment, status: http.StatusOK, response: []byte{}},
+}
+
+/*
+Registers API_ROUTES, one handler per path that picks the route by
+method. GET routes answer HEAD too
+*/
+func RegisterAPI(serv *http.ServeMux) {
+	var paths []string
+	routes := make(map[string]map[string]http.HandlerFunc)
+	for _, route := range API_ROUTES {
+		if routes[route.path] == nil {
+			paths = append(paths, route.path)
+			routes[route.path] = make(map[string]http.HandlerFunc)
+		}
+		routes[route.path][route.method] = route.handler
+		if route.method == http.MethodGet {
+			routes[route.path][http.MethodHead] = route.handler
+		}
+	}
+
+	for _, path := range paths {
+		methods := routes[path]
+		var allowed []string
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		slices.Sort(allowed)
+		pattern := API_PREFIX + path
+		serv.Handle(pattern, instrument(pattern, func(w http.ResponseWriter, req *http.Request) {
+			handler, ok := methods[req.Method]
+			if !ok {
+				methodNotAllowed(w, req, allowed)
+				return
+			}
+			handler(w, req)
+		}))
+	}
+	serv.HandleFunc(API_PREFIX+"/openapi.json", allow(ServeOpenAPI, http.MethodGet, http.MethodHead))
+}
+
+// A positive integer path parameter such as {user}, false after writing the error
+func pathId(w http.ResponseWriter, req *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(req.PathValue(name))
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, name+" must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// The {user} and {contact} path parameters
+func pathIds(w http.ResponseWriter, req *http.Request, other string) (int, int, bool) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return 0, 0, false
+	}
+	contact, ok := pathId(w, req, other)
+	return user, contact, ok
+}
+
+// Calls the leader and answers status with no body
+func callNoContent(w http.ResponseWriter, req *http.Request, funcName string, args any) {
+	var response RPCResponse
+	if callEndpoint(w, req, funcName, args, &response) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// =================================================
+//  REST API v1, users
+// =================================================
+
+func apiCreateUser(w http.ResponseWriter, req *http.Request) {
+	var message CreateAccountMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	if profile, ok := createAccount(w, req, message); ok {
+		w.Header().Set("Location", fmt.Sprintf("%s/users/%d", API_PREFIX, profile.UserId))
+		writeJSON(w, http.StatusCreated, profile)
+	}
+}
+
+func apiUpdateProfile(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message ProfileUpdate
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	updateProfile(w, req, UserProfile{UserId: user, Firstname: message.Firstname, Lastname: message.Lastname, Descr: message.Descr})
+}
+
+func apiDeleteUser(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message PasswordConfirmation
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.required("Password", message.Password)
+	if v.failed(w) {
+		return
+	}
+	callNoContent(w, req, "MessageHandler.DeleteAccount", &DeleteAccountRequest{UserId: user, Password: hashPassword(message.Password)})
+}
+
+func apiChangePassword(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message PasswordChange
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.required("OldPassword", message.OldPassword)
+	v.required("NewPassword", message.NewPassword)
+	if v.failed(w) {
+		return
+	}
+	callNoContent(w, req, "MessageHandler.ChangePassword", &ChangePasswordRequest{
+		UserId:      user,
+		OldPassword: hashPassword(message.OldPassword),
+		NewPassword: hashPassword(message.NewPassword),
+	})
+}
+
+func apiSetDiscoverable(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message Discoverability
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.check(message.Discoverable != nil, "Discoverable must be true or false")
+	if v.failed(w) {
+		return
+	}
+	callNoContent(w, req, "MessageHandler.SetDiscoverable", &DiscoverableRequest{UserId: user, Discoverable: *message.Discoverable})
+}
+
+func apiSearchUsers(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	query := req.URL.Query()
+	message := DirectoryRequest{UserId: user, Query: query.Get("q")}
+
+	var v validation
+	var err error
+	if text := query.Get("limit"); text != "" {
+		message.Limit, err = strconv.Atoi(text)
+		v.check(err == nil && message.Limit >= 0, "limit must be an integer, 0 or more")
+	}
+	if text := query.Get("after"); text != "" {
+		message.After, err = strconv.Atoi(text)
+		v.check(err == nil && message.After >= 0, "after must be an integer, 0 or more")
+	}
+	v.maxLength("q", message.Query, MAX_NAME_LENGTH)
+	if v.failed(w) {
+		return
+	}
+
+	var response Directory
+	if callEndpoint(w, req, "MessageHandler.SearchUsers", &message, &response) {
+		if response.Users == nil {
+			response.Users = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+func apiGetDevices(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		listDevices(w, req, user)
+	}
+}
+
+func apiRevokeDevice(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	callNoContent(w, req, "MessageHandler.RevokeDevice", &DeviceRequest{UserId: user, DeviceId: req.PathValue("device")})
+}
+
+func apiSyncDevice(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	query := req.URL.Query()
+	message := SyncRequest{UserId: user, DeviceId: req.PathValue("device")}
+
+	var v validation
+	var err error
+	if text := query.Get("cursor"); text != "" {
+		message.Cursor, err = strconv.ParseInt(text, 10, 64)
+		v.check(err == nil, "cursor must be an integer")
+	}
+	if text := query.Get("limit"); text != "" {
+		message.Limit, err = strconv.Atoi(text)
+		v.check(err == nil, "limit must be an integer")
+	}
+	if v.failed(w) {
+		return
+	}
+	syncDevice(w, req, message)
+}
+
+// =================================================
+//  REST API v1, contacts
+// =================================================
+
+// Lists one of the user's lists of profiles, pick chooses it from the reply
+func listProfiles(w http.ResponseWriter, req *http.Request, funcName string, pick func(*Contacts) []UserProfile) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var response Contacts
+	if callEndpoint(w, req, funcName, &UserProfile{UserId: user}, &response) {
+		profiles := pick(&response)
+		if profiles == nil {
+			profiles = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, profiles)
+	}
+}
+
+func apiGetContacts(w http.ResponseWriter, req *http.Request) {
+	listProfiles(w, req, "MessageHandler.GetContacts", func(c *Contacts) []UserProfile { return c.ContactList })
+}
+
+func apiGetContactRequests(w http.ResponseWriter, req *http.Request) {
+	listProfiles(w, req, "MessageHandler.GetContacts", func(c *Contacts) []UserProfile { return c.Pending })
+}
+
+func apiGetBlockedUsers(w http.ResponseWriter, req *http.Request) {
+	listProfiles(w, req, "MessageHandler.GetBlockedUsers", func(c *Contacts) []UserProfile { return c.ContactList })
+}
+
+func apiSendContactRequest(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message NewContactRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("ContactId", message.ContactId)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	messageToBack := &AddContactMessage{UserId: user, ContactId: message.ContactId, RequestId: requestId(req, message.RequestId)}
+	if callEndpoint(w, req, "MessageHandler.SendContactRequest", messageToBack, &response) {
+		writeJSON(w, http.StatusCreated, ContactStatus{Status: response.Message})
+	}
+}
+
+func apiRespondContactRequest(w http.ResponseWriter, req *http.Request) {
+	user, contact, ok := pathIds(w, req, "contact")
+	if !ok {
+		return
+	}
+	var message ContactAnswer
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.required("Response", message.Response)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	messageToBack := &ContactResponse{UserId: user, ContactId: contact, Response: message.Response}
+	if callEndpoint(w, req, "MessageHandler.RespondContactRequest", messageToBack, &response) {
+		writeJSON(w, http.StatusOK, ContactStatus{Status: response.Message})
+	}
+}
+
+func apiBlockUser(w http.ResponseWriter, req *http.Request) {
+	if user, blocked, ok := pathIds(w, req, "blocked"); ok {
+		callNoContent(w, req, "MessageHandler.BlockUser", &BlockUserRequest{UserId: user, BlockedId: blocked})
+	}
+}
+
+func apiUnblockUser(w http.ResponseWriter, req *http.Request) {
+	if user, blocked, ok := pathIds(w, req, "blocked"); ok {
+		callNoContent(w, req, "MessageHandler.UnblockUser", &BlockUserRequest{UserId: user, BlockedId: blocked})
+	}
+}
+
+// =================================================
+//  REST API v1, conversations and messages
+// =================================================
+
+func apiGetMessages(w http.ResponseWriter, req *http.Request) {
+	user, contact, ok := pathIds(w, req, "contact")
+	if !ok {
+		return
+	}
+	var response MessageList
+	if callEndpoint(w, req, "MessageHandler.GetMessages", &GetMessagesRequest{UserId: user, ContactId: contact}, &response) {
+		if response.Messages == nil {
+			response.Messages = []ChatMessage{} // gob drops empty slices
+		}
+		openMessages(user, response.Messages)
+		writeJSON(w, http.StatusOK, response.Messages)
+	}
+}
+
+func apiSendMessage(w http.ResponseWriter, req *http.Request) {
+	user, contact, ok := pathIds(w, req, "contact")
+	if !ok {
+		return
+	}
+	var message NewMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	queueMessage(w, req, ChatMessage{
+		Message:        message.Message,
+		Timestamp:      message.Timestamp,
+		From:           user,
+		To:             contact,
+		Encrypted:      message.Encrypted,
+		Attachment:     message.Attachment,
+		AttachmentName: message.AttachmentName,
+		ReplyToId:      message.ReplyToId,
+		RequestId:      message.RequestId,
+	}, API_PREFIX+"/outbox/")
+}
+
+func apiGetUserOutbox(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		entries := OUTBOX.ForUser(user)
+		if entries == nil {
+			entries = []OutboxEntry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+func apiGetOutboxEntry(w http.ResponseWriter, req *http.Request) {
+	entry, ok := OUTBOX.Get(req.PathValue("pending"))
+	if !ok {
+		writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "no such pending message")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func apiEditMessage(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message MessageText
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.required("Message", message.Message)
+	v.messageText("Message", message.Message, message.Encrypted)
+	if v.failed(w) {
+		return
+	}
+	edit := EditMessageRequest{
+		UserId:    user,
+		HLC:       req.PathValue("hlc"),
+		Message:   message.Message,
+		Encrypted: message.Encrypted,
+	}
+	if err := sealEdit(req.Context(), &edit, message.ContactId); err != nil {
+		writeRPCError(w, "MessageHandler.EditMessage", err, http.StatusBadRequest)
+		return
+	}
+	callNoContent(w, req, "MessageHandler.EditMessage", &edit)
+}
+
+func apiDeleteMessage(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		callNoContent(w, req, "MessageHandler.DeleteMessage", &EditMessageRequest{UserId: user, HLC: req.PathValue("hlc")})
+	}
+}
+
+func apiGetMessageHistory(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var response MessageHistory
+	if callEndpoint(w, req, "MessageHandler.GetMessageHistory", &EditMessageRequest{UserId: user, HLC: req.PathValue("hlc")}, &response) {
+		if response.Versions == nil {
+			response.Versions = []MessageVersion{}
+		}
+		writeJSON(w, http.StatusOK, response.Versions)
+	}
+}
+
+func apiReportMessage(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message NewReport
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.maxLength("Reason", message.Reason, MAX_REPORT_REASON)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, "MessageHandler.ReportMessage", &ReportRequest{UserId: user, HLC: req.PathValue("hlc"), Reason: message.Reason}, &response) {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func apiAddReaction(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		changeReaction(w, req, "MessageHandler.AddReaction", ReactionRequest{UserId: user, HLC: req.PathValue("hlc"), Emoji: req.PathValue("emoji")})
+	}
+}
+
+func apiRemoveReaction(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		changeReaction(w, req, "MessageHandler.RemoveReaction", ReactionRequest{UserId: user, HLC: req.PathValue("hlc"), Emoji: req.PathValue("emoji")})
+	}
+}
+
+// =================================================
+//  REST API v1, encryption
+// =================================================
+
+func apiRegisterPublicKey(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message PublicKey
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	registerPublicKey(w, req, PublicKeyRequest{UserId: user, PublicKey: message.PublicKey})
+}
+
+func apiGetPublicKey(w http.ResponseWriter, req *http.Request) {
+	if user, contact, ok := pathIds(w, req, "contact"); ok {
+		getPublicKey(w, req, GetPublicKeyRequest{UserId: user, ContactId: contact})
+	}
+}
+
+// =================================================
+//  REST API v1, presence
+// =================================================
+
+func apiHeartbeat(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message PresenceStatus
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	heartbeat(w, req, PresenceHeartbeat{UserId: user, Away: message.Away})
+}
+
+func apiGetPresence(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var response PresenceList
+	if callEndpoint(w, req, "MessageHandler.GetPresence", &PresenceRequest{UserId: user}, &response) {
+		if response.Users == nil {
+			response.Users = []PresenceInfo{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.Users)
+	}
+}
+
+func apiGetContactPresence(w http.ResponseWriter, req *http.Request) {
+	user, contact, ok := pathIds(w, req, "contact")
+	if !ok {
+		return
+	}
+	var response PresenceList
+	if callEndpoint(w, req, "MessageHandler.GetPresence", &PresenceRequest{UserId: user, ContactId: contact}, &response) {
+		if len(response.Users) != 1 {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "no such contact")
+			return
+		}
+		writeJSON(w, http.StatusOK, response.Users[0])
+	}
+}
+
+func apiSetTyping(w http.ResponseWriter, req *http.Request) {
+	user, contact, ok := pathIds(w, req, "contact")
+	if !ok {
+		return
+	}
+	var message TypingStatus
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	setTyping(w, req, TypingUpdate{UserId: user, ContactId: contact, Typing: message.Typing})
+}
+
+// =================================================
+//  REST API v1, attachments
+// =================================================
+
+func apiBeginUpload(w http.ResponseWriter, req *http.Request) {
+	user, ok := pathId(w, req, "user")
+	if !ok {
+		return
+	}
+	var message NewUpload
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.check(message.Size > 0, "Size is required")
+	if v.failed(w) {
+		return
+	}
+
+	var session UploadSession
+	if callEndpoint(w, req, "MessageHandler.BeginUpload", &BeginUploadRequest{UserId: user, Size: message.Size}, &session) {
+		writeJSON(w, http.StatusCreated, session)
+	}
+}
+
+func apiUploadChunk(w http.ResponseWriter, req *http.Request) {
+	uploadChunk(w, req, req.PathValue("upload"))
+}
+
+func apiFinishUpload(w http.ResponseWriter, req *http.Request) {
+	var info BlobInfo
+	if callEndpoint(w, req, "MessageHandler.FinishUpload", &UploadSession{UploadId: req.PathValue("upload")}, &info) {
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func apiDownloadAttachment(w http.ResponseWriter, req *http.Request) {
+	if user, ok := pathId(w, req, "user"); ok {
+		serveAttachment(w, req, user, req.PathValue("hash"))
+	}
+}
+
+// =================================================
+//  REST API v1, OpenAPI document
+// =================================================
+
+// Built once from API_ROUTES
+var openAPIDocument = sync.OnceValue(func() map[string]any { return OpenAPIDocument(API_ROUTES) })
+
+func ServeOpenAPI(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+// OpenAPI 3 document of routes, schemas come from the Go types
+func OpenAPIDocument(routes []apiRoute) map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]map[string]any)
+
+	for _, route := range routes {
+		var parameters []any
+		for _, name := range pathParams(route.path) {
+			param := API_PATH_PARAMS[name]
+			parameters = append(parameters, map[string]any{
+				"name": name, "in": "path", "required": true,
+				"description": param.description, "schema": map[string]any{"type": param.kind},
+			})
+		}
+		for _, param := range route.query {
+			parameters = append(parameters, map[string]any{
+				"name": param.name, "in": "query",
+				"description": param.description, "schema": map[string]any{"type": param.kind},
+			})
+		}
+
+		success := map[string]any{"description": http.StatusText(route.status)}
+		if route.response != nil {
+			success["content"] = openAPIContent(route.response, schemas)
+		}
+		operation := map[string]any{
+			"summary": route.summary,
+			"tags":    []string{route.tag},
+			"responses": map[string]any{
+				strconv.Itoa(route.status): success,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     openAPIContent(APIError{}, schemas),
+				},
+			},
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.body != nil {
+			operation["requestBody"] = map[string]any{"required": true, "content": openAPIContent(route.body, schemas)}
+		}
+
+		if paths[API_PREFIX+route.path] == nil {
+			paths[API_PREFIX+route.path] = make(map[string]any)
+		}
+		paths[API_PREFIX+route.path][strings.ToLower(route.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "MeChat gateway",
+			"version":     "1",
+			"description": "Errors are answered with an APIError body. 503 responses carry Retry-After.",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// names of the {name} parameters of a path, in order
+func pathParams(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, segment[1:len(segment)-1])
+		}
+	}
+	return names
+}
+
+// Request or response content, raw bytes for []byte
+func openAPIContent(body any, schemas map[string]any) map[string]any {
+	if _, ok := body.([]byte); ok {
+		return map[string]any{"application/octet-stream": map[string]any{
+			"schema": map[string]any{"type": "string", "format": "binary"},
+		}}
+	}
+	return map[string]any{"application/json": map[string]any{
+		"schema": openAPISchema(reflect.TypeOf(body), schemas),
+	}}
+}
+
+/*
+JSON schema of a Go type as encoding/json writes it. Named structs
+are added to schemas once and referenced
+*/
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		schema := openAPISchema(t.Elem(), schemas)
+		if _, ref := schema["$ref"]; !ref {
+			schema["nullable"] = true
+		}
+		return schema
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"} // base64
+		}
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIObject(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]any{} // placeholder, stops recursion
+			schemas[t.Name()] = openAPIObject(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func openAPIObject(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			// embedded, its fields are encoded inline
+			maps.Copy(properties, openAPIObject(field.Type, schemas)["properties"].(map[string]any))
+			continue
+		}
+		if tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		properties[name] = openAPISchema(field.Type, schemas)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The /api/v1 routes on a mux of their own, with an outbox in the test's directory
+func apiServer(t *testing.T) *http.ServeMux {
+	t.Helper()
+	saved := OUTBOX
+	OUTBOX = openTestOutbox(t, filepath.Join(t.TempDir(), "outbox.jsonl"))
+	t.Cleanup(func() { OUTBOX = saved })
+
+	serv := http.NewServeMux()
+	RegisterAPI(serv)
+	return serv
+}
+
+func serve(serv *http.ServeMux, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	serv.ServeHTTP(w, req)
+	return w
+}
+
+// The path of a route with every parameter filled in
+func routePath(route apiRoute) string {
+	path := route.path
+	for _, name := range pathParams(route.path) {
+		path = strings.Replace(path, "{"+name+"}", "7", 1)
+	}
+	return API_PREFIX + path
+}
+
+func TestEveryRouteRegistered(t *testing.T) {
+	_, replicas := fakeCluster(t, 1)
+	replicas[0].crash()
+	serv := apiServer(t)
+
+	for _, route := range API_ROUTES {
+		methods := []string{route.method}
+		if route.method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+		for _, method := range methods {
+			w := serve(serv, method, routePath(route), "{}")
+			// the mux answers unknown paths with text, handlers with an APIError
+			if w.Code == http.StatusMethodNotAllowed || w.Header().Get("Content-Type") != "application/json" && w.Code == http.StatusNotFound {
+				t.Errorf("%s %s: %d %s", method, route.path, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestAPIMethodNotAllowed(t *testing.T) {
+	serv := apiServer(t)
+	for _, test := range []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodPatch, "/users/7", "DELETE, PUT"},
+		{http.MethodGet, "/users", "POST"},
+		{http.MethodPost, "/users/7/contacts", "GET, HEAD"},
+		{http.MethodDelete, "/users/7/conversations/8/messages", "GET, HEAD, POST"},
+		{http.MethodPost, "/openapi.json", "GET, HEAD"},
+	} {
+		w := serve(serv, test.method, API_PREFIX+test.path, "")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s: %d, Allow %q, want %q", test.method, test.path, w.Code, w.Header().Get("Allow"), test.allow)
+			continue
+		}
+		if apiErr := errorBody(t, w); apiErr.Code != ERR_METHOD_NOT_ALLOWED {
+			t.Errorf("%s %s: code %q", test.method, test.path, apiErr.Code)
+		}
+	}
+}
+
+func TestAPIPathIds(t *testing.T) {
+	serv := apiServer(t)
+	for _, test := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/users/abc/contacts"},
+		{http.MethodGet, "/users/0/contacts"},
+		{http.MethodPut, "/users/-1/blocks/2"},
+		{http.MethodPut, "/users/1/blocks/x"},
+	} {
+		w := serve(serv, test.method, API_PREFIX+test.path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d", test.method, test.path, w.Code)
+			continue
+		}
+		if apiErr := errorBody(t, w); apiErr.Code != ERR_INVALID_REQUEST || !strings.Contains(apiErr.Message, "must be a positive integer") {
+			t.Errorf("%s %s: %+v", test.method, test.path, apiErr)
+		}
+	}
+}
+
+func TestAPISuccessStatus(t *testing.T) {
+	fakeCluster(t, 1)
+	serv := apiServer(t)
+
+	w := serve(serv, http.MethodPost, API_PREFIX+"/users", validAccount)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != API_PREFIX+"/users/1" {
+		t.Fatalf("create: %d, Location %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	w = serve(serv, http.MethodPut, API_PREFIX+"/users/1/blocks/2", "")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("block: %d %s", w.Code, w.Body)
+	}
+
+	w = serve(serv, http.MethodPost, API_PREFIX+"/users/1/conversations/2/messages", `{"Message": "hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("send: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, API_PREFIX+"/outbox/") {
+		t.Fatalf("Location %q", location)
+	}
+
+	w = serve(serv, http.MethodGet, location, "")
+	var entry OutboxEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("outbox entry: %d %s", w.Code, w.Body)
+	}
+	if entry.Message.From != 1 || entry.Message.To != 2 || entry.Status != OUTBOX_PENDING {
+		t.Errorf("outbox entry %+v", entry)
+	}
+
+	w = serve(serv, http.MethodHead, API_PREFIX+"/users/1/outbox", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("HEAD outbox: %d", w.Code)
+	}
+	if w = serve(serv, http.MethodGet, API_PREFIX+"/outbox/none", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown pending ID: %d", w.Code)
+	}
+}
+
+// The document as clients read it, from /api/v1/openapi.json
+func servedOpenAPI(t *testing.T) map[string]any {
+	t.Helper()
+	w := serve(apiServer(t), http.MethodGet, API_PREFIX+"/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var document map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	document := servedOpenAPI(t)
+	paths := document["paths"].(map[string]any)
+	schemas := document["components"].(map[string]any)["schemas"].(map[string]any)
+
+	operations := 0
+	for _, operationsOfPath := range paths {
+		operations += len(operationsOfPath.(map[string]any))
+	}
+	if operations != len(API_ROUTES) {
+		t.Errorf("%d operations for %d routes", operations, len(API_ROUTES))
+	}
+
+	for _, route := range API_ROUTES {
+		name := route.method + " " + route.path
+		operation, ok := paths[API_PREFIX+route.path].(map[string]any)[strings.ToLower(route.method)].(map[string]any)
+		if !ok {
+			t.Errorf("%s: not in the document", name)
+			continue
+		}
+		if operation["summary"] != route.summary || !slices.Equal(toStrings(operation["tags"]), []string{route.tag}) {
+			t.Errorf("%s: summary %v, tags %v", name, operation["summary"], operation["tags"])
+		}
+
+		responses := operation["responses"].(map[string]any)
+		success, ok := responses[strconv.Itoa(route.status)].(map[string]any)
+		if !ok || len(responses) != 2 || responses["default"] == nil {
+			t.Errorf("%s: responses %v, want %d and default", name, slices.Collect(maps.Keys(responses)), route.status)
+		} else if _, hasContent := success["content"]; hasContent != (route.response != nil) {
+			t.Errorf("%s: response content %v", name, success["content"])
+		}
+		if _, hasBody := operation["requestBody"]; hasBody != (route.body != nil) {
+			t.Errorf("%s: request body %v", name, operation["requestBody"])
+		}
+
+		var want []string
+		for _, param := range pathParams(route.path) {
+			if _, known := API_PATH_PARAMS[param]; !known {
+				t.Errorf("%s: {%s} is not in API_PATH_PARAMS", name, param)
+			}
+			want = append(want, "path "+param)
+		}
+		for _, param := range route.query {
+			want = append(want, "query "+param.name)
+		}
+		var got []string
+		for _, param := range toMaps(operation["parameters"]) {
+			got = append(got, param["in"].(string)+" "+param["name"].(string))
+			if param["schema"].(map[string]any)["type"] == "" {
+				t.Errorf("%s: parameter %v has no type", name, param["name"])
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: parameters %v, want %v", name, got, want)
+		}
+	}
+
+	// every reference resolves
+	var refs func(value any)
+	refs = func(value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			if ref, ok := value["$ref"].(string); ok {
+				if _, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+					t.Errorf("dangling reference %s", ref)
+				}
+			}
+			for _, inner := range value {
+				refs(inner)
+			}
+		case []any:
+			for _, inner := range value {
+				refs(inner)
+			}
+		}
+	}
+	refs(document)
+	if _, ok := schemas["APIError"]; !ok {
+		t.Error("no APIError schema")
+	}
+}
+
+func toStrings(value any) []string {
+	var list []string
+	for _, item := range value.([]any) {
+		list = append(list, item.(string))
+	}
+	return list
+}
+
+func toMaps(value any) []map[string]any {
+	var list []map[string]any
+	if value != nil {
+		for _, item := range value.([]any) {
+			list = append(list, item.(map[string]any))
+		}
+	}
+	return list
+}
@@ -1,33 +1,52 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"gopkg.in/yaml.v3"
 	"io"
-	_ "log"
+	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/mail"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ADDRESS_FILE = "replica_addrs.txt"
 var REPLICA_ADDRESSES []ReplicaAddress
-var ACTIVE_REPLICA ReplicaAddress
+
+// Mutual TLS towards the replicas, nil when TLS_CONFIG_FILE is absent
+var TLS_CONFIG_FILE = "tls_config.json"
+var GATEWAY_TLS *tls.Config
 
 type ReplicaAddress struct {
 	Address string
 	Port    uint16
 }
 
-var rpc_client *rpc.Client
+// Set once ConfirmLeader found a ready leader, served on /readyz
+var GATEWAY_READY atomic.Bool
 
 // =================================================
 //  RPC INTERFACE
@@ -43,6 +62,34 @@ type ChatMessage struct {
 	From      int
 	To        int
 	Acked     int
+	HLC       string // hybrid logical clock stamp, assigned by the leader, identifies the message
+	Edited    bool
+	Deleted   bool // tombstone, the text is gone
+	Encrypted bool // the text is an envelope, see END-TO-END ENCRYPTION
+
+	Attachment     string // hash of an uploaded blob, see /upload
+	AttachmentName string // file name given by the sender
+	AttachmentSize int64  // set by GetMessages
+	AttachmentMIME string // set by GetMessages, sniffed from the contents
+
+	ReplyToId string          // HLC of the quoted message of the same chat
+	Reactions []ReactionCount `json:",omitempty"` // set by GetMessages, per emoji, omitted when there are none
+
+	RequestId string // optional, see requestId
+}
+
+// JSON object, UserId adds or removes Emoji on the message HLC
+type ReactionRequest struct {
+	UserId int
+	HLC    string
+	Emoji  string
+}
+
+// JSON object, how many users reacted to a message with Emoji
+type ReactionCount struct {
+	Emoji string
+	Count int
+	Mine  bool // the requesting user is one of them
 }
 
 // JSON object, represents create account request received from user
@@ -52,6 +99,7 @@ type CreateAccountMessage struct {
 	Firstname string
 	Lastname  string
 	Descr     string
+	RequestId string // optional, see requestId
 }
 
 // JSON object, represents details that are relevant to a user, regaring
@@ -74,6 +122,7 @@ type GetMessagesRequest struct {
 // JSON object, array of user profiles
 type Contacts struct {
 	ContactList []UserProfile
+	Pending     []UserProfile // incoming contact requests
 }
 
 // JSON object, arrat of Chat messages
@@ -85,6 +134,9 @@ type MessageList struct {
 type LoginMessage struct {
 	Email    string
 	Password string
+
+	DeviceId   string // optional, resumes a device registered before
+	DeviceName string // optional, the User-Agent by default
 }
 
 // JSON object, represents a specific RPC response from a remote
@@ -97,396 +149,2587 @@ type RPCResponse struct {
 type AddContactMessage struct {
 	UserId    int
 	ContactId int
+	RequestId string // optional, see requestId
 }
 
-// JSON object, user ID number, wrapping in struct is necessary
-// for Golang RPC
-type IDNumber struct {
-	ID int
+// JSON object, answer to a contact request. UserId received the
+// request, ContactId sent it
+type ContactResponse struct {
+	UserId    int
+	ContactId int
+	Response  string // "accepted", "declined" or "blocked"
 }
 
-// =================================================
-//  HELPER FUNCTIONS
-// =================================================
+// JSON object, a password change. Both are SHA-256 digests
+type ChangePasswordRequest struct {
+	UserId      int
+	OldPassword string
+	NewPassword string
+}
 
-/*
-Function that acts as a wrapper around a Golang
-RPC call.
-*/
-func RemoteProcedureCall(funcName string, args any, reply any) error {
+// JSON object, deletes an account, the password confirms it
+type DeleteAccountRequest struct {
+	UserId   int
+	Password string
+}
 
-	leaderFound := ConfirmLeader()
-	for !leaderFound {
-		leaderFound = ConfirmLeader() // sets rpc_client
-	}
-	fmt.Printf("Leader is now: %s:%d\n", ACTIVE_REPLICA.Address, ACTIVE_REPLICA.Port)
-	err := rpc_client.Call(funcName, args, reply) // check for highest leader everytime
+// JSON object, a directory search
+type DirectoryRequest struct {
+	UserId int    // who is searching
+	Query  string // prefix of the first name, last name, full name or email
+	Limit  int    // users per page, 0 for the default
+	After  int    // cursor, Next of the previous page
+}
 
-	return err
+// JSON object, one page of the directory
+type Directory struct {
+	Users []UserProfile
+	Next  int // cursor for the next page, 0 on the last page
+}
 
+// JSON object, opts a user in or out of the directory
+type DiscoverableRequest struct {
+	UserId       int
+	Discoverable bool
 }
 
-/*
-Function that converts a JSON object from an HTTP
-request into a Golang map
-*/
-func RequestToJson(req *http.Request) map[string]interface{} {
-	// map to store results
-	var data map[string]interface{}
+// JSON object, UserId blocks or unblocks BlockedId
+type BlockUserRequest struct {
+	UserId    int
+	BlockedId int
+}
 
-	// read object from HTTP
-	body_text, read_err := io.ReadAll(req.Body)
-	if read_err != nil {
-		return nil
-	}
+// JSON object, a user reports a message they sent or received
+type ReportRequest struct {
+	UserId int
+	HLC    string // the reported message
+	Reason string
+}
 
-	// unmartial into map using json lib
-	err := json.Unmarshal(body_text, &data)
-	if err != nil {
-		return nil
-	}
+// JSON object, represents a request to edit or delete a sent message.
+// The message is identified by its HLC stamp
+type EditMessageRequest struct {
+	UserId    int // must be the sender
+	HLC       string
+	Message   string // new text, unused when deleting
+	Encrypted bool   // the new text is an envelope, as the message was
+}
 
-	return data
+// JSON object, one text a message had, stamped when it was written
+type MessageVersion struct {
+	Message string
+	HLC     string
 }
 
-/*
-Function to read available backend IP/ports
-for possible backend replicas.
+// JSON object, earlier texts of an edited message, oldest first
+type MessageHistory struct {
+	Versions []MessageVersion
+}
 
-These addresses are stored locally on machine,
-and may be updated by notifications from RPC
-*/
-func ReadReplicaAddresses(filename string) []ReplicaAddress {
-	var addrs []ReplicaAddress
-	bytes, _ := os.ReadFile(filename)
+// JSON object, request to start an upload
+type BeginUploadRequest struct {
+	UserId int
+	Size   int64 // total size of the file
+}
 
-	text := string(bytes)
-	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+// JSON object, an open upload session
+type UploadSession struct {
+	UploadId  string
+	ChunkSize int
+	Received  int64 // bytes stored so far, where the next chunk starts
+}
 
-	for _, replica := range lines {
-		addr := strings.Split(replica, ":")[0]
-		port, _ := strconv.ParseUint(strings.Split(replica, ":")[1], 10, 16)
-		addrs = append(addrs, ReplicaAddress{addr, uint16(port)})
-	}
+// JSON object, one chunk of an upload
+type UploadChunkRequest struct {
+	UploadId string
+	Offset   int64
+	Data     []byte
+}
 
-	return addrs
+// JSON object, a stored blob
+type BlobInfo struct {
+	Hash string // hex SHA-256 of the contents
+	Size int64
+	MIME string // sniffed from the contents
 }
 
-// =================================================
-//  HTTP ENDPOINT FUNCTIONS
-// =================================================
+// JSON object, request for part of a blob
+type ReadBlobRequest struct {
+	UserId int
+	Hash   string
+	Offset int64
+	Length int
+}
 
-/*
-Function that receives a chat message from the front-end
-UI user. Received over HTTP.
+// JSON object, part of a blob
+type BlobChunk struct {
+	Data []byte
+	Size int64 // total size of the blob
+	MIME string
+}
 
-RPC is made to remote Golang server to submit message to backend
-*/
-func HandleIncoming(w http.ResponseWriter, req *http.Request) {
+// JSON object, logs in and registers or resumes a device
+type DeviceLoginRequest struct {
+	Email      string
+	Password   string // SHA-256 digest
+	DeviceId   string // optional, a device registered before
+	DeviceName string // optional, shown in ListDevices
+}
 
-	// we expect a JSON object
-	var data map[string]interface{} // we expect
+// JSON object, the reply to DeviceLoginRequest
+type DeviceSession struct {
+	Profile  UserProfile
+	DeviceId string
+	Cursor   int64 // position in the change feed, see SyncRequest
+}
 
-	// try reading the JSON object
-	body_text, read_err := io.ReadAll(req.Body)
-	if read_err != nil {
-		http.Error(w, "Failure reading request", http.StatusBadRequest)
-		return
-	}
+// JSON object, a registered device
+type DeviceInfo struct {
+	DeviceId string
+	Name     string
+	Cursor   int64
+	Created  string // HLC of the login that registered it
+	LastSeen string // HLC of its last login or acknowledged sync
+}
 
-	// convert object into Golang map
-	err := json.Unmarshal(body_text, &data)
-	if err != nil {
-		http.Error(w, "Failure converting request to JSON", http.StatusBadRequest)
-		return
-	}
+// JSON object, the devices of a user
+type DeviceList struct {
+	Devices []DeviceInfo
+}
 
-	// parse out fields from map
-	message, _ := data["Message"].(string)
-	timestamp, _ := data["Timestamp"].(string)
-	from := int(data["From"].(float64))
-	to := int(data["To"].(float64))
-	acked := 1
+// JSON object, names a device of UserId
+type DeviceRequest struct {
+	UserId   int
+	DeviceId string
+}
 
-	// instantiate out ChatMessage for RPC call
-	messageToBack := &ChatMessage{
-		Message:   message,
-		Timestamp: timestamp,
-		From:      from,
-		To:        to,
-		Acked:     acked,
-	}
+// JSON object, asks for the changes after Cursor
+type SyncRequest struct {
+	UserId   int
+	DeviceId string
+	Cursor   int64 // the last cursor the device received, acknowledges it
+	Limit    int   // changes at most, 0 for the default
+}
 
-	// string response expected from remote
-	var response string
+// JSON object, a contact whose status changed. Status is "accepted",
+// "pending" (the user asked), "requested" (the contact asked),
+// "blocked" or empty when nothing is left between the two
+type ContactChange struct {
+	Contact UserProfile
+	Status  string
+	KeyId   string // public key of the contact, a new one means it changed
+}
 
-	// make RPC call with message, store result in response
-	resp := rpc_client.Call("MessageHandler.SaveMessage", messageToBack, &response)
+// JSON object, the changes after a cursor
+type SyncResult struct {
+	Messages []ChatMessage   // current state of new, edited and deleted messages
+	Contacts []ContactChange // current status of changed contacts
+	Cursor   int64           // acknowledge with the next sync
+	More     bool            // more changes follow, sync again
+}
 
-	// resp is either error or nil
-	if resp != nil {
-		fmt.Println("Error response from SaveMessage RPC ", resp)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		fmt.Println(data)
-		w.WriteHeader(http.StatusOK)
-	}
+// JSON object, registers the X25519 public key of UserId
+type PublicKeyRequest struct {
+	UserId    int
+	PublicKey string // base64, 32 bytes
+}
 
+// JSON object, asks for the public key of ContactId
+type GetPublicKeyRequest struct {
+	UserId    int
+	ContactId int
 }
 
-// TODO: Skip for now Should this be done differently? Do we want backend to notify
-//
-//	client of leader change?
-func ConfirmLeader() bool {
-	leaderId := -1
-	for _, replica := range REPLICA_ADDRESSES {
-		caller, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", replica.Address, replica.Port), 100*time.Millisecond) // #TODO MAKE FINDING NEW LEADER BETTER
-
-		if err == nil {
-			var pid IDNumber
-			msg := IDNumber{-1}
-			client := rpc.NewClient(caller)
-			client.Call("MessageHandler.GetPID", msg, &pid)
-			if pid.ID > leaderId {
-				leaderId = pid.ID
-			}
-		}
-	}
-	if leaderId == -1 {
-		return false
-	}
+// JSON object, the registered key of a user
+type PublicKeyInfo struct {
+	UserId     int
+	PublicKey  string // base64
+	KeyId      string
+	Registered string // HLC of the registration
+}
 
-	ACTIVE_REPLICA = REPLICA_ADDRESSES[leaderId]
-	rpc_client, _ = rpc.Dial("tcp", fmt.Sprintf("%s:%d", ACTIVE_REPLICA.Address, ACTIVE_REPLICA.Port))
-	return true
+// JSON object, a heartbeat of a logged-in user
+type PresenceHeartbeat struct {
+	UserId int
+	Away   bool          // the client is idle
+	Age    time.Duration // how long ago the user was seen, 0 for now
+}
 
+// JSON object, UserId started or stopped typing to ContactId
+type TypingUpdate struct {
+	UserId    int
+	ContactId int
+	Typing    bool
+	Age       time.Duration // how long ago the user said so, 0 for now
 }
 
-/*
-HTTP endpoint function. Receives account create request from user,
-relays request to remote over RPC, and returns result
-of database operation
-*/
-func CreateAccount(w http.ResponseWriter, req *http.Request) {
-	// convert JSON object, into map, parse out values
-	data := RequestToJson(req)
-	email, _ := data["Email"].(string)
-	pass, _ := data["Password"].(string)
-	first, _ := data["Firstname"].(string)
-	last, _ := data["Lastname"].(string)
-	descr, _ := data["Descr"].(string)
-
-	// store passwords as sha256 digests
-	h := sha256.New()
-	h.Write([]byte(pass))
-	hash_pass := hex.EncodeToString(h.Sum(nil))
+// JSON object, everything the gateway knows, sent to the leader
+type PresenceReport struct {
+	Heartbeats []PresenceHeartbeat
+	Typing     []TypingUpdate
+}
 
-	// instantiate message struct for use in RPC
-	messageToBack := &CreateAccountMessage{
-		Email:     email,
-		Password:  hash_pass,
-		Firstname: first,
-		Lastname:  last,
-		Descr:     descr,
-	}
+// JSON object, asks for the presence of ContactId, or of every contact when 0
+type PresenceRequest struct {
+	UserId    int
+	ContactId int
+}
 
-	// make RPC call, store response
-	var response RPCResponse
-	resp := RemoteProcedureCall("MessageHandler.CreateAccount", messageToBack, &response)
+// JSON object, presence of a contact as seen by the requesting user
+type PresenceInfo struct {
+	UserId   int
+	Status   string // online, away or offline
+	LastSeen string // RFC 3339, empty if the leader never heard of the user
+	Typing   bool   // typing to the requesting user
+}
 
-	// if there was an error, return error HTTP request
-	if resp != nil {
-		fmt.Println("Error response from create user RPC ", response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else { // else send HTTP 200 OK, send back user info including new user ID
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		user_id, _ := strconv.Atoi(response.Message)
-		profileResponse := UserProfile{
-			UserId:    user_id,
-			Email:     email,
-			Firstname: first,
-			Lastname:  last,
-			Descr:     descr,
-		}
-		json.NewEncoder(w).Encode(profileResponse)
-	}
+// JSON object, presence of several contacts
+type PresenceList struct {
+	Users []PresenceInfo
 }
 
-/*
-HTTP endpoint function. Receives an 'add contact'request from user,
-relays request to remote over RPC, and returns result
-of database operation
-*/
-func AddContact(w http.ResponseWriter, req *http.Request) {
-	// parse HTTP request, convert JSON string to map
-	data := RequestToJson(req)
-	user, _ := data["UserId"].(float64)
-	contact, _ := data["ContactId"].(float64)
-	int_user := int(user)
-	int_contact := int(contact)
+// JSON object, user ID number, wrapping in struct is necessary
+// for Golang RPC
+type IDNumber struct {
+	ID int
+}
+
+// Health of a replica, answer of MessageHandler.GetHealth
+type HealthStatus struct {
+	NodeID      int    `json:"node_id"`
+	Live        bool   `json:"live"`
+	Ready       bool   `json:"ready"`
+	Reason      string `json:"reason,omitempty"`
+	LeaderID    int    `json:"leader_id"`
+	IsLeader    bool   `json:"is_leader"`
+	LogIndex    int    `json:"log_index"`
+	LeaderIndex int    `json:"leader_index"`
+	Lag         int    `json:"lag"`
+}
+
+// =================================================
+//  LOGGING
+//
+//  Same settings as the replicas: MECHAT_LOG_LEVEL
+//  (debug, info, warn, error) and MECHAT_LOG_FORMAT
+//  (text, json). Every line names the gateway and
+//  the replica it currently treats as leader.
+// =================================================
+
+var logger = slog.New(&gatewayHandler{inner: slog.NewTextHandler(os.Stderr, nil)})
+
+// PID of the replica the gateway sends requests to, -1 until one is found
+var ACTIVE_LEADER atomic.Int64
+
+func init() {
+	ACTIVE_LEADER.Store(-1)
+}
 
-	// instantiate RPC message
-	messageToBack := &AddContactMessage{
-		UserId:    int_user,
-		ContactId: int_contact,
+func ConfigureLogging(level string, format string) error {
+	inner, err := newLogHandler(os.Stderr, level, format)
+	if err != nil {
+		return err
 	}
+	logger = slog.New(&gatewayHandler{inner: inner})
+	slog.SetDefault(logger)
+	return nil
+}
 
-	// make RPC call with remote backend
-	var response AddContactMessage
-	resp := RemoteProcedureCall("MessageHandler.AddContact", messageToBack, &response)
+func newLogHandler(w io.Writer, level string, format string) (slog.Handler, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %v", level, err)
+		}
+	}
 
-	// handle errors
-	if resp != nil {
-		fmt.Println("Error adding contact: ", response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
 	}
 }
 
-/*
-HTTP endpoint function. Receives a 'login' request from user,
-relays request to remote over RPC, and returns result
-of database operation
-*/
-func Login(w http.ResponseWriter, req *http.Request) {
-	// unmarshall JSON object from request
-	data := RequestToJson(req)
-	email, _ := data["Email"].(string)
-	pass, _ := data["Password"].(string)
+// Adds the gateway's context to every record
+type gatewayHandler struct {
+	inner slog.Handler
+}
 
-	// calculate sha256 digest of attempted password
-	h := sha256.New()
-	h.Write([]byte(pass))
-	hash_pass := hex.EncodeToString(h.Sum(nil))
+func (h *gatewayHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
 
-	// instantiate message for RPC request
-	messageToBack := &LoginMessage{
-		Email:    email,
-		Password: hash_pass,
-	}
+func (h *gatewayHandler) Handle(ctx context.Context, record slog.Record) error {
+	record = record.Clone()
+	record.AddAttrs(
+		slog.String("node", "gateway"),
+		slog.String("role", "gateway"),
+		slog.Int64("leader", ACTIVE_LEADER.Load()),
+	)
+	return h.inner.Handle(ctx, record)
+}
 
-	// make RPC call
-	var response UserProfile
-	err := RemoteProcedureCall("MessageHandler.Login", messageToBack, &response)
+func (h *gatewayHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &gatewayHandler{inner: h.inner.WithAttrs(attrs)}
+}
 
-	// handle errors, send appropriate HTTP respone to user webapp UI
-	if err != nil {
-		fmt.Println("Error response from create user RPC ", response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		profileResponse := UserProfile{
-			UserId:    response.UserId,
-			Email:     response.Email,
-			Firstname: response.Firstname,
-			Lastname:  response.Lastname,
-			Descr:     response.Descr,
+func (h *gatewayHandler) WithGroup(name string) slog.Handler {
+	return &gatewayHandler{inner: h.inner.WithGroup(name)}
+}
+
+// =================================================
+//  METRICS
+//
+//  Served on /metrics by HTTPThread
+// =================================================
+
+var METRICS_REGISTRY = prometheus.NewRegistry()
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mechat_gateway_rpc_duration_seconds",
+		Help:    "Time taken by RPCs to the leader, by method and result.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"method", "result"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mechat_gateway_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by path and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path", "code"})
+	leaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mechat_gateway_leader_changes_total",
+		Help: "Times the gateway switched to a different leader.",
+	})
+	leaderGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mechat_gateway_leader",
+		Help: "PID of the replica the gateway sends requests to, -1 if unknown.",
+	}, func() float64 { return float64(ACTIVE_LEADER.Load()) })
+	breakerOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mechat_gateway_breaker_opened_total",
+		Help: "Times the circuit breaker of a replica opened, by replica address.",
+	}, []string{"replica"})
+	outboxPending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mechat_gateway_outbox_pending",
+		Help: "Messages accepted by the gateway and not yet delivered to the leader.",
+	}, func() float64 {
+		if OUTBOX == nil {
+			return 0
 		}
-		json.NewEncoder(w).Encode(profileResponse)
-	}
+		OUTBOX.mutex.Lock()
+		defer OUTBOX.mutex.Unlock()
+		return float64(len(OUTBOX.queue))
+	})
+)
+
+func init() {
+	METRICS_REGISTRY.MustRegister(rpcDuration, httpDuration, leaderChanges, leaderGauge, breakerOpened, outboxPending, collectors.NewGoCollector())
 }
 
-/*
-HTTP endpoint function. Receives an 'add contact'request from user,
-relays request to remote over RPC, and returns result
-of database operation
+// Wraps an endpoint so its latency is recorded under path
+func instrument(path string, handler http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(prometheus.Labels{"path": path}), handler)
+}
 
-Returns list of user's contacts to user client via HTTP
-*/
-func GetContacts(w http.ResponseWriter, req *http.Request) {
-	// process request message from user
-	data := RequestToJson(req)
-	userid := int(data["UserId"].(float64))
-	messageToBack := &UserProfile{
-		UserId: userid,
-	}
+// =================================================
+//  HELPER FUNCTIONS
+// =================================================
 
-	// ask RPC for contacts of this user id
-	var response Contacts
-	resp := RemoteProcedureCall("MessageHandler.GetContacts", messageToBack, &response)
+// Certificate and private key, PEM files
+type CertificatePair struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
 
-	// handle errors, relay contact list from RPC if HTTP 200 OK
-	if resp != nil {
-		fmt.Println(response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response.ContactList)
-	}
+// Same file the replicas read, generated with "go run . gencerts <dir>" in server/
+type TLSConfigFile struct {
+	CAFile   string            `yaml:"ca_file" json:"ca_file"`
+	Replicas []CertificatePair `yaml:"replicas" json:"replicas"`
+	Gateway  CertificatePair   `yaml:"gateway" json:"gateway"`
 }
 
 /*
-HTTP endpoint function. Receives a 'get users' request from UI,
-invokes RPC with backend and returns registered users
+Loads the gateway certificate from the TLS config file. Returns nil
+if the file does not exist, the replicas are then reached over plain TCP
 */
-func GetAllUsers(w http.ResponseWriter, req *http.Request) {
-	// parse JSON object into map
-	data := RequestToJson(req)
-
-	userid := int(data["UserId"].(float64))
-
-	// instantiate struct for RPC, just need userid
-	messageToBack := &UserProfile{
-		UserId: userid,
+func ReadTLSConfig(filename string) (*tls.Config, error) {
+	bytes, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	var file TLSConfigFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	return file.GatewayTLS(filepath.Dir(filename))
+}
 
-	// invoke RPC
-	var response Contacts
-	resp := RemoteProcedureCall("MessageHandler.GetAllUsers", messageToBack, &response)
-
-	// handle errors, return user list if HTTP 200 OK
-	if resp != nil {
-		fmt.Println(response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response.ContactList)
+// Client TLS config of the gateway, relative paths are resolved against base
+func (file *TLSConfigFile) GatewayTLS(base string) (*tls.Config, error) {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(base, path)
+	}
+	cert, err := tls.LoadX509KeyPair(resolve(file.Gateway.CertFile), resolve(file.Gateway.KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("loading gateway certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(resolve(file.CAFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", file.CAFile)
 	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 /*
-HTTP endpoint function. Receives a 'get messages' request from user,
-relays request to remote over RPC, and returns result
-of database operation
+Function to read available backend IP/ports
+for possible backend replicas.
 
-returns all messages between userid and contactid from RPC backend
+These addresses are stored locally on machine,
+and may be updated by notifications from RPC
 */
-func GetMessages(w http.ResponseWriter, req *http.Request) {
-	// parse JSON request from user
-	data := RequestToJson(req)
-	userid := int(data["UserId"].(float64))
-	contactid := int(data["ContactId"].(float64))
+func ReadReplicaAddresses(filename string) ([]ReplicaAddress, error) {
+	var addrs []ReplicaAddress
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading replica addresses: %v", err)
+	}
+
+	text := string(bytes)
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
 
-	// message to RPC call
-	messageToBack := &GetMessagesRequest{
-		UserId:    userid,
-		ContactId: contactid,
+	for i, replica := range lines {
+		if strings.TrimSpace(replica) == "" {
+			continue
+		}
+		addr, err := ParseReplicaAddress(replica)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, i+1, err)
+		}
+		addrs = append(addrs, addr)
 	}
 
-	// invoke RPC
-	var response MessageList
-	resp := RemoteProcedureCall("MessageHandler.GetMessages", messageToBack, &response)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s lists no replicas", filename)
+	}
+	return addrs, nil
+}
 
-	// handle errors
-	if resp != nil {
-		fmt.Println(response)
-		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response.Messages)
+// Parses host:port
+func ParseReplicaAddress(text string) (ReplicaAddress, error) {
+	host, portText, err := net.SplitHostPort(strings.TrimSpace(text))
+	if err != nil {
+		return ReplicaAddress{}, fmt.Errorf("%q is not host:port", text)
 	}
+	if host == "" {
+		return ReplicaAddress{}, fmt.Errorf("%q has no host", text)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil || port == 0 {
+		return ReplicaAddress{}, fmt.Errorf("%q: port must be between 1 and 65535", text)
+	}
+	return ReplicaAddress{host, uint16(port)}, nil
 }
 
-/*
-Function to handle routing
-of HTTP requests.
+// =================================================
+//  CONFIGURATION
+//
+//  The gateway reads the same YAML file as the
+//  replicas (see server/config.go and
+//  server/mechat.example.yaml) and uses the peers,
+//  timeouts, tls, logging and gateway sections.
+//  MECHAT_* variables override the file. Without a
+//  file the peers come from replica_addrs.txt and
+//  TLS from tls_config.json.
+// =================================================
+
+var DEFAULT_CONFIG_FILE = "mechat.yaml"
+
+// Address the HTTP API listens on
+var LISTEN_ADDRESS = "127.0.0.1:8090"
+
+// Timeouts towards the replicas: connecting to the leader, and the health probes
+var RPC_TIMEOUT = 1 * time.Second
+var PROBE_TIMEOUT = 100 * time.Millisecond
+
+// Sections of the cluster config file the gateway uses
+type GatewayConfig struct {
+	Peers    []string `yaml:"peers"`
+	Timeouts struct {
+		Heartbeat time.Duration `yaml:"heartbeat"`
+		RPC       time.Duration `yaml:"rpc"`
+	} `yaml:"timeouts"`
+	TLS struct {
+		ConfigFile    string `yaml:"config_file"`
+		TLSConfigFile `yaml:",inline"`
+	} `yaml:"tls"`
+	Logging struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"logging"`
+	Gateway struct {
+		Listen      string        `yaml:"listen"`
+		Outbox      string        `yaml:"outbox"`       // file of messages waiting for the leader
+		CallTimeout time.Duration `yaml:"call_timeout"` // deadline of a call to the leader, retries included
+		Retries     int           `yaml:"retries"`      // attempts after the first while there is no leader
+		Keys        string        `yaml:"keys"`         // directory of user keys, see END-TO-END ENCRYPTION
+	} `yaml:"gateway"`
+
+	file string // file the config was read from, empty if none
+}
+
+/*
+Reads the config file, applies the environment and checks the result.
+A missing file is only an error if it was asked for explicitly
+*/
+func LoadGatewayConfig(filename string, required bool) (*GatewayConfig, error) {
+	config := &GatewayConfig{}
+	config.Timeouts.Heartbeat = PROBE_TIMEOUT
+	config.Timeouts.RPC = RPC_TIMEOUT
+	config.Logging.Level = "info"
+	config.Gateway.Listen = LISTEN_ADDRESS
+	config.Gateway.Outbox = OUTBOX_FILE
+	config.Gateway.CallTimeout = CALL_TIMEOUT
+	config.Gateway.Retries = CALL_RETRIES
+
+	bytes, err := os.ReadFile(filename)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(bytes, config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", filename, err)
+		}
+		config.file = filename
+	case os.IsNotExist(err) && !required:
+	default:
+		return nil, fmt.Errorf("reading config: %v", err)
+	}
+
+	var errs []error
+	env := func(name string, field *string) {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+	duration := func(name string, field *time.Duration) {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s=%q: not a duration such as 500ms or 5s", name, value))
+				return
+			}
+			*field = d
+		}
+	}
+	if value := os.Getenv("MECHAT_PEERS"); value != "" { // comma separated
+		config.Peers = nil
+		for _, peer := range strings.Split(value, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				config.Peers = append(config.Peers, peer)
+			}
+		}
+	}
+	duration("MECHAT_HEARTBEAT_TIMEOUT", &config.Timeouts.Heartbeat)
+	duration("MECHAT_RPC_TIMEOUT", &config.Timeouts.RPC)
+	env("MECHAT_TLS_CONFIG", &config.TLS.ConfigFile)
+	env("MECHAT_LOG_LEVEL", &config.Logging.Level)
+	env("MECHAT_LOG_FORMAT", &config.Logging.Format)
+	env("MECHAT_GATEWAY_LISTEN", &config.Gateway.Listen)
+	env("MECHAT_GATEWAY_OUTBOX", &config.Gateway.Outbox)
+	env("MECHAT_GATEWAY_KEYS", &config.Gateway.Keys)
+	duration("MECHAT_GATEWAY_CALL_TIMEOUT", &config.Gateway.CallTimeout)
+	if value := os.Getenv("MECHAT_GATEWAY_RETRIES"); value != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MECHAT_GATEWAY_RETRIES=%q: not an integer", value))
+		} else {
+			config.Gateway.Retries = n
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if config.file == "" && len(config.Peers) == 0 {
+		addrs, err := ReadReplicaAddresses(ADDRESS_FILE)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			config.Peers = append(config.Peers, net.JoinHostPort(addr.Address, strconv.Itoa(int(addr.Port))))
+		}
+	}
+	return config, config.Validate()
+}
+
+// Checks the configuration, the error lists every problem found
+func (c *GatewayConfig) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Peers) == 0 {
+		fail("peers: at least one replica address is required")
+	}
+	for i, peer := range c.Peers {
+		if _, err := ParseReplicaAddress(peer); err != nil {
+			fail("peers[%d]: %v", i, err)
+		}
+	}
+	if c.Timeouts.Heartbeat <= 0 {
+		fail("timeouts.heartbeat: must be positive, got %s", c.Timeouts.Heartbeat)
+	}
+	if c.Timeouts.RPC <= 0 {
+		fail("timeouts.rpc: must be positive, got %s", c.Timeouts.RPC)
+	}
+	if c.TLS.ConfigFile != "" && c.TLS.CAFile != "" {
+		fail("tls: set either config_file or the certificates inline, not both")
+	}
+	if _, err := newLogHandler(io.Discard, c.Logging.Level, c.Logging.Format); err != nil {
+		fail("logging: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(c.Gateway.Listen); err != nil {
+		fail("gateway.listen: %v", err)
+	}
+	if c.Gateway.Outbox == "" {
+		fail("gateway.outbox: a file is required")
+	}
+	if c.Gateway.CallTimeout <= 0 {
+		fail("gateway.call_timeout: must be positive, got %s", c.Gateway.CallTimeout)
+	}
+	if c.Gateway.Retries < 0 {
+		fail("gateway.retries: must not be negative, got %d", c.Gateway.Retries)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	source := "configuration"
+	if c.file != "" {
+		source = c.file
+	}
+	return fmt.Errorf("invalid %s:\n%w", source, errors.Join(errs...))
+}
+
+// Client TLS config towards the replicas, nil for plain TCP
+func (c *GatewayConfig) GatewayTLS() (*tls.Config, error) {
+	if c.TLS.ConfigFile != "" {
+		path := c.TLS.ConfigFile
+		if c.file != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(c.file), path)
+		}
+		config, err := ReadTLSConfig(path)
+		if err == nil && config == nil {
+			return nil, fmt.Errorf("tls.config_file: %s does not exist", path)
+		}
+		return config, err
+	}
+	if c.TLS.CAFile == "" {
+		return ReadTLSConfig(TLS_CONFIG_FILE)
+	}
+	return c.TLS.GatewayTLS(filepath.Dir(c.file))
+}
+
+/*
+Applies the configuration to the gateway globals and logging. The
+config must be valid
+*/
+func (c *GatewayConfig) Apply() error {
+	REPLICA_ADDRESSES = nil
+	for _, peer := range c.Peers {
+		addr, _ := ParseReplicaAddress(peer)
+		REPLICA_ADDRESSES = append(REPLICA_ADDRESSES, addr)
+	}
+	PROBE_TIMEOUT = c.Timeouts.Heartbeat
+	RPC_TIMEOUT = c.Timeouts.RPC
+	LISTEN_ADDRESS = c.Gateway.Listen
+	CALL_TIMEOUT = c.Gateway.CallTimeout
+	CALL_RETRIES = c.Gateway.Retries
+	OUTBOX_FILE = c.Gateway.Outbox
+	if c.file != "" && !filepath.IsAbs(OUTBOX_FILE) { // relative to the config file, as tls.config_file
+		OUTBOX_FILE = filepath.Join(filepath.Dir(c.file), OUTBOX_FILE)
+	}
+	KEYS_DIR = c.Gateway.Keys
+	if c.file != "" && KEYS_DIR != "" && !filepath.IsAbs(KEYS_DIR) {
+		KEYS_DIR = filepath.Join(filepath.Dir(c.file), KEYS_DIR)
+	}
+	return ConfigureLogging(c.Logging.Level, c.Logging.Format)
+}
+
+// =================================================
+//  REQUEST VALIDATION
+//
+//  Endpoints decode their JSON body into a typed
+//  request and check it before calling the leader.
+//  Every error is answered with the same JSON body,
+//  {"code": ..., "message": ...}, where code is one
+//  of the ERR_ constants below and message is meant
+//  for people. Errors returned by the leader are
+//  mapped to distinct statuses by writeRPCError.
+// =================================================
+
+// Error codes of the JSON error body
+const (
+	ERR_INVALID_JSON        = "invalid_json"
+	ERR_INVALID_REQUEST     = "invalid_request"
+	ERR_METHOD_NOT_ALLOWED  = "method_not_allowed"
+	ERR_TOO_LARGE           = "too_large"
+	ERR_INVALID_CREDENTIALS = "invalid_credentials"
+	ERR_INCORRECT_PASSWORD  = "incorrect_password"
+	ERR_FORBIDDEN           = "forbidden"
+	ERR_NOT_FOUND           = "not_found"
+	ERR_CONFLICT            = "conflict"
+	ERR_EMAIL_TAKEN         = "email_taken"
+	ERR_RATE_LIMITED        = "rate_limited"
+	ERR_UNAVAILABLE         = "unavailable"
+	ERR_TIMEOUT             = "timeout"
+	ERR_INTERNAL            = "internal"
+)
+
+// Limits on request fields, in bytes
+const (
+	MAX_REQUEST_BODY     = 1 << 20
+	MAX_MESSAGE_LENGTH   = 4000
+	MAX_ENVELOPE_LENGTH  = 8192 // an encrypted MAX_MESSAGE_LENGTH, see END-TO-END ENCRYPTION
+	MAX_NAME_LENGTH      = 100
+	MAX_EMAIL_LENGTH     = 254
+	MAX_DESCR_LENGTH     = 1000
+	MAX_FILE_NAME_LENGTH = 255
+	MAX_REPORT_REASON    = 1000 // as on the replicas
+	MAX_REACTION_LENGTH  = 32   // as on the replicas
+)
+
+// JSON object, the body of every error response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIError{Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+/*
+Reads the JSON body of a request into message. On failure the error
+response is written and false returned
+*/
+func decodeRequest(w http.ResponseWriter, req *http.Request, message any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_REQUEST_BODY)).Decode(message)
+
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, ERR_TOO_LARGE, fmt.Sprintf("request body is larger than %d bytes", MAX_REQUEST_BODY))
+	case errors.Is(err, io.EOF):
+		writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "request body is empty, a JSON object is expected")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, typeErr.Field+" must be "+jsonKind(typeErr.Type.String()))
+	default:
+		writeError(w, http.StatusBadRequest, ERR_INVALID_JSON, "request body is not a valid JSON object: "+err.Error())
+	}
+	return false
+}
+
+// How a Go field type is written in JSON, for error messages
+func jsonKind(goType string) string {
+	switch strings.TrimPrefix(goType, "*") {
+	case "int", "int64":
+		return "an integer"
+	case "bool":
+		return "true or false"
+	case "string":
+		return "a string"
+	}
+	return "a " + goType
+}
+
+// Reads a body of the form {UserId}
+func decodeUserId(w http.ResponseWriter, req *http.Request) (int, bool) {
+	var message UserProfile
+	if !decodeRequest(w, req, &message) {
+		return 0, false
+	}
+	var v validation
+	v.id("UserId", message.UserId)
+	return message.UserId, !v.failed(w)
+}
+
+// Problems found in a request, reported together
+type validation struct {
+	problems []string
+}
+
+func (v *validation) check(ok bool, problem string) {
+	if !ok {
+		v.problems = append(v.problems, problem)
+	}
+}
+
+// user IDs start at 1, so 0 is a missing field
+func (v *validation) id(field string, value int) {
+	v.check(value > 0, field+" is required")
+}
+
+func (v *validation) required(field string, value string) {
+	v.check(strings.TrimSpace(value) != "", field+" is required")
+}
+
+func (v *validation) maxLength(field string, value string, limit int) {
+	v.check(len(value) <= limit, fmt.Sprintf("%s is longer than %d bytes", field, limit))
+}
+
+// an envelope is longer than the text it encrypts. Plaintext the
+// gateway is to seal has the plaintext limit
+func (v *validation) messageText(field string, value string, encrypted bool) {
+	if encrypted && isEnvelope(value) {
+		v.maxLength(field, value, MAX_ENVELOPE_LENGTH)
+	} else {
+		v.maxLength(field, value, MAX_MESSAGE_LENGTH)
+	}
+}
+
+// required, at most MAX_NAME_LENGTH
+func (v *validation) name(field string, value string) {
+	v.required(field, value)
+	v.maxLength(field, value, MAX_NAME_LENGTH)
+}
+
+// a bare address such as ada@example.com, no display name
+func (v *validation) email(field string, value string) {
+	if value == "" {
+		v.check(false, field+" is required")
+		return
+	}
+	address, err := mail.ParseAddress(value)
+	v.check(err == nil && address.Address == value && len(value) <= MAX_EMAIL_LENGTH, field+" is not a valid email address")
+}
+
+// Writes the problems as one 400 response, false if there were none
+func (v *validation) failed(w http.ResponseWriter) bool {
+	if len(v.problems) == 0 {
+		return false
+	}
+	writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, strings.Join(v.problems, "; "))
+	return true
+}
+
+/*
+Wraps an endpoint so only the given methods reach it, anything else
+is answered with 405 and an Allow header. CORS preflights are
+answered before this, by the cors handler
+*/
+func allow(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !slices.Contains(methods, req.Method) {
+			methodNotAllowed(w, req, methods)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, req *http.Request, methods []string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, req.Method+" is not allowed, use "+strings.Join(methods, " or "))
+}
+
+// Whether err was returned by the leader's handler and contains text
+func isServerError(err error, text string) bool {
+	var serverErr rpc.ServerError
+	return errors.As(err, &serverErr) && strings.Contains(string(serverErr), text)
+}
+
+// Errors returned by the leader's handlers, by the text they contain
+var SERVER_ERRORS = []struct {
+	text   string
+	status int
+	code   string
+}{
+	{"UNIQUE constraint failed: users.email", http.StatusConflict, ERR_EMAIL_TAKEN},
+	{"incorrect password", http.StatusForbidden, ERR_INCORRECT_PASSWORD},
+	{"rate limit", http.StatusTooManyRequests, ERR_RATE_LIMITED},
+	{"blocked", http.StatusForbidden, ERR_FORBIDDEN},
+	{"not allowed", http.StatusForbidden, ERR_FORBIDDEN},
+	{"only the sender", http.StatusForbidden, ERR_FORBIDDEN},
+	{"deleted their account", http.StatusForbidden, ERR_FORBIDDEN},
+	{"no such", http.StatusNotFound, ERR_NOT_FOUND},
+	{"no pending", http.StatusNotFound, ERR_NOT_FOUND},
+	{"already", http.StatusConflict, ERR_CONFLICT},
+	{"over the size limit", http.StatusRequestEntityTooLarge, ERR_TOO_LARGE},
+	{"public key changed", http.StatusConflict, ERR_CONFLICT},
+	{"has no public key", http.StatusConflict, ERR_CONFLICT},
+	{"not the leader", http.StatusServiceUnavailable, ERR_UNAVAILABLE},
+}
+
+/*
+Calls the leader for an endpoint. On failure the error response is
+written and false returned
+*/
+func callEndpoint(w http.ResponseWriter, req *http.Request, funcName string, args any, reply any) bool {
+	if err := RemoteProcedureCall(req.Context(), funcName, args, reply); err != nil {
+		writeRPCError(w, funcName, err, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+/*
+Answers a failed RPC: 503 with Retry-After while the cluster is
+unavailable, 504 when the call timed out, the status of
+SERVER_ERRORS for known errors of the leader, status otherwise
+*/
+func writeRPCError(w http.ResponseWriter, funcName string, err error, status int) {
+	var unavailable *UnavailableError
+	switch {
+	case errors.As(err, &unavailable):
+		logger.Warn("Cluster unavailable", "rpc", funcName, "err", err)
+		seconds := int((unavailable.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, err.Error())
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("Timeout calling "+funcName+" RPC", "timeout", CALL_TIMEOUT)
+		writeError(w, http.StatusGatewayTimeout, ERR_TIMEOUT, "timed out waiting for the cluster")
+		return
+	}
+
+	logger.Warn("Error response from "+funcName+" RPC", "err", err)
+	for _, known := range SERVER_ERRORS {
+		if isServerError(err, known.text) {
+			message := err.Error()
+			if known.status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1") // an election is under way
+			}
+			if known.code == ERR_EMAIL_TAKEN {
+				message = "an account with this email already exists" // not the SQL
+			}
+			writeError(w, known.status, known.code, message)
+			return
+		}
+	}
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		// the connection failed mid-call, the leader may have applied it
+		writeError(w, http.StatusBadGateway, ERR_UNAVAILABLE, err.Error())
+		return
+	}
+	code := ERR_INVALID_REQUEST
+	if status == http.StatusNotFound {
+		code = ERR_NOT_FOUND
+	}
+	writeError(w, status, code, err.Error())
+}
+
+// =================================================
+//  HTTP ENDPOINT FUNCTIONS
+// =================================================
+
+/*
+Function that receives a chat message from the front-end
+UI user. Received over HTTP.
+
+The message goes to the outbox and is acknowledged with 202 and a
+pending ID, it is submitted to the backend by the outbox worker
+*/
+func HandleIncoming(w http.ResponseWriter, req *http.Request) {
+
+	// we expect a JSON object
+	var message ChatMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	queueMessage(w, req, message, "/outbox?id=")
+
+}
+
+/*
+Checks a message from a client and stores it in the outbox, answering
+202 with the pending ID. The Location header is location followed by
+the pending ID. With ?wait=true a sent message is answered with 200,
+a refused one with the leader's error, see OUTBOX
+*/
+func queueMessage(w http.ResponseWriter, req *http.Request, message ChatMessage, location string) {
+	var v validation
+	v.id("From", message.From)
+	v.id("To", message.To)
+	if message.Attachment == "" {
+		v.required("Message", message.Message)
+	}
+	v.messageText("Message", message.Message, message.Encrypted)
+	v.maxLength("AttachmentName", message.AttachmentName, MAX_FILE_NAME_LENGTH)
+	if v.failed(w) {
+		return
+	}
+
+	// instantiate out ChatMessage for RPC call, with only the
+	// fields a client may set
+	messageToBack := &ChatMessage{
+		Message:        message.Message,
+		Timestamp:      message.Timestamp,
+		From:           message.From,
+		To:             message.To,
+		Acked:          1,
+		Encrypted:      message.Encrypted,
+		Attachment:     message.Attachment,
+		AttachmentName: message.AttachmentName,
+		ReplyToId:      message.ReplyToId,
+		RequestId:      requestId(req, message.RequestId),
+	}
+
+	// sealed before it is stored, the outbox keeps no plaintext of it.
+	// Without a leader to ask for the recipient's key delivery seals it
+	ctx, cancel := context.WithTimeout(req.Context(), RPC_TIMEOUT)
+	if err := sealOutgoing(ctx, messageToBack); err != nil {
+		logger.Debug("Message queued unsealed", "err", err)
+	}
+	cancel()
+
+	// stored before it is sent, see OUTBOX
+	entry, err := OUTBOX.Enqueue(*messageToBack)
+	if err != nil {
+		logger.Error("Error queueing message", "err", err)
+		writeError(w, http.StatusInternalServerError, ERR_INTERNAL, "failure storing message")
+		return
+	}
+
+	w.Header().Set("Location", location+entry.PendingId)
+	if wait, _ := strconv.ParseBool(req.URL.Query().Get("wait")); wait {
+		ctx, cancel := context.WithTimeout(req.Context(), CALL_TIMEOUT)
+		defer cancel()
+		var err error
+		entry, err = OUTBOX.Wait(ctx, entry.PendingId)
+		switch entry.Status {
+		case OUTBOX_SENT:
+			writeJSON(w, http.StatusOK, PendingMessage{PendingId: entry.PendingId, Status: entry.Status})
+			return
+		case OUTBOX_FAILED:
+			writeRPCError(w, "MessageHandler.SaveMessage", err, http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusAccepted, PendingMessage{PendingId: entry.PendingId, Status: entry.Status})
+}
+
+/*
+Gateway health. The gateway is live while it serves HTTP, and ready
+once it is connected to a leader that reported itself ready
+*/
+func GatewayHealth(w http.ResponseWriter, req *http.Request) {
+	writeGatewayHealth(w, true)
+}
+
+func GatewayReady(w http.ResponseWriter, req *http.Request) {
+	writeGatewayHealth(w, GATEWAY_READY.Load())
+}
+
+func writeGatewayHealth(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"live":      true,
+		"ready":     GATEWAY_READY.Load(),
+		"leader_id": ACTIVE_LEADER.Load(),
+	})
+}
+
+/*
+HTTP endpoint function. Receives account create request from user,
+relays request to remote over RPC, and returns result
+of database operation
+*/
+func CreateAccount(w http.ResponseWriter, req *http.Request) {
+	// convert JSON object into the request
+	var message CreateAccountMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	// send HTTP 200 OK, send back user info including new user ID
+	if profile, ok := createAccount(w, req, message); ok {
+		writeJSON(w, http.StatusOK, profile)
+	}
+}
+
+/*
+Checks and creates an account, returning the new profile. On failure
+the error response is written and false returned
+*/
+func createAccount(w http.ResponseWriter, req *http.Request, message CreateAccountMessage) (UserProfile, bool) {
+	var v validation
+	v.email("Email", message.Email)
+	v.required("Password", message.Password)
+	v.name("Firstname", message.Firstname)
+	v.name("Lastname", message.Lastname)
+	v.maxLength("Descr", message.Descr, MAX_DESCR_LENGTH)
+	if v.failed(w) {
+		return UserProfile{}, false
+	}
+
+	// instantiate message struct for use in RPC, passwords are
+	// stored as sha256 digests
+	messageToBack := &CreateAccountMessage{
+		Email:     message.Email,
+		Password:  hashPassword(message.Password),
+		Firstname: message.Firstname,
+		Lastname:  message.Lastname,
+		Descr:     message.Descr,
+		RequestId: requestId(req, message.RequestId),
+	}
+
+	// make RPC call, store response
+	var response RPCResponse
+	if !callEndpoint(w, req, "MessageHandler.CreateAccount", messageToBack, &response) {
+		return UserProfile{}, false
+	}
+	user_id, _ := strconv.Atoi(response.Message)
+	return UserProfile{
+		UserId:    user_id,
+		Email:     message.Email,
+		Firstname: message.Firstname,
+		Lastname:  message.Lastname,
+		Descr:     message.Descr,
+	}, true
+}
+
+/*
+Client generated ID of a write, from the RequestId field or the
+Idempotency-Key header. Sending the same ID again, after a lost reply
+or a failover, returns the first reply instead of writing twice.
+Empty if the client sent none
+*/
+func requestId(req *http.Request, id string) string {
+	if id != "" {
+		return id
+	}
+	return req.Header.Get("Idempotency-Key")
+}
+
+/*
+HTTP endpoint function. Receives an 'add contact'request from user,
+relays request to remote over RPC, and returns result
+of database operation
+*/
+func AddContact(w http.ResponseWriter, req *http.Request) {
+	// parse HTTP request into the RPC message
+	var message AddContactMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("ContactId", message.ContactId)
+	if v.failed(w) {
+		return
+	}
+	message.RequestId = requestId(req, message.RequestId)
+
+	// make RPC call with remote backend
+	var response AddContactMessage
+	if callEndpoint(w, req, "MessageHandler.AddContact", &message, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+/*
+HTTP endpoint functions for the contact request flow. A request is
+sent with /sendcontactrequest {UserId, ContactId}, the other user
+lists it with /contactrequests {UserId} and answers with
+/respondcontactrequest {UserId, ContactId, Response}. The reply
+carries the resulting status
+*/
+func SendContactRequest(w http.ResponseWriter, req *http.Request) {
+	var message AddContactMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("ContactId", message.ContactId)
+	if v.failed(w) {
+		return
+	}
+	message.RequestId = requestId(req, message.RequestId)
+	writeContactStatus(w, req, "MessageHandler.SendContactRequest", &message)
+}
+
+func RespondContactRequest(w http.ResponseWriter, req *http.Request) {
+	var message ContactResponse
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("ContactId", message.ContactId)
+	v.required("Response", message.Response)
+	if v.failed(w) {
+		return
+	}
+	writeContactStatus(w, req, "MessageHandler.RespondContactRequest", &message)
+}
+
+func writeContactStatus(w http.ResponseWriter, req *http.Request, funcName string, messageToBack any) {
+	var response RPCResponse
+	if callEndpoint(w, req, funcName, messageToBack, &response) {
+		writeJSON(w, http.StatusOK, map[string]string{"Status": response.Message})
+	}
+}
+
+func GetContactRequests(w http.ResponseWriter, req *http.Request) {
+	userid, ok := decodeUserId(w, req)
+	if !ok {
+		return
+	}
+
+	var response Contacts
+	if callEndpoint(w, req, "MessageHandler.GetContacts", &UserProfile{UserId: userid}, &response) {
+		if response.Pending == nil {
+			response.Pending = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.Pending)
+	}
+}
+
+/*
+HTTP endpoint functions. Block and unblock a user {UserId, BlockedId},
+list the users someone blocked {UserId}, and report a message
+{UserId, HLC, Reason} to the moderators
+*/
+func BlockUser(w http.ResponseWriter, req *http.Request) {
+	changeBlock(w, req, "MessageHandler.BlockUser")
+}
+
+func UnblockUser(w http.ResponseWriter, req *http.Request) {
+	changeBlock(w, req, "MessageHandler.UnblockUser")
+}
+
+func changeBlock(w http.ResponseWriter, req *http.Request, funcName string) {
+	var message BlockUserRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("BlockedId", message.BlockedId)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, funcName, &message, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func GetBlockedUsers(w http.ResponseWriter, req *http.Request) {
+	userid, ok := decodeUserId(w, req)
+	if !ok {
+		return
+	}
+
+	var response Contacts
+	if callEndpoint(w, req, "MessageHandler.GetBlockedUsers", &UserProfile{UserId: userid}, &response) {
+		if response.ContactList == nil {
+			response.ContactList = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.ContactList)
+	}
+}
+
+func ReportMessage(w http.ResponseWriter, req *http.Request) {
+	var message ReportRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("HLC", message.HLC)
+	v.maxLength("Reason", message.Reason, MAX_REPORT_REASON)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, "MessageHandler.ReportMessage", &message, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// passwords leave the gateway only as sha256 digests
+func hashPassword(pass string) string {
+	h := sha256.New()
+	h.Write([]byte(pass))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+HTTP endpoint function. Updates the profile of a user
+{UserId, Firstname, Lastname, Descr} and returns the new profile
+*/
+func UpdateProfile(w http.ResponseWriter, req *http.Request) {
+	var message UserProfile
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	updateProfile(w, req, message)
+}
+
+func updateProfile(w http.ResponseWriter, req *http.Request, message UserProfile) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.name("Firstname", message.Firstname)
+	v.name("Lastname", message.Lastname)
+	v.maxLength("Descr", message.Descr, MAX_DESCR_LENGTH)
+	if v.failed(w) {
+		return
+	}
+
+	messageToBack := &UserProfile{
+		UserId:    message.UserId,
+		Firstname: message.Firstname,
+		Lastname:  message.Lastname,
+		Descr:     message.Descr,
+	}
+
+	var response UserProfile
+	if callEndpoint(w, req, "MessageHandler.UpdateProfile", messageToBack, &response) {
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+/*
+HTTP endpoint functions. Change the password of a user
+{UserId, OldPassword, NewPassword} and delete an account
+{UserId, Password}. Both need the current password
+*/
+func ChangePassword(w http.ResponseWriter, req *http.Request) {
+	var message ChangePasswordRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("OldPassword", message.OldPassword)
+	v.required("NewPassword", message.NewPassword)
+	if v.failed(w) {
+		return
+	}
+
+	messageToBack := &ChangePasswordRequest{
+		UserId:      message.UserId,
+		OldPassword: hashPassword(message.OldPassword),
+		NewPassword: hashPassword(message.NewPassword),
+	}
+	writeAccountResponse(w, req, "MessageHandler.ChangePassword", messageToBack)
+}
+
+func DeleteAccount(w http.ResponseWriter, req *http.Request) {
+	var message DeleteAccountRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("Password", message.Password)
+	if v.failed(w) {
+		return
+	}
+
+	messageToBack := &DeleteAccountRequest{
+		UserId:   message.UserId,
+		Password: hashPassword(message.Password),
+	}
+	writeAccountResponse(w, req, "MessageHandler.DeleteAccount", messageToBack)
+}
+
+// a wrong password is answered with 403, see writeRPCError
+func writeAccountResponse(w http.ResponseWriter, req *http.Request, funcName string, messageToBack any) {
+	var response RPCResponse
+	if callEndpoint(w, req, funcName, messageToBack, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// JSON object, the profile of a logged in user and their device
+type LoginResult struct {
+	UserProfile
+	DeviceId string // send with /sync, and with the next login to resume the device
+	Cursor   int64  // where the device's sync starts
+}
+
+/*
+HTTP endpoint function. Receives a 'login' request from user,
+relays request to remote over RPC, and returns result
+of database operation. Every login registers a device, or resumes
+the one named by DeviceId. A revoked DeviceId is not found, the
+client logs in again without it
+*/
+func Login(w http.ResponseWriter, req *http.Request) {
+	// unmarshall JSON object from request
+	var message LoginMessage
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	if message.DeviceName == "" {
+		message.DeviceName = req.UserAgent()
+		if len(message.DeviceName) > MAX_NAME_LENGTH {
+			message.DeviceName = message.DeviceName[:MAX_NAME_LENGTH]
+		}
+	}
+
+	var v validation
+	v.required("Email", message.Email)
+	v.required("Password", message.Password)
+	v.maxLength("DeviceName", message.DeviceName, MAX_NAME_LENGTH)
+	if v.failed(w) {
+		return
+	}
+
+	// instantiate message for RPC request, with the sha256
+	// digest of the attempted password
+	messageToBack := &DeviceLoginRequest{
+		Email:      message.Email,
+		Password:   hashPassword(message.Password),
+		DeviceId:   message.DeviceId,
+		DeviceName: message.DeviceName,
+	}
+
+	// make RPC call
+	var response DeviceSession
+	err := RemoteProcedureCall(req.Context(), "MessageHandler.LoginDevice", messageToBack, &response)
+
+	// handle errors, send appropriate HTTP respone to user webapp UI.
+	// An unknown email and a wrong password look the same
+	switch {
+	case err == nil:
+		ensureUserKey(req.Context(), response.Profile.UserId)
+		writeJSON(w, http.StatusOK, LoginResult{
+			UserProfile: response.Profile,
+			DeviceId:    response.DeviceId,
+			Cursor:      response.Cursor,
+		})
+	case isServerError(err, "no such user"), isServerError(err, "incorrect password"):
+		logger.Debug("Login failed", "err", err)
+		writeError(w, http.StatusUnauthorized, ERR_INVALID_CREDENTIALS, "incorrect email or password")
+	default:
+		writeRPCError(w, "MessageHandler.LoginDevice", err, http.StatusBadRequest)
+	}
+}
+
+/*
+HTTP endpoint functions. List the devices of a user {UserId}, revoke
+one {UserId, DeviceId}, and sync a device {UserId, DeviceId, Cursor}:
+the changes after Cursor, which the device received from the previous
+sync
+*/
+func GetDevices(w http.ResponseWriter, req *http.Request) {
+	userid, ok := decodeUserId(w, req)
+	if !ok {
+		return
+	}
+	listDevices(w, req, userid)
+}
+
+func listDevices(w http.ResponseWriter, req *http.Request, userid int) {
+	var response DeviceList
+	if callEndpoint(w, req, "MessageHandler.ListDevices", &UserProfile{UserId: userid}, &response) {
+		if response.Devices == nil {
+			response.Devices = []DeviceInfo{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.Devices)
+	}
+}
+
+func RevokeDevice(w http.ResponseWriter, req *http.Request) {
+	var message DeviceRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("DeviceId", message.DeviceId)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, "MessageHandler.RevokeDevice", &message, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func SyncDevice(w http.ResponseWriter, req *http.Request) {
+	var message SyncRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	syncDevice(w, req, message)
+}
+
+func syncDevice(w http.ResponseWriter, req *http.Request, message SyncRequest) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("DeviceId", message.DeviceId)
+	v.check(message.Cursor >= 0, "Cursor must be 0 or more")
+	v.check(message.Limit >= 0, "Limit must be 0 or more")
+	if v.failed(w) {
+		return
+	}
+
+	var response SyncResult
+	if callEndpoint(w, req, "MessageHandler.Sync", &message, &response) {
+		// gob drops empty slices
+		if response.Messages == nil {
+			response.Messages = []ChatMessage{}
+		}
+		if response.Contacts == nil {
+			response.Contacts = []ContactChange{}
+		}
+		openMessages(message.UserId, response.Messages)
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+/*
+HTTP endpoint function. Receives an 'add contact'request from user,
+relays request to remote over RPC, and returns result
+of database operation
+
+Returns list of user's contacts to user client via HTTP
+*/
+func GetContacts(w http.ResponseWriter, req *http.Request) {
+	// process request message from user
+	userid, ok := decodeUserId(w, req)
+	if !ok {
+		return
+	}
+	messageToBack := &UserProfile{
+		UserId: userid,
+	}
+
+	// ask RPC for contacts of this user id, relay the contact list
+	var response Contacts
+	if callEndpoint(w, req, "MessageHandler.GetContacts", messageToBack, &response) {
+		if response.ContactList == nil {
+			response.ContactList = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.ContactList)
+	}
+}
+
+/*
+HTTP endpoint function. Receives a 'get users' request from UI,
+invokes RPC with backend and returns registered users
+*/
+func GetAllUsers(w http.ResponseWriter, req *http.Request) {
+	// parse JSON object, just need userid
+	userid, ok := decodeUserId(w, req)
+	if !ok {
+		return
+	}
+
+	// instantiate struct for RPC
+	messageToBack := &UserProfile{
+		UserId: userid,
+	}
+
+	// invoke RPC, return the user list
+	var response Contacts
+	if callEndpoint(w, req, "MessageHandler.GetAllUsers", messageToBack, &response) {
+		if response.ContactList == nil {
+			response.ContactList = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.ContactList)
+	}
+}
+
+/*
+HTTP endpoint function. Searches the user directory with
+{UserId, Query, Limit, After} and returns one page {Users, Next}.
+Pass Next as After to get the following page
+*/
+func SearchUsers(w http.ResponseWriter, req *http.Request) {
+	var message DirectoryRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.maxLength("Query", message.Query, MAX_NAME_LENGTH)
+	v.check(message.Limit >= 0, "Limit must not be negative")
+	v.check(message.After >= 0, "After must not be negative")
+	if v.failed(w) {
+		return
+	}
+
+	var response Directory
+	if callEndpoint(w, req, "MessageHandler.SearchUsers", &message, &response) {
+		if response.Users == nil {
+			response.Users = []UserProfile{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+/*
+HTTP endpoint function. Hides a user from the directory
+{UserId, Discoverable: false} or shows them again
+*/
+func SetDiscoverable(w http.ResponseWriter, req *http.Request) {
+	var message struct {
+		UserId       int
+		Discoverable *bool // required, false is a valid answer
+	}
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.check(message.Discoverable != nil, "Discoverable must be true or false")
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, "MessageHandler.SetDiscoverable", &DiscoverableRequest{UserId: message.UserId, Discoverable: *message.Discoverable}, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+/*
+HTTP endpoint function. Receives a 'get messages' request from user,
+relays request to remote over RPC, and returns result
+of database operation
+
+returns all messages between userid and contactid from RPC backend
+*/
+func GetMessages(w http.ResponseWriter, req *http.Request) {
+	// parse JSON request from user into the RPC message
+	var messageToBack GetMessagesRequest
+	if !decodeRequest(w, req, &messageToBack) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", messageToBack.UserId)
+	v.id("ContactId", messageToBack.ContactId)
+	if v.failed(w) {
+		return
+	}
+
+	// invoke RPC
+	var response MessageList
+	if callEndpoint(w, req, "MessageHandler.GetMessages", &messageToBack, &response) {
+		if response.Messages == nil {
+			response.Messages = []ChatMessage{} // gob drops empty slices
+		}
+		openMessages(messageToBack.UserId, response.Messages)
+		writeJSON(w, http.StatusOK, response.Messages)
+	}
+}
+
+/*
+HTTP endpoint functions. Edit, delete and list the earlier texts of a
+message. Only the sender may edit or delete, the message is named by
+its HLC stamp as returned by /getmessages
+*/
+func EditMessage(w http.ResponseWriter, req *http.Request) {
+	changeMessage(w, req, "MessageHandler.EditMessage", true)
+}
+
+func DeleteMessage(w http.ResponseWriter, req *http.Request) {
+	changeMessage(w, req, "MessageHandler.DeleteMessage", false)
+}
+
+// JSON object, body of /editmessage and /deletemessage
+type MessageChange struct {
+	EditMessageRequest
+	ContactId int // recipient of an encrypted message, see END-TO-END ENCRYPTION
+}
+
+func changeMessage(w http.ResponseWriter, req *http.Request, funcName string, needsText bool) {
+	// parse JSON request from user
+	var message MessageChange
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	messageToBack := message.EditMessageRequest
+
+	var v validation
+	v.id("UserId", messageToBack.UserId)
+	v.required("HLC", messageToBack.HLC)
+	if needsText {
+		v.required("Message", messageToBack.Message)
+		v.messageText("Message", messageToBack.Message, messageToBack.Encrypted)
+	}
+	if v.failed(w) {
+		return
+	}
+	if needsText {
+		if err := sealEdit(req.Context(), &messageToBack, message.ContactId); err != nil {
+			writeRPCError(w, funcName, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// invoke RPC
+	var response RPCResponse
+	if callEndpoint(w, req, funcName, &messageToBack, &response) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func GetMessageHistory(w http.ResponseWriter, req *http.Request) {
+	// parse JSON request from user
+	var message EditMessageRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("HLC", message.HLC)
+	if v.failed(w) {
+		return
+	}
+
+	messageToBack := &EditMessageRequest{
+		UserId: message.UserId,
+		HLC:    message.HLC,
+	}
+
+	// invoke RPC
+	var response MessageHistory
+	if callEndpoint(w, req, "MessageHandler.GetMessageHistory", messageToBack, &response) {
+		if response.Versions == nil {
+			response.Versions = []MessageVersion{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.Versions)
+	}
+}
+
+/*
+HTTP endpoint functions. Add and remove a reaction {UserId, HLC, Emoji}
+on a message the user sent or received. Adding a reaction twice or
+removing one that is not there changes nothing. A reply is sent to
+/incoming with ReplyToId set to the HLC of the quoted message
+*/
+func AddReaction(w http.ResponseWriter, req *http.Request) {
+	var message ReactionRequest
+	if decodeRequest(w, req, &message) {
+		changeReaction(w, req, "MessageHandler.AddReaction", message)
+	}
+}
+
+func RemoveReaction(w http.ResponseWriter, req *http.Request) {
+	var message ReactionRequest
+	if decodeRequest(w, req, &message) {
+		changeReaction(w, req, "MessageHandler.RemoveReaction", message)
+	}
+}
+
+func changeReaction(w http.ResponseWriter, req *http.Request, funcName string, message ReactionRequest) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("HLC", message.HLC)
+	v.required("Emoji", message.Emoji)
+	v.maxLength("Emoji", message.Emoji, MAX_REACTION_LENGTH)
+	if v.failed(w) {
+		return
+	}
+	callNoContent(w, req, funcName, &message)
+}
+
+// =================================================
+//  OUTBOX
+//
+//  Messages from /incoming are written to a local
+//  append-only file and acknowledged with 202 and a
+//  pending ID before they reach the cluster. A
+//  worker delivers them to the leader in order,
+//  retrying with backoff while there is no leader,
+//  and /outbox reports the status of each one.
+//  With ?wait=true the request waits for the
+//  delivery instead, up to CALL_TIMEOUT, and a
+//  refusal of the leader is answered as any other
+//  endpoint's. Every change to an entry appends the
+//  whole entry as a JSON line, the last line for an
+//  ID wins. Messages the gateway encrypts are sealed
+//  before they are written; one queued while that
+//  was not possible is dropped from the file once
+//  it is finished.
+// =================================================
+
+// states of an outbox entry
+const (
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_FAILED  = "failed" // refused by the leader, not retried
+)
+
+// File of the outbox, relative to the working directory
+var OUTBOX_FILE = "gateway-outbox.jsonl"
+
+// Delivery backoff, doubled after every failed attempt
+var OUTBOX_MIN_BACKOFF = 100 * time.Millisecond
+var OUTBOX_MAX_BACKOFF = 10 * time.Second
+
+// How long sent and failed entries can still be looked up
+var OUTBOX_RETENTION = 1 * time.Hour
+
+// JSON object, a message waiting for or past delivery
+type OutboxEntry struct {
+	PendingId string
+	Message   ChatMessage // its text is blanked once the entry is sent or failed
+	Status    string
+	Error     string `json:",omitempty"` // why the last attempt failed
+	Attempts  int
+	Created   time.Time
+	Updated   time.Time
+
+	retryAt time.Time     // next attempt, not persisted
+	done    chan struct{} // closed once sent or failed
+	err     error         // why delivery failed, as returned by the leader
+	inClear bool          // sealed on delivery, the file has its plaintext
+}
+
+// JSON object, reply to a queued message
+type PendingMessage struct {
+	PendingId string
+	Status    string
+}
+
+type Outbox struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]*OutboxEntry
+	queue   []string // pending IDs, oldest first
+	lines   int      // lines in the file, for compaction
+	wake    chan struct{}
+}
+
+var OUTBOX *Outbox
+
+/*
+Opens the outbox file, replaying it to rebuild the entries. Pending
+entries are delivered again, a torn last line from a crash is skipped
+*/
+func OpenOutbox(path string) (*Outbox, error) {
+	o := &Outbox{
+		path:    path,
+		entries: make(map[string]*OutboxEntry),
+		wake:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading outbox: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			logger.Warn("Skipping unreadable outbox line", "file", path, "err", err)
+			continue
+		}
+		if _, seen := o.entries[entry.PendingId]; !seen && entry.Status == OUTBOX_PENDING {
+			o.queue = append(o.queue, entry.PendingId)
+		}
+		entry.done = make(chan struct{})
+		if entry.Status != OUTBOX_PENDING {
+			close(entry.done)
+		}
+		if entry.Status == OUTBOX_FAILED {
+			entry.err = errors.New(entry.Error)
+		}
+		o.entries[entry.PendingId] = &entry
+	}
+	o.queue = slices.DeleteFunc(o.queue, func(id string) bool {
+		return o.entries[id].Status != OUTBOX_PENDING
+	})
+
+	if err := o.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	if len(o.queue) > 0 {
+		logger.Info("Resuming outbox", "pending", len(o.queue))
+	}
+	return o, nil
+}
+
+// Appends the entry to the file and flushes it to disk
+func (o *Outbox) write(entry *OutboxEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	o.lines++
+	return o.file.Sync()
+}
+
+/*
+Rewrites the file with one line per entry, dropping finished entries
+older than OUTBOX_RETENTION. The new file replaces the old one with a
+rename, so a crash leaves one or the other
+*/
+func (o *Outbox) compact(now time.Time) error {
+	for id, entry := range o.entries {
+		if entry.Status != OUTBOX_PENDING && now.Sub(entry.Updated) > OUTBOX_RETENTION {
+			delete(o.entries, id)
+		}
+	}
+
+	tmp := o.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("writing outbox: %v", err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range o.entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return fmt.Errorf("writing outbox: %v", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("writing outbox: %v", err)
+	}
+	file.Close()
+	if err := os.Rename(tmp, o.path); err != nil {
+		return fmt.Errorf("writing outbox: %v", err)
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	o.lines = len(o.entries)
+	return err
+}
+
+/*
+Stores a message for delivery and returns its entry. The message is
+on disk when this returns. Its request ID (the pending ID unless the
+client gave one) makes redelivery after a lost reply harmless
+*/
+func (o *Outbox) Enqueue(message ChatMessage) (OutboxEntry, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := time.Now()
+	entry := &OutboxEntry{
+		PendingId: hex.EncodeToString(id),
+		Message:   message,
+		Status:    OUTBOX_PENDING,
+		Created:   now,
+		Updated:   now,
+		done:      make(chan struct{}),
+	}
+	if entry.Message.RequestId == "" {
+		entry.Message.RequestId = "outbox-" + entry.PendingId
+	}
+	if err := o.write(entry); err != nil {
+		return OutboxEntry{}, fmt.Errorf("writing outbox: %v", err)
+	}
+	o.entries[entry.PendingId] = entry
+	o.queue = append(o.queue, entry.PendingId)
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return *entry, nil
+}
+
+// Copy of an entry
+func (o *Outbox) Get(id string) (OutboxEntry, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entry, ok := o.entries[id]
+	if !ok {
+		return OutboxEntry{}, false
+	}
+	return *entry, true
+}
+
+// Entries sent by a user, oldest first
+func (o *Outbox) ForUser(user int) []OutboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	list := []OutboxEntry{}
+	for _, entry := range o.entries {
+		if entry.Message.From == user {
+			list = append(list, *entry)
+		}
+	}
+	slices.SortFunc(list, func(a, b OutboxEntry) int { return a.Created.Compare(b.Created) })
+	return list
+}
+
+/*
+Waits until the entry is sent or failed and returns it, with the error
+of a failed delivery. While it is pending when ctx is done the entry
+is returned with ctx's error
+*/
+func (o *Outbox) Wait(ctx context.Context, id string) (OutboxEntry, error) {
+	o.mutex.Lock()
+	entry, ok := o.entries[id]
+	o.mutex.Unlock()
+	if !ok {
+		return OutboxEntry{}, fmt.Errorf("no such pending message")
+	}
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if entry.Status == OUTBOX_PENDING {
+		return *entry, ctx.Err()
+	}
+	return *entry, entry.err
+}
+
+/*
+Oldest pending entry that may be tried now. Later messages of a sender
+whose earlier message is waiting stay behind it, so each sender's
+messages arrive in order. The time is when to look again otherwise
+*/
+func (o *Outbox) next(now time.Time) (*OutboxEntry, time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var wait time.Time
+	waiting := make(map[int]bool)
+	for _, id := range o.queue {
+		entry := o.entries[id]
+		if waiting[entry.Message.From] {
+			continue
+		}
+		if !entry.retryAt.After(now) {
+			return entry, time.Time{}
+		}
+		waiting[entry.Message.From] = true
+		if wait.IsZero() || entry.retryAt.Before(wait) {
+			wait = entry.retryAt
+		}
+	}
+	return nil, wait
+}
+
+// Records the outcome of a delivery attempt
+func (o *Outbox) finish(entry *OutboxEntry, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	entry.Attempts++
+	entry.Updated = now
+	entry.Error = ""
+	switch {
+	case err == nil:
+		entry.Status = OUTBOX_SENT
+	case retryable(err):
+		entry.Error = err.Error()
+		backoff := OUTBOX_MIN_BACKOFF << min(entry.Attempts-1, 16)
+		entry.retryAt = now.Add(min(backoff, OUTBOX_MAX_BACKOFF))
+	default:
+		entry.Status = OUTBOX_FAILED
+		entry.Error = err.Error()
+	}
+	if entry.Status != OUTBOX_PENDING {
+		o.queue = slices.DeleteFunc(o.queue, func(id string) bool { return id == entry.PendingId })
+		entry.err = err
+		close(entry.done)
+		// a finished entry needs no text, the file keeps none of it,
+		// and none at all of a message sealed on delivery
+		entry.Message.Message = ""
+	}
+
+	if err := o.write(entry); err != nil {
+		logger.Error("Error writing outbox", "err", err)
+	}
+	if o.lines > 2*len(o.entries)+100 || entry.Status != OUTBOX_PENDING && entry.inClear {
+		if err := o.compact(now); err != nil {
+			logger.Error("Error compacting outbox", "err", err)
+		}
+	}
+}
+
+/*
+Whether a failed delivery should be tried again. Errors returned by
+the leader's handler are final, except that it stopped being leader
+or the sender is over their rate limit. Anything else is a transport
+problem
+*/
+func retryable(err error) bool {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "not the leader") || strings.Contains(err.Error(), "rate limit")
+}
+
+// Delivers outbox entries to the leader, forever
+func (o *Outbox) DeliveryThread() {
+	for {
+		entry, wait := o.next(time.Now())
+		if entry == nil {
+			var timer <-chan time.Time
+			if !wait.IsZero() {
+				timer = time.After(time.Until(wait))
+			}
+			select {
+			case <-o.wake:
+			case <-timer:
+			}
+			continue
+		}
+
+		o.deliver(entry)
+	}
+}
+
+// One attempt to deliver an entry to the leader
+func (o *Outbox) deliver(entry *OutboxEntry) {
+	// sealed on every attempt when queueing could not seal it
+	message := entry.Message
+	err := sealOutgoing(context.Background(), &message)
+	if message.Encrypted && !entry.Message.Encrypted {
+		o.mutex.Lock()
+		entry.inClear = true
+		o.mutex.Unlock()
+	}
+	if err == nil {
+		var response string
+		err = RemoteProcedureCall(context.Background(), "MessageHandler.SaveMessage", &message, &response)
+	}
+	if err != nil {
+		logger.Warn("Outbox delivery failed", "pending_id", entry.PendingId, "attempt", entry.Attempts+1, "err", err)
+	} else {
+		logger.Debug("Message sent", "pending_id", entry.PendingId, "from", entry.Message.From, "to", entry.Message.To)
+	}
+	o.finish(entry, err)
+}
+
+/*
+HTTP endpoint function. Status of outbox entries, one by pending ID
+(/outbox?id=<id>) or every entry of a sender (/outbox?user=<id>)
+*/
+func GetOutboxStatus(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if id := query.Get("id"); id != "" {
+		entry, ok := OUTBOX.Get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, ERR_NOT_FOUND, "no such pending message")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+
+	user, err := strconv.Atoi(query.Get("user"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "id or user is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, OUTBOX.ForUser(user))
+}
+
+// =================================================
+//  ATTACHMENTS
+//
+//  Files are uploaded in chunks to the leader:
+//  POST /upload/begin {UserId, Size}, then the raw
+//  bytes of each chunk with
+//  POST /upload/chunk?upload=<id>&offset=<n>, then
+//  POST /upload/finish {UploadId}. The returned hash
+//  goes in the Attachment field of /incoming.
+//  GET /attachment?user=<id>&hash=<hash> downloads,
+//  with Range support.
+// =================================================
+
+// Largest chunk body accepted, the leader may set a smaller chunk size
+var MAX_CHUNK_BODY int64 = 4 << 20
+
+// Bytes fetched from the leader per read when serving a download
+var DOWNLOAD_CHUNK = 256 << 10
+
+func BeginUpload(w http.ResponseWriter, req *http.Request) {
+	var message BeginUploadRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.check(message.Size > 0, "Size is required")
+	if v.failed(w) {
+		return
+	}
+
+	var session UploadSession
+	if callEndpoint(w, req, "MessageHandler.BeginUpload", &message, &session) {
+		writeJSON(w, http.StatusOK, session)
+	}
+}
+
+func UploadChunk(w http.ResponseWriter, req *http.Request) {
+	uploadChunk(w, req, req.URL.Query().Get("upload"))
+}
+
+// Stores the request body at ?offset=<n> of the upload
+func uploadChunk(w http.ResponseWriter, req *http.Request, upload_id string) {
+	offset, err := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "offset must be an integer")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MAX_CHUNK_BODY))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, ERR_TOO_LARGE, "chunk too large")
+		return
+	}
+
+	chunk := &UploadChunkRequest{UploadId: upload_id, Offset: offset, Data: body}
+	var session UploadSession
+	if callEndpoint(w, req, "MessageHandler.UploadChunk", chunk, &session) {
+		writeJSON(w, http.StatusOK, session)
+	}
+}
+
+func FinishUpload(w http.ResponseWriter, req *http.Request) {
+	var message UploadSession
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.required("UploadId", message.UploadId)
+	if v.failed(w) {
+		return
+	}
+
+	var info BlobInfo
+	if callEndpoint(w, req, "MessageHandler.FinishUpload", &UploadSession{UploadId: message.UploadId}, &info) {
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+/*
+Reads a blob from the leader on demand, so http.ServeContent can
+answer range requests without the gateway holding the whole file
+*/
+type blobReader struct {
+	ctx    context.Context // of the download request
+	user   int
+	hash   string
+	size   int64
+	offset int64
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	var chunk BlobChunk
+	req := &ReadBlobRequest{UserId: b.user, Hash: b.hash, Offset: b.offset, Length: min(len(p), DOWNLOAD_CHUNK)}
+	if err := RemoteProcedureCall(b.ctx, "MessageHandler.ReadBlob", req, &chunk); err != nil {
+		return 0, err
+	}
+	if len(chunk.Data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, chunk.Data)
+	b.offset += int64(n)
+	return n, nil
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+// types a browser may show inline, everything else is downloaded
+var INLINE_TYPES = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+func DownloadAttachment(w http.ResponseWriter, req *http.Request) {
+	userid, err := strconv.Atoi(req.URL.Query().Get("user"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ERR_INVALID_REQUEST, "user must be an integer")
+		return
+	}
+	serveAttachment(w, req, userid, req.URL.Query().Get("hash"))
+}
+
+// Serves a blob the user may read, with Range support
+func serveAttachment(w http.ResponseWriter, req *http.Request, userid int, hash string) {
+
+	// size and type first, this also checks the user may read it
+	var head BlobChunk
+	resp := RemoteProcedureCall(req.Context(), "MessageHandler.ReadBlob", &ReadBlobRequest{UserId: userid, Hash: hash}, &head)
+	if resp != nil {
+		writeRPCError(w, "MessageHandler.ReadBlob", resp, http.StatusNotFound)
+		return
+	}
+
+	disposition := "attachment"
+	if INLINE_TYPES[head.MIME] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", head.MIME)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+hash+`"`) // content-addressed, never changes
+	http.ServeContent(w, req, "", time.Time{}, &blobReader{ctx: req.Context(), user: userid, hash: hash, size: head.Size})
+}
+
+// =================================================
+//  PRESENCE
+//
+//  Clients of logged-in users call
+//  POST /heartbeat {UserId, Away} every few seconds
+//  and POST /typing {UserId, ContactId, Typing}
+//  while the user types; POST /presence {UserId,
+//  ContactId} tells who of the user's contacts is
+//  online, away or offline, and whether they are
+//  typing to the user. The leader keeps presence in
+//  memory only, see server/presence.go. The gateway
+//  remembers what it forwarded and reports all of
+//  it to every new leader, and again every
+//  PRESENCE_REPORT_INTERVAL, so a failover loses
+//  presence for a few seconds at most.
+// =================================================
+
+// How often the gateway reports everything it knows to the leader
+var PRESENCE_REPORT_INTERVAL = 5 * time.Second
+
+// How long a user who stopped sending heartbeats is still reported,
+// so the new leader knows when they were last seen
+var PRESENCE_RETENTION = 24 * time.Hour
+
+// Typing stops by itself after this long, as on the replicas
+var TYPING_TIMEOUT = 6 * time.Second
+
+type presence struct {
+	seen time.Time
+	away bool
+}
+
+// Presence forwarded to the leader, by user and typing start by {user, contact}
+type presenceTable struct {
+	mutex  sync.Mutex
+	users  map[int]presence
+	typing map[[2]int]time.Time
+}
+
+var PRESENCE = &presenceTable{users: make(map[int]presence), typing: make(map[[2]int]time.Time)}
+
+func (p *presenceTable) heartbeat(user int, away bool, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.users[user] = presence{seen: now, away: away}
+}
+
+func (p *presenceTable) setTyping(user int, contact int, typing bool, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.users[user] = presence{seen: now}
+	if typing {
+		p.typing[[2]int{user, contact}] = now
+	} else {
+		delete(p.typing, [2]int{user, contact})
+	}
+}
+
+// Everything still worth telling the leader, as ages from now. Drops the rest
+func (p *presenceTable) report(now time.Time) PresenceReport {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	report := PresenceReport{Heartbeats: []PresenceHeartbeat{}, Typing: []TypingUpdate{}}
+	for user, current := range p.users {
+		age := now.Sub(current.seen)
+		if age > PRESENCE_RETENTION {
+			delete(p.users, user)
+			continue
+		}
+		report.Heartbeats = append(report.Heartbeats, PresenceHeartbeat{UserId: user, Away: current.away, Age: max(age, 0)})
+	}
+	for key, since := range p.typing {
+		age := now.Sub(since)
+		if age >= TYPING_TIMEOUT {
+			delete(p.typing, key)
+			continue
+		}
+		report.Typing = append(report.Typing, TypingUpdate{UserId: key[0], ContactId: key[1], Typing: true, Age: max(age, 0)})
+	}
+	return report
+}
+
+/*
+Reports all presence to the leader every PRESENCE_REPORT_INTERVAL,
+and as soon as WatchLeader found a new one, forever
+*/
+func PresenceThread() {
+	reported := int64(-1) // leader that has the last report
+	var last time.Time
+	for {
+		leader := ACTIVE_LEADER.Load()
+		if leader != -1 && (leader != reported || time.Since(last) >= PRESENCE_REPORT_INTERVAL) {
+			report := PRESENCE.report(time.Now())
+			var response RPCResponse
+			if err := RemoteProcedureCall(context.Background(), "MessageHandler.ReportPresence", &report, &response); err != nil {
+				logger.Debug("Presence report failed", "err", err)
+			} else {
+				if leader != reported {
+					logger.Info("Presence reported to the leader", "users", len(report.Heartbeats), "typing", len(report.Typing))
+				}
+				reported, last = leader, time.Now()
+			}
+		}
+		time.Sleep(LEADER_REFRESH)
+	}
+}
+
+/*
+HTTP endpoint functions. A heartbeat of a logged-in user {UserId, Away},
+typing started or stopped {UserId, ContactId, Typing}, and the presence
+of the user's contacts {UserId, ContactId}, of all of them when
+ContactId is 0
+*/
+func Heartbeat(w http.ResponseWriter, req *http.Request) {
+	var message PresenceHeartbeat
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	heartbeat(w, req, message)
+}
+
+func heartbeat(w http.ResponseWriter, req *http.Request, message PresenceHeartbeat) {
+	var v validation
+	v.id("UserId", message.UserId)
+	if v.failed(w) {
+		return
+	}
+
+	// kept even if the leader is unreachable, the next report sends it
+	message.Age = 0
+	PRESENCE.heartbeat(message.UserId, message.Away, time.Now())
+	callNoContent(w, req, "MessageHandler.Heartbeat", &message)
+}
+
+func SetTyping(w http.ResponseWriter, req *http.Request) {
+	var message TypingUpdate
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	setTyping(w, req, message)
+}
+
+func setTyping(w http.ResponseWriter, req *http.Request, message TypingUpdate) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("ContactId", message.ContactId)
+	v.check(message.UserId != message.ContactId, "ContactId must differ from UserId")
+	if v.failed(w) {
+		return
+	}
+
+	message.Age = 0
+	PRESENCE.setTyping(message.UserId, message.ContactId, message.Typing, time.Now())
+	callNoContent(w, req, "MessageHandler.SetTyping", &message)
+}
+
+func GetPresence(w http.ResponseWriter, req *http.Request) {
+	var message PresenceRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+
+	var v validation
+	v.id("UserId", message.UserId)
+	v.check(message.ContactId >= 0, "ContactId must not be negative")
+	if v.failed(w) {
+		return
+	}
+
+	var response PresenceList
+	if callEndpoint(w, req, "MessageHandler.GetPresence", &message, &response) {
+		if response.Users == nil {
+			response.Users = []PresenceInfo{} // gob drops empty slices
+		}
+		writeJSON(w, http.StatusOK, response.Users)
+	}
+}
+
+// =================================================
+
+/*
+Function to handle routing
+of HTTP requests.
 
 This function runs an HTTP server
 on a separate thread. Endpoints available
@@ -495,30 +2738,124 @@ with their appropriate RPC call functions.
 */
 func HTTPThread() {
 	serv := http.NewServeMux()
-	serv.HandleFunc("/incoming", HandleIncoming)
-	serv.HandleFunc("/register", CreateAccount)
-	serv.HandleFunc("/login", Login)
-	serv.HandleFunc("/getcontacts", GetContacts)
-	serv.HandleFunc("/getmessages", GetMessages)
-	serv.HandleFunc("/allusers", GetAllUsers)
-	serv.HandleFunc("/addcontact", AddContact)
-	http.ListenAndServe("127.0.0.1:8090", cors.Default().Handler(serv))
+	serv.Handle("/incoming", instrument("/incoming", allow(HandleIncoming, http.MethodPost)))
+	serv.Handle("/outbox", instrument("/outbox", allow(GetOutboxStatus, http.MethodGet, http.MethodHead)))
+	serv.Handle("/register", instrument("/register", allow(CreateAccount, http.MethodPost)))
+	serv.Handle("/login", instrument("/login", allow(Login, http.MethodPost)))
+	serv.Handle("/updateprofile", instrument("/updateprofile", allow(UpdateProfile, http.MethodPost)))
+	serv.Handle("/changepassword", instrument("/changepassword", allow(ChangePassword, http.MethodPost)))
+	serv.Handle("/deleteaccount", instrument("/deleteaccount", allow(DeleteAccount, http.MethodPost)))
+	serv.Handle("/devices", instrument("/devices", allow(GetDevices, http.MethodPost)))
+	serv.Handle("/revokedevice", instrument("/revokedevice", allow(RevokeDevice, http.MethodPost)))
+	serv.Handle("/sync", instrument("/sync", allow(SyncDevice, http.MethodPost)))
+	serv.Handle("/getcontacts", instrument("/getcontacts", allow(GetContacts, http.MethodPost)))
+	serv.Handle("/getmessages", instrument("/getmessages", allow(GetMessages, http.MethodPost)))
+	serv.Handle("/allusers", instrument("/allusers", allow(GetAllUsers, http.MethodPost)))
+	serv.Handle("/searchusers", instrument("/searchusers", allow(SearchUsers, http.MethodPost)))
+	serv.Handle("/setdiscoverable", instrument("/setdiscoverable", allow(SetDiscoverable, http.MethodPost)))
+	serv.Handle("/addcontact", instrument("/addcontact", allow(AddContact, http.MethodPost)))
+	serv.Handle("/sendcontactrequest", instrument("/sendcontactrequest", allow(SendContactRequest, http.MethodPost)))
+	serv.Handle("/respondcontactrequest", instrument("/respondcontactrequest", allow(RespondContactRequest, http.MethodPost)))
+	serv.Handle("/contactrequests", instrument("/contactrequests", allow(GetContactRequests, http.MethodPost)))
+	serv.Handle("/blockuser", instrument("/blockuser", allow(BlockUser, http.MethodPost)))
+	serv.Handle("/unblockuser", instrument("/unblockuser", allow(UnblockUser, http.MethodPost)))
+	serv.Handle("/blockedusers", instrument("/blockedusers", allow(GetBlockedUsers, http.MethodPost)))
+	serv.Handle("/reportmessage", instrument("/reportmessage", allow(ReportMessage, http.MethodPost)))
+	serv.Handle("/editmessage", instrument("/editmessage", allow(EditMessage, http.MethodPost)))
+	serv.Handle("/deletemessage", instrument("/deletemessage", allow(DeleteMessage, http.MethodPost)))
+	serv.Handle("/messagehistory", instrument("/messagehistory", allow(GetMessageHistory, http.MethodPost)))
+	serv.Handle("/addreaction", instrument("/addreaction", allow(AddReaction, http.MethodPost)))
+	serv.Handle("/removereaction", instrument("/removereaction", allow(RemoveReaction, http.MethodPost)))
+	serv.Handle("/registerkey", instrument("/registerkey", allow(RegisterPublicKey, http.MethodPost)))
+	serv.Handle("/publickey", instrument("/publickey", allow(GetPublicKey, http.MethodPost)))
+	serv.Handle("/heartbeat", instrument("/heartbeat", allow(Heartbeat, http.MethodPost)))
+	serv.Handle("/typing", instrument("/typing", allow(SetTyping, http.MethodPost)))
+	serv.Handle("/presence", instrument("/presence", allow(GetPresence, http.MethodPost)))
+	serv.Handle("/upload/begin", instrument("/upload/begin", allow(BeginUpload, http.MethodPost)))
+	serv.Handle("/upload/chunk", instrument("/upload/chunk", allow(UploadChunk, http.MethodPost)))
+	serv.Handle("/upload/finish", instrument("/upload/finish", allow(FinishUpload, http.MethodPost)))
+	serv.Handle("/attachment", instrument("/attachment", allow(DownloadAttachment, http.MethodGet, http.MethodHead)))
+	serv.HandleFunc("/healthz", allow(GatewayHealth, http.MethodGet, http.MethodHead))
+	serv.HandleFunc("/readyz", allow(GatewayReady, http.MethodGet, http.MethodHead))
+	RegisterAPI(serv)
+	serv.Handle("/metrics", promhttp.HandlerFor(METRICS_REGISTRY, promhttp.HandlerOpts{}))
+	// cors.Default, plus the Idempotency-Key header, see requestId
+	cross_origin := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodHead, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Idempotency-Key"},
+	})
+	if err := http.ListenAndServe(LISTEN_ADDRESS, cross_origin.Handler(serv)); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
-	// parse possibl addresses
-	REPLICA_ADDRESSES = ReadReplicaAddresses(ADDRESS_FILE)
+	// configuration, see CONFIGURATION
+	configFile := flag.String("config", "", "YAML config file (default $MECHAT_CONFIG or "+DEFAULT_CONFIG_FILE+")")
+	openapi := flag.Bool("openapi", false, "print the OpenAPI document of "+API_PREFIX+" and exit")
+	flag.Parse()
+
+	if *openapi {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(openAPIDocument()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	filename, required := *configFile, true
+	if filename == "" {
+		filename = os.Getenv("MECHAT_CONFIG")
+	}
+	if filename == "" {
+		filename, required = DEFAULT_CONFIG_FILE, false
+	}
+	config, err := LoadGatewayConfig(filename, required)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Apply(); err != nil {
+		log.Fatal(err)
+	}
+
+	tlsConfig, err := config.GatewayTLS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	GATEWAY_TLS = tlsConfig
+	if GATEWAY_TLS != nil {
+		logger.Info("Using mutual TLS")
+	}
+
+	// messages accepted before a restart are sent again
+	OUTBOX, err = OpenOutbox(OUTBOX_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go OUTBOX.DeliveryThread()
 
-	// ask back-end for leader address
-	leaderFound := ConfirmLeader()
-	for !leaderFound {
-		leaderFound = ConfirmLeader()
+	// keys of users whose messages the gateway encrypts, see END-TO-END ENCRYPTION
+	if KEYS_DIR != "" {
+		KEYS, err = OpenKeyStore(KEYS_DIR)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info("Keeping user keys", "dir", KEYS_DIR)
+	}
+
+	// the leader is looked up in the background, until it is found
+	// the endpoints answer 503 and /readyz reports not ready
+	if err := ConfirmLeader(); err != nil {
+		logger.Warn("Starting without a leader", "err", err)
+	} else {
+		logger.Info("RPC connection succeeded")
 	}
+	go WatchLeader()
 
-	// output leader ID, debug after connect
-	fmt.Printf("Leader: %s:%d\n", ACTIVE_REPLICA.Address, ACTIVE_REPLICA.Port)
-	fmt.Println("RPC connection succeeded.")
-	fmt.Println(rpc_client)
+	// presence lives on the leader only, every new leader gets a report
+	go PresenceThread()
 
 	// kickoff HTTP thread for client UI
 	// communication
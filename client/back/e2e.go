@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// =================================================
+//  END-TO-END ENCRYPTION
+//
+//  Optional, for 1:1 chats. Clients keep an X25519
+//  key pair and register the public key with
+//  POST /registerkey {UserId, PublicKey}; the key of
+//  a contact comes from POST /publickey {UserId,
+//  ContactId}. An encrypted message is sent with
+//  Encrypted set and an envelope as its text, the
+//  scheme is described in server/e2e.go. A
+//  contact's new key shows up as a new KeyId in
+//  /sync.
+//
+//  Clients that do not encrypt themselves can let
+//  the gateway do it: with gateway.keys set, the
+//  gateway keeps a key pair for every user who logs
+//  in (see KeyStore) and registers its public key,
+//  unless the user's client registered one of its
+//  own. Messages of such a user are then sealed
+//  before delivery when the recipient has a key,
+//  and messages they read are opened: the text is
+//  plaintext and Encrypted stays set. An edit of an
+//  encrypted message is sent with Encrypted set and
+//  the plaintext, plus ContactId so the gateway can
+//  seal it. Envelopes the gateway cannot open, and
+//  the texts in /messagehistory, are passed on as
+//  they are.
+// =================================================
+
+// base64 of a 32-byte key
+const MAX_PUBLIC_KEY_LENGTH = 44
+
+// as on the replicas
+const (
+	ENVELOPE_VERSION  = 1
+	MAX_ENVELOPE_KEYS = 8
+	KEY_ID_LENGTH     = 16 // hex digits
+)
+
+// Directory of the user keys the gateway keeps, empty to keep none
+var KEYS_DIR = ""
+
+// nil when KEYS_DIR is empty
+var KEYS *KeyStore
+
+// Encrypted text of a message, as stored in messages.message
+type Envelope struct {
+	Version    int          `json:"v"`
+	Nonce      string       `json:"nonce"` // base64, 12 bytes
+	Ciphertext string       `json:"ct"`    // base64, AES-256-GCM of the text
+	Keys       []WrappedKey `json:"keys"`
+}
+
+// The content key of an envelope, sealed for one public key
+type WrappedKey struct {
+	KeyId     string `json:"kid"`
+	Ephemeral string `json:"epk"`   // base64, 32 bytes
+	Nonce     string `json:"nonce"` // base64, 12 bytes
+	Key       string `json:"key"`   // base64, 32 bytes and the GCM tag
+}
+
+// ID of a public key, as used in WrappedKey
+func publicKeyId(key []byte) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:])[:KEY_ID_LENGTH]
+}
+
+// Whether text is an envelope rather than plaintext
+func isEnvelope(text string) bool {
+	var envelope Envelope
+	return json.Unmarshal([]byte(text), &envelope) == nil && envelope.Version != 0 && len(envelope.Keys) > 0
+}
+
+// HKDF-SHA256 (RFC 5869) for a single 32-byte block
+func hkdf32(secret []byte, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seals plaintext under key with a random nonce
+func gcmSeal(key []byte, plaintext []byte, aad []byte) (nonce []byte, sealed []byte, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key []byte, nonce []byte, sealed []byte, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce is %d bytes, want %d", len(nonce), aead.NonceSize())
+	}
+	return aead.Open(nil, nonce, sealed, aad)
+}
+
+// Additional data of the text of a message, binds it to its chat
+func messageAAD(from int, to int) []byte {
+	return []byte(fmt.Sprintf("mechat e2e v1 %d %d", from, to))
+}
+
+// Key that wraps a content key for recipient, from the ephemeral key's side or the recipient's
+func wrappingKey(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdf32(shared, salt, "mechat e2e v1 key wrap")
+}
+
+/*
+Encrypts the text of a message from one user to another, wrapping the
+content key for each of the given public keys: the recipient's, and
+usually the sender's own so their other devices can read it
+*/
+func SealEnvelope(text string, from int, to int, keys ...*ecdh.PublicKey) (string, error) {
+	if len(keys) == 0 || len(keys) > MAX_ENVELOPE_KEYS {
+		return "", fmt.Errorf("envelope must have 1 to %d keys", MAX_ENVELOPE_KEYS)
+	}
+	content := make([]byte, 32)
+	if _, err := rand.Read(content); err != nil {
+		return "", err
+	}
+	nonce, ciphertext, err := gcmSeal(content, []byte(text), messageAAD(from, to))
+	if err != nil {
+		return "", err
+	}
+	envelope := Envelope{
+		Version:    ENVELOPE_VERSION,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+
+	for _, key := range keys {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		shared, err := ephemeral.ECDH(key)
+		if err != nil {
+			return "", err
+		}
+		wrapNonce, wrapped, err := gcmSeal(wrappingKey(shared, ephemeral.PublicKey().Bytes(), key.Bytes()), content, nil)
+		if err != nil {
+			return "", err
+		}
+		envelope.Keys = append(envelope.Keys, WrappedKey{
+			KeyId:     publicKeyId(key.Bytes()),
+			Ephemeral: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+			Nonce:     base64.StdEncoding.EncodeToString(wrapNonce),
+			Key:       base64.StdEncoding.EncodeToString(wrapped),
+		})
+	}
+
+	encoded, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+/*
+Decrypts the text of a message from one user to another with the
+private key of one of its readers. A changed envelope, or one moved
+to another chat, fails to open
+*/
+func OpenEnvelope(text string, from int, to int, key *ecdh.PrivateKey) (string, error) {
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+		return "", fmt.Errorf("not an envelope: %v", err)
+	}
+	if envelope.Version != ENVELOPE_VERSION {
+		return "", fmt.Errorf("envelope version %d is not supported", envelope.Version)
+	}
+	decode := base64.StdEncoding.DecodeString
+	keyId := publicKeyId(key.PublicKey().Bytes())
+	for _, wrapped := range envelope.Keys {
+		if wrapped.KeyId != keyId {
+			continue
+		}
+		ephemeralBytes, err := decode(wrapped.Ephemeral)
+		if err != nil {
+			return "", fmt.Errorf("envelope key is malformed")
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+		if err != nil {
+			return "", err
+		}
+		shared, err := key.ECDH(ephemeral)
+		if err != nil {
+			return "", err
+		}
+		wrapNonce, err1 := decode(wrapped.Nonce)
+		sealedKey, err2 := decode(wrapped.Key)
+		nonce, err3 := decode(envelope.Nonce)
+		ciphertext, err4 := decode(envelope.Ciphertext)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return "", fmt.Errorf("envelope is malformed")
+		}
+		content, err := gcmOpen(wrappingKey(shared, ephemeralBytes, key.PublicKey().Bytes()), wrapNonce, sealedKey, nil)
+		if err != nil {
+			return "", fmt.Errorf("opening content key: %v", err)
+		}
+		plaintext, err := gcmOpen(content, nonce, ciphertext, messageAAD(from, to))
+		if err != nil {
+			return "", fmt.Errorf("opening message: %v", err)
+		}
+		return string(plaintext), nil
+	}
+	return "", fmt.Errorf("envelope is not wrapped for this key")
+}
+
+/*
+Private keys the gateway keeps for its users, one file per user in a
+directory only the gateway can read. The keys never leave the gateway
+*/
+type KeyStore struct {
+	mutex sync.Mutex
+	dir   string
+	keys  map[int]*ecdh.PrivateKey
+}
+
+// Opens the key directory, creating it if needed
+func OpenKeyStore(dir string) (*KeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating key directory: %v", err)
+	}
+	return &KeyStore{dir: dir, keys: make(map[int]*ecdh.PrivateKey)}, nil
+}
+
+func (k *KeyStore) path(user int) string {
+	return filepath.Join(k.dir, strconv.Itoa(user)+".key")
+}
+
+// Key of user, nil when the gateway keeps none for them
+func (k *KeyStore) Get(user int) (*ecdh.PrivateKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.load(user)
+}
+
+func (k *KeyStore) load(user int) (*ecdh.PrivateKey, error) {
+	if key, ok := k.keys[user]; ok {
+		return key, nil
+	}
+	data, err := os.ReadFile(k.path(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading key of user %d: %v", user, err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key of user %d is not base64", user)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("key of user %d: %v", user, err)
+	}
+	k.keys[user] = key
+	return key, nil
+}
+
+/*
+Key of user, generated and stored if the gateway keeps none yet.
+created tells whether it is new
+*/
+func (k *KeyStore) GetOrCreate(user int) (key *ecdh.PrivateKey, created bool, err error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if key, err := k.load(user); key != nil || err != nil {
+		return key, false, err
+	}
+
+	key, err = ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	// written to a temporary file first, so a crash leaves no torn key
+	tmp := k.path(user) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(base64.StdEncoding.EncodeToString(key.Bytes())+"\n"), 0600); err != nil {
+		return nil, false, fmt.Errorf("writing key of user %d: %v", user, err)
+	}
+	if err := os.Rename(tmp, k.path(user)); err != nil {
+		return nil, false, fmt.Errorf("writing key of user %d: %v", user, err)
+	}
+	k.keys[user] = key
+	return key, true, nil
+}
+
+/*
+Registered public key of a user, nil when they have none. user is the
+one asking
+*/
+func registeredKey(ctx context.Context, user int, owner int) (*PublicKeyInfo, error) {
+	var info PublicKeyInfo
+	err := RemoteProcedureCall(ctx, "MessageHandler.GetPublicKey", &GetPublicKeyRequest{UserId: user, ContactId: owner}, &info)
+	if isServerError(err, "no such public key") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+/*
+Called when a user logs in: makes sure the gateway keeps a key for them
+and that it is registered, unless their client registered its own.
+Failures are logged, the login goes on without encryption
+*/
+func ensureUserKey(ctx context.Context, user int) {
+	if KEYS == nil {
+		return
+	}
+	key, created, err := KEYS.GetOrCreate(user)
+	if err != nil {
+		logger.Error("Error reading user key", "user", user, "err", err)
+		return
+	}
+	public := key.PublicKey().Bytes()
+	if !created {
+		current, err := registeredKey(ctx, user, user)
+		if err != nil {
+			logger.Warn("Error looking up user key", "user", user, "err", err)
+			return
+		}
+		if current != nil {
+			if current.KeyId != publicKeyId(public) {
+				logger.Debug("User registered a key of their own client", "user", user, "key", current.KeyId)
+			}
+			return
+		}
+	}
+
+	var response RPCResponse
+	request := PublicKeyRequest{UserId: user, PublicKey: base64.StdEncoding.EncodeToString(public)}
+	if err := RemoteProcedureCall(ctx, "MessageHandler.RegisterPublicKey", &request, &response); err != nil {
+		logger.Warn("Error registering user key", "user", user, "err", err)
+		return
+	}
+	logger.Info("Registered gateway key", "user", user, "key", response.Message)
+}
+
+/*
+Envelope of text from one user to another when the gateway keeps the
+sender's key and the recipient has one registered. ok is false when
+the text is to be sent as it is
+*/
+func sealFor(ctx context.Context, text string, from int, to int) (sealed string, ok bool, err error) {
+	if KEYS == nil {
+		return "", false, nil
+	}
+	key, err := KEYS.Get(from)
+	if err != nil || key == nil {
+		return "", false, err
+	}
+	info, err := registeredKey(ctx, from, to)
+	if err != nil || info == nil {
+		return "", false, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(info.PublicKey)
+	if err != nil {
+		return "", false, fmt.Errorf("public key of user %d is not base64", to)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(decoded)
+	if err != nil {
+		return "", false, fmt.Errorf("public key of user %d: %v", to, err)
+	}
+	sealed, err = SealEnvelope(text, from, to, recipient, key.PublicKey())
+	return sealed, err == nil, err
+}
+
+/*
+Seals a message about to be delivered, see sealFor. A message that is
+already an envelope, or has no text, is left alone
+*/
+func sealOutgoing(ctx context.Context, message *ChatMessage) error {
+	if message.Message == "" || message.Encrypted && isEnvelope(message.Message) {
+		return nil
+	}
+	sealed, ok, err := sealFor(ctx, message.Message, message.From, message.To)
+	if ok {
+		message.Message, message.Encrypted = sealed, true
+	}
+	return err
+}
+
+/*
+Seals the plaintext edit of an encrypted message sent to contact.
+Edits the gateway cannot seal are left to the leader to refuse
+*/
+func sealEdit(ctx context.Context, message *EditMessageRequest, contact int) error {
+	if !message.Encrypted || isEnvelope(message.Message) || contact == 0 {
+		return nil
+	}
+	sealed, ok, err := sealFor(ctx, message.Message, message.UserId, contact)
+	if ok {
+		message.Message = sealed
+	}
+	return err
+}
+
+// Opens the envelopes in messages read by user, for whom the gateway may keep a key
+func openMessages(user int, messages []ChatMessage) {
+	if KEYS == nil {
+		return
+	}
+	key, err := KEYS.Get(user)
+	if err != nil || key == nil {
+		if err != nil {
+			logger.Error("Error reading user key", "user", user, "err", err)
+		}
+		return
+	}
+	for i := range messages {
+		message := &messages[i]
+		if !message.Encrypted || message.Deleted {
+			continue
+		}
+		text, err := OpenEnvelope(message.Message, message.From, message.To, key)
+		if err != nil {
+			logger.Debug("Envelope not opened", "user", user, "message", message.HLC, "err", err)
+			continue
+		}
+		message.Message = text
+	}
+}
+
+func RegisterPublicKey(w http.ResponseWriter, req *http.Request) {
+	var message PublicKeyRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	registerPublicKey(w, req, message)
+}
+
+func registerPublicKey(w http.ResponseWriter, req *http.Request, message PublicKeyRequest) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.required("PublicKey", message.PublicKey)
+	v.maxLength("PublicKey", message.PublicKey, MAX_PUBLIC_KEY_LENGTH)
+	if v.failed(w) {
+		return
+	}
+
+	var response RPCResponse
+	if callEndpoint(w, req, "MessageHandler.RegisterPublicKey", &message, &response) {
+		writeJSON(w, http.StatusOK, RegisteredKey{KeyId: response.Message})
+	}
+}
+
+func GetPublicKey(w http.ResponseWriter, req *http.Request) {
+	var message GetPublicKeyRequest
+	if !decodeRequest(w, req, &message) {
+		return
+	}
+	getPublicKey(w, req, message)
+}
+
+func getPublicKey(w http.ResponseWriter, req *http.Request, message GetPublicKeyRequest) {
+	var v validation
+	v.id("UserId", message.UserId)
+	v.id("ContactId", message.ContactId)
+	if v.failed(w) {
+		return
+	}
+
+	var response PublicKeyInfo
+	if callEndpoint(w, req, "MessageHandler.GetPublicKey", &message, &response) {
+		writeJSON(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Sealed for the key privateKeyBytes, from user 1 to 2. Stored envelopes must keep opening
+const REPLICA_ENVELOPE = `{"v":1,"nonce":"ZnHUYrvdgguXLvGT","ct":"xgVfbNt3AonnkeMP5dxqZLjIgzPWHPrMdnQW1g==","keys":[{"kid":"aaa8fff703b50b22","epk":"qQzd5ErKa85jVCcA2rNl95XtB00AeJUNBbgNs3LEWDc=","nonce":"YsHJxq048ZriwInv","key":"rh+oMYBAraeGyxkIV+zFIOS8QZvaZkPSOiY24Zc6vzAmN55Xj5dT/8vM+TFS+sJE"}]}`
+
+func privateKeyBytes() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+	return key
+}
+
+func newX25519Key(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestOpenStoredEnvelope(t *testing.T) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKeyBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := OpenEnvelope(REPLICA_ENVELOPE, 1, 2, key); err != nil || text != "meet at noon" {
+		t.Fatalf("opened %q, %v", text, err)
+	}
+	if _, err := OpenEnvelope(REPLICA_ENVELOPE, 1, 3, key); err == nil {
+		t.Error("envelope opened for another chat")
+	}
+}
+
+// SealEnvelope that fails the test on error
+func sealEnvelope(t *testing.T, text string, from int, to int, keys ...*ecdh.PublicKey) string {
+	t.Helper()
+	envelope, err := SealEnvelope(text, from, to, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	alice, bob, carol := newX25519Key(t), newX25519Key(t), newX25519Key(t)
+	for _, text := range []string{"meet at noon", "", strings.Repeat("ü", 2000)} {
+		sealed := sealEnvelope(t, text, 1, 2, bob.PublicKey(), alice.PublicKey())
+		if !isEnvelope(sealed) {
+			t.Fatalf("sealed text is not an envelope: %s", sealed)
+		}
+		if strings.Contains(sealed, "noon") {
+			t.Errorf("plaintext in the envelope: %s", sealed)
+		}
+		for name, key := range map[string]*ecdh.PrivateKey{"recipient": bob, "sender": alice} {
+			if opened, err := OpenEnvelope(sealed, 1, 2, key); err != nil || opened != text {
+				t.Errorf("opened by %s: %q, %v", name, opened, err)
+			}
+		}
+		if _, err := OpenEnvelope(sealed, 1, 2, carol); err == nil {
+			t.Error("opened with a key it was not wrapped for")
+		}
+	}
+	if isEnvelope("meet at noon") || isEnvelope(`{"v":1}`) {
+		t.Error("plaintext taken for an envelope")
+	}
+
+	// every envelope has its own content key and nonces
+	if sealEnvelope(t, "same", 1, 2, bob.PublicKey()) == sealEnvelope(t, "same", 1, 2, bob.PublicKey()) {
+		t.Error("two envelopes of the same text are equal")
+	}
+	if _, err := SealEnvelope("no readers", 1, 2); err == nil {
+		t.Error("sealed without a key")
+	}
+}
+
+func TestEnvelopeTamperRejected(t *testing.T) {
+	bob := newX25519Key(t)
+	sealed := sealEnvelope(t, "meet at noon", 1, 2, bob.PublicKey())
+
+	// flips the first bit of a base64 field
+	flip := func(field string) string {
+		decoded, _ := base64.StdEncoding.DecodeString(field)
+		decoded[0] ^= 1
+		return base64.StdEncoding.EncodeToString(decoded)
+	}
+	for _, test := range []struct {
+		name   string
+		from   int
+		to     int
+		tamper func(*Envelope)
+	}{
+		{"ciphertext", 1, 2, func(e *Envelope) { e.Ciphertext = flip(e.Ciphertext) }},
+		{"nonce", 1, 2, func(e *Envelope) { e.Nonce = flip(e.Nonce) }},
+		{"wrapped key", 1, 2, func(e *Envelope) { e.Keys[0].Key = flip(e.Keys[0].Key) }},
+		{"key nonce", 1, 2, func(e *Envelope) { e.Keys[0].Nonce = flip(e.Keys[0].Nonce) }},
+		{"ephemeral key", 1, 2, func(e *Envelope) { e.Keys[0].Ephemeral = flip(e.Keys[0].Ephemeral) }},
+		{"version", 1, 2, func(e *Envelope) { e.Version = 2 }},
+		{"moved to another chat", 1, 3, func(e *Envelope) {}},
+		{"sender swapped", 2, 1, func(e *Envelope) {}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var envelope Envelope
+			if err := json.Unmarshal([]byte(sealed), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			test.tamper(&envelope)
+			tampered, _ := json.Marshal(envelope)
+			if opened, err := OpenEnvelope(string(tampered), test.from, test.to, bob); err == nil {
+				t.Errorf("tampered envelope opened: %q", opened)
+			}
+		})
+	}
+
+	if _, err := OpenEnvelope("meet at noon", 1, 2, bob); err == nil {
+		t.Error("plaintext opened as an envelope")
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := store.Get(1); key != nil || err != nil {
+		t.Fatalf("key of an unknown user: %v, %v", key, err)
+	}
+	key, created, err := store.GetOrCreate(1)
+	if err != nil || !created {
+		t.Fatalf("creating a key: created %v, %v", created, err)
+	}
+	if again, created, _ := store.GetOrCreate(1); created || !again.Equal(key) {
+		t.Error("key created twice")
+	}
+	info, err := os.Stat(store.path(1))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", info, err)
+	}
+
+	// the key outlives a restart of the gateway
+	reopened, err := OpenKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := reopened.Get(1); err != nil || loaded == nil || !loaded.Equal(key) {
+		t.Errorf("key after reopening: %v", err)
+	}
+}
+
+func TestOpenMessages(t *testing.T) {
+	store, err := OpenKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	KEYS = store
+	t.Cleanup(func() { KEYS = nil })
+	bob, _, err := store.GetOrCreate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealEnvelope("meet at noon", 1, 2, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := SealEnvelope("not for bob", 1, 2, newX25519Key(t).PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []ChatMessage{
+		{Message: sealed, From: 1, To: 2, Encrypted: true},
+		{Message: foreign, From: 1, To: 2, Encrypted: true},
+		{Message: "plain", From: 1, To: 2},
+	}
+	openMessages(2, messages)
+	if messages[0].Message != "meet at noon" || !messages[0].Encrypted {
+		t.Errorf("message for a kept key: %+v", messages[0])
+	}
+	if messages[1].Message != foreign || messages[2].Message != "plain" {
+		t.Errorf("messages the gateway cannot open changed: %+v", messages[1:])
+	}
+
+	// nothing is opened for a user the gateway keeps no key for
+	other := []ChatMessage{{Message: sealed, From: 1, To: 2, Encrypted: true}}
+	openMessages(1, other)
+	if other[0].Message != sealed {
+		t.Errorf("opened without a key: %+v", other[0])
+	}
+}
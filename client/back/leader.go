@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =================================================
+//  LEADER CONNECTION
+//
+//  One RPC connection to the leader, shared by
+//  every handler and the outbox. Calls carry a
+//  context deadline. While there is no leader, or
+//  the leader just stepped down, a call is retried
+//  a few times with jittered backoff before the
+//  endpoint answers 503 with Retry-After. Every
+//  replica has a circuit breaker: after
+//  BREAKER_FAILURES failures in a row it is not
+//  contacted for BREAKER_COOLDOWN, then a single
+//  probe decides whether it is closed again.
+// =================================================
+
+// Deadline of a call to the leader, retries included
+var CALL_TIMEOUT = 5 * time.Second
+
+// Attempts after the first one, and the backoff between them
+var CALL_RETRIES = 3
+var RETRY_MIN_BACKOFF = 50 * time.Millisecond
+var RETRY_MAX_BACKOFF = 1 * time.Second
+
+// Failures in a row that open a replica's breaker, and for how long
+var BREAKER_FAILURES = 3
+var BREAKER_COOLDOWN = 5 * time.Second
+
+// How often the leader is looked up again in the background
+var LEADER_REFRESH = 1 * time.Second
+
+// Returned when no replica can be used as leader
+type UnavailableError struct {
+	RetryAfter time.Duration // when it is worth trying again
+	Err        error
+}
+
+func (e *UnavailableError) Error() string {
+	return "cluster unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Returned when a call failed before it was written to the connection, see CallLeader
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+type circuitBreaker struct {
+	failures  int       // in a row
+	openUntil time.Time // zero while closed
+}
+
+type leaderConnection struct {
+	mutex    sync.Mutex
+	replica  ReplicaAddress
+	leaderId int
+	client   *rpc.Client // nil until a leader is found, or after the connection broke
+	breakers map[ReplicaAddress]*circuitBreaker
+
+	probing sync.Mutex   // one lookup at a time, concurrent callers wait for it
+	closing sync.RWMutex // held for reading while a call is sent, see closeClient
+}
+
+var LEADER = &leaderConnection{leaderId: -1, breakers: make(map[ReplicaAddress]*circuitBreaker)}
+
+// Connection to the current leader, nil if there is none
+func (l *leaderConnection) current() (*rpc.Client, ReplicaAddress) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.client, l.replica
+}
+
+// Whether the replica may be contacted, or when its breaker closes
+func (l *leaderConnection) allow(replica ReplicaAddress, now time.Time) (bool, time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.breakers[replica]
+	if !ok || now.After(b.openUntil) {
+		return true, time.Time{}
+	}
+	return false, b.openUntil
+}
+
+func (l *leaderConnection) success(replica ReplicaAddress) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if b, ok := l.breakers[replica]; ok && b.failures >= BREAKER_FAILURES {
+		logger.Info("Circuit closed", "address", net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port))))
+	}
+	delete(l.breakers, replica)
+}
+
+/*
+Counts a failure of the replica. Once the breaker is open every
+further failure, such as the probe after the cooldown, opens it again
+*/
+func (l *leaderConnection) failure(replica ReplicaAddress, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.breakers[replica]
+	if !ok {
+		b = &circuitBreaker{}
+		l.breakers[replica] = b
+	}
+	b.failures++
+	if b.failures >= BREAKER_FAILURES {
+		if b.failures == BREAKER_FAILURES {
+			breakerOpened.WithLabelValues(net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port)))).Inc()
+			logger.Warn("Circuit opened", "address", net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port))), "cooldown", BREAKER_COOLDOWN)
+		}
+		b.openUntil = now.Add(BREAKER_COOLDOWN)
+	}
+}
+
+/*
+Closes a connection once no call is being sent on it. Calls in
+flight fail and are not retried, later calls fail with a
+notSentError, which is
+*/
+func (l *leaderConnection) closeClient(client *rpc.Client) {
+	l.closing.Lock()
+	defer l.closing.Unlock()
+	client.Close()
+}
+
+/*
+Drops the connection if it is still the current one, the next call
+looks the leader up again. In-flight calls on it fail, see
+closeClient
+*/
+func (l *leaderConnection) drop(client *rpc.Client) {
+	l.mutex.Lock()
+	if client == nil || l.client != client {
+		l.mutex.Unlock()
+		return
+	}
+	l.client = nil
+	GATEWAY_READY.Store(false)
+	l.mutex.Unlock()
+	l.closeClient(client)
+}
+
+/*
+Finds the leader by asking every replica for its health. Only a
+replica that reports itself as a ready leader is used, a lagging or
+stale replica never receives requests. If several claim leadership
+(mid election) the highest PID wins, as in the bully algorithm.
+
+The connection is only replaced when the leader changed or the old
+one broke, and the old one is closed once nothing can pick it up.
+Replicas with an open breaker are skipped. Returns an
+*UnavailableError when no leader was found
+*/
+func ConfirmLeader() error {
+	LEADER.probing.Lock()
+	defer LEADER.probing.Unlock()
+
+	now := time.Now()
+	leaderId := -1
+	retryAt := time.Time{} // first breaker to close, if every replica was skipped
+	skipped := 0
+	for _, replica := range REPLICA_ADDRESSES {
+		ok, until := LEADER.allow(replica, now)
+		if !ok {
+			skipped++
+			if retryAt.IsZero() || until.Before(retryAt) {
+				retryAt = until
+			}
+			continue
+		}
+		status, err := ReplicaHealth(replica, PROBE_TIMEOUT)
+		if err != nil {
+			logger.Debug("Replica unreachable", "address", net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port))), "err", err)
+			LEADER.failure(replica, now)
+			continue
+		}
+		LEADER.success(replica)
+		if status.IsLeader && status.Ready && status.NodeID > leaderId {
+			leaderId = status.NodeID
+		}
+	}
+	if leaderId == -1 || leaderId >= len(REPLICA_ADDRESSES) {
+		GATEWAY_READY.Store(false)
+		retryAfter := time.Second // an election takes about this long
+		if skipped == len(REPLICA_ADDRESSES) {
+			retryAfter = max(retryAfter, time.Until(retryAt))
+		}
+		return &UnavailableError{RetryAfter: retryAfter, Err: fmt.Errorf("no leader available")}
+	}
+
+	replica := REPLICA_ADDRESSES[leaderId]
+	if client, current := LEADER.current(); client != nil && current == replica {
+		GATEWAY_READY.Store(true)
+		return nil
+	}
+	conn, err := DialReplica(replica, RPC_TIMEOUT)
+	if err != nil {
+		LEADER.failure(replica, now)
+		GATEWAY_READY.Store(false)
+		return &UnavailableError{RetryAfter: time.Second, Err: err}
+	}
+
+	LEADER.mutex.Lock()
+	old := LEADER.client
+	LEADER.client = rpc.NewClient(conn)
+	LEADER.replica = replica
+	LEADER.leaderId = leaderId
+	LEADER.mutex.Unlock()
+	if old != nil {
+		LEADER.closeClient(old)
+	}
+
+	if previous := ACTIVE_LEADER.Swap(int64(leaderId)); previous != int64(leaderId) {
+		if previous != -1 {
+			leaderChanges.Inc()
+		}
+		logger.Info("Leader changed", "address", net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port))))
+	}
+	GATEWAY_READY.Store(true)
+	return nil
+}
+
+// Looks the leader up every LEADER_REFRESH, so a new leader is found without a failed call
+func WatchLeader() {
+	for {
+		if err := ConfirmLeader(); err != nil {
+			logger.Debug("No leader", "err", err)
+		}
+		time.Sleep(LEADER_REFRESH)
+	}
+}
+
+// Asks a single replica for its health over a short lived connection
+func ReplicaHealth(replica ReplicaAddress, timeout time.Duration) (HealthStatus, error) {
+	var status HealthStatus
+	conn, err := DialReplica(replica, timeout)
+	if err != nil {
+		return status, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	dummy := 0
+	err = client.Call("MessageHandler.GetHealth", &dummy, &status)
+	return status, err
+}
+
+/*
+Calls the current leader once, timing the call. Gives up when ctx is
+done, reply must not be used after an error. A broken connection is
+dropped and counts against the leader's breaker
+*/
+func CallLeader(ctx context.Context, funcName string, args any, reply any) error {
+	client, replica := LEADER.current()
+	if client == nil {
+		return &UnavailableError{RetryAfter: time.Second, Err: fmt.Errorf("not connected to a leader")}
+	}
+
+	start := time.Now()
+	var err error
+	finished := false
+	// closeClient waits for the lock, so rpc.ErrShutdown while it is
+	// held means the client was closed before the call was sent
+	LEADER.closing.RLock()
+	call := client.Go(funcName, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		finished, err = true, call.Error
+		if errors.Is(err, rpc.ErrShutdown) {
+			err = &notSentError{err}
+		}
+	default:
+	}
+	LEADER.closing.RUnlock()
+	if !finished {
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	rpcDuration.WithLabelValues(funcName, result).Observe(time.Since(start).Seconds())
+
+	var serverErr rpc.ServerError
+	switch {
+	case err == nil:
+		LEADER.success(replica)
+	case errors.As(err, &serverErr), errors.Is(err, context.Canceled):
+		// the leader answered, or the caller went away
+	case errors.Is(err, context.DeadlineExceeded):
+		LEADER.failure(replica, time.Now())
+	default:
+		LEADER.failure(replica, time.Now())
+		LEADER.drop(client)
+	}
+	return err
+}
+
+/*
+Whether a failed call can safely be made again: there was no leader,
+the leader stepped down before applying it, or the connection was
+already closed when it was sent. A timeout or a connection lost or
+closed mid-call is not retried, the leader may have applied the call;
+clients repeat writes with a RequestId for that
+*/
+func retryableCall(err error) bool {
+	var unavailable *UnavailableError
+	var notSent *notSentError
+	if errors.As(err, &unavailable) || errors.As(err, &notSent) {
+		return true
+	}
+	var serverErr rpc.ServerError
+	return errors.As(err, &serverErr) && strings.Contains(err.Error(), "not the leader")
+}
+
+// Random wait before retry attempt (from 0), between half and all of the doubled backoff
+func retryBackoff(attempt int) time.Duration {
+	backoff := min(RETRY_MIN_BACKOFF<<min(attempt, 16), RETRY_MAX_BACKOFF)
+	return backoff/2 + mrand.N(backoff/2+1)
+}
+
+/*
+Function that acts as a wrapper around a Golang
+RPC call. Finds the leader if there is none, and retries up to
+CALL_RETRIES times while it is unavailable, all within CALL_TIMEOUT
+*/
+func RemoteProcedureCall(ctx context.Context, funcName string, args any, reply any) error {
+	ctx, cancel := context.WithTimeout(ctx, CALL_TIMEOUT)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		var err error
+		if client, _ := LEADER.current(); client == nil {
+			err = ConfirmLeader()
+		}
+		if err == nil {
+			client, replica := LEADER.current()
+			logger.Debug("Sending request to leader", "rpc", funcName, "address", net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port))))
+			err = CallLeader(ctx, funcName, args, reply)
+			if err == nil || !retryableCall(err) {
+				return err
+			}
+			if !errors.Is(err, rpc.ErrShutdown) {
+				LEADER.drop(client) // it stepped down, look again
+			}
+		}
+
+		if attempt == CALL_RETRIES {
+			return err
+		}
+		logger.Debug("Retrying request", "rpc", funcName, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(retryBackoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// How the gateway connects to the replicas
+type Transport interface {
+	Dial(replica ReplicaAddress, timeout time.Duration) (net.Conn, error)
+}
+
+// Transport used by DialReplica, tests connect to in-process replicas instead
+var TRANSPORT Transport = NetTransport{}
+
+// Opens a connection to a replica over TRANSPORT
+func DialReplica(replica ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	return TRANSPORT.Dial(replica, timeout)
+}
+
+/*
+TCP, or mutual TLS once GATEWAY_TLS is set. Only peers presenting a
+replica certificate are accepted
+*/
+type NetTransport struct{}
+
+func (NetTransport) Dial(replica ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	address := net.JoinHostPort(replica.Address, strconv.Itoa(int(replica.Port)))
+	if GATEWAY_TLS == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	config := GATEWAY_TLS.Clone()
+	config.ServerName = replica.Address
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, unit := range state.PeerCertificates[0].Subject.OrganizationalUnit {
+			if unit == "replica" {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s did not present a replica certificate", address)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, config)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// =================================================
+//  IN-MEMORY REPLICAS
+// =================================================
+
+/*
+Connects the gateway to fake replicas of the test process through
+net.Pipe, as the MemoryTransport of the replicas' tests does
+*/
+type memoryTransport struct {
+	mutex    sync.Mutex
+	replicas map[ReplicaAddress]*fakeReplica
+	dials    map[ReplicaAddress]int
+}
+
+func (t *memoryTransport) Dial(replica ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	t.mutex.Lock()
+	t.dials[replica]++
+	r := t.replicas[replica]
+	t.mutex.Unlock()
+	if r == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", replica.Address)
+	}
+	return r.connect()
+}
+
+func (t *memoryTransport) dialed(replica ReplicaAddress) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dials[replica]
+}
+
+// The MessageHandler of a replica, as far as the gateway needs it
+type fakeReplica struct {
+	mutex  sync.Mutex
+	id     int
+	leader bool
+	down   bool
+	conns  []net.Conn
+	calls  int // GetPID calls answered
+
+	saved       map[string]ChatMessage // by request ID, as the leader keeps replies
+	requests    []string               // request IDs of every SaveMessage and CreateAccount call
+	refuse      string                 // error of SaveMessage and CreateAccount, if set
+	dropReplies int                    // SaveMessage calls whose reply is lost
+	hold        chan struct{}          // CreateAccount waits for it to close, if set
+	keys        map[int]string         // registered public keys, base64, by user
+}
+
+func (r *fakeReplica) connect() (net.Conn, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.down {
+		return nil, fmt.Errorf("dial replica %d: connection refused", r.id)
+	}
+	client, server := net.Pipe()
+	r.conns = append(r.conns, server)
+	handler := rpc.NewServer()
+	handler.RegisterName("MessageHandler", &fakeHandler{r})
+	go handler.ServeConn(server)
+	return client, nil
+}
+
+// Stops answering: open connections break and new ones are refused
+func (r *fakeReplica) crash() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.down = true
+	r.closeConns()
+}
+
+func (r *fakeReplica) closeConns() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *fakeReplica) set(leader bool, down bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.leader, r.down = leader, down
+}
+
+type fakeHandler struct {
+	replica *fakeReplica
+}
+
+func (h *fakeHandler) GetHealth(args *int, status *HealthStatus) error {
+	r := h.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	*status = HealthStatus{NodeID: r.id, Live: true, Ready: true, IsLeader: r.leader}
+	return nil
+}
+
+// Answers with the replica's ID, only the leader accepts calls
+func (h *fakeHandler) GetPID(args IDNumber, reply *IDNumber) error {
+	r := h.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.leader {
+		return fmt.Errorf("not the leader node")
+	}
+	r.calls++
+	reply.ID = r.id
+	return nil
+}
+
+/*
+Saves a message once per request ID. A lost reply is a message saved
+while the connection breaks before the answer
+*/
+func (h *fakeHandler) SaveMessage(message *ChatMessage, reply *string) error {
+	r := h.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.leader {
+		return fmt.Errorf("not the leader node")
+	}
+	r.requests = append(r.requests, message.RequestId)
+	if r.refuse != "" {
+		return errors.New(r.refuse)
+	}
+	if _, ok := r.saved[message.RequestId]; !ok {
+		r.saved[message.RequestId] = *message
+	}
+	if r.dropReplies > 0 {
+		r.dropReplies--
+		r.closeConns()
+	}
+	*reply = "ACK"
+	return nil
+}
+
+// Creates an account numbered after the calls so far, or fails with refuse
+func (h *fakeHandler) CreateAccount(message *CreateAccountMessage, reply *RPCResponse) error {
+	r := h.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.leader {
+		return fmt.Errorf("not the leader node")
+	}
+	r.requests = append(r.requests, message.RequestId)
+	if r.refuse != "" {
+		return errors.New(r.refuse)
+	}
+	reply.Message = strconv.Itoa(len(r.requests))
+	if hold := r.hold; hold != nil {
+		r.mutex.Unlock()
+		<-hold
+		r.mutex.Lock()
+	}
+	return nil
+}
+
+func (h *fakeHandler) GetPublicKey(message *GetPublicKeyRequest, info *PublicKeyInfo) error {
+	r := h.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key, ok := r.keys[message.ContactId]
+	if !ok {
+		return fmt.Errorf("no such public key")
+	}
+	*info = PublicKeyInfo{UserId: message.ContactId, PublicKey: key}
+	return nil
+}
+
+// Lists that are always empty, as for a user with no contacts or messages
+func (h *fakeHandler) GetContacts(message *UserProfile, reply *Contacts) error {
+	return nil
+}
+
+func (h *fakeHandler) GetAllUsers(message *UserProfile, reply *Contacts) error {
+	return nil
+}
+
+func (h *fakeHandler) GetBlockedUsers(message *UserProfile, reply *Contacts) error {
+	return nil
+}
+
+func (h *fakeHandler) GetMessages(message *GetMessagesRequest, reply *MessageList) error {
+	return nil
+}
+
+// Accepts every block, the replicas' tests check what it does
+func (h *fakeHandler) BlockUser(message *BlockUserRequest, reply *RPCResponse) error {
+	reply.Message = "OK"
+	return nil
+}
+
+/*
+Points the gateway at n fake replicas, the first one is leader.
+Gateway globals are restored when the test ends
+*/
+func fakeCluster(t *testing.T, n int) (*memoryTransport, []*fakeReplica) {
+	t.Helper()
+	transport := &memoryTransport{replicas: make(map[ReplicaAddress]*fakeReplica), dials: make(map[ReplicaAddress]int)}
+	var replicas []*fakeReplica
+	var addrs []ReplicaAddress
+	for i := 0; i < n; i++ {
+		addr := ReplicaAddress{"127.0.0.1", uint16(12345 + i)}
+		replica := &fakeReplica{id: i, leader: i == 0, saved: make(map[string]ChatMessage)}
+		transport.replicas[addr] = replica
+		replicas = append(replicas, replica)
+		addrs = append(addrs, addr)
+	}
+
+	saved := struct {
+		transport         Transport
+		addrs             []ReplicaAddress
+		leader            *leaderConnection
+		failures, retries int
+		cooldown, backoff time.Duration
+	}{TRANSPORT, REPLICA_ADDRESSES, LEADER, BREAKER_FAILURES, CALL_RETRIES, BREAKER_COOLDOWN, RETRY_MIN_BACKOFF}
+	t.Cleanup(func() {
+		if client, _ := LEADER.current(); client != nil {
+			client.Close()
+		}
+		TRANSPORT, REPLICA_ADDRESSES, LEADER = saved.transport, saved.addrs, saved.leader
+		BREAKER_FAILURES, CALL_RETRIES = saved.failures, saved.retries
+		BREAKER_COOLDOWN, RETRY_MIN_BACKOFF = saved.cooldown, saved.backoff
+		ACTIVE_LEADER.Store(-1)
+		GATEWAY_READY.Store(false)
+	})
+
+	TRANSPORT = transport
+	REPLICA_ADDRESSES = addrs
+	LEADER = &leaderConnection{leaderId: -1, breakers: make(map[ReplicaAddress]*circuitBreaker)}
+	BREAKER_FAILURES = 3
+	RETRY_MIN_BACKOFF = time.Millisecond
+	ACTIVE_LEADER.Store(-1)
+	return transport, replicas
+}
+
+// ID of the replica that answered GetPID through the gateway
+func callPID(t *testing.T) (int, error) {
+	t.Helper()
+	var reply IDNumber
+	err := RemoteProcedureCall(context.Background(), "MessageHandler.GetPID", IDNumber{-1}, &reply)
+	return reply.ID, err
+}
+
+// =================================================
+//  TESTS
+// =================================================
+
+func TestCircuitBreaker(t *testing.T) {
+	replica := ReplicaAddress{"127.0.0.1", 12345}
+	start := time.Unix(1000, 0)
+
+	type step struct {
+		at    time.Duration // since start
+		event string        // "fail", "ok", or "" to only check
+		allow bool          // whether the replica may be contacted after the event
+	}
+	for _, test := range []struct {
+		name  string
+		steps []step
+	}{
+		{"closed below the threshold", []step{
+			{0, "fail", true}, {time.Millisecond, "fail", true},
+		}},
+		{"success resets the count", []step{
+			{0, "fail", true}, {0, "fail", true}, {0, "ok", true}, {0, "fail", true}, {0, "fail", true},
+		}},
+		{"opens after failures in a row", []step{
+			{0, "fail", true}, {0, "fail", true}, {0, "fail", false}, {4 * time.Second, "", false},
+		}},
+		{"half open after the cooldown", []step{
+			{0, "fail", true}, {0, "fail", true}, {0, "fail", false}, {6 * time.Second, "", true},
+		}},
+		{"failed probe opens it again", []step{
+			{0, "fail", true}, {0, "fail", true}, {0, "fail", false},
+			{6 * time.Second, "fail", false}, {10 * time.Second, "", false}, {12 * time.Second, "", true},
+		}},
+		{"successful probe closes it", []step{
+			{0, "fail", true}, {0, "fail", true}, {0, "fail", false},
+			{6 * time.Second, "ok", true}, {6 * time.Second, "fail", true}, {6 * time.Second, "fail", true},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			saved, savedCooldown := BREAKER_FAILURES, BREAKER_COOLDOWN
+			BREAKER_FAILURES, BREAKER_COOLDOWN = 3, 5*time.Second
+			defer func() { BREAKER_FAILURES, BREAKER_COOLDOWN = saved, savedCooldown }()
+
+			l := &leaderConnection{leaderId: -1, breakers: make(map[ReplicaAddress]*circuitBreaker)}
+			for i, s := range test.steps {
+				now := start.Add(s.at)
+				switch s.event {
+				case "fail":
+					l.failure(replica, now)
+				case "ok":
+					l.success(replica)
+				}
+				if ok, until := l.allow(replica, now); ok != s.allow {
+					t.Fatalf("step %d (%s at %s): allowed %v, want %v (open until %s)", i, s.event, s.at, ok, s.allow, until)
+				}
+			}
+		})
+	}
+}
+
+func TestLeaderRediscovery(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// moves leadership from replica 0 to 1
+		failover func(replicas []*fakeReplica)
+	}{
+		// the connection breaks under the gateway
+		{"leader crashed", func(replicas []*fakeReplica) {
+			replicas[0].crash()
+			replicas[1].set(true, false)
+		}},
+		// the old leader still answers, with "not the leader"
+		{"leader stepped down", func(replicas []*fakeReplica) {
+			replicas[0].set(false, false)
+			replicas[1].set(true, false)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, replicas := fakeCluster(t, 3)
+			if id, err := callPID(t); err != nil || id != 0 {
+				t.Fatalf("first call answered by %d, %v", id, err)
+			}
+			if !GATEWAY_READY.Load() || ACTIVE_LEADER.Load() != 0 {
+				t.Errorf("ready %v, leader %d", GATEWAY_READY.Load(), ACTIVE_LEADER.Load())
+			}
+
+			test.failover(replicas)
+			id, err := callPID(t)
+			var serverErr rpc.ServerError
+			if err != nil && !errors.As(err, &serverErr) {
+				// the connection broke under a call in flight, which is not retried
+				// as the leader may have applied it. The next call finds the new leader
+				id, err = callPID(t)
+			}
+			if err != nil || id != 1 {
+				t.Fatalf("call after the failover answered by %d, %v", id, err)
+			}
+			if ACTIVE_LEADER.Load() != 1 {
+				t.Errorf("active leader %d", ACTIVE_LEADER.Load())
+			}
+			if replicas[1].calls != 1 {
+				t.Errorf("new leader answered %d calls", replicas[1].calls)
+			}
+		})
+	}
+}
+
+func TestClosedConnectionRetry(t *testing.T) {
+	_, replicas := fakeCluster(t, 1)
+	if _, err := callPID(t); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed before the call is sent: nothing reached the leader, the call is made again
+	firstClient().Close()
+	if id, err := callPID(t); err != nil || id != 0 {
+		t.Fatalf("call on a closed connection: %d, %v", id, err)
+	}
+
+	// closed while the leader works on it: the leader may have applied it
+	r := replicas[0]
+	r.mutex.Lock()
+	r.hold = make(chan struct{})
+	r.mutex.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		var reply RPCResponse
+		done <- RemoteProcedureCall(context.Background(), "MessageHandler.CreateAccount", &CreateAccountMessage{Email: "a@example.com"}, &reply)
+	}()
+	for reached := false; !reached; {
+		time.Sleep(time.Millisecond)
+		r.mutex.Lock()
+		reached = len(r.requests) == 1
+		r.mutex.Unlock()
+	}
+	LEADER.drop(firstClient())
+	err := <-done
+	close(r.hold)
+
+	if err == nil || retryableCall(err) {
+		t.Errorf("call closed in flight: %v", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.requests) != 1 {
+		t.Errorf("leader called %d times", len(r.requests))
+	}
+}
+
+func TestNoLeaderIsUnavailable(t *testing.T) {
+	_, replicas := fakeCluster(t, 3)
+	replicas[0].set(false, false)
+	CALL_RETRIES = 1
+
+	_, err := callPID(t)
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter <= 0 {
+		t.Fatalf("call without a leader: %v", err)
+	}
+	if GATEWAY_READY.Load() {
+		t.Error("ready without a leader")
+	}
+}
+
+func TestBreakerSkipsDownReplica(t *testing.T) {
+	transport, replicas := fakeCluster(t, 3)
+	BREAKER_COOLDOWN = time.Hour
+	replicas[2].set(false, true)
+
+	// every lookup probes the replica until its breaker opens
+	for i := 0; i < BREAKER_FAILURES; i++ {
+		LEADER.drop(firstClient())
+		if err := ConfirmLeader(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down := REPLICA_ADDRESSES[2]
+	if n := transport.dialed(down); n != BREAKER_FAILURES {
+		t.Fatalf("down replica dialed %d times, want %d", n, BREAKER_FAILURES)
+	}
+	LEADER.drop(firstClient())
+	if err := ConfirmLeader(); err != nil {
+		t.Fatal(err)
+	}
+	if n := transport.dialed(down); n != BREAKER_FAILURES {
+		t.Errorf("replica with an open breaker dialed again, %d times", n)
+	}
+
+	// once every breaker is open the cluster is unavailable until the first closes
+	replicas[0].crash()
+	replicas[1].set(false, true)
+	for i := 0; i < BREAKER_FAILURES; i++ {
+		ConfirmLeader()
+	}
+	err := ConfirmLeader()
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter < time.Minute {
+		t.Errorf("every breaker open: %v", err)
+	}
+}
+
+func firstClient() *rpc.Client {
+	client, _ := LEADER.current()
+	return client
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Outbox in a file of the test's directory, closed when the test ends
+func openTestOutbox(t *testing.T, path string) *Outbox {
+	t.Helper()
+	o, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.file.Close() })
+	return o
+}
+
+func enqueue(t *testing.T, o *Outbox, from int, text string) OutboxEntry {
+	t.Helper()
+	entry, err := o.Enqueue(ChatMessage{Message: text, From: from, To: 2, Acked: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// finish for the entry with the given ID, as the delivery worker calls it
+func finishEntry(o *Outbox, id string, err error) {
+	o.mutex.Lock()
+	entry := o.entries[id]
+	o.mutex.Unlock()
+	o.finish(entry, err)
+}
+
+func fileLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestOutboxReplayAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openTestOutbox(t, path)
+	sent := enqueue(t, o, 1, "sent")
+	refused := enqueue(t, o, 1, "refused")
+	retried := enqueue(t, o, 1, "retried")
+	other := enqueue(t, o, 3, "other sender")
+	finishEntry(o, sent.PendingId, nil)
+	finishEntry(o, refused.PendingId, rpc.ServerError("message blocked"))
+	finishEntry(o, retried.PendingId, errors.New("connection refused"))
+
+	// the gateway dies while writing a line
+	o.file.Close()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"PendingId":"torn","Message":{"Mess`)
+	file.Close()
+
+	restarted := openTestOutbox(t, path)
+	for _, want := range []struct {
+		id       string
+		status   string
+		attempts int
+		err      string
+	}{
+		{sent.PendingId, OUTBOX_SENT, 1, ""},
+		{refused.PendingId, OUTBOX_FAILED, 1, "message blocked"},
+		{retried.PendingId, OUTBOX_PENDING, 1, "connection refused"},
+		{other.PendingId, OUTBOX_PENDING, 0, ""},
+	} {
+		entry, ok := restarted.Get(want.id)
+		if !ok || entry.Status != want.status || entry.Attempts != want.attempts || entry.Error != want.err {
+			t.Errorf("after the restart: %+v, want %+v", entry, want)
+		}
+		if ok && entry.Message.RequestId != "outbox-"+want.id {
+			t.Errorf("request id %q of %s changed", entry.Message.RequestId, want.id)
+		}
+	}
+	if _, ok := restarted.Get("torn"); ok {
+		t.Error("torn line replayed")
+	}
+	if !slices.Equal(restarted.queue, []string{retried.PendingId, other.PendingId}) {
+		t.Errorf("queue %v, want the pending entries in order", restarted.queue)
+	}
+	if entry, _ := restarted.next(time.Now()); entry == nil || entry.PendingId != retried.PendingId {
+		t.Errorf("first delivery after the restart: %+v", entry)
+	}
+
+	// finished entries need no waiting, a refusal keeps its reason
+	if _, err := restarted.Wait(context.Background(), sent.PendingId); err != nil {
+		t.Errorf("waiting for a sent entry: %v", err)
+	}
+	if _, err := restarted.Wait(context.Background(), refused.PendingId); err == nil || err.Error() != "message blocked" {
+		t.Errorf("waiting for a refused entry: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if entry, err := restarted.Wait(ctx, other.PendingId); entry.Status != OUTBOX_PENDING || !errors.Is(err, context.Canceled) {
+		t.Errorf("waiting for a pending entry: %s, %v", entry.Status, err)
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	saved := OUTBOX_RETENTION
+	t.Cleanup(func() { OUTBOX_RETENTION = saved })
+
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openTestOutbox(t, path)
+	sent := enqueue(t, o, 1, "sent")
+	finishEntry(o, sent.PendingId, nil)
+	pending := enqueue(t, o, 1, "pending")
+
+	// every attempt appends a line, the file is rewritten before it grows far
+	for i := 0; i < 200; i++ {
+		finishEntry(o, pending.PendingId, errors.New("connection refused"))
+		if lines := fileLines(t, path); lines > 2*len(o.entries)+101 {
+			t.Fatalf("attempt %d: %d lines for %d entries", i, lines, len(o.entries))
+		}
+	}
+	if entry, _ := o.Get(pending.PendingId); entry.Attempts != 200 {
+		t.Errorf("attempts %d after compaction", entry.Attempts)
+	}
+
+	// finished entries are dropped once past the retention, pending ones never
+	OUTBOX_RETENTION = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	o.file.Close()
+	restarted := openTestOutbox(t, path)
+	if _, ok := restarted.Get(sent.PendingId); ok {
+		t.Error("sent entry kept past the retention")
+	}
+	if entry, ok := restarted.Get(pending.PendingId); !ok || entry.Attempts != 200 {
+		t.Errorf("pending entry after compaction: %+v", entry)
+	}
+	if lines := fileLines(t, path); lines != 1 {
+		t.Errorf("%d lines after compacting a single entry", lines)
+	}
+}
+
+func TestOutboxForgetsText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := openTestOutbox(t, path)
+	sent := enqueue(t, o, 1, "meet at noon")
+	refused := enqueue(t, o, 1, "meet at one")
+	pending := enqueue(t, o, 3, "still queued")
+	finishEntry(o, sent.PendingId, nil)
+	finishEntry(o, refused.PendingId, rpc.ServerError("message blocked"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first line of each, written by Enqueue, has the text
+	if n := strings.Count(string(data), "meet at noon") + strings.Count(string(data), "meet at one"); n != 2 {
+		t.Fatalf("text of finished entries written %d times", n)
+	}
+
+	// compaction drops the lines written by Enqueue
+	o.file.Close()
+	restarted := openTestOutbox(t, path)
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "meet at") {
+		t.Errorf("text of finished entries kept:\n%s", data)
+	}
+	if entry, _ := restarted.Get(pending.PendingId); entry.Message.Message != "still queued" {
+		t.Errorf("pending entry lost its text: %+v", entry)
+	}
+	if entry, ok := restarted.Get(sent.PendingId); !ok || entry.Status != OUTBOX_SENT || entry.Message.Message != "" {
+		t.Errorf("sent entry after the restart: %+v", entry)
+	}
+}
+
+func TestOutboxKeepsNoPlaintext(t *testing.T) {
+	_, replicas := fakeCluster(t, 1)
+	store, err := OpenKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	KEYS = store
+	t.Cleanup(func() { KEYS = nil })
+	if _, _, err := store.GetOrCreate(1); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	saved := OUTBOX
+	OUTBOX = openTestOutbox(t, path)
+	t.Cleanup(func() { OUTBOX = saved })
+
+	// queued before the recipient has a key, sealed on delivery
+	queued := enqueue(t, OUTBOX, 1, "meet at noon")
+	replicas[0].mutex.Lock()
+	replicas[0].keys = map[int]string{2: base64.StdEncoding.EncodeToString(newX25519Key(t).PublicKey().Bytes())}
+	replicas[0].mutex.Unlock()
+	deliverNext(OUTBOX)
+	if entry, _ := OUTBOX.Get(queued.PendingId); entry.Status != OUTBOX_SENT {
+		t.Fatalf("late sealed message: %+v", entry)
+	}
+
+	// queued with a key to seal it for
+	if w := post(HandleIncoming, "/incoming", `{"Message": "meet at one", "From": 1, "To": 2}`); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	plaintext := func(when string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "meet at") {
+			t.Errorf("plaintext in the outbox %s:\n%s", when, data)
+		}
+	}
+	plaintext("while queued")
+	deliverNext(OUTBOX)
+	plaintext("after delivery")
+	replicas[0].mutex.Lock()
+	defer replicas[0].mutex.Unlock()
+	if len(replicas[0].saved) != 2 {
+		t.Fatalf("leader saved %d messages", len(replicas[0].saved))
+	}
+	for _, message := range replicas[0].saved {
+		if !message.Encrypted || !isEnvelope(message.Message) {
+			t.Errorf("message sent unsealed: %+v", message)
+		}
+	}
+}
+
+func TestOutboxDuplicateDelivery(t *testing.T) {
+	_, replicas := fakeCluster(t, 1)
+	leader := replicas[0]
+	leader.dropReplies = 1
+
+	o := openTestOutbox(t, filepath.Join(t.TempDir(), "outbox.jsonl"))
+	queued := enqueue(t, o, 1, "hello")
+
+	// the leader saves the message but its answer is lost
+	entry, _ := o.next(time.Now())
+	o.deliver(entry)
+	if got, _ := o.Get(queued.PendingId); got.Status != OUTBOX_PENDING || got.Error == "" {
+		t.Fatalf("after a lost reply: %+v", got)
+	}
+	if again, _ := o.next(time.Now()); again != nil {
+		t.Fatalf("redelivered without backoff")
+	}
+
+	entry, _ = o.next(time.Now().Add(OUTBOX_MAX_BACKOFF))
+	if entry == nil {
+		t.Fatal("nothing to redeliver")
+	}
+	o.deliver(entry)
+	if got, _ := o.Get(queued.PendingId); got.Status != OUTBOX_SENT || got.Attempts != 2 {
+		t.Fatalf("after redelivery: %+v", got)
+	}
+
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	want := "outbox-" + queued.PendingId
+	if !slices.Equal(leader.requests, []string{want, want}) || len(leader.saved) != 1 {
+		t.Errorf("leader saw requests %v and saved %d messages", leader.requests, len(leader.saved))
+	}
+}
+
+// Delivers the next entry of o once one is queued, as the delivery worker would
+func deliverNext(o *Outbox) {
+	for {
+		if entry, _ := o.next(time.Now()); entry != nil {
+			o.deliver(entry)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIncomingWaitsForDelivery(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		query  string
+		refuse string
+		status int
+		code   string // of the error body
+	}{
+		{"queued", "", "", http.StatusAccepted, ""},
+		{"sent", "?wait=true", "", http.StatusOK, ""},
+		{"refused", "?wait=true", "message blocked", http.StatusForbidden, ERR_FORBIDDEN},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, replicas := fakeCluster(t, 1)
+			replicas[0].refuse = test.refuse
+			saved := OUTBOX
+			OUTBOX = openTestOutbox(t, filepath.Join(t.TempDir(), "outbox.jsonl"))
+			t.Cleanup(func() { OUTBOX = saved })
+
+			done := make(chan struct{})
+			if test.query != "" {
+				go func() { deliverNext(OUTBOX); close(done) }()
+			} else {
+				close(done)
+			}
+			body := `{"Message": "hello", "From": 1, "To": 2}`
+			req := httptest.NewRequest(http.MethodPost, "/incoming"+test.query, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			HandleIncoming(w, req)
+			<-done
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if !strings.HasPrefix(w.Header().Get("Location"), "/outbox?id=") {
+				t.Errorf("Location %q", w.Header().Get("Location"))
+			}
+			if test.code != "" {
+				var apiErr APIError
+				if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil || apiErr.Code != test.code {
+					t.Errorf("error body %s, want code %s", w.Body, test.code)
+				}
+				return
+			}
+			var pending PendingMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil || pending.PendingId == "" {
+				t.Fatalf("body %s: %v", w.Body, err)
+			}
+			want := map[int]string{http.StatusAccepted: OUTBOX_PENDING, http.StatusOK: OUTBOX_SENT}[test.status]
+			if pending.Status != want {
+				t.Errorf("status %s, want %s", pending.Status, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Sends body to handler, with the method and headers of a browser's POST
+func post(handler http.HandlerFunc, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// The JSON error body of a response, failing the test if it is not one
+func errorBody(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var apiErr APIError
+	decoder := json.NewDecoder(w.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&apiErr); err != nil {
+		t.Fatalf("error body is not {code, message}: %v", err)
+	}
+	if apiErr.Code == "" || apiErr.Message == "" {
+		t.Errorf("error body %+v has an empty field", apiErr)
+	}
+	return apiErr
+}
+
+const validAccount = `{"Email": "ada@example.com", "Password": "secret", "Firstname": "Ada", "Lastname": "Lovelace"}`
+
+func TestRejectedFields(t *testing.T) {
+	_, replicas := fakeCluster(t, 1)
+	long := strings.Repeat("x", MAX_MESSAGE_LENGTH+1)
+
+	for _, test := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		body     string
+		status   int
+		code     string
+		problems []string // each in the message
+	}{
+		{"empty body", CreateAccount, "", http.StatusBadRequest, ERR_INVALID_JSON, []string{"empty"}},
+		{"not JSON", CreateAccount, "{Email:", http.StatusBadRequest, ERR_INVALID_JSON, []string{"not a valid JSON object"}},
+		{"wrong type", CreateAccount, `{"Email": 5}`, http.StatusBadRequest, ERR_INVALID_REQUEST, []string{"Email must be a string"}},
+		{"too large", CreateAccount, `{"Descr": "` + strings.Repeat("x", MAX_REQUEST_BODY) + `"}`,
+			http.StatusRequestEntityTooLarge, ERR_TOO_LARGE, []string{"larger than"}},
+		{"every field reported", CreateAccount, `{"Email": "Ada <ada@example.com>", "Lastname": "` + strings.Repeat("x", MAX_NAME_LENGTH+1) + `"}`,
+			http.StatusBadRequest, ERR_INVALID_REQUEST,
+			[]string{"Email is not a valid email address", "Password is required", "Firstname is required", "Lastname is longer than 100 bytes"}},
+		{"blank name", CreateAccount, `{"Email": "ada@example.com", "Password": "secret", "Firstname": "  ", "Lastname": "Lovelace"}`,
+			http.StatusBadRequest, ERR_INVALID_REQUEST, []string{"Firstname is required"}},
+		{"missing ids", HandleIncoming, `{"Message": "hello"}`, http.StatusBadRequest, ERR_INVALID_REQUEST,
+			[]string{"From is required", "To is required"}},
+		{"empty message", HandleIncoming, `{"From": 1, "To": 2}`, http.StatusBadRequest, ERR_INVALID_REQUEST,
+			[]string{"Message is required"}},
+		{"long message", HandleIncoming, `{"From": 1, "To": 2, "Message": "` + long + `"}`, http.StatusBadRequest, ERR_INVALID_REQUEST,
+			[]string{"Message is longer than 4000 bytes"}},
+		{"user id", GetContacts, `{"UserId": 0}`, http.StatusBadRequest, ERR_INVALID_REQUEST, []string{"UserId is required"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := post(test.handler, "/", test.body)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			apiErr := errorBody(t, w)
+			if apiErr.Code != test.code {
+				t.Errorf("code %q, want %q", apiErr.Code, test.code)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(apiErr.Message, problem) {
+					t.Errorf("message %q does not mention %q", apiErr.Message, problem)
+				}
+			}
+		})
+	}
+
+	// nothing rejected reached the leader
+	replicas[0].mutex.Lock()
+	defer replicas[0].mutex.Unlock()
+	if len(replicas[0].requests) != 0 {
+		t.Errorf("the leader was called %d times", len(replicas[0].requests))
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	handler := allow(CreateAccount, http.MethodPost)
+	req := httptest.NewRequest(http.MethodGet, "/register", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if apiErr := errorBody(t, w); apiErr.Code != ERR_METHOD_NOT_ALLOWED {
+		t.Errorf("code %q", apiErr.Code)
+	}
+}
+
+func TestServerErrorStatus(t *testing.T) {
+	for _, known := range SERVER_ERRORS {
+		t.Run(known.text, func(t *testing.T) {
+			_, replicas := fakeCluster(t, 1)
+			replicas[0].refuse = "leader says: " + known.text
+
+			w := post(CreateAccount, "/register", validAccount)
+			if w.Code != known.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, known.status, w.Body)
+			}
+			apiErr := errorBody(t, w)
+			if apiErr.Code != known.code {
+				t.Errorf("code %q, want %q", apiErr.Code, known.code)
+			}
+			if known.code == ERR_EMAIL_TAKEN && strings.Contains(apiErr.Message, "UNIQUE") {
+				t.Errorf("message %q shows the SQL error", apiErr.Message)
+			}
+			if retry := w.Header().Get("Retry-After"); (retry != "") != (known.status == http.StatusServiceUnavailable) {
+				t.Errorf("Retry-After %q with status %d", retry, w.Code)
+			}
+		})
+	}
+
+	t.Run("unknown error", func(t *testing.T) {
+		_, replicas := fakeCluster(t, 1)
+		replicas[0].refuse = "something else went wrong"
+		w := post(CreateAccount, "/register", validAccount)
+		if apiErr := errorBody(t, w); w.Code != http.StatusBadRequest || apiErr.Code != ERR_INVALID_REQUEST {
+			t.Errorf("status %d, code %q", w.Code, apiErr.Code)
+		}
+	})
+
+	t.Run("no leader", func(t *testing.T) {
+		_, replicas := fakeCluster(t, 1)
+		replicas[0].crash()
+		w := post(CreateAccount, "/register", validAccount)
+		if apiErr := errorBody(t, w); w.Code != http.StatusServiceUnavailable || apiErr.Code != ERR_UNAVAILABLE {
+			t.Errorf("status %d, code %q", w.Code, apiErr.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("no Retry-After")
+		}
+	})
+
+	t.Run("created", func(t *testing.T) {
+		_, replicas := fakeCluster(t, 1)
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(validAccount))
+		req.Header.Set("Idempotency-Key", "key-1")
+		w := httptest.NewRecorder()
+		CreateAccount(w, req)
+		var profile UserProfile
+		if err := json.Unmarshal(w.Body.Bytes(), &profile); w.Code != http.StatusOK || err != nil || profile.UserId != 1 {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		replicas[0].mutex.Lock()
+		defer replicas[0].mutex.Unlock()
+		if !slices.Equal(replicas[0].requests, []string{"key-1"}) {
+			t.Errorf("request ids %v, want the Idempotency-Key", replicas[0].requests)
+		}
+	})
+}
+
+func TestEmptyLists(t *testing.T) {
+	fakeCluster(t, 1)
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"contacts", GetContacts, `{"UserId": 1}`},
+		{"all users", GetAllUsers, `{"UserId": 1}`},
+		{"contact requests", GetContactRequests, `{"UserId": 1}`},
+		{"blocked users", GetBlockedUsers, `{"UserId": 1}`},
+		{"messages", GetMessages, `{"UserId": 1, "ContactId": 2}`},
+	} {
+		w := post(test.handler, "/", test.body)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || strings.TrimSpace(w.Body.String()) != "[]" {
+			t.Errorf("%s: %d %q %s", test.name, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+/*
+Profile changes, password changes and account deletion.
+
+Passwords arrive as the SHA-256 digest computed by the gateway, as in
+CreateAccount and Login. Deleting an account keeps the users row as a
+tombstone: the email, password and profile are erased, and triggers
+remove the user's contacts, requests and devices. Messages the user
+sent become tombstones, as DeleteMessage leaves them: no text, no
+attachment, no edit history. The rows stay, attributed to the erased
+profile, so the other side keeps the shape of the chat and the
+messages it sent itself. Reports keep the copy of the text moderators
+were sent, and the user's reactions stay in the counts.
+*/
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// shown in place of the profile of a deleted account
+const (
+	DELETED_FIRSTNAME = "Deleted"
+	DELETED_LASTNAME  = "user"
+)
+
+// JSON object, a password change. Both are SHA-256 digests
+type ChangePasswordRequest struct {
+	UserId      int
+	OldPassword string
+	NewPassword string
+}
+
+// JSON object, deletes an account, the password confirms it
+type DeleteAccountRequest struct {
+	UserId   int
+	Password string
+}
+
+/*
+Checks the password digest of an account that was not deleted.
+Returns the stored value, which is sealed with encryption at rest
+*/
+func (t *MessageHandler) checkPassword(user int, password string) (string, error) {
+	rows, err := t.server.Query(`SELECT [password] FROM users WHERE userid = ? AND deleted = 0`, user)
+	if err != nil {
+		t.server.logger.Error("Error checking password", "err", err)
+		return "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", fmt.Errorf("no such user")
+	}
+	var stored string
+	if err := rows.Scan(&stored); err != nil {
+		t.server.logger.Error("Error scanning password", "err", err)
+		return "", err
+	}
+	db_pass, err := t.server.Keyring.OpenField(stored)
+	if err != nil {
+		t.server.logger.Error("Error opening password", "err", err)
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(db_pass), []byte(password)) != 1 {
+		return "", fmt.Errorf("incorrect password")
+	}
+	return stored, nil
+}
+
+/*
+RPC: Replaces the first name, last name and description of a user,
+returns the updated profile. The email cannot be changed
+*/
+func (t *MessageHandler) UpdateProfile(message *UserProfile, profile *UserProfile) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		return fmt.Errorf("not the leader node")
+	}
+	if message.Firstname == "" || message.Lastname == "" {
+		return fmt.Errorf("first and last name are required")
+	}
+
+	result, err := t.execReplicated(`UPDATE users
+				SET [firstname] = ?, [lastname] = ?, [descr] = ?
+				WHERE userid = ? AND deleted = 0`,
+		message.Firstname, message.Lastname, message.Descr, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Error updating profile", "err", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user")
+	}
+
+	profiles, err := t.queryProfiles(`SELECT userid, email, firstname, lastname, descr
+				FROM users WHERE userid = ?`, message.UserId)
+	if err != nil || len(profiles) == 0 {
+		return fmt.Errorf("no such user")
+	}
+	*profile = profiles[0]
+	t.server.logger.Info("Updated profile", "user", message.UserId)
+	return nil
+}
+
+// RPC: Sets a new password, the old one must match
+func (t *MessageHandler) ChangePassword(message *ChangePasswordRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if message.NewPassword == "" {
+		response.Message = "error"
+		return fmt.Errorf("new password is empty")
+	}
+	stored, err := t.checkPassword(message.UserId, message.OldPassword)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+
+	// the old password is repeated so a replica applies the same check,
+	// as stored since it may be sealed
+	_, err = t.execReplicated(`UPDATE users SET [password] = ?
+				WHERE userid = ? AND [password] = ? AND deleted = 0`,
+		t.server.Keyring.SealField(message.NewPassword), message.UserId, stored)
+	if err != nil {
+		t.server.logger.Error("Error changing password", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	t.server.logger.Info("Changed password", "user", message.UserId)
+	response.Message = "ACK"
+	return nil
+}
+
+/*
+RPC: Deletes an account. The profile is erased, contacts and
+requests are removed, sent messages become tombstones
+*/
+func (t *MessageHandler) DeleteAccount(message *DeleteAccountRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if _, err := t.checkPassword(message.UserId, message.Password); err != nil {
+		response.Message = "error"
+		return err
+	}
+
+	// deleted_hlc stamps the tombstones of the user's messages
+	stamp := t.server.Clock.Now()
+	script := `UPDATE users
+				SET [deleted] = 1, [deleted_hlc] = ?, [email] = NULL, [password] = NULL,
+				[firstname] = ?, [lastname] = ?, [descr] = '', [discoverable] = 0
+				WHERE userid = ? AND deleted = 0`
+	args := []any{stamp.String(), DELETED_FIRSTNAME, DELETED_LASTNAME, message.UserId}
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, HLC: stamp}, nil); err != nil {
+		t.server.logger.Error("Error deleting account", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	t.server.logger.Info("Deleted account", "user", message.UserId)
+	response.Message = "ACK"
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileAndPassword(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+
+	var profile UserProfile
+	update := UserProfile{UserId: 1, Email: "other@example.com", Firstname: "Ada", Lastname: "Lovelace", Descr: "engines"}
+	if err := c.client(leader).Call("MessageHandler.UpdateProfile", &update, &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Email != "a@example.com" || profile.Firstname != "Ada" || profile.Descr != "engines" {
+		t.Errorf("updated profile: %+v", profile)
+	}
+	var missing UserProfile
+	if err := c.client(leader).Call("MessageHandler.UpdateProfile", &UserProfile{UserId: 1, Firstname: "Ada"}, &missing); err == nil {
+		t.Error("profile without a last name accepted")
+	}
+
+	var resp RPCResponse
+	err := c.client(leader).Call("MessageHandler.ChangePassword", &ChangePasswordRequest{UserId: 1, OldPassword: "wrong", NewPassword: "new"}, &resp)
+	if err == nil || !strings.Contains(err.Error(), "incorrect password") {
+		t.Errorf("password changed without the old one: %v", err)
+	}
+	if err := c.client(leader).Call("MessageHandler.ChangePassword", &ChangePasswordRequest{UserId: 1, OldPassword: "digest", NewPassword: "new"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	var user UserProfile
+	if err := c.client(0).Call("MessageHandler.Login", &LoginMessage{Email: "a@example.com", Password: "new"}, &user); err != nil || user.Lastname != "Lovelace" {
+		t.Errorf("login on follower after change: %+v %v", user, err)
+	}
+	var old UserProfile
+	if err := c.client(0).Call("MessageHandler.Login", &LoginMessage{Email: "a@example.com", Password: "digest"}, &old); err == nil {
+		t.Error("old password still works")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		c.createUser(leader, email)
+	}
+
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 1, ContactId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: 2, ContactId: 1, Response: CONTACT_ACCEPTED}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 1, ContactId: 3}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	c.sendMessage(leader, 1, 2, "see you")
+	c.sendMessage(leader, 2, 1, "hi")
+	sent := getMessages(t, c, leader, 1, 2)[0]
+	edit := EditMessageRequest{UserId: 1, HLC: sent.HLC, Message: "bye"}
+	if err := c.client(leader).Call("MessageHandler.EditMessage", &edit, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.client(leader).Call("MessageHandler.DeleteAccount", &DeleteAccountRequest{UserId: 1, Password: "wrong"}, &resp); err == nil {
+		t.Fatal("account deleted with a wrong password")
+	}
+	if err := c.client(leader).Call("MessageHandler.DeleteAccount", &DeleteAccountRequest{UserId: 1, Password: "digest"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.DeleteAccount", &DeleteAccountRequest{UserId: 1, Password: "digest"}, &resp); err == nil {
+		t.Error("account deleted twice")
+	}
+
+	var reply string
+	msg := ChatMessage{Message: "hello?", Timestamp: "12:00", From: 2, To: 1, Acked: 1}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &msg, &reply); err == nil {
+		t.Error("message sent to a deleted account")
+	}
+
+	// the email can be used again
+	c.createUser(leader, "a@example.com")
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	if got := getContacts(t, c, 0, 2); len(got.ContactList) != 0 {
+		t.Errorf("deleted account still a contact: %+v", got.ContactList)
+	}
+	if got := getContacts(t, c, 0, 3); len(got.Pending) != 0 {
+		t.Errorf("request from deleted account still pending: %+v", got.Pending)
+	}
+	// the deleted user's message is a tombstone, the other user's stays
+	got := getMessages(t, c, 0, 2, 1)
+	if len(got) != 2 || got[0].HLC != sent.HLC || !got[0].Deleted || got[0].Message != "" || got[1].Message != "hi" {
+		t.Errorf("messages of the other user: %+v", got)
+	}
+	dump := c.dumpDatabase(0)
+	if strings.Contains(dump, "see you") || strings.Contains(dump, "bye") {
+		t.Errorf("text of the deleted user stored:\n%s", dump)
+	}
+	// userid, password, email, names, descr, discoverable, deleted
+	if !strings.Contains(dump, "1 <nil> <nil> Deleted user  0 1") {
+		t.Errorf("profile not erased:\n%s", dump)
+	}
+}
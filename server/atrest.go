@@ -0,0 +1,423 @@
+package main
+
+/*
+Encryption at rest.
+
+With a key configured (encryption.key or encryption.key_file, see
+config.go) a replica keeps its data directory unreadable without it:
+
+ 1. every log file, logs-node-N/log-N.json, is sealed as a whole
+ 2. the sensitive columns in SEALED_COLUMNS are sealed one value at a
+    time: password digests, message texts and their copies in the edit
+    history and in reports
+
+Both use AES-256-GCM under a 32-byte key. A sealed value names the key
+that sealed it, the first 8 hex digits of the key's SHA-256, so older
+keys can still open it:
+
+	log file:  "mechat-enc1:" key ID "\n" nonce ciphertext
+	column:    "enc1:" key ID ":" base64(nonce ciphertext)
+
+A log file is sealed with its file name as additional data, so files
+cannot be swapped. Columns are sealed by the leader before the
+statement is logged, every replica stores the same ciphertext and all
+of them must share the keys. Emails, names and the rest of the schema
+stay in the clear: lookups by email and its uniqueness need them.
+There are no snapshots to protect, a replica rebuilds its database by
+replaying the log.
+
+Values written before a key was configured are read as they are.
+To rotate, make the new key the current one and move the old one to
+encryption.previous_keys on every replica. ReencryptThread then
+re-seals in the background: each replica rewrites its own log files
+and the leader replaces old column values with replicated UPDATEs, a
+batch per heartbeat interval. Entries logged before the rotation keep
+the column values they carried, the UPDATEs after them replace those
+values on every replica. Drop the old key once every replica has
+logged "Log files sealed" and the leader "Re-encryption done".
+*/
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AT_REST_KEY_SIZE      = 32
+	AT_REST_KEY_ID_LENGTH = 8 // hex digits
+	SEALED_FIELD_PREFIX   = "enc1:"
+	SEALED_LOG_PREFIX     = "mechat-enc1:"
+	REENCRYPT_BATCH       = 100 // values per column and pass
+)
+
+// Columns sealed at rest, rows are found by key when they are re-sealed
+var SEALED_COLUMNS = []struct {
+	table  string
+	key    string
+	column string
+}{
+	{"users", "userid", "password"},
+	{"messages", "rec_id", "message"},
+	{"message_edits", "rec_id", "message"},
+	{"reports", "rec_id", "message"},
+	{"reports", "rec_id", "reason"},
+}
+
+// Keys for data at rest: the current key seals, every key opens. A nil
+// Keyring leaves everything in the clear
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD // by key ID, the current and previous keys
+}
+
+// ID of an at-rest key, as written in sealed values
+func atRestKeyId(key []byte) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:])[:AT_REST_KEY_ID_LENGTH]
+}
+
+// Parses a base64 key, as found in the config or a key file
+func parseAtRestKey(text string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("not base64")
+	}
+	if len(key) != AT_REST_KEY_SIZE {
+		return nil, fmt.Errorf("must be %d bytes, got %d", AT_REST_KEY_SIZE, len(key))
+	}
+	return key, nil
+}
+
+// Keyring sealing with current, previous keys are only used to open
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, previous...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := atRestKeyId(key)
+		if i == 0 {
+			k.current = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ID of the key new values are sealed with
+func (k *Keyring) CurrentId() string {
+	return k.current
+}
+
+// The nonce followed by the ciphertext, under the current key
+func (k *Keyring) seal(plaintext []byte, aad []byte) []byte {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func (k *Keyring) open(id string, sealed []byte, aad []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("data is encrypted at rest but no key is configured")
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("data is sealed with unknown key %s", id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("sealed data does not open with key %s", id)
+	}
+	return plaintext, nil
+}
+
+// Seals a column value, empty values and a nil Keyring leave it as it is
+func (k *Keyring) SealField(text string) string {
+	if k == nil || text == "" {
+		return text
+	}
+	return SEALED_FIELD_PREFIX + k.current + ":" + base64.StdEncoding.EncodeToString(k.seal([]byte(text), nil))
+}
+
+// Key ID and sealed bytes of a column value, ok is false for plaintext
+func parseSealedField(text string) (id string, sealed []byte, ok bool) {
+	rest, found := strings.CutPrefix(text, SEALED_FIELD_PREFIX)
+	if !found || len(rest) <= AT_REST_KEY_ID_LENGTH || rest[AT_REST_KEY_ID_LENGTH] != ':' {
+		return "", nil, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(rest[AT_REST_KEY_ID_LENGTH+1:])
+	if err != nil {
+		return "", nil, false
+	}
+	return rest[:AT_REST_KEY_ID_LENGTH], sealed, true
+}
+
+// Opens a column value, plaintext from before encryption is returned as it is
+func (k *Keyring) OpenField(text string) (string, error) {
+	id, sealed, ok := parseSealedField(text)
+	if !ok {
+		return text, nil
+	}
+	plaintext, err := k.open(id, sealed, nil)
+	return string(plaintext), err
+}
+
+// Seals the contents of the log file name
+func (k *Keyring) SealLog(name string, data []byte) []byte {
+	if k == nil {
+		return data
+	}
+	header := SEALED_LOG_PREFIX + k.current + "\n"
+	return append([]byte(header), k.seal(data, []byte(name))...)
+}
+
+// Opens the log file name, id is the key that sealed it, empty for plaintext
+func (k *Keyring) OpenLog(name string, data []byte) (plaintext []byte, id string, err error) {
+	rest, found := bytes.CutPrefix(data, []byte(SEALED_LOG_PREFIX))
+	if !found {
+		return data, "", nil
+	}
+	if len(rest) <= AT_REST_KEY_ID_LENGTH || rest[AT_REST_KEY_ID_LENGTH] != '\n' {
+		return nil, "", fmt.Errorf("%s: malformed header", name)
+	}
+	id = string(rest[:AT_REST_KEY_ID_LENGTH])
+	plaintext, err = k.open(id, rest[AT_REST_KEY_ID_LENGTH+1:], []byte(name))
+	if err != nil {
+		return nil, id, fmt.Errorf("%s: %v", name, err)
+	}
+	return plaintext, id, nil
+}
+
+// =================================================
+//  LOG FILES
+// =================================================
+
+// Writes entry to its log file, sealed if a key is configured
+func (s *Server) writeLogFile(entry LogEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing log entry: %v", err)
+	}
+
+	name := fmt.Sprintf("log-%d.json", entry.Index)
+	if err := os.WriteFile(filepath.Join(s.LogDir, name), s.Keyring.SealLog(name, data), 0644); err != nil {
+		return fmt.Errorf("error writing log file: %v", err)
+	}
+	return nil
+}
+
+// Reads the log file name from the log directory
+func (s *Server) readLogFile(name string) (LogEntry, error) {
+	var entry LogEntry
+	data, err := os.ReadFile(filepath.Join(s.LogDir, name))
+	if err != nil {
+		return entry, err
+	}
+	data, _, err = s.Keyring.OpenLog(name, data)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+/*
+Seals the log file name with the current key unless it already is,
+returns whether it was rewritten. The file is replaced by a rename,
+appends and EraseLogsFromDir are held off meanwhile
+*/
+func (s *Server) reencryptLogFile(name string) (bool, error) {
+	s.replicationHandler.mutex.Lock()
+	defer s.replicationHandler.mutex.Unlock()
+	s.LogMutex.Lock()
+	defer s.LogMutex.Unlock()
+
+	path := filepath.Join(s.LogDir, name)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil // erased in the meantime
+	}
+	if err != nil {
+		return false, err
+	}
+	plaintext, id, err := s.Keyring.OpenLog(name, data)
+	if err != nil {
+		return false, err
+	}
+	if id == s.Keyring.CurrentId() {
+		return false, nil
+	}
+
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, s.Keyring.SealLog(name, plaintext), 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(temp, path)
+}
+
+// Seals every log file with the current key, returns how many were rewritten
+func (s *Server) reencryptLogs() (int, error) {
+	files, err := os.ReadDir(s.LogDir)
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, file := range files {
+		if s.isStopped() {
+			return rewritten, fmt.Errorf("server stopped")
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		done, err := s.reencryptLogFile(file.Name())
+		if err != nil {
+			return rewritten, err
+		}
+		if done {
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// =================================================
+//  COLUMNS
+// =================================================
+
+/*
+Leader only: replaces up to REENCRYPT_BATCH values of each column in
+SEALED_COLUMNS that are in the clear or sealed with an older key, one
+UPDATE per column and batch. The UPDATE repeats the old values, so a
+replica applies it only to the rows the leader changed. Returns how
+many values were re-sealed
+*/
+func (t *MessageHandler) reencryptColumns() (int, error) {
+	keys := t.server.Keyring
+	prefix := SEALED_FIELD_PREFIX + keys.CurrentId() + ":"
+	resealed := 0
+
+	for _, sealed := range SEALED_COLUMNS {
+		n, err := t.reencryptColumn(sealed.table, sealed.key, sealed.column, prefix)
+		resealed += n
+		if err != nil {
+			return resealed, fmt.Errorf("%s.%s: %v", sealed.table, sealed.column, err)
+		}
+	}
+	return resealed, nil
+}
+
+func (t *MessageHandler) reencryptColumn(table string, key string, column string, prefix string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.server.LeaderID() != t.server.PID {
+		return 0, nil
+	}
+
+	query := fmt.Sprintf(`SELECT %s, %s FROM %s WHERE %s != '' AND substr(%s, 1, ?) != ? LIMIT ?`,
+		key, column, table, column, column)
+	rows, err := t.server.Query(query, len(prefix), prefix, REENCRYPT_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	type stale struct {
+		id    int64
+		value string
+	}
+	var values []stale
+	for rows.Next() {
+		var v stale
+		if err := rows.Scan(&v.id, &v.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values = append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	// the whole batch is one statement, so one log entry and one push
+	// to the replicas. batch holds (key, old value, new value) rows
+	tuples := make([]string, 0, len(values))
+	args := make([]any, 0, 3*len(values))
+	for _, v := range values {
+		plaintext, err := t.server.Keyring.OpenField(v.value)
+		if err != nil {
+			return 0, err
+		}
+		tuples = append(tuples, "(?, ?, ?)")
+		args = append(args, v.id, v.value, t.server.Keyring.SealField(plaintext))
+	}
+	script := fmt.Sprintf(`UPDATE %[1]s SET %[3]s = batch.column3 FROM (VALUES %[4]s) AS batch
+            WHERE %[1]s.%[2]s = batch.column1 AND %[1]s.%[3]s = batch.column2`,
+		table, key, column, strings.Join(tuples, ", "))
+	if _, err := t.execReplicated(script, args...); err != nil {
+		return 0, err
+	}
+	return len(values), nil
+}
+
+/*
+Brings the data directory onto the current key, see the top of this
+file. Log files are done once at start, new ones are sealed with the
+current key anyway. The leader re-seals columns a batch per heartbeat
+interval until none is left
+*/
+func (s *Server) ReencryptThread() {
+	logsDone, columnsDone := false, false
+	for {
+		if !logsDone {
+			n, err := s.reencryptLogs()
+			if err != nil {
+				s.logger.Warn("Re-encrypting log files", "err", err)
+			} else {
+				logsDone = true
+				s.logger.Info("Log files sealed", "key", s.Keyring.CurrentId(), "rewritten", n)
+			}
+		}
+
+		if !columnsDone && s.LeaderID() == s.PID {
+			n, err := s.messageHandler.reencryptColumns()
+			if err != nil {
+				s.logger.Warn("Re-encrypting columns", "err", err)
+			} else if n == 0 {
+				columnsDone = true
+			} else {
+				s.logger.Info("Columns re-sealed", "key", s.Keyring.CurrentId(), "values", n)
+			}
+		}
+
+		if logsDone && columnsDone {
+			s.logger.Info("Re-encryption done", "key", s.Keyring.CurrentId())
+			return
+		}
+		if !s.sleep(s.HeartbeatInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKey() []byte {
+	key := make([]byte, AT_REST_KEY_SIZE)
+	rand.Read(key)
+	return key
+}
+
+func newTestKeyring(t *testing.T, current []byte, previous ...[]byte) *Keyring {
+	t.Helper()
+	keys, err := NewKeyring(current, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Raw values of a column on node i, as stored
+func columnValues(c *testCluster, i int, table string, column string) []string {
+	db, err := openDatabase(filepath.Join(c.dirs[i], GenerateDatabaseName(i)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT ` + column + ` FROM ` + table + ` WHERE ` + column + ` != '' ORDER BY rowid`)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			c.t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// Whether every log file and sealed column of node i is sealed with key
+func sealedWith(c *testCluster, i int, key []byte) bool {
+	id := atRestKeyId(key)
+	dir := filepath.Join(c.dirs[i], fmt.Sprintf("logs-node-%d", i))
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil || !strings.HasPrefix(string(data), SEALED_LOG_PREFIX+id+"\n") {
+			return false
+		}
+	}
+	for _, sealed := range SEALED_COLUMNS {
+		for _, value := range columnValues(c, i, sealed.table, sealed.column) {
+			if !strings.HasPrefix(value, SEALED_FIELD_PREFIX+id+":") {
+				return false
+			}
+		}
+	}
+	return len(files) > 0
+}
+
+func TestKeyringSealsAndOpens(t *testing.T) {
+	old, current := newKey(), newKey()
+	keys := newTestKeyring(t, current, old)
+
+	sealed := keys.SealField("hello")
+	if !strings.HasPrefix(sealed, SEALED_FIELD_PREFIX+atRestKeyId(current)+":") || keys.SealField("hello") == sealed {
+		t.Errorf("sealed field %q", sealed)
+	}
+	if text, err := keys.OpenField(sealed); err != nil || text != "hello" {
+		t.Errorf("opened %q %v", text, err)
+	}
+	if text, err := keys.OpenField(newTestKeyring(t, old).SealField("before")); err != nil || text != "before" {
+		t.Errorf("previous key: %q %v", text, err)
+	}
+	if text, err := keys.OpenField("enc1: in the clear"); err != nil || text != "enc1: in the clear" {
+		t.Errorf("plaintext: %q %v", text, err)
+	}
+	if _, err := newTestKeyring(t, newKey()).OpenField(sealed); err == nil {
+		t.Error("opened with an unknown key")
+	}
+	var none *Keyring
+	if none.SealField("hello") != "hello" {
+		t.Error("sealed without a key")
+	}
+	if _, err := none.OpenField(sealed); err == nil {
+		t.Error("opened without a key")
+	}
+
+	log := keys.SealLog("log-1.json", []byte(`{"index": 1}`))
+	if data, id, err := keys.OpenLog("log-1.json", log); err != nil || id != keys.CurrentId() || string(data) != `{"index": 1}` {
+		t.Errorf("opened log %q %q %v", data, id, err)
+	}
+	if _, _, err := keys.OpenLog("log-2.json", log); err == nil {
+		t.Error("log file opened under another name")
+	}
+}
+
+// Whether any file in the data directory of node i contains text
+func storedInClear(c *testCluster, i int, text string) bool {
+	found := false
+	filepath.WalkDir(c.dirs[i], func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			data, _ := os.ReadFile(path)
+			found = found || strings.Contains(string(data), text)
+		}
+		return nil
+	})
+	return found
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	key := newKey()
+	c := newTestCluster(t, 3)
+	c.keyring = newTestKeyring(t, key)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.sendMessage(leader, 1, 2, "secret plans")
+
+	messages := getMessages(t, c, leader, 1, 2)
+	if len(messages) != 1 || messages[0].Message != "secret plans" {
+		t.Fatalf("messages: %+v", messages)
+	}
+	var resp RPCResponse
+	edit := EditMessageRequest{UserId: 1, HLC: messages[0].HLC, Message: "secret plans, revised"}
+	if err := c.client(leader).Call("MessageHandler.EditMessage", &edit, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var history MessageHistory
+	if err := c.client(leader).Call("MessageHandler.GetMessageHistory", &EditMessageRequest{UserId: 2, HLC: messages[0].HLC}, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Versions) != 1 || history.Versions[0].Message != "secret plans" {
+		t.Errorf("history: %+v", history.Versions)
+	}
+	if err := c.client(leader).Call("MessageHandler.ReportMessage", &ReportRequest{UserId: 2, HLC: messages[0].HLC, Reason: "spoilers"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	request := ChangePasswordRequest{UserId: 1, OldPassword: "digest", NewPassword: "new digest"}
+	if err := c.client(leader).Call("MessageHandler.ChangePassword", &request, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var profile UserProfile
+	if err := c.client(leader).Call("MessageHandler.Login", &LoginMessage{Email: "a@example.com", Password: "new digest"}, &profile); err != nil || profile.UserId != 1 {
+		t.Errorf("login after a password change: %+v %v", profile, err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	for i := 0; i < 3; i++ {
+		if !sealedWith(c, i, key) {
+			t.Errorf("node %d has values not sealed with the key", i)
+		}
+		for _, text := range []string{"secret plans", "spoilers", "digest"} {
+			if storedInClear(c, i, text) {
+				t.Errorf("node %d stores %q in the clear", i, text)
+			}
+		}
+	}
+
+	// a replica without the key cannot read the log
+	c.crash(leader)
+	c.keyring = nil
+	server := c.newNode(leader)
+	defer server.Stop()
+	if _, err := ReadAllEntires(server); err == nil {
+		t.Error("sealed log read without the key")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	session := loginDevice(t, c, leader, "b@example.com", "")
+	c.sendMessage(leader, 1, 2, "written in the clear")
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+
+	// a first key seals what was written before it, a second one
+	// replaces it while the first is still known
+	first, second := newKey(), newKey()
+	for _, step := range []struct {
+		keys *Keyring
+		key  []byte
+	}{
+		{newTestKeyring(t, first), first},
+		{newTestKeyring(t, second, first), second},
+	} {
+		c.stopAll()
+		c.keyring = step.keys
+		c.startAll()
+		leader = c.waitForLeader(5 * time.Second)
+		eventually(t, 10*time.Second, func() bool {
+			for i := 0; i < 3; i++ {
+				if !sealedWith(c, i, step.key) {
+					return false
+				}
+			}
+			return true
+		}, "data sealed with the new key")
+		c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	}
+
+	// re-sealing is neither an edit nor a change to sync
+	messages := getMessages(t, c, leader, 1, 2)
+	if len(messages) != 1 || messages[0].Message != "written in the clear" || messages[0].Edited {
+		t.Fatalf("messages after rotation: %+v", messages)
+	}
+	var history MessageHistory
+	if err := c.client(leader).Call("MessageHandler.GetMessageHistory", &EditMessageRequest{UserId: 1, HLC: messages[0].HLC}, &history); err != nil || len(history.Versions) != 0 {
+		t.Errorf("history after rotation: %+v %v", history.Versions, err)
+	}
+	if result := syncDevice(t, c, leader, 2, session.DeviceId, session.Cursor); len(result.Messages) != 1 || len(columnValues(c, leader, "changes", "message_hlc")) != 1 {
+		t.Errorf("changes after rotation: %+v", result)
+	}
+
+	// the first key is no longer needed
+	c.stopAll()
+	c.keyring = newTestKeyring(t, second)
+	c.startAll()
+	leader = c.waitForLeader(5 * time.Second)
+	if messages := getMessages(t, c, leader, 2, 1); len(messages) != 1 || messages[0].Message != "written in the clear" {
+		t.Errorf("messages without the first key: %+v", messages)
+	}
+	var profile UserProfile
+	if err := c.client(leader).Call("MessageHandler.Login", &LoginMessage{Email: "a@example.com", Password: "digest"}, &profile); err != nil {
+		t.Errorf("login without the first key: %v", err)
+	}
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+}
+
+func TestKeyRotationInBatches(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	// more passwords in the clear than fit in two batches, written by a single entry
+	users := 2*REENCRYPT_BATCH + REENCRYPT_BATCH/2
+	_, err := c.node(leader).messageHandler.execReplicated(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?)
+        INSERT INTO users (email, password, firstname, lastname, descr)
+        SELECT 'user' || i || '@example.com', 'digest', 'Test', 'User', '' FROM n`, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	before := c.node(leader).LogIndex()
+
+	key := newKey()
+	c.stopAll()
+	c.keyring = newTestKeyring(t, key)
+	c.startAll()
+	leader = c.waitForLeader(5 * time.Second)
+	eventually(t, 10*time.Second, func() bool {
+		for i := 0; i < 3; i++ {
+			if !sealedWith(c, i, key) {
+				return false
+			}
+		}
+		return true
+	}, "passwords sealed with the new key")
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+
+	// one log entry per batch
+	if entries := c.node(leader).LogIndex() - before; entries != 3 {
+		t.Errorf("re-sealing %d values took %d log entries, want 3", users, entries)
+	}
+	if values := columnValues(c, leader, "users", "password"); len(values) != users {
+		t.Errorf("%d passwords after rotation, want %d", len(values), users)
+	}
+	var profile UserProfile
+	last := fmt.Sprintf("user%d@example.com", users)
+	if err := c.client(leader).Call("MessageHandler.Login", &LoginMessage{Email: last, Password: "digest"}, &profile); err != nil {
+		t.Errorf("login after rotation: %v", err)
+	}
+}
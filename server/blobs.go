@@ -0,0 +1,530 @@
+package main
+
+/*
+Attachments.
+
+File contents are stored as content-addressed blobs: one file per
+blob in blobs-node-<PID>, named by the SHA-256 of its contents.
+Clients upload through the leader in chunks:
+
+ 1. BeginUpload opens an upload session and returns its ID
+ 2. UploadChunk appends the next chunk, chunks arrive in order
+ 3. FinishUpload hashes the file, sniffs its MIME type and stores
+    the blob
+
+Finishing an upload appends a row to the replicated blobs table. The
+blob contents do not travel in the log: every replica runs a blob sync
+that fetches blobs it is missing from its peers, the leader first, and
+verifies their hash. Messages reference a blob by hash, see SaveMessage.
+
+Sessions live in the leader's memory. An upload interrupted by a
+leader change has to be restarted.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_ATTACHMENT_SIZE = 25 << 20  // bytes
+	DEFAULT_CHUNK_SIZE          = 256 << 10 // bytes per UploadChunk and blob read
+	MAX_CHUNK_SIZE              = 4 << 20   // the gateway reads chunks into memory
+	UPLOAD_SESSION_TTL          = 10 * time.Minute
+)
+
+// JSON object, request to start an upload
+type BeginUploadRequest struct {
+	UserId int
+	Size   int64 // total size announced by the client
+}
+
+// JSON object, an open upload session
+type UploadSession struct {
+	UploadId  string
+	ChunkSize int
+	Received  int64 // bytes stored so far, where the next chunk starts
+}
+
+// JSON object, one chunk of an upload, Offset must equal Received
+type UploadChunkRequest struct {
+	UploadId string
+	Offset   int64
+	Data     []byte
+}
+
+// JSON object, a stored blob
+type BlobInfo struct {
+	Hash string // hex SHA-256 of the contents
+	Size int64
+	MIME string // sniffed from the contents
+}
+
+// JSON object, request for part of a blob
+type ReadBlobRequest struct {
+	UserId int // MessageHandler only: must be allowed to see the blob
+	Hash   string
+	Offset int64
+	Length int
+}
+
+// JSON object, part of a blob
+type BlobChunk struct {
+	Data []byte
+	Size int64 // total size of the blob
+	MIME string
+}
+
+// =================================================
+//  BLOB STORE
+// =================================================
+
+type BlobStore struct {
+	Dir string
+}
+
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "uploads"), 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory: %v", err)
+	}
+	return &BlobStore{Dir: dir}, nil
+}
+
+// Whether hash is a hex SHA-256, which keeps it safe to use as a file name
+func ValidBlobHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size && hex.EncodeToString(decoded) == hash
+}
+
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.Dir, hash)
+}
+
+func (b *BlobStore) Has(hash string) bool {
+	if !ValidBlobHash(hash) {
+		return false
+	}
+	_, err := os.Stat(b.path(hash))
+	return err == nil
+}
+
+// Reads up to length bytes at offset, and the blob's total size
+func (b *BlobStore) ReadAt(hash string, offset int64, length int) ([]byte, int64, error) {
+	if !ValidBlobHash(hash) {
+		return nil, 0, fmt.Errorf("invalid blob hash")
+	}
+	file, err := os.Open(b.path(hash))
+	if os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("blob %s not available", hash)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || offset > info.Size() {
+		return nil, info.Size(), fmt.Errorf("offset %d outside of blob of %d bytes", offset, info.Size())
+	}
+	data := make([]byte, min(int64(length), info.Size()-offset))
+	n, err := file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, info.Size(), err
+	}
+	return data[:n], info.Size(), nil
+}
+
+/*
+Moves a finished temporary file into the store under the hash of its
+contents. If want is set the contents must match it. Returns the hash
+and the sniffed MIME type
+*/
+func (b *BlobStore) Commit(tmp string, want string) (string, string, error) {
+	file, err := os.Open(tmp)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", "", err
+	}
+	hash := hex.EncodeToString(digest.Sum(nil))
+	if want != "" && hash != want {
+		return "", "", fmt.Errorf("blob contents do not match hash %s", want)
+	}
+
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	mime := http.DetectContentType(head[:n])
+
+	return hash, mime, os.Rename(tmp, b.path(hash))
+}
+
+// =================================================
+//  UPLOAD SESSIONS (LEADER)
+// =================================================
+
+type upload struct {
+	user     int
+	size     int64
+	received int64
+	file     *os.File
+	touched  time.Time
+}
+
+type uploads struct {
+	mutex    sync.Mutex
+	sessions map[string]*upload
+}
+
+// Drops sessions that saw no chunk for UPLOAD_SESSION_TTL, the caller holds the mutex
+func (u *uploads) expire(now time.Time) {
+	for id, session := range u.sessions {
+		if now.Sub(session.touched) > UPLOAD_SESSION_TTL {
+			session.file.Close()
+			os.Remove(session.file.Name())
+			delete(u.sessions, id)
+		}
+	}
+}
+
+func newUploadId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RPC: opens an upload session on the leader
+func (t *MessageHandler) BeginUpload(req *BeginUploadRequest, session *UploadSession) error {
+	s := t.server
+	if s.LeaderID() != s.PID {
+		return fmt.Errorf("not the leader node")
+	}
+	if req.Size <= 0 || req.Size > s.MaxAttachmentSize {
+		return fmt.Errorf("attachment size must be between 1 and %d bytes", s.MaxAttachmentSize)
+	}
+
+	// the uploader is recorded with the blob, see FinishUpload
+	rows, err := s.Query(`SELECT 1 FROM users WHERE userid = ? AND deleted = 0`, req.UserId)
+	if err != nil {
+		s.logger.Error("Query failed", "err", err)
+		return err
+	}
+	exists := rows.Next()
+	rows.Close()
+	if !exists {
+		return fmt.Errorf("no such user")
+	}
+
+	file, err := os.CreateTemp(filepath.Join(s.Blobs.Dir, "uploads"), "upload-")
+	if err != nil {
+		s.logger.Error("Error creating upload file", "err", err)
+		return err
+	}
+
+	s.uploads.mutex.Lock()
+	defer s.uploads.mutex.Unlock()
+	s.uploads.expire(time.Now())
+
+	session.UploadId = newUploadId()
+	session.ChunkSize = s.ChunkSize
+	s.uploads.sessions[session.UploadId] = &upload{user: req.UserId, size: req.Size, file: file, touched: time.Now()}
+	s.logger.Debug("Upload started", "user", req.UserId, "upload", session.UploadId, "size", req.Size)
+	return nil
+}
+
+/*
+RPC: appends a chunk to an upload. A chunk at an offset that was
+already received is accepted again, so a client can retry a chunk
+whose answer it lost
+*/
+func (t *MessageHandler) UploadChunk(req *UploadChunkRequest, session *UploadSession) error {
+	s := t.server
+	s.uploads.mutex.Lock()
+	defer s.uploads.mutex.Unlock()
+
+	u, ok := s.uploads.sessions[req.UploadId]
+	if !ok {
+		return fmt.Errorf("no such upload")
+	}
+	if len(req.Data) > s.ChunkSize {
+		return fmt.Errorf("chunk of %d bytes is larger than %d", len(req.Data), s.ChunkSize)
+	}
+	end := req.Offset + int64(len(req.Data))
+	if req.Offset < 0 || req.Offset > u.received {
+		return fmt.Errorf("chunk at offset %d, expected %d", req.Offset, u.received)
+	}
+	if end > u.size {
+		return fmt.Errorf("upload is larger than the announced %d bytes", u.size)
+	}
+
+	if _, err := u.file.WriteAt(req.Data, req.Offset); err != nil {
+		s.logger.Error("Error writing upload", "err", err)
+		return err
+	}
+	u.received = max(u.received, end)
+	u.touched = time.Now()
+
+	session.UploadId = req.UploadId
+	session.ChunkSize = s.ChunkSize
+	session.Received = u.received
+	return nil
+}
+
+/*
+RPC: completes an upload. The blob is stored under its hash and
+recorded in the replicated blobs table, owned by the uploader
+*/
+func (t *MessageHandler) FinishUpload(req *UploadSession, info *BlobInfo) error {
+	s := t.server
+	s.uploads.mutex.Lock()
+	u, ok := s.uploads.sessions[req.UploadId]
+	if ok {
+		delete(s.uploads.sessions, req.UploadId)
+	}
+	s.uploads.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such upload")
+	}
+	tmp := u.file.Name()
+	u.file.Close()
+	defer os.Remove(tmp)
+
+	if u.received != u.size {
+		return fmt.Errorf("upload incomplete, received %d of %d bytes", u.received, u.size)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if s.LeaderID() != s.PID {
+		return fmt.Errorf("not the leader node")
+	}
+
+	hash, mime, err := s.Blobs.Commit(tmp, "")
+	if err != nil {
+		s.logger.Error("Error storing blob", "err", err)
+		return err
+	}
+
+	script := `INSERT OR IGNORE INTO blobs (
+		[hash],
+		[size],
+		[mime],
+		[uploader])
+		VALUES (?, ?, ?, ?);`
+	args := []any{hash, u.size, mime, u.user}
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, Blob: hash}, nil); err != nil {
+		s.logger.Error("Error saving blob", "err", err)
+		return err
+	}
+
+	*info = BlobInfo{Hash: hash, Size: u.size, MIME: mime}
+	s.logger.Info("Stored blob", "user", u.user, "hash", hash, "size", u.size, "mime", mime)
+	return nil
+}
+
+// =================================================
+//  READING BLOBS
+// =================================================
+
+/*
+Size and MIME type of a blob the user may read: they uploaded it, or
+sent or received a message that references it
+*/
+func (t *MessageHandler) blobAccess(user int, hash string) (BlobInfo, error) {
+	query := `SELECT B.size, B.mime FROM blobs B
+            WHERE B.hash = ?
+            AND (B.uploader = ?
+            OR EXISTS (SELECT 1 FROM messages M
+                WHERE M.attachment = B.hash
+                AND (M.from_userid = ? OR M.to_userid = ?)))
+            LIMIT 1`
+	rows, err := t.server.Query(query, hash, user, user, user)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return BlobInfo{}, fmt.Errorf("no such attachment")
+	}
+	info := BlobInfo{Hash: hash}
+	if err := rows.Scan(&info.Size, &info.MIME); err != nil {
+		return BlobInfo{}, err
+	}
+	return info, nil
+}
+
+// Checks that user uploaded the blob, which lets them attach it to a message
+func (t *MessageHandler) checkUploader(user int, hash string) error {
+	rows, err := t.server.Query(`SELECT 1 FROM blobs WHERE hash = ? AND uploader = ?`, hash, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return fmt.Errorf("no such attachment")
+	}
+	return nil
+}
+
+// RPC: part of a blob, for a user allowed to see it
+func (t *MessageHandler) ReadBlob(req *ReadBlobRequest, chunk *BlobChunk) error {
+	info, err := t.blobAccess(req.UserId, req.Hash)
+	if err != nil {
+		return err
+	}
+	data, size, err := t.server.Blobs.ReadAt(req.Hash, req.Offset, min(req.Length, t.server.ChunkSize))
+	if err != nil {
+		return err
+	}
+	*chunk = BlobChunk{Data: data, Size: size, MIME: info.MIME}
+	return nil
+}
+
+// RPC: part of a blob, for blob sync between replicas
+func (r *ReplicationHandler) GetBlob(req *ReadBlobRequest, chunk *BlobChunk) error {
+	data, size, err := r.server.Blobs.ReadAt(req.Hash, req.Offset, min(req.Length, r.server.ChunkSize))
+	if err != nil {
+		return err
+	}
+	*chunk = BlobChunk{Data: data, Size: size}
+	return nil
+}
+
+// =================================================
+//  BLOB SYNC
+// =================================================
+
+// Asks the blob sync to run now, without waiting for the next heartbeat
+func (s *Server) kickBlobSync() {
+	select {
+	case s.blobSync <- struct{}{}:
+	default:
+	}
+}
+
+// Fetches missing blobs every heartbeat, or when kicked, until the server stops
+func (s *Server) BlobSyncThread() {
+	for {
+		s.SyncBlobs()
+		select {
+		case <-s.stopped:
+			return
+		case <-s.blobSync:
+		case <-time.After(s.HeartbeatInterval):
+		}
+	}
+}
+
+// Fetches every blob in the blobs table that is not stored locally
+func (s *Server) SyncBlobs() {
+	rows, err := s.Query(`SELECT DISTINCT hash FROM blobs`)
+	if err != nil {
+		s.logger.Warn("Listing blobs", "err", err)
+		return
+	}
+	var missing []string
+	for rows.Next() {
+		var hash string
+		if rows.Scan(&hash) == nil && !s.Blobs.Has(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	rows.Close()
+
+	for _, hash := range missing {
+		if s.isStopped() {
+			return
+		}
+		if err := s.fetchBlob(hash); err != nil {
+			s.logger.Warn("Blob not fetched", "hash", hash, "err", err)
+		}
+	}
+}
+
+// Copies a blob from the first peer that has it, the leader first
+func (s *Server) fetchBlob(hash string) error {
+	if !ValidBlobHash(hash) {
+		return fmt.Errorf("invalid blob hash")
+	}
+	peers := []int{}
+	if leader := int(s.leader.Load()); leader >= 0 && leader != s.PID {
+		peers = append(peers, leader)
+	}
+	for id := range s.BackupNodes {
+		if id != s.PID && id != int(s.leader.Load()) {
+			peers = append(peers, id)
+		}
+	}
+
+	last := fmt.Errorf("no peers")
+	for _, id := range peers {
+		err := s.fetchBlobFrom(id, hash)
+		if err == nil {
+			s.logger.Debug("Fetched blob", "hash", hash, "peer", id)
+			return nil
+		}
+		last = fmt.Errorf("peer %d: %v", id, err)
+	}
+	return last
+}
+
+func (s *Server) fetchBlobFrom(id int, hash string) error {
+	client, err := s.connectReplica(s.BackupNodes[id], s.RPCTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	file, err := os.CreateTemp(filepath.Join(s.Blobs.Dir, "uploads"), "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var offset int64
+	for {
+		var chunk BlobChunk
+		req := ReadBlobRequest{Hash: hash, Offset: offset, Length: s.ChunkSize}
+		if err := client.Call("ReplicationHandler.GetBlob", req, &chunk); err != nil {
+			return err
+		}
+		if chunk.Size > s.MaxAttachmentSize {
+			return fmt.Errorf("blob of %d bytes is over the size limit", chunk.Size)
+		}
+		if _, err := file.Write(chunk.Data); err != nil {
+			return err
+		}
+		offset += int64(len(chunk.Data))
+		if offset >= chunk.Size {
+			break
+		}
+		if len(chunk.Data) == 0 {
+			return fmt.Errorf("blob ended at %d of %d bytes", offset, chunk.Size)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	_, _, err = s.Blobs.Commit(file.Name(), hash)
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Uploads data through node i in chunks of chunkSize
+func uploadBlob(t *testing.T, c *testCluster, i int, user int, data []byte, chunkSize int) BlobInfo {
+	t.Helper()
+	client := c.client(i)
+	var session UploadSession
+	if err := client.Call("MessageHandler.BeginUpload", &BeginUploadRequest{UserId: user, Size: int64(len(data))}, &session); err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		chunk := data[offset:min(offset+chunkSize, len(data))]
+		req := UploadChunkRequest{UploadId: session.UploadId, Offset: int64(offset), Data: chunk}
+		if err := client.Call("MessageHandler.UploadChunk", &req, &session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var info BlobInfo
+	if err := client.Call("MessageHandler.FinishUpload", &session, &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestAttachmentUploadAndSync(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.createUser(leader, "c@example.com")
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte("pixels"), 1000)...)
+	info := uploadBlob(t, c, leader, 1, png, 1000)
+	digest := sha256.Sum256(png)
+	if info.Hash != hex.EncodeToString(digest[:]) || info.Size != int64(len(png)) || info.MIME != "image/png" {
+		t.Fatalf("unexpected blob: %+v", info)
+	}
+
+	// the log entry names the blob, followers fetch it when they apply it
+	entry, err := c.node(leader).readLogFile(fmt.Sprintf("log-%d.json", c.node(leader).LogIndex()))
+	if err != nil || entry.Blob != info.Hash {
+		t.Errorf("log entry of the upload: %+v %v", entry, err)
+	}
+
+	// only the uploader may attach it
+	var resp string
+	msg := ChatMessage{Message: "look", From: 2, To: 1, Attachment: info.Hash}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &msg, &resp); err == nil {
+		t.Errorf("attached a blob uploaded by someone else")
+	}
+	msg = ChatMessage{Message: "look", From: 1, To: 2, Attachment: info.Hash, AttachmentName: "cat.png"}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &msg, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// the row replicates through the log, the contents through blob sync
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	eventually(t, 5*time.Second, func() bool {
+		return c.node(0).Blobs.Has(info.Hash) && c.node(1).Blobs.Has(info.Hash)
+	}, "followers to fetch the blob")
+	data, _, err := c.node(0).Blobs.ReadAt(info.Hash, 0, len(png))
+	if err != nil || !bytes.Equal(data, png) {
+		t.Errorf("follower blob differs: %v", err)
+	}
+
+	messages := getMessages(t, c, 0, 2, 1)
+	if len(messages) != 1 || messages[0].Attachment != info.Hash || messages[0].AttachmentName != "cat.png" ||
+		messages[0].AttachmentSize != int64(len(png)) || messages[0].AttachmentMIME != "image/png" {
+		t.Errorf("attachment not returned: %+v", messages)
+	}
+
+	// the recipient reads a range, a third user cannot read at all
+	var chunk BlobChunk
+	if err := c.client(leader).Call("MessageHandler.ReadBlob", &ReadBlobRequest{UserId: 2, Hash: info.Hash, Offset: 8, Length: 6}, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if string(chunk.Data) != "pixels" || chunk.Size != int64(len(png)) || chunk.MIME != "image/png" {
+		t.Errorf("unexpected range: %q %+v", chunk.Data, chunk)
+	}
+	err = c.client(leader).Call("MessageHandler.ReadBlob", &ReadBlobRequest{UserId: 3, Hash: info.Hash, Length: 6}, &chunk)
+	if err == nil || !strings.Contains(err.Error(), "no such attachment") {
+		t.Errorf("third user read the attachment: %v", err)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+	client := c.client(0)
+	c.createUser(0, "a@example.com")
+
+	var session UploadSession
+	if err := client.Call("MessageHandler.BeginUpload", &BeginUploadRequest{UserId: 2, Size: 10}, &session); err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("upload by an unknown user: %v", err)
+	}
+	if err := client.Call("MessageHandler.BeginUpload", &BeginUploadRequest{UserId: 1, Size: DEFAULT_MAX_ATTACHMENT_SIZE + 1}, &session); err == nil {
+		t.Errorf("oversized upload accepted")
+	}
+
+	if err := client.Call("MessageHandler.BeginUpload", &BeginUploadRequest{UserId: 1, Size: 10}, &session); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(offset int64, data string) error {
+		var reply UploadSession
+		return client.Call("MessageHandler.UploadChunk", &UploadChunkRequest{UploadId: session.UploadId, Offset: offset, Data: []byte(data)}, &reply)
+	}
+	if err := chunk(0, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk(7, "xyz"); err == nil || !strings.Contains(err.Error(), "expected 5") {
+		t.Errorf("gap accepted: %v", err)
+	}
+	if err := chunk(0, "hello"); err != nil {
+		t.Errorf("retried chunk rejected: %v", err)
+	}
+	if err := chunk(5, "world!"); err == nil {
+		t.Errorf("more than the announced size accepted")
+	}
+
+	var info BlobInfo
+	if err := client.Call("MessageHandler.FinishUpload", &session, &info); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Errorf("incomplete upload finished: %v", err)
+	}
+	if err := client.Call("MessageHandler.FinishUpload", &session, &info); err == nil {
+		t.Errorf("upload finished twice")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+/*
+Cluster certificate authority and peer roles.
+
+Every process in the cluster holds a certificate signed by the cluster
+CA. The organizational unit of the certificate names the role of the
+holder:
+
+ 1. ROLE_REPLICA, may call replication and election RPCs
+ 2. ROLE_GATEWAY, may call the client RPCs of MessageHandler
+
+The CA generator here is meant for local clusters and tests, run it
+with: go run . gencerts <dir>
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	ROLE_REPLICA = "replica"
+	ROLE_GATEWAY = "gateway"
+	ROLE_ANY     = "" // unauthenticated peer on a plaintext transport, may call anything
+
+	CERT_VALIDITY = 365 * 24 * time.Hour
+)
+
+var TLS_CONFIG_FILE = "tls_config.json"
+
+// Returns the role a certificate was issued for
+func CertificateRole(cert *x509.Certificate) (string, error) {
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == ROLE_REPLICA || unit == ROLE_GATEWAY {
+			return unit, nil
+		}
+	}
+	return "", fmt.Errorf("certificate %q carries no cluster role", cert.Subject.CommonName)
+}
+
+// =================================================
+//  TLS CONFIG FILE
+// =================================================
+
+// Certificate and private key of one process, PEM files
+type CertificatePair struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+/*
+Contents of TLS_CONFIG_FILE, shared by the replicas and the gateway.
+Replicas[i] belongs to replica i of the peer list.
+Relative paths are resolved against the directory of the config file.
+*/
+type TLSConfigFile struct {
+	CAFile   string            `yaml:"ca_file" json:"ca_file"`
+	Replicas []CertificatePair `yaml:"replicas" json:"replicas"`
+	Gateway  CertificatePair   `yaml:"gateway" json:"gateway"`
+}
+
+/*
+Reads the TLS config. A missing file is not an error: it returns nil
+and the cluster runs over plain TCP
+*/
+func ReadTLSConfig(filename string) (*TLSConfigFile, error) {
+	bytes, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config TLSConfigFile
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+
+	config.resolve(filepath.Dir(filename))
+	return &config, nil
+}
+
+// Makes relative certificate paths relative to base
+func (c *TLSConfigFile) resolve(base string) {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(base, path)
+	}
+	c.CAFile = resolve(c.CAFile)
+	for i := range c.Replicas {
+		c.Replicas[i].CertFile = resolve(c.Replicas[i].CertFile)
+		c.Replicas[i].KeyFile = resolve(c.Replicas[i].KeyFile)
+	}
+	c.Gateway.CertFile = resolve(c.Gateway.CertFile)
+	c.Gateway.KeyFile = resolve(c.Gateway.KeyFile)
+}
+
+// Transport for the replica with the given PID
+func (c *TLSConfigFile) ReplicaTransport(PID int) (*TLSTransport, error) {
+	if PID < 0 || PID >= len(c.Replicas) {
+		return nil, fmt.Errorf("no certificate configured for replica %d", PID)
+	}
+	pair := c.Replicas[PID]
+	return NewTLSTransport(pair.CertFile, pair.KeyFile, c.CAFile)
+}
+
+// =================================================
+//  CERTIFICATE AUTHORITY
+// =================================================
+
+type CertificateAuthority struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Creates a self-signed cluster CA
+func NewCertificateAuthority(name string) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"MeChat"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CERT_VALIDITY),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{Cert: cert, Key: key, der: der}, nil
+}
+
+// Writes the CA certificate (not its key) to certFile
+func (ca *CertificateAuthority) WriteCertificate(certFile string) error {
+	return writePEMFile(certFile, "CERTIFICATE", ca.der)
+}
+
+/*
+Issues a certificate for the given role and writes it with its key.
+hosts are the IP addresses or DNS names the holder is reachable at,
+replicas need them since peers verify the address they dial
+*/
+func (ca *CertificateAuthority) Issue(role string, name string, hosts []string, pair CertificatePair) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"MeChat"},
+			OrganizationalUnit: []string{role},
+			CommonName:         name,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(CERT_VALIDITY),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if role == ROLE_REPLICA {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEMFile(pair.CertFile, "CERTIFICATE", der); err != nil {
+		return err
+	}
+	return writePEMFile(pair.KeyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEMFile(filename string, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(filename, data, 0600)
+}
+
+/*
+Generates a CA, a certificate per replica and one for the gateway into
+dir, and writes the matching TLS config file there. The CA key is not
+kept, so new certificates need a new CA
+*/
+func GenerateClusterCertificates(dir string, replicas []ReplicaAddress) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	ca, err := NewCertificateAuthority("MeChat cluster CA")
+	if err != nil {
+		return "", err
+	}
+
+	config := TLSConfigFile{CAFile: "ca.pem"}
+	if err := ca.WriteCertificate(filepath.Join(dir, config.CAFile)); err != nil {
+		return "", err
+	}
+
+	for i, addr := range replicas {
+		pair := CertificatePair{
+			CertFile: fmt.Sprintf("replica-%d.pem", i),
+			KeyFile:  fmt.Sprintf("replica-%d-key.pem", i),
+		}
+		err := ca.Issue(ROLE_REPLICA, fmt.Sprintf("replica-%d", i), []string{addr.Address}, CertificatePair{
+			CertFile: filepath.Join(dir, pair.CertFile),
+			KeyFile:  filepath.Join(dir, pair.KeyFile),
+		})
+		if err != nil {
+			return "", err
+		}
+		config.Replicas = append(config.Replicas, pair)
+	}
+
+	config.Gateway = CertificatePair{CertFile: "gateway.pem", KeyFile: "gateway-key.pem"}
+	err = ca.Issue(ROLE_GATEWAY, "gateway", nil, CertificatePair{
+		CertFile: filepath.Join(dir, config.Gateway.CertFile),
+		KeyFile:  filepath.Join(dir, config.Gateway.KeyFile),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	configFile := filepath.Join(dir, TLS_CONFIG_FILE)
+	return configFile, os.WriteFile(configFile, bytes, 0600)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClusterElectsHighestReplica(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+
+	if leader := c.waitForLeader(5 * time.Second); leader != 2 {
+		t.Fatalf("expected node 2 to lead, got %d", leader)
+	}
+	if !c.node(2).IsLeader() || c.node(0).IsLeader() || c.node(1).IsLeader() {
+		t.Fatalf("IsLeader does not follow LeaderID")
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	c.createUser(2, "a@example.com")
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+
+	c.crash(2)
+	if leader := c.waitForLeader(5*time.Second, 0, 1); leader != 1 {
+		t.Fatalf("expected node 1 to take over, got %d", leader)
+	}
+
+	// the new leader accepts writes and replicates them
+	c.createUser(1, "b@example.com")
+	c.waitForConsistency(5*time.Second, 1, 0)
+
+	// the old leader comes back, catches up and takes over again
+	c.start(2)
+	if leader := c.waitForLeader(5 * time.Second); leader != 2 {
+		t.Fatalf("expected node 2 to lead after restart, got %d", leader)
+	}
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+}
+
+func TestCrashedReplicaCatchesUp(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	c.createUser(2, "a@example.com")
+	c.createUser(2, "b@example.com")
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+
+	c.crash(0)
+	for i := 0; i < 5; i++ {
+		c.sendMessage(2, 1, 2, fmt.Sprintf("message %d", i))
+	}
+	c.waitForConsistency(5*time.Second, 2, 1)
+
+	c.start(0)
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+}
+
+func TestCatchupInSmallBatches(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.batchSize = 2
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	c.createUser(2, "a@example.com")
+	c.createUser(2, "b@example.com")
+	c.crash(0)
+	// more than ten entries, so log file names no longer sort by index
+	for i := 0; i < 11; i++ {
+		c.sendMessage(2, 1, 2, fmt.Sprintf("message %d", i))
+	}
+
+	c.start(0)
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+}
+
+func TestPartitionedReplicaRejoins(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+	c.createUser(2, "a@example.com")
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+
+	c.network.partition([]int{0}, []int{1, 2})
+	for i := 0; i < 5; i++ {
+		c.sendMessage(2, 1, 1, fmt.Sprintf("message %d", i))
+	}
+	c.waitForConsistency(5*time.Second, 2, 1)
+
+	c.network.heal()
+	if leader := c.waitForLeader(5 * time.Second); leader != 2 {
+		t.Fatalf("expected node 2 to lead after the partition healed, got %d", leader)
+	}
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+}
+
+func TestReplicationSurvivesDroppedAndDelayedRPCs(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+	c.createUser(2, "a@example.com")
+
+	c.network.setDelay(5 * time.Millisecond)
+	c.network.setDropRate(2, 0, 0.5)
+	c.network.setDropRate(2, 1, 0.5)
+	for i := 0; i < 10; i++ {
+		c.sendMessage(2, 1, 1, fmt.Sprintf("message %d", i))
+	}
+
+	// periodic log sync repairs whatever replication missed
+	c.network.heal()
+	c.waitForConsistency(10*time.Second, 2, 0, 1)
+	if leader := c.agreedLeader(); leader != 2 {
+		t.Fatalf("faults on the leader's outgoing links caused a leader change to %d", leader)
+	}
+}
+
+func TestClockSkewIsCorrected(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.setSkew(0, 150*time.Millisecond)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	// 150ms at the slew rate takes a few seconds to apply
+	eventually(t, 10*time.Second, func() bool {
+		diff := c.node(0).getTime().Sub(c.node(2).getTime())
+		return absDuration(diff) < 10*time.Millisecond
+	}, "node 0 to slew its clock to the leader")
+
+	// skew never makes the HLC of messages go backwards
+	c.sendMessage(2, 1, 1, "first")
+	c.sendMessage(2, 1, 1, "second")
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+
+	var list MessageList
+	if err := c.client(0).Call("MessageHandler.GetMessages", &GetMessagesRequest{UserId: 1, ContactId: 1}, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 2 || list.Messages[0].Message != "first" || list.Messages[0].HLC >= list.Messages[1].HLC {
+		t.Fatalf("messages out of causal order: %+v", list.Messages)
+	}
+}
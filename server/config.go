@@ -0,0 +1,511 @@
+package main
+
+/*
+Declarative configuration of a replica.
+
+The configuration is a YAML file, mechat.yaml by default (see
+mechat.example.yaml). The replicas and the gateway can share one
+file: every replica reads the same peer list and picks its own entry
+by node.id. Settings are applied in this order, later ones win:
+
+ 1. built-in defaults
+ 2. the config file, if it exists
+ 3. MECHAT_* environment variables, see ApplyEnv
+ 4. the positional command line arguments <node id> <clock offset>
+
+Without a config file the peers come from replica_addrs.txt and TLS
+from tls_config.json, as before. Validate reports every problem at
+once instead of failing on the first.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_CONFIG_FILE = "mechat.yaml"
+	CONFIG_FILE_ENV     = "MECHAT_CONFIG"
+
+	DEFAULT_HEARTBEAT_TIMEOUT      = 110 * time.Millisecond // two transmissions and processing
+	DEFAULT_RPC_TIMEOUT            = 1 * time.Second
+	DEFAULT_REPLICATION_TIMEOUT    = 3 * time.Second
+	DEFAULT_REPLICATION_BATCH_SIZE = 100
+	DEFAULT_GATEWAY_LISTEN         = "127.0.0.1:8090"
+)
+
+type Config struct {
+	Node        NodeConfig        `yaml:"node"`
+	Peers       []string          `yaml:"peers"` // host:port of every replica, in node id order
+	DataDir     string            `yaml:"data_dir"`
+	HTTP        HTTPConfig        `yaml:"http"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Replication ReplicationConfig `yaml:"replication"`
+	Attachments AttachmentConfig  `yaml:"attachments"`
+	Limits      LimitConfig       `yaml:"limits"`
+	TLS         TLSConfig         `yaml:"tls"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Encryption  EncryptionConfig  `yaml:"encryption"`
+	Gateway     GatewayConfig     `yaml:"gateway"`
+
+	file string // file the config was read from, empty if none
+}
+
+type NodeConfig struct {
+	ID          int           `yaml:"id"`
+	ClockOffset time.Duration `yaml:"clock_offset"` // initial offset applied to the local clock
+}
+
+type HTTPConfig struct {
+	Address    string `yaml:"address"`     // /metrics, /healthz and /readyz of this node, overrides port_offset
+	PortOffset int    `yaml:"port_offset"` // otherwise served this far above the RPC port, 0 disables
+}
+
+type TimeoutConfig struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // failure detection, time sync and log sync
+	Heartbeat         time.Duration `yaml:"heartbeat"`          // how long a heartbeat waits for the leader
+	Election          time.Duration `yaml:"election"`           // how long an election waits for answers
+	RPC               time.Duration `yaml:"rpc"`                // other replica-to-replica calls and TLS handshakes
+	Replication       time.Duration `yaml:"replication"`        // connecting to push log entries, and each batch
+}
+
+type ReplicationConfig struct {
+	BatchSize   int `yaml:"batch_size"`    // log entries per ApplyEntries call
+	MaxReadyLag int `yaml:"max_ready_lag"` // entries a follower may trail and still be ready
+}
+
+type AttachmentConfig struct {
+	MaxSize   int64 `yaml:"max_size"`   // bytes per attachment
+	ChunkSize int   `yaml:"chunk_size"` // bytes per upload chunk
+}
+
+type LimitConfig struct {
+	SendRate  int `yaml:"send_rate"`  // messages per minute and user
+	SendBurst int `yaml:"send_burst"` // messages a user may send at once
+}
+
+// Either a TLS config file written by gencerts, or the same settings inline
+type TLSConfig struct {
+	ConfigFile    string `yaml:"config_file"`
+	TLSConfigFile `yaml:",inline"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Key for encryption at rest, see atrest.go. Keys are base64, 32 bytes
+type EncryptionConfig struct {
+	Key          string   `yaml:"key"`
+	KeyFile      string   `yaml:"key_file"`      // file holding the key, instead of key
+	PreviousKeys []string `yaml:"previous_keys"` // still opened after a rotation
+}
+
+// Settings of the gateway, see client/back. Replicas only check them
+type GatewayConfig struct {
+	Listen      string        `yaml:"listen"`
+	Outbox      string        `yaml:"outbox"`       // file of messages waiting for the leader
+	CallTimeout time.Duration `yaml:"call_timeout"` // a call to the leader, retries included
+	Retries     int           `yaml:"retries"`      // attempts after the first while there is no leader
+	Keys        string        `yaml:"keys"`         // directory of the user keys it keeps, empty for none
+}
+
+// Configuration before the file, environment and command line are applied
+func DefaultConfig() *Config {
+	return &Config{
+		DataDir: ".",
+		HTTP:    HTTPConfig{PortOffset: HTTP_PORT_OFFSET},
+		Timeouts: TimeoutConfig{
+			HeartbeatInterval: DEFAULT_HEARTBEAT_INTERVAL,
+			Heartbeat:         DEFAULT_HEARTBEAT_TIMEOUT,
+			Election:          DEFAULT_ELECTION_WAIT,
+			RPC:               DEFAULT_RPC_TIMEOUT,
+			Replication:       DEFAULT_REPLICATION_TIMEOUT,
+		},
+		Replication: ReplicationConfig{
+			BatchSize:   DEFAULT_REPLICATION_BATCH_SIZE,
+			MaxReadyLag: DEFAULT_MAX_READY_LAG,
+		},
+		Attachments: AttachmentConfig{
+			MaxSize:   DEFAULT_MAX_ATTACHMENT_SIZE,
+			ChunkSize: DEFAULT_CHUNK_SIZE,
+		},
+		Limits: LimitConfig{
+			SendRate:  DEFAULT_SEND_RATE,
+			SendBurst: DEFAULT_SEND_BURST,
+		},
+		Logging: LoggingConfig{Level: "info", Format: "text"},
+		Gateway: GatewayConfig{Listen: DEFAULT_GATEWAY_LISTEN},
+	}
+}
+
+/*
+Reads the config file over the defaults and applies the environment.
+A missing file is only an error if it was asked for explicitly, with
+required; otherwise the legacy address and TLS files are used. Keys
+the file should not have, typos included, are errors
+*/
+func LoadConfig(filename string, required bool) (*Config, error) {
+	config := DefaultConfig()
+
+	file, err := os.Open(filename)
+	switch {
+	case err == nil:
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err := decoder.Decode(config)
+		file.Close()
+		if err != nil && err != io.EOF { // io.EOF: the file is empty
+			return nil, fmt.Errorf("parsing %s: %v", filename, err)
+		}
+		config.file = filename
+	case os.IsNotExist(err) && !required:
+	default:
+		return nil, fmt.Errorf("reading config: %v", err)
+	}
+
+	if err := config.ApplyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+
+	if config.file == "" && len(config.Peers) == 0 {
+		addrs, err := ReadReplicaAddresses(ADDRESS_FILE)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			config.Peers = append(config.Peers, addressString(addr))
+		}
+	}
+	return config, nil
+}
+
+// =================================================
+//  ENVIRONMENT OVERRIDES
+// =================================================
+
+/*
+Applies the MECHAT_* variables read with getenv (os.Getenv outside of
+tests). Empty variables are ignored
+*/
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	var errs []error
+	str := func(name string, field *string) {
+		if value := getenv(name); value != "" {
+			*field = value
+		}
+	}
+	integer := func(name string, field *int) {
+		if value := getenv(name); value != "" {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s=%q: not an integer", name, value))
+				return
+			}
+			*field = n
+		}
+	}
+	duration := func(name string, field *time.Duration) {
+		if value := getenv(name); value != "" {
+			d, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s=%q: not a duration such as 500ms or 5s", name, value))
+				return
+			}
+			*field = d
+		}
+	}
+
+	integer("MECHAT_NODE_ID", &c.Node.ID)
+	duration("MECHAT_CLOCK_OFFSET", &c.Node.ClockOffset)
+	if value := getenv("MECHAT_PEERS"); value != "" { // comma separated
+		c.Peers = nil
+		for _, peer := range strings.Split(value, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				c.Peers = append(c.Peers, peer)
+			}
+		}
+	}
+	str("MECHAT_DATA_DIR", &c.DataDir)
+	str("MECHAT_HTTP_ADDRESS", &c.HTTP.Address)
+	integer("MECHAT_HTTP_PORT_OFFSET", &c.HTTP.PortOffset)
+	duration("MECHAT_HEARTBEAT_INTERVAL", &c.Timeouts.HeartbeatInterval)
+	duration("MECHAT_HEARTBEAT_TIMEOUT", &c.Timeouts.Heartbeat)
+	duration("MECHAT_ELECTION_TIMEOUT", &c.Timeouts.Election)
+	duration("MECHAT_RPC_TIMEOUT", &c.Timeouts.RPC)
+	duration("MECHAT_REPLICATION_TIMEOUT", &c.Timeouts.Replication)
+	integer("MECHAT_REPLICATION_BATCH_SIZE", &c.Replication.BatchSize)
+	integer("MECHAT_MAX_READY_LAG", &c.Replication.MaxReadyLag)
+	if value := getenv("MECHAT_MAX_ATTACHMENT_SIZE"); value != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MECHAT_MAX_ATTACHMENT_SIZE=%q: not an integer", value))
+		} else {
+			c.Attachments.MaxSize = n
+		}
+	}
+	integer("MECHAT_CHUNK_SIZE", &c.Attachments.ChunkSize)
+	integer("MECHAT_SEND_RATE", &c.Limits.SendRate)
+	integer("MECHAT_SEND_BURST", &c.Limits.SendBurst)
+	str("MECHAT_TLS_CONFIG", &c.TLS.ConfigFile)
+	str(LOG_LEVEL_ENV, &c.Logging.Level)
+	str(LOG_FORMAT_ENV, &c.Logging.Format)
+	// either key replaces both from the file
+	if value := getenv("MECHAT_ENCRYPTION_KEY"); value != "" {
+		c.Encryption.Key, c.Encryption.KeyFile = value, ""
+	}
+	if value := getenv("MECHAT_ENCRYPTION_KEY_FILE"); value != "" {
+		c.Encryption.Key, c.Encryption.KeyFile = "", value
+	}
+	if value := getenv("MECHAT_PREVIOUS_ENCRYPTION_KEYS"); value != "" { // comma separated
+		c.Encryption.PreviousKeys = nil
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				c.Encryption.PreviousKeys = append(c.Encryption.PreviousKeys, key)
+			}
+		}
+	}
+	str("MECHAT_GATEWAY_LISTEN", &c.Gateway.Listen)
+
+	return errors.Join(errs...)
+}
+
+// =================================================
+//  VALIDATION
+// =================================================
+
+// Checks the whole configuration, the error lists every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	replicas, err := c.Replicas()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.Peers) == 0 {
+		fail("peers: at least one replica address is required")
+	} else if c.Node.ID < 0 || c.Node.ID >= len(c.Peers) {
+		fail("node.id: %d is not a peer, expected 0 to %d", c.Node.ID, len(c.Peers)-1)
+	}
+	seen := make(map[string]int)
+	for i, addr := range replicas {
+		if j, ok := seen[addressString(addr)]; ok {
+			fail("peers: %s is listed as both replica %d and %d", addressString(addr), j, i)
+		}
+		seen[addressString(addr)] = i
+	}
+
+	if c.DataDir == "" {
+		fail("data_dir: must not be empty")
+	}
+	if c.HTTP.Address != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Address); err != nil {
+			fail("http.address: %v", err)
+		}
+	}
+	for i, addr := range replicas {
+		if c.HTTP.Address == "" && c.HTTP.PortOffset != 0 && int(addr.Port)+c.HTTP.PortOffset > 65535 {
+			fail("http.port_offset: %d puts the HTTP port of replica %d above 65535", c.HTTP.PortOffset, i)
+		}
+	}
+	if c.HTTP.PortOffset < 0 {
+		fail("http.port_offset: must not be negative")
+	}
+
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			fail("timeouts.%s: must be positive, got %s", name, d)
+		}
+	}
+	positive("heartbeat_interval", c.Timeouts.HeartbeatInterval)
+	positive("heartbeat", c.Timeouts.Heartbeat)
+	positive("election", c.Timeouts.Election)
+	positive("rpc", c.Timeouts.RPC)
+	positive("replication", c.Timeouts.Replication)
+	if c.Timeouts.Heartbeat > 0 && c.Timeouts.Heartbeat >= c.Timeouts.HeartbeatInterval {
+		fail("timeouts.heartbeat: %s must be shorter than timeouts.heartbeat_interval (%s)", c.Timeouts.Heartbeat, c.Timeouts.HeartbeatInterval)
+	}
+
+	if c.Replication.BatchSize <= 0 {
+		fail("replication.batch_size: must be positive, got %d", c.Replication.BatchSize)
+	}
+	if c.Replication.MaxReadyLag <= 0 {
+		fail("replication.max_ready_lag: must be positive, got %d", c.Replication.MaxReadyLag)
+	}
+
+	if c.Attachments.MaxSize <= 0 {
+		fail("attachments.max_size: must be positive, got %d", c.Attachments.MaxSize)
+	}
+	if c.Attachments.ChunkSize <= 0 || c.Attachments.ChunkSize > MAX_CHUNK_SIZE {
+		fail("attachments.chunk_size: must be between 1 and %d, got %d", MAX_CHUNK_SIZE, c.Attachments.ChunkSize)
+	}
+
+	if c.Limits.SendRate <= 0 {
+		fail("limits.send_rate: must be positive, got %d", c.Limits.SendRate)
+	}
+	if c.Limits.SendBurst <= 0 {
+		fail("limits.send_burst: must be positive, got %d", c.Limits.SendBurst)
+	}
+
+	if c.TLS.ConfigFile != "" && c.TLS.CAFile != "" {
+		fail("tls: set either config_file or the certificates inline, not both")
+	}
+	if c.TLS.CAFile != "" && len(c.TLS.Replicas) != len(c.Peers) {
+		fail("tls.replicas: %d certificates for %d peers", len(c.TLS.Replicas), len(c.Peers))
+	}
+
+	if _, err := newLogHandler(io.Discard, c.Logging.Level, c.Logging.Format); err != nil {
+		fail("logging: %v", err)
+	}
+	if _, err := c.Keyring(); err != nil {
+		fail("encryption.%v", err)
+	}
+	if _, _, err := net.SplitHostPort(c.Gateway.Listen); err != nil {
+		fail("gateway.listen: %v", err)
+	}
+	if c.Gateway.CallTimeout < 0 {
+		fail("gateway.call_timeout: %s must not be negative", c.Gateway.CallTimeout)
+	}
+	if c.Gateway.Retries < 0 {
+		fail("gateway.retries: %d must not be negative", c.Gateway.Retries)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	source := "configuration"
+	if c.file != "" {
+		source = c.file
+	}
+	return fmt.Errorf("invalid %s:\n%w", source, errors.Join(errs...))
+}
+
+// =================================================
+//  USING THE CONFIGURATION
+// =================================================
+
+// Parsed peer addresses
+func (c *Config) Replicas() ([]ReplicaAddress, error) {
+	var addrs []ReplicaAddress
+	var errs []error
+	for i, peer := range c.Peers {
+		addr, err := ParseReplicaAddress(peer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peers[%d]: %v", i, err))
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, errors.Join(errs...)
+}
+
+// Options for NewServer, the config must be valid
+func (c *Config) ServerOptions() ServerOptions {
+	replicas, _ := c.Replicas()
+	opts := ServerOptions{
+		PID:                  c.Node.ID,
+		Replicas:             replicas,
+		DataDir:              c.DataDir,
+		ClockOffset:          c.Node.ClockOffset,
+		HeartbeatInterval:    c.Timeouts.HeartbeatInterval,
+		HeartbeatTimeout:     c.Timeouts.Heartbeat,
+		ElectionWait:         c.Timeouts.Election,
+		RPCTimeout:           c.Timeouts.RPC,
+		ReplicationTimeout:   c.Timeouts.Replication,
+		ReplicationBatchSize: c.Replication.BatchSize,
+		HTTPAddress:          c.HTTP.Address,
+		MaxReadyLag:          c.Replication.MaxReadyLag,
+		MaxAttachmentSize:    c.Attachments.MaxSize,
+		ChunkSize:            c.Attachments.ChunkSize,
+		SendRate:             c.Limits.SendRate,
+		SendBurst:            c.Limits.SendBurst,
+	}
+	opts.Keyring, _ = c.Keyring()
+	if opts.HTTPAddress == "" && c.HTTP.PortOffset != 0 {
+		addr := replicas[c.Node.ID]
+		opts.HTTPAddress = addressString(ReplicaAddress{addr.Address, addr.Port + uint16(c.HTTP.PortOffset)})
+	}
+	return opts
+}
+
+/*
+TLS settings of the cluster, nil for plain TCP. Relative paths are
+resolved against the file that names them. Without any TLS setting
+tls_config.json is used if it exists
+*/
+func (c *Config) TLSConfigFile() (*TLSConfigFile, error) {
+	if c.TLS.ConfigFile != "" {
+		path := c.TLS.ConfigFile
+		if c.file != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(c.file), path)
+		}
+		tls, err := ReadTLSConfig(path)
+		if err == nil && tls == nil {
+			return nil, fmt.Errorf("tls.config_file: %s does not exist", path)
+		}
+		return tls, err
+	}
+	if c.TLS.CAFile == "" {
+		return ReadTLSConfig(TLS_CONFIG_FILE)
+	}
+	tls := c.TLS.TLSConfigFile
+	tls.Replicas = append([]CertificatePair(nil), tls.Replicas...)
+	tls.resolve(filepath.Dir(c.file))
+	return &tls, nil
+}
+
+/*
+Keys for encryption at rest, nil when no key is set. A relative
+key_file is resolved against the config file
+*/
+func (c *Config) Keyring() (*Keyring, error) {
+	e := c.Encryption
+	if e.Key != "" && e.KeyFile != "" {
+		return nil, fmt.Errorf("key: set either key or key_file, not both")
+	}
+	text := e.Key
+	if e.KeyFile != "" {
+		path := e.KeyFile
+		if c.file != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(c.file), path)
+		}
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("key_file: %v", err)
+		}
+		text = string(bytes)
+	}
+	if text == "" {
+		if len(e.PreviousKeys) > 0 {
+			return nil, fmt.Errorf("previous_keys: set without a current key")
+		}
+		return nil, nil
+	}
+
+	current, err := parseAtRestKey(text)
+	if err != nil {
+		return nil, fmt.Errorf("key: %v", err)
+	}
+	var previous [][]byte
+	for i, text := range e.PreviousKeys {
+		key, err := parseAtRestKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("previous_keys[%d]: %v", i, err)
+		}
+		previous = append(previous, key)
+	}
+	return NewKeyring(current, previous...)
+}
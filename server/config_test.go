@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, text string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "mechat.yaml")
+	writeFile(t, file, `
+node:
+  id: 1
+  clock_offset: 2s
+peers: [10.0.0.1:7000, 10.0.0.2:7000]
+data_dir: /var/lib/mechat
+timeouts:
+  heartbeat_interval: 2s
+  election: 500ms
+replication:
+  batch_size: 20
+tls:
+  ca_file: certs/ca.pem
+  replicas:
+    - {cert_file: certs/r0.pem, key_file: certs/r0-key.pem}
+    - {cert_file: /etc/r1.pem, key_file: /etc/r1-key.pem}
+`)
+
+	config, err := LoadConfig(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := config.ServerOptions()
+	if opts.PID != 1 || len(opts.Replicas) != 2 || opts.Replicas[1] != (ReplicaAddress{"10.0.0.2", 7000}) {
+		t.Errorf("unexpected identity: %+v", opts)
+	}
+	if opts.DataDir != "/var/lib/mechat" || opts.ClockOffset != 2*time.Second {
+		t.Errorf("unexpected node settings: %+v", opts)
+	}
+	if opts.HeartbeatInterval != 2*time.Second || opts.ElectionWait != 500*time.Millisecond || opts.ReplicationBatchSize != 20 {
+		t.Errorf("unexpected timeouts: %+v", opts)
+	}
+	// defaults for what the file leaves out
+	if opts.RPCTimeout != DEFAULT_RPC_TIMEOUT || opts.MaxReadyLag != DEFAULT_MAX_READY_LAG || opts.HTTPAddress != "10.0.0.2:8000" {
+		t.Errorf("defaults not applied: %+v", opts)
+	}
+
+	tls, err := config.TLSConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tls.CAFile != filepath.Join(dir, "certs/ca.pem") || tls.Replicas[1].CertFile != "/etc/r1.pem" {
+		t.Errorf("TLS paths not resolved against the config file: %+v", tls)
+	}
+}
+
+func TestEnvironmentOverridesConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Peers = []string{"127.0.0.1:1"}
+	env := map[string]string{
+		"MECHAT_NODE_ID":                "2",
+		"MECHAT_PEERS":                  "a:1, b:2 ,c:3",
+		"MECHAT_HEARTBEAT_INTERVAL":     "750ms",
+		"MECHAT_REPLICATION_BATCH_SIZE": "5",
+		"MECHAT_LOG_FORMAT":             "json",
+		"MECHAT_DATA_DIR":               "",
+	}
+	if err := config.ApplyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if config.Node.ID != 2 || strings.Join(config.Peers, ",") != "a:1,b:2,c:3" {
+		t.Errorf("identity not overridden: %+v", config)
+	}
+	if config.Timeouts.HeartbeatInterval != 750*time.Millisecond || config.Replication.BatchSize != 5 || config.Logging.Format != "json" {
+		t.Errorf("settings not overridden: %+v", config)
+	}
+	if config.DataDir != "." {
+		t.Errorf("empty variable overrode data_dir: %q", config.DataDir)
+	}
+
+	env = map[string]string{"MECHAT_NODE_ID": "one", "MECHAT_RPC_TIMEOUT": "3"}
+	err := config.ApplyEnv(func(name string) string { return env[name] })
+	if err == nil || !strings.Contains(err.Error(), "MECHAT_NODE_ID") || !strings.Contains(err.Error(), "MECHAT_RPC_TIMEOUT") {
+		t.Errorf("invalid variables not reported: %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "mechat.yaml")
+	writeFile(t, file, `
+peers: [127.0.0.1:5000]
+timeouts:
+  hearbeat: 1s
+`)
+	_, err := LoadConfig(file, true)
+	if err == nil || !strings.Contains(err.Error(), "line 4: field hearbeat not found") {
+		t.Errorf("misspelled key: %v", err)
+	}
+
+	// an empty file leaves the defaults
+	writeFile(t, file, "")
+	config, err := LoadConfig(file, true)
+	if err != nil || config.Timeouts.Heartbeat != DEFAULT_HEARTBEAT_TIMEOUT {
+		t.Errorf("empty file: %+v %v", config, err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := DefaultConfig()
+	config.Node.ID = 3
+	config.Peers = []string{"127.0.0.1:5000", "127.0.0.1:5000", "nohost", "127.0.0.1:70000"}
+	config.Timeouts.Election = 0
+	config.Timeouts.Heartbeat = time.Minute
+	config.Replication.BatchSize = -1
+	config.Logging.Level = "loud"
+	config.Gateway.Listen = "8090"
+	config.Gateway.Retries = -1
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	for _, want := range []string{
+		"peers[2]", "peers[3]", "port must be between 1 and 65535",
+		"listed as both replica 0 and 1",
+		"timeouts.election", "timeouts.heartbeat: 1m0s must be shorter",
+		"replication.batch_size", "invalid log level", "gateway.listen", "gateway.retries",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+
+	config = DefaultConfig()
+	config.Peers = []string{"127.0.0.1:5000"}
+	config.Node.ID = 1
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "node.id: 1 is not a peer") {
+		t.Errorf("node outside of peers: %v", err)
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	dir := t.TempDir()
+	key, old := newKey(), newKey()
+	writeFile(t, filepath.Join(dir, "mechat.key"), base64.StdEncoding.EncodeToString(key)+"\n")
+	file := filepath.Join(dir, "mechat.yaml")
+	writeFile(t, file, `
+peers: [127.0.0.1:5000]
+encryption:
+  key_file: mechat.key
+  previous_keys: [`+base64.StdEncoding.EncodeToString(old)+`]
+`)
+
+	config, err := LoadConfig(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	keys := config.ServerOptions().Keyring
+	if keys == nil || keys.CurrentId() != atRestKeyId(key) || keys.keys[atRestKeyId(old)] == nil {
+		t.Fatalf("key file not read relative to the config: %+v", keys)
+	}
+
+	// a key in the environment replaces the key file
+	env := map[string]string{"MECHAT_ENCRYPTION_KEY": base64.StdEncoding.EncodeToString(old), "MECHAT_PREVIOUS_ENCRYPTION_KEYS": ""}
+	if err := config.ApplyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := config.Keyring(); err != nil || keys.CurrentId() != atRestKeyId(old) {
+		t.Errorf("key not overridden: %v", err)
+	}
+
+	config.Encryption = EncryptionConfig{Key: "c2hvcnQ=", PreviousKeys: []string{"not base64!"}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "encryption.key: must be 32 bytes") {
+		t.Errorf("short key: %v", err)
+	}
+	config.Encryption = EncryptionConfig{PreviousKeys: []string{base64.StdEncoding.EncodeToString(old)}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "encryption.previous_keys") {
+		t.Errorf("previous key without a current one: %v", err)
+	}
+	config.Encryption = EncryptionConfig{}
+	if keys, err := config.Keyring(); keys != nil || err != nil {
+		t.Errorf("keyring without a key: %v", err)
+	}
+}
+
+func TestReadReplicaAddresses(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.txt")
+	writeFile(t, good, "127.0.0.1:12345\r\n127.0.0.1:12346\n\n")
+	addrs, err := ReadReplicaAddresses(good)
+	if err != nil || len(addrs) != 2 || addrs[1].Port != 12346 {
+		t.Errorf("ReadReplicaAddresses = %v, %v", addrs, err)
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	writeFile(t, bad, "127.0.0.1:12345\n127.0.0.1\n")
+	if _, err := ReadReplicaAddresses(bad); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("malformed line not reported: %v", err)
+	}
+	if _, err := ReadReplicaAddresses(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("missing file not reported")
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	config, err := LoadConfig("mechat.example.yaml", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Contacts and pending requests of a user as seen by node i
+func getContacts(t *testing.T, c *testCluster, i int, user int) Contacts {
+	t.Helper()
+	var contacts Contacts
+	if err := c.client(i).Call("MessageHandler.GetContacts", &UserProfile{UserId: user}, &contacts); err != nil {
+		t.Fatal(err)
+	}
+	return contacts
+}
+
+func userIds(profiles []UserProfile) []int {
+	ids := []int{}
+	for _, p := range profiles {
+		ids = append(ids, p.UserId)
+	}
+	return ids
+}
+
+func TestContactRequests(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		c.createUser(leader, email)
+	}
+
+	request := func(user int, contact int) (string, error) {
+		var resp RPCResponse
+		err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: user, ContactId: contact}, &resp)
+		return resp.Message, err
+	}
+	respond := func(user int, contact int, answer string) error {
+		var resp RPCResponse
+		return c.client(leader).Call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: user, ContactId: contact, Response: answer}, &resp)
+	}
+
+	if status, err := request(1, 2); err != nil || status != CONTACT_PENDING {
+		t.Fatalf("request 1 -> 2: %q %v", status, err)
+	}
+	if _, err := request(1, 2); err == nil || !strings.Contains(err.Error(), "already sent") {
+		t.Errorf("duplicate request: %v", err)
+	}
+	if _, err := request(1, 1); err == nil {
+		t.Error("request to self accepted")
+	}
+	if _, err := request(1, 42); err == nil {
+		t.Error("request to unknown user accepted")
+	}
+
+	got := getContacts(t, c, leader, 2)
+	if len(got.ContactList) != 0 || len(got.Pending) != 1 || got.Pending[0].UserId != 1 {
+		t.Fatalf("user 2 before answering: %+v", got)
+	}
+	if len(getContacts(t, c, leader, 1).Pending) != 0 {
+		t.Error("outgoing request listed as incoming")
+	}
+	if err := respond(2, 1, "maybe"); err == nil {
+		t.Error("unknown response accepted")
+	}
+	if err := respond(1, 2, CONTACT_ACCEPTED); err == nil {
+		t.Error("sender answered their own request")
+	}
+	if err := respond(2, 1, CONTACT_ACCEPTED); err != nil {
+		t.Fatal(err)
+	}
+
+	// declined requests may be sent again, blocked ones may not
+	request(3, 1)
+	if err := respond(1, 3, CONTACT_DECLINED); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := request(3, 1); err != nil || status != CONTACT_PENDING {
+		t.Fatalf("request after decline: %q %v", status, err)
+	}
+	if err := respond(1, 3, CONTACT_BLOCKED); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(3, 1); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("request after block: %v", err)
+	}
+
+	// asking someone who already asked you accepts their request
+	request(2, 3)
+	if status, err := request(3, 2); err != nil || status != CONTACT_ACCEPTED {
+		t.Fatalf("crossing requests: %q %v", status, err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	want := map[int][]int{1: {2}, 2: {1, 3}, 3: {2}}
+	for user, ids := range want {
+		got := getContacts(t, c, 0, user)
+		if !slices.Equal(userIds(got.ContactList), ids) || len(got.Pending) != 0 {
+			t.Errorf("user %d on follower: contacts %v pending %v, want contacts %v", user, userIds(got.ContactList), userIds(got.Pending), ids)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+/*
+Devices and sync cursors.
+
+A user logging in through LoginDevice registers a device, or resumes
+one it registered before. Each device has a cursor into the user's
+change feed, the changes table. Triggers append a row to it for every
+message sent, edited, deleted or reacted to and every contact change
+that concerns a user with at least one device, so the feed is derived
+from the log and identical on every replica.
+
+Sync returns the changes after the device's cursor: the current state
+of each changed message and contact. The device acknowledges them by
+sending the returned cursor with its next Sync, only then is the cursor
+stored, through the log. A reply lost on the way is sent again. Rows
+every device of the user acknowledged are dropped (trigger
+changes_delivered).
+
+A new device starts at the end of the feed, it loads the existing
+chats with GetContacts and GetMessages and syncs from there. Revoking
+a device deletes it. Every RPC naming a device goes through
+checkDevice, so a revoked device fails with "no such device" in Sync,
+RevokeDevice and LoginDevice alike; it logs in again without its
+DeviceId and is registered as a new device.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	DEFAULT_SYNC_LIMIT = 200 // changes per Sync
+	MAX_SYNC_LIMIT     = 1000
+	MAX_DEVICE_NAME    = 100
+)
+
+// incoming contact request, in ContactChange
+const CONTACT_REQUESTED = "requested"
+
+// JSON object, logs in and registers or resumes a device
+type DeviceLoginRequest struct {
+	Email      string
+	Password   string // SHA-256 digest, as in Login
+	DeviceId   string // optional, a device registered before
+	DeviceName string // optional, shown in ListDevices
+}
+
+// JSON object, the reply to DeviceLoginRequest
+type DeviceSession struct {
+	Profile  UserProfile
+	DeviceId string
+	Cursor   int64 // position in the change feed, see Sync
+}
+
+// JSON object, a registered device
+type DeviceInfo struct {
+	DeviceId string
+	Name     string
+	Cursor   int64
+	Created  string // HLC of the login that registered it
+	LastSeen string // HLC of its last login or acknowledged sync
+}
+
+// JSON object, the devices of a user
+type DeviceList struct {
+	Devices []DeviceInfo
+}
+
+// JSON object, names a device of UserId
+type DeviceRequest struct {
+	UserId   int
+	DeviceId string
+}
+
+// JSON object, asks for the changes after Cursor
+type SyncRequest struct {
+	UserId   int
+	DeviceId string
+	Cursor   int64 // the last cursor the device received, acknowledges it
+	Limit    int   // changes at most, DEFAULT_SYNC_LIMIT when 0
+}
+
+/*
+JSON object, a contact whose status changed. Status is CONTACT_ACCEPTED,
+CONTACT_PENDING (the user asked), CONTACT_REQUESTED (the contact asked),
+CONTACT_BLOCKED (the user blocked the contact) or empty when nothing is
+left between the two
+*/
+type ContactChange struct {
+	Contact UserProfile
+	Status  string
+	KeyId   string // public key of the contact, a new one means it changed, see e2e.go
+}
+
+// JSON object, the reply to SyncRequest
+type SyncResult struct {
+	Messages []ChatMessage   // current state of new, edited and deleted messages
+	Contacts []ContactChange // current status of changed contacts
+	Cursor   int64           // acknowledge with the next Sync
+	More     bool            // more changes follow, sync again
+}
+
+func newDeviceId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Stored cursor of a device of user, found is false for an unknown device
+func (t *MessageHandler) deviceCursor(user int, device string) (cursor int64, found bool, err error) {
+	rows, err := t.server.Query(`SELECT sync_cursor FROM devices WHERE device_id = ? AND userid = ?`, device, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, false, nil
+	}
+	if err := rows.Scan(&cursor); err != nil {
+		t.server.logger.Error("Scan failed", "err", err)
+		return 0, false, err
+	}
+	return cursor, true, nil
+}
+
+// deviceCursor for a device that must exist, the check of every RPC naming a device
+func (t *MessageHandler) checkDevice(user int, device string) (int64, error) {
+	cursor, found, err := t.deviceCursor(user, device)
+	if err == nil && !found {
+		err = fmt.Errorf("no such device")
+	}
+	return cursor, err
+}
+
+// Last row of the change feed, 0 when it is empty
+func (t *MessageHandler) feedEnd() (int64, error) {
+	rows, err := t.server.Query(`SELECT COALESCE(MAX(rec_id), 0) FROM changes`)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	var end int64
+	if rows.Next() {
+		if err := rows.Scan(&end); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return 0, err
+		}
+	}
+	return end, rows.Err()
+}
+
+// RPC: checks the password like Login, then registers or resumes a device
+func (t *MessageHandler) LoginDevice(message *DeviceLoginRequest, session *DeviceSession) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		return fmt.Errorf("not the leader node")
+	}
+	if len(message.DeviceName) > MAX_DEVICE_NAME {
+		return fmt.Errorf("device name is longer than %d bytes", MAX_DEVICE_NAME)
+	}
+
+	profiles, err := t.queryProfiles(`SELECT userid, email, firstname, lastname, descr
+				FROM users WHERE email = ? AND deleted = 0`, message.Email)
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("no such user")
+	}
+	user := profiles[0].UserId
+	if _, err := t.checkPassword(user, message.Password); err != nil {
+		return err
+	}
+
+	stamp := t.server.Clock.Now().String()
+	session.Profile = profiles[0]
+
+	// a revoked device is not resumed, it logs in without DeviceId
+	if message.DeviceId != "" {
+		cursor, err := t.checkDevice(user, message.DeviceId)
+		if err != nil {
+			return err
+		}
+		_, err = t.execReplicated(`UPDATE devices SET seen_hlc = ?, name = COALESCE(NULLIF(?, ''), name)
+				WHERE device_id = ? AND userid = ?`, stamp, message.DeviceName, message.DeviceId, user)
+		if err != nil {
+			t.server.logger.Error("Error resuming device", "err", err)
+			return err
+		}
+		session.DeviceId, session.Cursor = message.DeviceId, cursor
+		t.server.logger.Info("Device logged in", "user", user, "device", message.DeviceId)
+		return nil
+	}
+
+	// the feed ends at the same row on every replica
+	device := newDeviceId()
+	_, err = t.execReplicated(`INSERT INTO devices (device_id, userid, name, sync_cursor, created_hlc, seen_hlc)
+				VALUES (?, ?, ?, (SELECT COALESCE(MAX(rec_id), 0) FROM changes), ?, ?)`,
+		device, user, message.DeviceName, stamp, stamp)
+	if err != nil {
+		t.server.logger.Error("Error registering device", "err", err)
+		return err
+	}
+	cursor, err := t.checkDevice(user, device)
+	if err != nil {
+		return err
+	}
+	session.DeviceId, session.Cursor = device, cursor
+	t.server.logger.Info("Registered device", "user", user, "device", device)
+	return nil
+}
+
+// RPC: the devices of a user, oldest first
+func (t *MessageHandler) ListDevices(message *UserProfile, devices *DeviceList) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rows, err := t.server.Query(`SELECT device_id, COALESCE(name, ''), sync_cursor, created_hlc, seen_hlc
+				FROM devices WHERE userid = ? ORDER BY created_hlc`, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	devices.Devices = []DeviceInfo{}
+	for rows.Next() {
+		var device DeviceInfo
+		if err := rows.Scan(&device.DeviceId, &device.Name, &device.Cursor, &device.Created, &device.LastSeen); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return err
+		}
+		devices.Devices = append(devices.Devices, device)
+	}
+	return rows.Err()
+}
+
+// RPC: revokes a device, it has to log in again
+func (t *MessageHandler) RevokeDevice(message *DeviceRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if _, err := t.checkDevice(message.UserId, message.DeviceId); err != nil {
+		response.Message = "error"
+		return err
+	}
+
+	_, err := t.execReplicated(`DELETE FROM devices WHERE device_id = ? AND userid = ?`, message.DeviceId, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Error revoking device", "err", err)
+		response.Message = "error"
+		return err
+	}
+	t.server.logger.Info("Revoked device", "user", message.UserId, "device", message.DeviceId)
+	response.Message = "ACK"
+	return nil
+}
+
+/*
+RPC: Acknowledges Cursor, then returns the changes after it. Sync runs
+on the leader, the acknowledged cursor is replicated
+*/
+func (t *MessageHandler) Sync(message *SyncRequest, result *SyncResult) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		return fmt.Errorf("not the leader node")
+	}
+	limit := message.Limit
+	if limit <= 0 {
+		limit = DEFAULT_SYNC_LIMIT
+	}
+	limit = min(limit, MAX_SYNC_LIMIT)
+
+	cursor, err := t.checkDevice(message.UserId, message.DeviceId)
+	if err != nil {
+		return err
+	}
+
+	// only a cursor the feed reached can be acknowledged, an
+	// acknowledgement that moves nothing is not logged
+	end, err := t.feedEnd()
+	if err != nil {
+		return err
+	}
+	if message.Cursor > cursor && message.Cursor <= end {
+		_, err := t.execReplicated(`UPDATE devices SET sync_cursor = ?, seen_hlc = ?
+				WHERE device_id = ? AND userid = ? AND sync_cursor < ?`,
+			message.Cursor, t.server.Clock.Now().String(), message.DeviceId, message.UserId, message.Cursor)
+		if err != nil {
+			t.server.logger.Error("Error storing cursor", "err", err)
+			return err
+		}
+		if cursor, err = t.checkDevice(message.UserId, message.DeviceId); err != nil {
+			return err
+		}
+	}
+
+	rows, err := t.server.Query(`SELECT rec_id, COALESCE(message_hlc, ''), COALESCE(contactid, 0)
+				FROM changes WHERE userid = ? AND rec_id > ?
+				ORDER BY rec_id LIMIT ?`, message.UserId, cursor, limit+1)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	var hlcs []any
+	var contacts []int
+	seenMessage, seenContact := map[string]bool{}, map[int]bool{}
+	result.Cursor = cursor
+	result.More = false
+	for n := 0; rows.Next(); n++ {
+		if n == limit {
+			result.More = true
+			break
+		}
+		var id int64
+		var hlc string
+		var contact int
+		if err := rows.Scan(&id, &hlc, &contact); err != nil {
+			rows.Close()
+			t.server.logger.Error("Scan failed", "err", err)
+			return err
+		}
+		result.Cursor = id
+		switch {
+		case hlc != "" && !seenMessage[hlc]:
+			seenMessage[hlc] = true
+			hlcs = append(hlcs, hlc)
+		case contact != 0 && !seenContact[contact]:
+			seenContact[contact] = true
+			contacts = append(contacts, contact)
+		}
+	}
+	rows.Close()
+
+	result.Messages = []ChatMessage{}
+	if len(hlcs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(hlcs)), ", ")
+		result.Messages, err = t.queryMessages(message.UserId, `WHERE M.hlc IN (`+placeholders+`) ORDER BY M.hlc, M.rec_id`, hlcs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	result.Contacts = []ContactChange{}
+	for _, contact := range contacts {
+		change, err := t.contactChange(message.UserId, contact)
+		if err != nil {
+			return err
+		}
+		result.Contacts = append(result.Contacts, change)
+	}
+	return nil
+}
+
+// Status of contact as seen by user, a block by the contact is not shown
+func (t *MessageHandler) contactChange(user int, contact int) (ContactChange, error) {
+	change := ContactChange{Contact: UserProfile{UserId: contact}}
+	profiles, err := t.queryProfiles(`SELECT userid, COALESCE(email, ''), firstname, lastname, descr
+				FROM users WHERE userid = ?`, contact)
+	if err != nil {
+		return change, err
+	}
+	if len(profiles) > 0 {
+		change.Contact = profiles[0]
+	}
+
+	key, _, err := t.publicKey(contact)
+	if err != nil {
+		return change, err
+	}
+	change.KeyId = key.KeyId
+
+	mine, err := t.contactStatus(user, contact)
+	if err != nil {
+		return change, err
+	}
+	theirs, err := t.contactStatus(contact, user)
+	if err != nil {
+		return change, err
+	}
+
+	switch {
+	case mine == CONTACT_ACCEPTED:
+		change.Status = CONTACT_ACCEPTED
+	case theirs == CONTACT_BLOCKED:
+		change.Status = CONTACT_BLOCKED
+	case mine == CONTACT_PENDING, mine == CONTACT_DECLINED:
+		// a declined request looks pending to the user who sent it
+		change.Status = CONTACT_PENDING
+	case theirs == CONTACT_PENDING:
+		change.Status = CONTACT_REQUESTED
+	}
+	return change, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func loginDevice(t *testing.T, c *testCluster, i int, email string, device string) DeviceSession {
+	t.Helper()
+	var session DeviceSession
+	login := DeviceLoginRequest{Email: email, Password: "digest", DeviceId: device, DeviceName: "browser"}
+	if err := c.client(i).Call("MessageHandler.LoginDevice", &login, &session); err != nil {
+		t.Fatalf("logging in %s: %v", email, err)
+	}
+	return session
+}
+
+func syncDevice(t *testing.T, c *testCluster, i int, user int, device string, cursor int64) SyncResult {
+	t.Helper()
+	var result SyncResult
+	if err := c.client(i).Call("MessageHandler.Sync", &SyncRequest{UserId: user, DeviceId: device, Cursor: cursor}, &result); err != nil {
+		t.Fatalf("syncing device %s: %v", device, err)
+	}
+	return result
+}
+
+func TestDeviceSync(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.sendMessage(leader, 1, 2, "before any device")
+
+	var wrong DeviceSession
+	if err := c.client(leader).Call("MessageHandler.LoginDevice", &DeviceLoginRequest{Email: "a@example.com", Password: "wrong"}, &wrong); err == nil {
+		t.Error("device registered with a wrong password")
+	}
+
+	phone := loginDevice(t, c, leader, "a@example.com", "")
+	laptop := loginDevice(t, c, leader, "a@example.com", "")
+	if phone.Profile.UserId != 1 || phone.DeviceId == "" || phone.DeviceId == laptop.DeviceId {
+		t.Fatalf("device sessions: %+v %+v", phone, laptop)
+	}
+	if again := loginDevice(t, c, leader, "a@example.com", phone.DeviceId); again.DeviceId != phone.DeviceId {
+		t.Errorf("device not resumed: %+v", again)
+	}
+
+	// a new device starts after the existing history
+	result := syncDevice(t, c, leader, 1, phone.DeviceId, phone.Cursor)
+	if len(result.Messages) != 0 || len(result.Contacts) != 0 {
+		t.Errorf("new device got old changes: %+v", result)
+	}
+
+	c.sendMessage(leader, 2, 1, "hello")
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 2, ContactId: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	result = syncDevice(t, c, leader, 1, phone.DeviceId, phone.Cursor)
+	if len(result.Messages) != 1 || result.Messages[0].Message != "hello" {
+		t.Fatalf("synced messages: %+v", result.Messages)
+	}
+	if len(result.Contacts) != 1 || result.Contacts[0].Contact.UserId != 2 || result.Contacts[0].Status != CONTACT_REQUESTED {
+		t.Fatalf("synced contacts: %+v", result.Contacts)
+	}
+
+	// not acknowledged yet, the same changes again
+	repeat := syncDevice(t, c, leader, 1, phone.DeviceId, phone.Cursor)
+	if len(repeat.Messages) != 1 || repeat.Cursor != result.Cursor {
+		t.Errorf("unacknowledged changes not repeated: %+v", repeat)
+	}
+
+	hlc := result.Messages[0].HLC
+	cursor := result.Cursor
+	if err := c.client(leader).Call("MessageHandler.EditMessage", &EditMessageRequest{UserId: 2, HLC: hlc, Message: "hello!"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	result = syncDevice(t, c, leader, 1, phone.DeviceId, cursor)
+	if len(result.Messages) != 1 || result.Messages[0].Message != "hello!" || !result.Messages[0].Edited {
+		t.Fatalf("synced edit: %+v", result.Messages)
+	}
+	if len(result.Contacts) != 0 {
+		t.Errorf("acknowledged contact synced again: %+v", result.Contacts)
+	}
+
+	// acknowledging the stored cursor again, or one past the feed, logs nothing
+	index := c.node(leader).LogIndex()
+	syncDevice(t, c, leader, 1, phone.DeviceId, cursor)
+	syncDevice(t, c, leader, 1, phone.DeviceId, result.Cursor+1000)
+	if after := c.node(leader).LogIndex(); after != index {
+		t.Errorf("empty acknowledgements logged, index %d to %d", index, after)
+	}
+
+	// the other device has its own cursor
+	other := syncDevice(t, c, leader, 1, laptop.DeviceId, laptop.Cursor)
+	if len(other.Messages) != 1 || other.Messages[0].Message != "hello!" || len(other.Contacts) != 1 {
+		t.Errorf("second device: %+v", other)
+	}
+
+	var devices DeviceList
+	if err := c.client(leader).Call("MessageHandler.ListDevices", &UserProfile{UserId: 1}, &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices.Devices) != 2 || devices.Devices[0].DeviceId != phone.DeviceId || devices.Devices[0].Cursor != cursor {
+		t.Errorf("devices: %+v", devices.Devices)
+	}
+
+	if err := c.client(leader).Call("MessageHandler.RevokeDevice", &DeviceRequest{UserId: 2, DeviceId: laptop.DeviceId}, &resp); err == nil {
+		t.Error("device revoked by another user")
+	}
+	if err := c.client(leader).Call("MessageHandler.RevokeDevice", &DeviceRequest{UserId: 1, DeviceId: laptop.DeviceId}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var revoked SyncResult
+	err := c.client(leader).Call("MessageHandler.Sync", &SyncRequest{UserId: 1, DeviceId: laptop.DeviceId}, &revoked)
+	if err == nil || !strings.Contains(err.Error(), "no such device") {
+		t.Errorf("revoked device synced: %v", err)
+	}
+	var resumed DeviceSession
+	login := DeviceLoginRequest{Email: "a@example.com", Password: "digest", DeviceId: laptop.DeviceId}
+	if err := c.client(leader).Call("MessageHandler.LoginDevice", &login, &resumed); err == nil || !strings.Contains(err.Error(), "no such device") {
+		t.Errorf("revoked device resumed: %+v %v", resumed, err)
+	}
+	if err := c.client(leader).Call("MessageHandler.RevokeDevice", &DeviceRequest{UserId: 1, DeviceId: laptop.DeviceId}, &resp); err == nil {
+		t.Error("device revoked twice")
+	}
+	if fresh := loginDevice(t, c, leader, "a@example.com", ""); fresh.DeviceId == laptop.DeviceId {
+		t.Errorf("revoked device id registered again: %+v", fresh)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+}
+
+func TestSyncCursorSurvivesFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+
+	session := loginDevice(t, c, leader, "a@example.com", "")
+	c.sendMessage(leader, 2, 1, "one")
+	first := syncDevice(t, c, leader, 1, session.DeviceId, session.Cursor)
+	c.sendMessage(leader, 2, 1, "two")
+	if second := syncDevice(t, c, leader, 1, session.DeviceId, first.Cursor); len(second.Messages) != 1 {
+		t.Fatalf("second sync: %+v", second.Messages)
+	}
+
+	others := []int{}
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	c.waitForConsistency(5*time.Second, leader, others...)
+	c.crash(leader)
+	next := c.waitForLeader(10*time.Second, others...)
+
+	// the acknowledged cursor was replicated, "one" is not sent again
+	result := syncDevice(t, c, next, 1, session.DeviceId, 0)
+	if len(result.Messages) != 1 || result.Messages[0].Message != "two" {
+		t.Errorf("sync on the new leader: %+v", result.Messages)
+	}
+}
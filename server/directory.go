@@ -0,0 +1,136 @@
+package main
+
+/*
+User directory.
+
+Lists users someone could add as a contact: everyone except the user
+themselves, their contacts, users they blocked or who blocked them,
+and users who opted out of discovery. Results are ordered by user ID
+and paged with a cursor, the last user ID of the previous page.
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DEFAULT_DIRECTORY_PAGE = 20
+	MAX_DIRECTORY_PAGE     = 100
+)
+
+// JSON object, a directory search
+type DirectoryRequest struct {
+	UserId int    // who is searching
+	Query  string // prefix of the first name, last name, full name or email, empty for everyone
+	Limit  int    // users per page, 0 means DEFAULT_DIRECTORY_PAGE
+	After  int    // cursor, Next of the previous page
+}
+
+// JSON object, one page of the directory
+type Directory struct {
+	Users []UserProfile
+	Next  int // cursor for the next page, 0 on the last page
+}
+
+// JSON object, opts a user in or out of the directory
+type DiscoverableRequest struct {
+	UserId       int
+	Discoverable bool
+}
+
+// escapes the LIKE wildcards so the query is matched literally
+func likePrefix(query string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query)
+	return escaped + "%"
+}
+
+// One page of the directory for the request
+func (t *MessageHandler) searchUsers(message *DirectoryRequest) (Directory, error) {
+	limit := message.Limit
+	if limit <= 0 {
+		limit = DEFAULT_DIRECTORY_PAGE
+	}
+	limit = min(limit, MAX_DIRECTORY_PAGE)
+
+	query := `SELECT
+                U.userid,
+                U.email,
+                U.firstname,
+                U.lastname,
+                U.descr
+                FROM users U
+                WHERE U.userid != ?
+                AND U.userid > ?
+                AND U.discoverable = 1
+                AND (U.firstname LIKE ? ESCAPE '\'
+                    OR U.lastname LIKE ? ESCAPE '\'
+                    OR U.firstname || ' ' || U.lastname LIKE ? ESCAPE '\'
+                    OR U.email LIKE ? ESCAPE '\')
+                AND NOT EXISTS (SELECT 1 FROM contacts C
+                    WHERE (C.userid = ? AND C.contactid = U.userid AND C.status = 'accepted')
+                    OR (C.status = 'blocked'
+                        AND ((C.userid = U.userid AND C.contactid = ?)
+                            OR (C.userid = ? AND C.contactid = U.userid))))
+                ORDER BY U.userid
+                LIMIT ?`
+
+	pattern := likePrefix(strings.TrimSpace(message.Query))
+	user := message.UserId
+	// one extra row tells whether there is a next page
+	users, err := t.queryProfiles(query, user, message.After, pattern, pattern, pattern, pattern, user, user, user, limit+1)
+	if err != nil {
+		return Directory{}, err
+	}
+
+	page := Directory{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.Next = page.Users[limit-1].UserId
+	}
+	return page, nil
+}
+
+// RPC: searches the directory, see DirectoryRequest
+func (t *MessageHandler) SearchUsers(message *DirectoryRequest, page *Directory) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result, err := t.searchUsers(message)
+	if err != nil {
+		return err
+	}
+	*page = result
+	return nil
+}
+
+// RPC: hides the user from the directory of others, or shows them again
+func (t *MessageHandler) SetDiscoverable(message *DiscoverableRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	discoverable := 0
+	if message.Discoverable {
+		discoverable = 1
+	}
+	result, err := t.execReplicated(`UPDATE users SET discoverable = ?
+				WHERE userid = ? AND deleted = 0`, discoverable, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Error updating user", "err", err)
+		response.Message = "error"
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		response.Message = "error"
+		return fmt.Errorf("no such user")
+	}
+
+	response.Message = "ACK"
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSearchUsers(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	people := []CreateAccountMessage{
+		{Email: "me@example.com", Firstname: "Me", Lastname: "Myself"},
+		{Email: "alice@example.com", Firstname: "Alice", Lastname: "Archer"},
+		{Email: "bob@example.com", Firstname: "Bob", Lastname: "Baker"},
+		{Email: "carol@example.com", Firstname: "Carol", Lastname: "Alston"},
+		{Email: "dave@example.com", Firstname: "Dave", Lastname: "Dane"},
+		{Email: "erin@example.com", Firstname: "Erin", Lastname: "East"},
+		{Email: "frank@example.com", Firstname: "Frank", Lastname: "Fox"},
+	}
+	for _, p := range people {
+		var resp RPCResponse
+		p.Password = "digest"
+		if err := c.client(leader).Call("MessageHandler.CreateAccount", &p, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var resp RPCResponse
+	call := func(method string, args any) {
+		t.Helper()
+		if err := c.client(leader).Call(method, args, &resp); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+	}
+	// 2 is a contact, 5 is blocked, 6 opted out
+	call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 1, ContactId: 2})
+	call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: 2, ContactId: 1, Response: CONTACT_ACCEPTED})
+	call("MessageHandler.BlockUser", &BlockUserRequest{UserId: 5, BlockedId: 1})
+	call("MessageHandler.SetDiscoverable", &DiscoverableRequest{UserId: 6, Discoverable: false})
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+
+	search := func(req DirectoryRequest) ([]int, int) {
+		t.Helper()
+		var page Directory
+		if err := c.client(0).Call("MessageHandler.SearchUsers", &req, &page); err != nil {
+			t.Fatal(err)
+		}
+		return userIds(page.Users), page.Next
+	}
+
+	// paging through everyone
+	var all []int
+	next := 0
+	for pages := 0; ; pages++ {
+		ids, n := search(DirectoryRequest{UserId: 1, Limit: 2, After: next})
+		all = append(all, ids...)
+		if n == 0 {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("paging does not end")
+		}
+		next = n
+	}
+	if !slices.Equal(all, []int{3, 4, 7}) {
+		t.Errorf("directory of user 1: %v", all)
+	}
+
+	cases := []struct {
+		query string
+		want  []int
+	}{
+		{"b", []int{3}},         // first or last name
+		{"CAROL@", []int{4}},    // email, any case
+		{"carol als", []int{4}}, // full name
+		{"al", []int{4}},        // alice is a contact
+		{"dave", []int{}},       // blocked
+		{"erin", []int{}},       // opted out
+		{"%", []int{}},          // wildcards match literally
+		{"  fr  ", []int{7}},
+	}
+	for _, tc := range cases {
+		if ids, _ := search(DirectoryRequest{UserId: 1, Query: tc.query}); !slices.Equal(ids, tc.want) {
+			t.Errorf("query %q: got %v, want %v", tc.query, ids, tc.want)
+		}
+	}
+
+	var legacy Contacts
+	if err := c.client(0).Call("MessageHandler.GetAllUsers", &UserProfile{UserId: 2}, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIds(legacy.ContactList); !slices.Equal(ids, []int{3, 4, 5, 7}) {
+		t.Errorf("all users for user 2: %v", ids)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+/*
+End-to-end encrypted direct messages.
+
+Encryption is optional and done by clients, the replicas only see
+ciphertext. Each user registers an X25519 public key with
+RegisterPublicKey; the private key never leaves the user's client.
+A key is identified by its key ID, the first 16 hex digits of the
+SHA-256 of the key.
+
+An encrypted message has Encrypted set and its text is an envelope,
+the JSON object Envelope. The sender picks a random 32-byte content
+key and seals the text with AES-256-GCM under it, with the additional
+data "mechat e2e v1 <from> <to>" so the text cannot be moved to
+another chat. The content key is then wrapped for the recipient's key
+and, so the sender's other devices can read it, for the sender's own:
+
+ 1. generate an ephemeral X25519 key pair
+ 2. shared = X25519(ephemeral private key, recipient public key)
+ 3. wrapping key = HKDF-SHA256(shared, salt = ephemeral public key
+    || recipient public key, info = "mechat e2e v1 key wrap"), 32 bytes
+ 4. seal the content key with AES-256-GCM under the wrapping key
+
+Clients seal and open envelopes, and so does the gateway for users
+whose keys it keeps, see SealEnvelope and OpenEnvelope in
+client/back/e2e.go. The replicas never hold a private key.
+
+SaveMessage and EditMessage only check the envelope's shape and that
+it is wrapped for the recipient's current key, so a sender holding an
+old key is told to fetch the new one. Registering a new key appends a
+change for the owner's accepted contacts, Sync then reports the new
+KeyId in ContactChange: that is the key-change notification.
+
+Attachments, timestamps and who talks to whom are not encrypted.
+Reported encrypted messages reach moderators as ciphertext.
+*/
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ENVELOPE_VERSION  = 1
+	MAX_ENVELOPE_KEYS = 8
+	KEY_ID_LENGTH     = 16 // hex digits
+)
+
+// JSON object, registers the X25519 public key of UserId
+type PublicKeyRequest struct {
+	UserId    int
+	PublicKey string // base64, 32 bytes
+}
+
+// JSON object, asks for the public key of ContactId
+type GetPublicKeyRequest struct {
+	UserId    int
+	ContactId int
+}
+
+// JSON object, the registered key of a user
+type PublicKeyInfo struct {
+	UserId     int
+	PublicKey  string // base64
+	KeyId      string
+	Registered string // HLC of the registration
+}
+
+// Encrypted text of a message, stored as JSON in messages.message
+type Envelope struct {
+	Version    int          `json:"v"`
+	Nonce      string       `json:"nonce"` // base64, 12 bytes
+	Ciphertext string       `json:"ct"`    // base64, AES-256-GCM of the text
+	Keys       []WrappedKey `json:"keys"`
+}
+
+// The content key of an envelope, sealed for one public key
+type WrappedKey struct {
+	KeyId     string `json:"kid"`
+	Ephemeral string `json:"epk"`   // base64, 32 bytes
+	Nonce     string `json:"nonce"` // base64, 12 bytes
+	Key       string `json:"key"`   // base64, 32 bytes and the GCM tag
+}
+
+// ID of a public key, as used in WrappedKey
+func publicKeyId(key []byte) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:])[:KEY_ID_LENGTH]
+}
+
+// Whether text is base64 of exactly size bytes, or at least size when atLeast
+func base64Size(text string, size int, atLeast bool) bool {
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return false
+	}
+	return len(decoded) == size || atLeast && len(decoded) > size
+}
+
+// Checks the shape of an envelope, it must be wrapped for keyId
+func checkEnvelope(text string, keyId string) error {
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+		return fmt.Errorf("encrypted message is not an envelope")
+	}
+	if envelope.Version != ENVELOPE_VERSION {
+		return fmt.Errorf("envelope version %d is not supported", envelope.Version)
+	}
+	if !base64Size(envelope.Nonce, 12, false) || !base64Size(envelope.Ciphertext, 16, true) {
+		return fmt.Errorf("envelope nonce or ciphertext is malformed")
+	}
+	if len(envelope.Keys) == 0 || len(envelope.Keys) > MAX_ENVELOPE_KEYS {
+		return fmt.Errorf("envelope must have 1 to %d keys", MAX_ENVELOPE_KEYS)
+	}
+
+	wrapped := false
+	for _, key := range envelope.Keys {
+		if len(key.KeyId) != KEY_ID_LENGTH || !base64Size(key.Ephemeral, 32, false) ||
+			!base64Size(key.Nonce, 12, false) || !base64Size(key.Key, 48, false) {
+			return fmt.Errorf("envelope key is malformed")
+		}
+		wrapped = wrapped || key.KeyId == keyId
+	}
+	if !wrapped {
+		return fmt.Errorf("recipient public key changed, fetch it again")
+	}
+	return nil
+}
+
+// Registered key of user, found is false when they have none
+func (t *MessageHandler) publicKey(user int) (info PublicKeyInfo, found bool, err error) {
+	rows, err := t.server.Query(`SELECT userid, public_key, key_id, registered_hlc FROM public_keys WHERE userid = ?`, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return info, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return info, false, nil
+	}
+	if err := rows.Scan(&info.UserId, &info.PublicKey, &info.KeyId, &info.Registered); err != nil {
+		t.server.logger.Error("Scan failed", "err", err)
+		return info, false, err
+	}
+	return info, true, nil
+}
+
+// Checks an encrypted text sent to user
+func (t *MessageHandler) checkEncrypted(to int, text string) error {
+	key, found, err := t.publicKey(to)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("recipient has no public key")
+	}
+	return checkEnvelope(text, key.KeyId)
+}
+
+// RPC: registers or replaces the public key of a user, replies with its key ID
+func (t *MessageHandler) RegisterPublicKey(message *PublicKeyRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(message.PublicKey)
+	if err == nil {
+		_, err = ecdh.X25519().NewPublicKey(decoded)
+	}
+	if err != nil {
+		response.Message = "error"
+		return fmt.Errorf("public key must be a base64 X25519 key")
+	}
+	keyId := publicKeyId(decoded)
+
+	current, found, err := t.publicKey(message.UserId)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	if found && current.KeyId == keyId {
+		response.Message = keyId
+		return nil
+	}
+
+	result, err := t.execReplicated(`INSERT OR REPLACE INTO public_keys (userid, public_key, key_id, registered_hlc)
+				SELECT userid, ?, ?, ? FROM users WHERE userid = ? AND deleted = 0`,
+		base64.StdEncoding.EncodeToString(decoded), keyId, t.server.Clock.Now().String(), message.UserId)
+	if err != nil {
+		t.server.logger.Error("Error registering public key", "err", err)
+		response.Message = "error"
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		response.Message = "error"
+		return fmt.Errorf("no such user")
+	}
+
+	t.server.logger.Info("Registered public key", "user", message.UserId, "key", keyId, "replaced", found)
+	response.Message = keyId
+	return nil
+}
+
+// RPC: the public key of ContactId, to encrypt messages to them
+func (t *MessageHandler) GetPublicKey(message *GetPublicKeyRequest, info *PublicKeyInfo) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key, found, err := t.publicKey(message.ContactId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no such public key")
+	}
+	*info = key
+	return nil
+}
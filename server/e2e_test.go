@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Envelope of the right shape wrapped for the given keys, its bytes are
+random. The replicas only check the shape, the gateway's tests seal
+and open real envelopes
+*/
+func shapedEnvelope(t *testing.T, keys ...*ecdh.PublicKey) string {
+	t.Helper()
+	random := func(size int) string {
+		bytes := make([]byte, size)
+		if _, err := rand.Read(bytes); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(bytes)
+	}
+	envelope := Envelope{Version: ENVELOPE_VERSION, Nonce: random(12), Ciphertext: random(28)}
+	for _, key := range keys {
+		envelope.Keys = append(envelope.Keys, WrappedKey{
+			KeyId:     publicKeyId(key.Bytes()),
+			Ephemeral: random(32),
+			Nonce:     random(12),
+			Key:       random(48),
+		})
+	}
+	encoded, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func newX25519Key(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func registerKey(t *testing.T, c *testCluster, i int, user int) *ecdh.PrivateKey {
+	t.Helper()
+	key := newX25519Key(t)
+	var resp RPCResponse
+	request := PublicKeyRequest{UserId: user, PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())}
+	if err := c.client(i).Call("MessageHandler.RegisterPublicKey", &request, &resp); err != nil {
+		t.Fatalf("registering key of user %d: %v", user, err)
+	}
+	if resp.Message != publicKeyId(key.PublicKey().Bytes()) {
+		t.Errorf("key id %q", resp.Message)
+	}
+	return key
+}
+
+func TestEncryptedMessages(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.RegisterPublicKey", &PublicKeyRequest{UserId: 1, PublicKey: "c2hvcnQ="}, &resp); err == nil {
+		t.Error("short public key registered")
+	}
+	var reply string
+	sealed := ChatMessage{Message: "{}", Timestamp: "12:00", From: 1, To: 2, Acked: 1, Encrypted: true}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &sealed, &reply); err == nil || !strings.Contains(err.Error(), "no public key") {
+		t.Errorf("encrypted message to a user without a key: %v", err)
+	}
+
+	alice := registerKey(t, c, leader, 1)
+	bob := registerKey(t, c, leader, 2)
+
+	var info PublicKeyInfo
+	if err := c.client(leader).Call("MessageHandler.GetPublicKey", &GetPublicKeyRequest{UserId: 1, ContactId: 2}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.PublicKey != base64.StdEncoding.EncodeToString(bob.PublicKey().Bytes()) {
+		t.Fatalf("public key of bob: %+v", info)
+	}
+
+	sealed.Message = shapedEnvelope(t, bob.PublicKey(), alice.PublicKey())
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &sealed, &reply); err != nil {
+		t.Fatal(err)
+	}
+	bad := sealed
+	bad.Message = "meet at noon"
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &bad, &reply); err == nil {
+		t.Error("plaintext accepted as an encrypted message")
+	}
+
+	messages := getMessages(t, c, leader, 2, 1)
+	if len(messages) != 1 || !messages[0].Encrypted {
+		t.Fatalf("messages: %+v", messages)
+	}
+	if messages[0].Message != sealed.Message {
+		t.Errorf("envelope changed on the way: %q", messages[0].Message)
+	}
+
+	hlc := messages[0].HLC
+	edit := EditMessageRequest{UserId: 1, HLC: hlc, Message: "meet at one"}
+	if err := c.client(leader).Call("MessageHandler.EditMessage", &edit, &resp); err == nil {
+		t.Error("encrypted message edited in plaintext")
+	}
+	edit = EditMessageRequest{UserId: 1, HLC: hlc, Message: shapedEnvelope(t, bob.PublicKey(), alice.PublicKey()), Encrypted: true}
+	if err := c.client(leader).Call("MessageHandler.EditMessage", &edit, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if messages := getMessages(t, c, leader, 2, 1); len(messages) != 1 || messages[0].Message != edit.Message || !messages[0].Encrypted {
+		t.Errorf("after the edit: %+v", messages)
+	}
+
+	// bob's new key makes envelopes for the old one stale
+	registerKey(t, c, leader, 2)
+	sealed.Message = shapedEnvelope(t, bob.PublicKey())
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &sealed, &reply); err == nil || !strings.Contains(err.Error(), "public key changed") {
+		t.Errorf("envelope for an old key: %v", err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	for i := 0; i < 3; i++ {
+		if dump := c.dumpDatabase(i); strings.Contains(dump, "noon") || strings.Contains(dump, "meet at one") {
+			t.Errorf("plaintext stored on node %d", i)
+		}
+	}
+}
+
+func TestKeyChangeNotification(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.createUser(leader, "c@example.com")
+
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 1, ContactId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: 2, ContactId: 1, Response: CONTACT_ACCEPTED}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	alice := loginDevice(t, c, leader, "a@example.com", "")
+	carol := loginDevice(t, c, leader, "c@example.com", "")
+
+	key := registerKey(t, c, leader, 2)
+	result := syncDevice(t, c, leader, 1, alice.DeviceId, alice.Cursor)
+	if len(result.Contacts) != 1 || result.Contacts[0].Contact.UserId != 2 || result.Contacts[0].KeyId != publicKeyId(key.PublicKey().Bytes()) {
+		t.Fatalf("key change for a contact: %+v", result.Contacts)
+	}
+	if other := syncDevice(t, c, leader, 3, carol.DeviceId, carol.Cursor); len(other.Contacts) != 0 {
+		t.Errorf("key change sent to a stranger: %+v", other.Contacts)
+	}
+
+	// registering the same key again is not a change
+	var again RPCResponse
+	request := PublicKeyRequest{UserId: 2, PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())}
+	if err := c.client(leader).Call("MessageHandler.RegisterPublicKey", &request, &again); err != nil {
+		t.Fatal(err)
+	}
+	if next := syncDevice(t, c, leader, 1, alice.DeviceId, result.Cursor); len(next.Contacts) != 0 {
+		t.Errorf("unchanged key notified: %+v", next.Contacts)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+}
@@ -0,0 +1,491 @@
+package main
+
+/*
+In-process test harness for the replication cluster.
+
+Starts N Server instances, each with its own temporary data
+directory, connected by an in-memory transport (or loopback TCP).
+Every replica-to-replica connection goes through a faultNetwork so
+tests can partition the cluster, drop or delay RPCs, crash and
+restart nodes and skew their physical clocks.
+
+The harness reads replica state only through accessors that are safe
+from any goroutine (LeaderID, LogIndex), and the suite must pass
+"go test -race ./...".
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_HEARTBEAT_INTERVAL = 100 * time.Millisecond
+	TEST_ELECTION_WAIT      = 100 * time.Millisecond
+)
+
+// =================================================
+//  FAULT INJECTION
+// =================================================
+
+// link between two nodes, directional
+type link struct {
+	from int
+	to   int
+}
+
+/*
+Decides the fate of every connection between replicas. Faults are
+applied when a connection is opened (partitions, drops) and on every
+write (delays), which covers each RPC since replicas dial per call.
+*/
+type faultNetwork struct {
+	inner     Transport
+	mutex     sync.Mutex
+	ids       map[string]int // address -> node id
+	blocked   map[link]bool
+	dropRates map[link]float64
+	delay     time.Duration
+	rng       *rand.Rand
+}
+
+func newFaultNetwork(inner Transport, addrs []ReplicaAddress) *faultNetwork {
+	ids := make(map[string]int)
+	for i, addr := range addrs {
+		ids[addressString(addr)] = i
+	}
+	return &faultNetwork{
+		inner:     inner,
+		ids:       ids,
+		blocked:   make(map[link]bool),
+		dropRates: make(map[link]float64),
+		rng:       rand.New(rand.NewSource(1)),
+	}
+}
+
+// Cuts every link between nodes in different groups
+func (f *faultNetwork) partition(groups ...[]int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	group := make(map[int]int)
+	for g, nodes := range groups {
+		for _, n := range nodes {
+			group[n] = g
+		}
+	}
+	for a := range f.ids {
+		for b := range f.ids {
+			from, to := f.ids[a], f.ids[b]
+			if group[from] != group[to] {
+				f.blocked[link{from, to}] = true
+			}
+		}
+	}
+}
+
+// Removes all partitions, drops and delays
+func (f *faultNetwork) heal() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.blocked = make(map[link]bool)
+	f.dropRates = make(map[link]float64)
+	f.delay = 0
+}
+
+// Drops a fraction of the connections opened from one node to another
+func (f *faultNetwork) setDropRate(from int, to int, rate float64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dropRates[link{from, to}] = rate
+}
+
+// Delays every write on every link
+func (f *faultNetwork) setDelay(delay time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.delay = delay
+}
+
+func (f *faultNetwork) currentDelay() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.delay
+}
+
+// Transport seen by node 'from'
+func (f *faultNetwork) transport(from int) Transport {
+	return &faultTransport{network: f, from: from}
+}
+
+type faultTransport struct {
+	network *faultNetwork
+	from    int
+}
+
+func (t *faultTransport) Listen(addr ReplicaAddress) (net.Listener, error) {
+	return t.network.inner.Listen(addr)
+}
+
+func (t *faultTransport) Dial(addr ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	f := t.network
+	address := addressString(addr)
+
+	f.mutex.Lock()
+	to, known := f.ids[address]
+	blocked := known && f.blocked[link{t.from, to}]
+	dropped := known && f.rng.Float64() < f.dropRates[link{t.from, to}]
+	f.mutex.Unlock()
+
+	if blocked {
+		// a partitioned peer looks like one that never answers
+		time.Sleep(min(timeout, 20*time.Millisecond))
+		return nil, fmt.Errorf("dial %s: partitioned from node %d", address, t.from)
+	}
+	if dropped {
+		return nil, fmt.Errorf("dial %s: dropped", address)
+	}
+
+	conn, err := f.inner.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, network: f}, nil
+}
+
+// Connection that applies the network's delay to each write
+type faultConn struct {
+	net.Conn
+	network *faultNetwork
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if delay := c.network.currentDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	return c.Conn.Write(b)
+}
+
+// =================================================
+//  CLUSTER
+// =================================================
+
+type testCluster struct {
+	t         *testing.T
+	transport Transport // shared by all nodes, without faults
+	gateway   Transport // used by client(), the nodes' transport unless set
+	addrs     []ReplicaAddress
+	dirs      []string
+	skews     []atomic.Int64 // physical clock skew per node, nanoseconds
+	network   *faultNetwork
+
+	// passed to nodes created after they are set, 0 for the defaults
+	maxReadyLag int
+	batchSize   int
+	keyring     *Keyring
+
+	mutex sync.Mutex
+	nodes []*Server // nil while a node is crashed
+}
+
+// Reserves n free loopback ports
+func freeAddresses(t *testing.T, n int) []ReplicaAddress {
+	addrs := make([]ReplicaAddress, n)
+	listeners := make([]net.Listener, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("reserving port: %v", err)
+		}
+		listeners[i] = l
+		addrs[i] = ReplicaAddress{"127.0.0.1", uint16(l.Addr().(*net.TCPAddr).Port)}
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	return addrs
+}
+
+// Creates an n node cluster on the in-memory transport. Nodes are not started yet
+func newTestCluster(t *testing.T, n int) *testCluster {
+	addrs := make([]ReplicaAddress, n)
+	for i := range addrs {
+		addrs[i] = ReplicaAddress{"127.0.0.1", uint16(12345 + i)}
+	}
+	return newTestClusterOn(t, NewMemoryTransport(), addrs)
+}
+
+// Creates a cluster on the given transport and addresses
+func newTestClusterOn(t *testing.T, transport Transport, addrs []ReplicaAddress) *testCluster {
+	n := len(addrs)
+	c := &testCluster{
+		t:         t,
+		transport: transport,
+		gateway:   transport,
+		addrs:     addrs,
+		dirs:      make([]string, n),
+		skews:     make([]atomic.Int64, n),
+		nodes:     make([]*Server, n),
+	}
+	for i := range c.dirs {
+		c.dirs[i] = t.TempDir()
+	}
+	c.network = newFaultNetwork(transport, c.addrs)
+	t.Cleanup(c.stopAll)
+	return c
+}
+
+func (c *testCluster) newNode(i int) *Server {
+	server, err := NewServer(ServerOptions{
+		PID:                  i,
+		Replicas:             c.addrs,
+		DataDir:              c.dirs[i],
+		HeartbeatInterval:    TEST_HEARTBEAT_INTERVAL,
+		ElectionWait:         TEST_ELECTION_WAIT,
+		MaxReadyLag:          c.maxReadyLag,
+		ReplicationBatchSize: c.batchSize,
+		Keyring:              c.keyring,
+	})
+	if err != nil {
+		c.t.Fatalf("creating node %d: %v", i, err)
+	}
+	server.Now = func() time.Time {
+		return time.Now().Add(time.Duration(c.skews[i].Load()))
+	}
+	server.Transport = c.network.transport(i)
+	return server
+}
+
+// Starts (or restarts) node i on its data directory
+func (c *testCluster) start(i int) {
+	server := c.newNode(i)
+	if err := server.Start(); err != nil {
+		c.t.Fatalf("starting node %d: %v", i, err)
+	}
+	c.mutex.Lock()
+	c.nodes[i] = server
+	c.mutex.Unlock()
+}
+
+// Starts every node concurrently, like separate processes would
+func (c *testCluster) startAll() {
+	var wg sync.WaitGroup
+	for i := range c.nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.start(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Crashes node i, its data directory is kept
+func (c *testCluster) crash(i int) {
+	c.mutex.Lock()
+	server := c.nodes[i]
+	c.nodes[i] = nil
+	c.mutex.Unlock()
+	if server != nil {
+		server.Stop()
+	}
+}
+
+func (c *testCluster) restart(i int) {
+	c.crash(i)
+	c.start(i)
+}
+
+func (c *testCluster) stopAll() {
+	for i := range c.nodes {
+		c.crash(i)
+	}
+}
+
+func (c *testCluster) node(i int) *Server {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[i]
+}
+
+// Skews the physical clock of node i
+func (c *testCluster) setSkew(i int, skew time.Duration) {
+	c.skews[i].Store(int64(skew))
+}
+
+// Leader every running node agrees on, or -1
+func (c *testCluster) agreedLeader(among ...int) int {
+	if len(among) == 0 {
+		for i := range c.addrs {
+			among = append(among, i)
+		}
+	}
+
+	leader := -1
+	for _, i := range among {
+		server := c.node(i)
+		if server == nil {
+			continue
+		}
+		if server.LeaderID() < 0 || (leader != -1 && server.LeaderID() != leader) {
+			return -1
+		}
+		leader = server.LeaderID()
+	}
+	if leader == -1 || c.node(leader) == nil {
+		return -1
+	}
+	return leader
+}
+
+// Waits until the given nodes (default: all running ones) agree on a leader
+func (c *testCluster) waitForLeader(timeout time.Duration, among ...int) int {
+	leader := -1
+	eventually(c.t, timeout, func() bool {
+		leader = c.agreedLeader(among...)
+		return leader != -1
+	}, "nodes to agree on a leader")
+	return leader
+}
+
+// RPC client connected to node i over the gateway transport, bypassing fault injection
+func (c *testCluster) client(i int) *rpc.Client {
+	conn, err := c.gateway.Dial(c.addrs[i], time.Second)
+	if err != nil {
+		c.t.Fatalf("connecting to node %d: %v", i, err)
+	}
+	client := rpc.NewClient(conn)
+	c.t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Creates a user through node i (normally the leader)
+func (c *testCluster) createUser(i int, email string) {
+	var resp RPCResponse
+	msg := CreateAccountMessage{Email: email, Password: "digest", Firstname: "Test", Lastname: "User"}
+	if err := c.client(i).Call("MessageHandler.CreateAccount", &msg, &resp); err != nil {
+		c.t.Fatalf("creating user %s: %v", email, err)
+	}
+}
+
+// Sends a chat message through node i
+func (c *testCluster) sendMessage(i int, from int, to int, text string) {
+	var resp string
+	msg := ChatMessage{Message: text, Timestamp: "12:00", From: from, To: to, Acked: 1}
+	if err := c.client(i).Call("MessageHandler.SaveMessage", &msg, &resp); err != nil {
+		c.t.Fatalf("sending message %q: %v", text, err)
+	}
+}
+
+/*
+Text dump of every table of node i, rows in insertion order. Two
+replicas are consistent when their dumps are equal. Tables come from
+sqlite_master, so new ones are compared without changes here, and
+each must be listed in REPLICATED_TABLES
+*/
+func (c *testCluster) dumpDatabase(i int) string {
+	db, err := openDatabase(filepath.Join(c.dirs[i], GenerateDatabaseName(i)))
+	if err != nil {
+		c.t.Fatalf("opening database of node %d: %v", i, err)
+	}
+	defer db.Close()
+
+	tables, err := db.Query(`SELECT name FROM sqlite_master
+				WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		c.t.Fatalf("listing tables of node %d: %v", i, err)
+	}
+	var queries []string
+	for tables.Next() {
+		var name string
+		if err := tables.Scan(&name); err != nil {
+			tables.Close()
+			c.t.Fatalf("listing tables of node %d: %v", i, err)
+		}
+		if !slices.Contains(REPLICATED_TABLES, name) {
+			tables.Close()
+			c.t.Fatalf("table %s of node %d is missing from REPLICATED_TABLES", name, i)
+		}
+		queries = append(queries, `SELECT * FROM `+name+` ORDER BY rowid`)
+	}
+	tables.Close()
+
+	var dump strings.Builder
+	for _, query := range queries {
+		rows, err := db.Query(query)
+		if err != nil {
+			c.t.Fatalf("dumping node %d: %v", i, err)
+		}
+		cols, _ := rows.Columns()
+		for rows.Next() {
+			values := make([]any, len(cols))
+			pointers := make([]any, len(cols))
+			for k := range values {
+				pointers[k] = &values[k]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				c.t.Fatalf("dumping node %d: %v", i, err)
+			}
+			fmt.Fprintln(&dump, values...)
+		}
+		rows.Close()
+		dump.WriteString("--\n")
+	}
+	return dump.String()
+}
+
+// Waits until the log index and database of every listed node match node 'reference'
+func (c *testCluster) waitForConsistency(timeout time.Duration, reference int, nodes ...int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		want := c.node(reference)
+		caught_up := want != nil
+		indexes := []int{}
+		for _, i := range nodes {
+			server := c.node(i)
+			if server == nil {
+				indexes = append(indexes, -1)
+				caught_up = false
+				continue
+			}
+			indexes = append(indexes, server.LogIndex())
+			caught_up = caught_up && server.LogIndex() == want.LogIndex()
+		}
+		if caught_up {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out after %s waiting for nodes %v (log indexes %v) to catch up with node %d", timeout, nodes, indexes, reference)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	want := c.dumpDatabase(reference)
+	for _, i := range nodes {
+		if got := c.dumpDatabase(i); got != want {
+			c.t.Fatalf("database of node %d differs from node %d:\n%s\nvs\n%s", i, reference, got, want)
+		}
+	}
+}
+
+// Polls cond until it holds or the timeout expires
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
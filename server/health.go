@@ -0,0 +1,106 @@
+package main
+
+/*
+Liveness and readiness of a replica.
+
+A replica is live once Start has brought it up and until it is
+stopped. It is ready when it can serve requests with current data:
+
+ 1. it knows a leader, and
+ 2. it is the leader, or it heard from the leader within
+    LEADER_CONTACT_HEARTBEATS heartbeats and is at most MaxReadyLag
+    entries behind it
+
+Followers learn the leader's log index from the IsStatusOK heartbeat.
+The state is served over RPC (MessageHandler.GetHealth) and on
+/healthz and /readyz of the replica's HTTP server.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_READY_LAG     = 10 // entries a follower may be behind and still be ready
+	LEADER_CONTACT_HEARTBEATS = 3  // heartbeats without leader contact before a follower is unready
+)
+
+type HealthStatus struct {
+	NodeID      int    `json:"node_id"`
+	Live        bool   `json:"live"`
+	Ready       bool   `json:"ready"`
+	Reason      string `json:"reason,omitempty"` // why the node is not ready
+	LeaderID    int    `json:"leader_id"`
+	IsLeader    bool   `json:"is_leader"`
+	LogIndex    int    `json:"log_index"`
+	LeaderIndex int    `json:"leader_index"` // last log index reported by the leader
+	Lag         int    `json:"lag"`          // entries behind the leader
+}
+
+// Marks the server as serving (or not)
+func (s *Server) setActive(active bool) {
+	s.active.Store(active)
+}
+
+// Records a heartbeat answer from the leader
+func (s *Server) leaderContacted(leaderIndex int) {
+	s.leaderIndex.Store(int64(leaderIndex))
+	s.leaderContact.Store(s.Now().UnixNano())
+}
+
+func (s *Server) Health() HealthStatus {
+	status := HealthStatus{
+		NodeID:   s.PID,
+		Live:     s.active.Load() && !s.isStopped(),
+		LeaderID: int(s.leader.Load()),
+		LogIndex: int(s.logIndex.Load()),
+	}
+	status.IsLeader = status.LeaderID == s.PID
+
+	if status.IsLeader {
+		status.LeaderIndex = status.LogIndex
+	} else {
+		status.LeaderIndex = int(s.leaderIndex.Load())
+		status.Lag = max(status.LeaderIndex-status.LogIndex, 0)
+	}
+
+	contact := time.Unix(0, s.leaderContact.Load())
+	stale := LEADER_CONTACT_HEARTBEATS * s.HeartbeatInterval
+
+	switch {
+	case !status.Live:
+		status.Reason = "not serving"
+	case status.LeaderID < 0:
+		status.Reason = "no known leader"
+	case status.IsLeader:
+	case s.Now().Sub(contact) > stale:
+		status.Reason = fmt.Sprintf("no contact with leader %d for over %s", status.LeaderID, stale)
+	case status.Lag > s.MaxReadyLag:
+		status.Reason = fmt.Sprintf("%d entries behind the leader (limit %d)", status.Lag, s.MaxReadyLag)
+	}
+	status.Ready = status.Live && status.Reason == ""
+	return status
+}
+
+// RPC: health of this replica, used by the gateway to pick where to send requests
+func (t *MessageHandler) GetHealth(dummy *int, status *HealthStatus) error {
+	*status = t.server.Health()
+	return nil
+}
+
+// Writes the health status as JSON, 200 if ok(status) else 503
+func healthHandler(s *Server, ok func(HealthStatus) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status := s.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if ok(status) {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fetches one of the health endpoints of a node
+func getHealth(t *testing.T, server *Server, path string) (int, HealthStatus) {
+	t.Helper()
+	ok := func(h HealthStatus) bool { return h.Live }
+	if path == "/readyz" {
+		ok = func(h HealthStatus) bool { return h.Ready }
+	}
+	recorder := httptest.NewRecorder()
+	healthHandler(server, ok).ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+	var status HealthStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return recorder.Code, status
+}
+
+func TestReplicasBecomeReady(t *testing.T) {
+	c := newTestCluster(t, 3)
+
+	// not started yet
+	unstarted := c.newNode(0)
+	code, status := getHealth(t, unstarted, "/healthz")
+	unstarted.Stop()
+	if code != http.StatusServiceUnavailable || status.Live {
+		t.Fatalf("unstarted node is live: %d %+v", code, status)
+	}
+
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	eventually(t, 5*time.Second, func() bool {
+		for i := 0; i < 3; i++ {
+			if !c.node(i).Health().Ready {
+				return false
+			}
+		}
+		return true
+	}, "all nodes to become ready")
+
+	code, status = getHealth(t, c.node(0), "/readyz")
+	if code != http.StatusOK || status.LeaderID != leader || status.IsLeader {
+		t.Errorf("follower /readyz: %d %+v", code, status)
+	}
+
+	var rpcStatus HealthStatus
+	if err := c.client(leader).Call("MessageHandler.GetHealth", 0, &rpcStatus); err != nil {
+		t.Fatal(err)
+	}
+	if !rpcStatus.Ready || !rpcStatus.IsLeader {
+		t.Errorf("leader GetHealth: %+v", rpcStatus)
+	}
+
+	// a stopped node is neither live nor ready
+	node := c.node(1)
+	c.crash(1)
+	if code, status := getHealth(t, node, "/healthz"); code != http.StatusServiceUnavailable || status.Live || status.Ready {
+		t.Errorf("crashed node /healthz: %d %+v", code, status)
+	}
+}
+
+func TestLaggingFollowerIsNotReady(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.maxReadyLag = 1
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	eventually(t, 5*time.Second, func() bool { return c.node(0).Health().Ready }, "node 0 to become ready")
+
+	// the leader can no longer push entries to node 0, but node 0 still
+	// reaches the leader and sees how far behind it is
+	c.network.setDropRate(leader, 0, 1)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		c.createUser(leader, email)
+	}
+
+	var status HealthStatus
+	eventually(t, 5*time.Second, func() bool {
+		status = c.node(0).Health()
+		return !status.Ready
+	}, "node 0 to become unready")
+	if status.Lag < 2 || !strings.Contains(status.Reason, "behind the leader") {
+		t.Errorf("unexpected status of lagging node: %+v", status)
+	}
+
+	// the leader does not report a lagging follower as unready itself
+	if !c.node(leader).Health().Ready {
+		t.Errorf("leader became unready")
+	}
+
+	c.network.setDropRate(leader, 0, 0)
+	eventually(t, 5*time.Second, func() bool { return c.node(0).Health().Ready }, "node 0 to catch up and become ready")
+}
+
+func TestIsStatusOKOnlyFromLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+
+	for i := 0; i < 3; i++ {
+		var resp ReplicationResponse
+		if err := c.client(i).Call("ReplicationHandler.IsStatusOK", ReplicationRequest{}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		want := "NOTLEADER"
+		if i == leader {
+			want = "STATUSOK"
+		}
+		if resp.Message != want || resp.LastIndex != 1 {
+			t.Errorf("node %d IsStatusOK: %+v, want %s at index 1", i, resp, want)
+		}
+	}
+}
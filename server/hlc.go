@@ -0,0 +1,160 @@
+package main
+
+/*
+	Hybrid logical clock (HLC) implementation.
+
+	Every replica keeps one HybridClock. The clock combines the
+	(offset adjusted) physical time of the node with a logical counter,
+	so that events are ordered causally even when the wall clocks of
+	the replicas disagree. Timestamps are carried on every inter-replica
+	RPC and stamped onto log entries and chat messages.
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// Remote timestamps further than this ahead of our physical clock come
+// from a badly skewed node. They are still merged, so a receive orders
+// after its send, but logged and counted, see AheadMerges
+const HLC_MAX_DRIFT = 500 * time.Millisecond
+
+// A single HLC reading. WallTime is unix nanoseconds
+type HLCTimestamp struct {
+	WallTime int64  `json:"wall"`
+	Logical  uint32 `json:"logical"`
+}
+
+// Clock state, guarded by its own mutex since it is touched from
+// every RPC handler
+type HybridClock struct {
+	mutex    sync.Mutex
+	last     HLCTimestamp
+	physical func() time.Time
+	logger   *slog.Logger
+	ahead    uint64 // remote timestamps merged past HLC_MAX_DRIFT
+}
+
+// Create a clock that reads physical time from the given source
+func NewHybridClock(physical func() time.Time, logger *slog.Logger) *HybridClock {
+	return &HybridClock{physical: physical, logger: logger}
+}
+
+/*
+Returns a timestamp for a local or send event.
+
+The result is strictly greater than every timestamp
+previously returned or merged by this clock
+*/
+func (c *HybridClock) Now() HLCTimestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pt := c.physical().UnixNano()
+	if pt > c.last.WallTime {
+		c.last = HLCTimestamp{WallTime: pt}
+	} else {
+		c.last = c.last.tick()
+	}
+	return c.last
+}
+
+/*
+Merges a timestamp received from another replica (receive event)
+and returns the new local timestamp, which orders after remote. A
+remote timestamp more than HLC_MAX_DRIFT ahead of our physical time
+is merged all the same, with a warning
+*/
+func (c *HybridClock) Update(remote HLCTimestamp) HLCTimestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pt := c.physical().UnixNano()
+	if remote.WallTime > pt+int64(HLC_MAX_DRIFT) {
+		c.ahead++
+		c.logger.Warn("Remote clock is ahead of local physical time beyond the drift bound", "ahead", time.Duration(remote.WallTime-pt), "limit", HLC_MAX_DRIFT)
+	}
+
+	wall := max(c.last.WallTime, remote.WallTime, pt)
+	switch {
+	case wall == c.last.WallTime && wall == remote.WallTime:
+		if remote.Logical > c.last.Logical {
+			c.last = remote
+		}
+		c.last = c.last.tick()
+	case wall == c.last.WallTime:
+		c.last = c.last.tick()
+	case wall == remote.WallTime:
+		c.last = remote.tick()
+	default:
+		c.last = HLCTimestamp{WallTime: wall}
+	}
+	return c.last
+}
+
+// How many remote timestamps were merged more than HLC_MAX_DRIFT ahead
+func (c *HybridClock) AheadMerges() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ahead
+}
+
+// Latest timestamp issued or merged, without advancing the clock
+func (c *HybridClock) Peek() HLCTimestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
+// Returns -1, 0 or 1 depending on whether t orders before, equal to or after o
+func (t HLCTimestamp) Compare(o HLCTimestamp) int {
+	switch {
+	case t.WallTime < o.WallTime:
+		return -1
+	case t.WallTime > o.WallTime:
+		return 1
+	case t.Logical < o.Logical:
+		return -1
+	case t.Logical > o.Logical:
+		return 1
+	}
+	return 0
+}
+
+// The next timestamp after t, on the next nanosecond once the logical counter is exhausted
+func (t HLCTimestamp) tick() HLCTimestamp {
+	if t.Logical == math.MaxUint32 {
+		return HLCTimestamp{WallTime: t.WallTime + 1}
+	}
+	return HLCTimestamp{WallTime: t.WallTime, Logical: t.Logical + 1}
+}
+
+func (t HLCTimestamp) IsZero() bool {
+	return t.WallTime == 0 && t.Logical == 0
+}
+
+func (t HLCTimestamp) Time() time.Time {
+	return time.Unix(0, t.WallTime)
+}
+
+/*
+Fixed width string form of the timestamp. Lexical order of these
+strings matches causal order, so they can be stored in SQLite
+and sorted with ORDER BY
+*/
+func (t HLCTimestamp) String() string {
+	return fmt.Sprintf("%020d.%010d", t.WallTime, t.Logical)
+}
+
+// Inverse of String
+func ParseHLCTimestamp(text string) (HLCTimestamp, error) {
+	var t HLCTimestamp
+	if _, err := fmt.Sscanf(text, "%d.%d", &t.WallTime, &t.Logical); err != nil {
+		return HLCTimestamp{}, fmt.Errorf("invalid HLC timestamp %q: %v", text, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Clock on a physical time the test sets, logging into the returned buffer
+func testClock(now *time.Time) (*HybridClock, *bytes.Buffer) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	return NewHybridClock(func() time.Time { return *now }, logger), &logs
+}
+
+func TestHLCMonotonic(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock, _ := testClock(&now)
+
+	last := clock.Now()
+	for i := 0; i < 100; i++ {
+		// physical time stands still, goes back, then moves on
+		switch i {
+		case 30:
+			now = now.Add(-time.Second)
+		case 60:
+			now = now.Add(2 * time.Second)
+		}
+		next := clock.Now()
+		if next.Compare(last) <= 0 || next.String() <= last.String() {
+			t.Fatalf("step %d: %s after %s", i, next, last)
+		}
+		last = next
+	}
+	if clock.Peek() != last {
+		t.Errorf("peek %s, last issued %s", clock.Peek(), last)
+	}
+}
+
+func TestHLCMergesRemoteAhead(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock, logs := testClock(&now)
+	local := clock.Now()
+
+	remote := HLCTimestamp{WallTime: now.Add(100 * time.Millisecond).UnixNano(), Logical: 7}
+	merged := clock.Update(remote)
+	if merged != (HLCTimestamp{WallTime: remote.WallTime, Logical: 8}) {
+		t.Errorf("merged %s, want %s plus one", merged, remote)
+	}
+	if next := clock.Now(); next.Compare(remote) <= 0 || next.Compare(local) <= 0 {
+		t.Errorf("local event %s does not order after %s", next, remote)
+	}
+
+	// a remote timestamp behind ours only advances the counter
+	before := clock.Peek()
+	if got := clock.Update(HLCTimestamp{WallTime: local.WallTime - 1}); got != before.tick() {
+		t.Errorf("merging an old timestamp: %s, want %s", got, before.tick())
+	}
+	// physical time ahead of both wins with a fresh counter
+	now = now.Add(time.Second)
+	if got := clock.Update(remote); got != (HLCTimestamp{WallTime: now.UnixNano()}) {
+		t.Errorf("merging behind physical time: %s", got)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("warnings within the drift bound:\n%s", logs)
+	}
+}
+
+func TestHLCCounterRollover(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock, _ := testClock(&now)
+
+	full := HLCTimestamp{WallTime: now.UnixNano(), Logical: math.MaxUint32}
+	got := clock.Update(full)
+	if got != (HLCTimestamp{WallTime: full.WallTime + 1}) {
+		t.Fatalf("merging an exhausted counter: %s", got)
+	}
+	if got.Compare(full) <= 0 || got.String() <= full.String() {
+		t.Errorf("%s does not order after %s", got, full)
+	}
+	if next := clock.Now(); next != (HLCTimestamp{WallTime: full.WallTime + 1, Logical: 1}) {
+		t.Errorf("next local event: %s", next)
+	}
+}
+
+func TestHLCReportsRemoteBeyondMaxDrift(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock, logs := testClock(&now)
+
+	// within the bound nothing is reported
+	clock.Update(HLCTimestamp{WallTime: now.Add(HLC_MAX_DRIFT).UnixNano()})
+	if clock.AheadMerges() != 0 || logs.Len() != 0 {
+		t.Fatalf("timestamp at the bound reported:\n%s", logs)
+	}
+
+	// beyond it the receive still orders after the send
+	remote := HLCTimestamp{WallTime: now.Add(time.Hour).UnixNano(), Logical: 3}
+	if got := clock.Update(remote); got != (HLCTimestamp{WallTime: remote.WallTime, Logical: 4}) {
+		t.Errorf("merging a timestamp an hour ahead: %s, want %s", got, HLCTimestamp{WallTime: remote.WallTime, Logical: 4})
+	}
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "ahead=1h0m0s") {
+		t.Errorf("skew was not reported:\n%s", logs)
+	}
+	for i := 0; i < 3; i++ {
+		if got := clock.Update(remote); got.Compare(remote) <= 0 {
+			t.Errorf("receive %s orders before send %s", got, remote)
+		}
+	}
+	if n := clock.AheadMerges(); n != 4 {
+		t.Errorf("%d merges counted, want 4", n)
+	}
+	if got := clock.Now(); got.Compare(remote) <= 0 {
+		t.Errorf("local event %s after the merge orders before %s", got, remote)
+	}
+}
+
+func TestHLCStringRoundTrip(t *testing.T) {
+	for _, stamp := range []HLCTimestamp{{}, {WallTime: 1, Logical: 2}, {WallTime: time.Unix(1000, 5).UnixNano(), Logical: math.MaxUint32}} {
+		parsed, err := ParseHLCTimestamp(stamp.String())
+		if err != nil || parsed != stamp {
+			t.Errorf("%s parsed as %s, %v", stamp, parsed, err)
+		}
+	}
+	if _, err := ParseHLCTimestamp("yesterday"); err == nil {
+		t.Error("parsed an invalid timestamp")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+/*
+Idempotent writes.
+
+Clients attach a request ID of their choosing to SaveMessage,
+CreateAccount and AddContact (and SendContactRequest). The first call
+with an ID is applied and its reply is stored in the requests table,
+in the same transaction as the write and in the same log entry, so
+every replica has both or neither. A repeat, to this leader or to the
+next one after a failover, gets the stored reply and changes nothing.
+
+IDs are scoped to the user and the method: two users, or one user
+calling two methods, may pick the same ID. CreateAccount has no user
+yet, its IDs share user 0; a repeat must name the email of the
+account the ID created, or it is refused, so two clients that pick
+the same ID do not learn each other's account.
+
+Records are pruned by the leader once they are REQUEST_RETENTION old,
+through the log like any other write.
+*/
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	REQUEST_RETENTION      = 24 * time.Hour
+	REQUEST_PRUNE_INTERVAL = time.Hour
+	MAX_REQUEST_ID         = 128 // bytes
+)
+
+// The request a log entry applied, with the reply repeats get
+type RequestRecord struct {
+	User   int    `json:"user"`
+	Id     string `json:"id"`
+	Method string `json:"method"`
+	Result string `json:"result"`
+}
+
+// Record for a client request ID, nil when the client sent none
+func newRequest(user int, id string, method string, result string) *RequestRecord {
+	if id == "" {
+		return nil
+	}
+	return &RequestRecord{User: user, Id: id, Method: method, Result: result}
+}
+
+// Checks a client request ID, empty means the client does not want deduplication
+func validRequestId(id string) error {
+	if len(id) > MAX_REQUEST_ID {
+		return fmt.Errorf("request id is longer than %d bytes", MAX_REQUEST_ID)
+	}
+	return nil
+}
+
+// Reply recorded for a request ID of the user, found is false for a new request
+func (s *Server) requestResult(user int, id string, method string) (result string, found bool, err error) {
+	if id == "" {
+		return "", false, nil
+	}
+	if err := validRequestId(id); err != nil {
+		return "", false, err
+	}
+
+	rows, err := s.Query(`SELECT result FROM requests WHERE user_id = ? AND method = ? AND request_id = ?`,
+		user, method, id)
+	if err != nil {
+		s.logger.Error("Query failed", "err", err)
+		return "", false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", false, nil
+	}
+	if err := rows.Scan(&result); err != nil {
+		s.logger.Error("Scan failed", "err", err)
+		return "", false, err
+	}
+	s.Metrics.DuplicateRequests.Inc()
+	s.logger.Debug("Repeated request", "user", user, "request", id, "method", method)
+	return result, true, nil
+}
+
+// Checks that the account a CreateAccount request ID created has the given email
+func (t *MessageHandler) sameAccount(user string, email string) error {
+	rows, err := t.server.Query(`SELECT email FROM users WHERE userid = ?`, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	created := ""
+	if rows.Next() {
+		if err := rows.Scan(&created); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return err
+		}
+	}
+	if created != email {
+		return fmt.Errorf("request id already used for another account")
+	}
+	return nil
+}
+
+/*
+Runs the statement of a log entry, and records its request if it has
+one, in one transaction. On the leader result computes the reply to
+record from the statement's result, replicas pass nil and keep the
+reply that came with the entry
+*/
+func (s *Server) execEntry(entry *LogEntry, result func(sql.Result) string) (sql.Result, error) {
+	if entry.Request == nil {
+		return s.Exec(entry.SQL, entry.Args...)
+	}
+	defer s.Metrics.ObserveQuery(entry.SQL, time.Now())
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(entry.SQL, entry.Args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if result != nil {
+		entry.Request.Result = result(res)
+	}
+	_, err = tx.Exec(`INSERT INTO requests (user_id, method, request_id, result, created_hlc) VALUES (?, ?, ?, ?, ?)`,
+		entry.Request.User, entry.Request.Method, entry.Request.Id, entry.Request.Result, entry.HLC.String())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+/*
+Leader only: drops request records older than REQUEST_RETENTION, at
+most once per REQUEST_PRUNE_INTERVAL. The cutoff travels in the log
+entry so replicas drop the same rows
+*/
+func (t *MessageHandler) pruneRequests() {
+	now := t.server.getTime()
+	if now.Sub(t.requestsPruned) < REQUEST_PRUNE_INTERVAL {
+		return
+	}
+	t.requestsPruned = now
+
+	cutoff := HLCTimestamp{WallTime: now.Add(-REQUEST_RETENTION).UnixNano()}.String()
+	if _, err := t.execReplicated(`DELETE FROM requests WHERE created_hlc < ?`, cutoff); err != nil {
+		t.server.logger.Error("Error pruning requests", "err", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatedRequestsSurviveFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	create := func(i int, id string, email string) string {
+		t.Helper()
+		var resp RPCResponse
+		msg := CreateAccountMessage{Email: email, Password: "digest", Firstname: "Test", Lastname: "User", RequestId: id}
+		if err := c.client(i).Call("MessageHandler.CreateAccount", &msg, &resp); err != nil {
+			t.Fatalf("creating %s: %v", email, err)
+		}
+		return resp.Message
+	}
+	send := func(i int, id string) error {
+		var reply string
+		msg := ChatMessage{Message: "once", Timestamp: "12:00", From: 1, To: 2, Acked: 1, RequestId: id}
+		return c.client(i).Call("MessageHandler.SaveMessage", &msg, &reply)
+	}
+	addContact := func(i int, id string) (string, error) {
+		var resp RPCResponse
+		err := c.client(i).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 1, ContactId: 2, RequestId: id}, &resp)
+		return resp.Message, err
+	}
+
+	first := create(leader, "create-a", "a@example.com")
+	if again := create(leader, "create-a", "a@example.com"); again != first {
+		t.Errorf("repeated CreateAccount returned user %s, first was %s", again, first)
+	}
+	create(leader, "create-b", "b@example.com")
+	for i := 0; i < 2; i++ {
+		if err := send(leader, "msg-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status, err := addContact(leader, "contact-1"); err != nil || status != CONTACT_PENDING {
+		t.Fatalf("contact request: %q %v", status, err)
+	}
+	if status, err := addContact(leader, "contact-1"); err != nil || status != CONTACT_PENDING {
+		t.Errorf("repeated contact request: %q %v", status, err)
+	}
+
+	// the records travel with the writes, the next leader knows them
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	c.crash(leader)
+	next := c.waitForLeader(5*time.Second, 0, 1)
+
+	if again := create(next, "create-a", "a@example.com"); again != first {
+		t.Errorf("CreateAccount repeated on the new leader returned user %s, first was %s", again, first)
+	}
+	if err := send(next, "msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := addContact(next, "contact-1"); err != nil || status != CONTACT_PENDING {
+		t.Errorf("contact request repeated on the new leader: %q %v", status, err)
+	}
+	if err := send(next, "msg-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getMessages(t, c, next, 1, 2); len(got) != 2 {
+		t.Errorf("expected 2 messages, got %d: %+v", len(got), got)
+	}
+}
+
+// Request IDs are chosen by clients, only the same user and method repeat a request
+func TestRequestIdsAreScopedToUserAndMethod(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	var resp RPCResponse
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		msg := CreateAccountMessage{Email: email, Password: "digest", RequestId: "req-" + email}
+		if err := c.client(leader).Call("MessageHandler.CreateAccount", &msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another client picks the ID of a's account
+	stranger := CreateAccountMessage{Email: "d@example.com", Password: "digest", RequestId: "req-a@example.com"}
+	resp = RPCResponse{}
+	if err := c.client(leader).Call("MessageHandler.CreateAccount", &stranger, &resp); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("account of another email returned: %q %v", resp.Message, err)
+	}
+
+	// 1 and 3 both write to 2 with the same ID
+	for _, from := range []int{1, 3, 1} {
+		var reply string
+		msg := ChatMessage{Message: "hi", Timestamp: "12:00", From: from, To: 2, Acked: 1, RequestId: "1"}
+		if err := c.client(leader).Call("MessageHandler.SaveMessage", &msg, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1 uses the ID again for another method
+	msg := AddContactMessage{UserId: 1, ContactId: 2, RequestId: "1"}
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &msg, &resp); err != nil || resp.Message != CONTACT_PENDING {
+		t.Fatalf("contact request with a reused id: %q %v", resp.Message, err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	follower := (leader + 1) % 3
+	if got := getMessages(t, c, follower, 1, 2); len(got) != 1 {
+		t.Errorf("messages from 1: %+v", got)
+	}
+	if got := getMessages(t, c, follower, 3, 2); len(got) != 1 {
+		t.Errorf("messages from 3: %+v", got)
+	}
+	if got := columnValues(c, follower, "requests", "method"); len(got) != 6 {
+		t.Errorf("request records: %v", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// Sends logging to buf for the duration of the test
+func captureLogs(t *testing.T, level string, format string) *bytes.Buffer {
+	t.Helper()
+	handler, logger := LOG_HANDLER, slog.Default()
+	t.Cleanup(func() {
+		LOG_HANDLER = handler
+		slog.SetDefault(logger)
+	})
+
+	var buf bytes.Buffer
+	if err := ConfigureLogging(&buf, level, format); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestLogLinesCarryNodeContext(t *testing.T) {
+	buf := captureLogs(t, "info", "json")
+
+	addrs := []ReplicaAddress{{"127.0.0.1", 12345}, {"127.0.0.1", 12346}}
+	server, err := NewServer(ServerOptions{PID: 0, Replicas: addrs, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	server.SetLeader(1)
+	server.setLogIndex(7)
+	server.logger.Info("hello", "key", "value")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+		t.Fatalf("log line is not JSON: %v\n%s", err, buf.String())
+	}
+
+	want := map[string]any{
+		"msg":       "hello",
+		"key":       "value",
+		"node":      float64(0),
+		"role":      "follower",
+		"leader":    float64(1),
+		"log_index": float64(7),
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s = %v, want %v", k, record[k], v)
+		}
+	}
+
+	server.SetLeader(0)
+	buf.Reset()
+	server.logger.Info("leading")
+	if !strings.Contains(buf.String(), `"role":"leader"`) {
+		t.Errorf("leader not reported: %s", buf.String())
+	}
+}
+
+func TestLogLevelFiltersDebug(t *testing.T) {
+	buf := captureLogs(t, "info", "text")
+
+	addrs := []ReplicaAddress{{"127.0.0.1", 12345}}
+	server, err := NewServer(ServerOptions{PID: 0, Replicas: addrs, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	server.logger.Debug("heartbeat chatter")
+	server.logger.Warn("something worth seeing")
+	if strings.Contains(buf.String(), "heartbeat chatter") {
+		t.Errorf("debug line written at info level")
+	}
+	if !strings.Contains(buf.String(), "something worth seeing") || !strings.Contains(buf.String(), "node=0") {
+		t.Errorf("warning missing or without node context: %s", buf.String())
+	}
+
+	if err := ConfigureLogging(buf, "verbose", "text"); err == nil {
+		t.Errorf("invalid level accepted")
+	}
+	if err := ConfigureLogging(buf, "info", "xml"); err == nil {
+		t.Errorf("invalid format accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Messages between two users as seen by node i
+func getMessages(t *testing.T, c *testCluster, i int, user int, contact int) []ChatMessage {
+	t.Helper()
+	var list MessageList
+	if err := c.client(i).Call("MessageHandler.GetMessages", &GetMessagesRequest{UserId: user, ContactId: contact}, &list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Messages
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.sendMessage(leader, 1, 2, "helo")
+	c.sendMessage(leader, 1, 2, "oops")
+
+	sent := getMessages(t, c, leader, 1, 2)
+	if len(sent) != 2 || sent[0].HLC == "" {
+		t.Fatalf("unexpected messages: %+v", sent)
+	}
+	first, second := sent[0].HLC, sent[1].HLC
+
+	var resp RPCResponse
+	err := c.client(leader).Call("MessageHandler.EditMessage", &EditMessageRequest{UserId: 2, HLC: first, Message: "hijacked"}, &resp)
+	if err == nil || !strings.Contains(err.Error(), "only the sender") {
+		t.Errorf("recipient edited a message: %v", err)
+	}
+	for _, text := range []string{"hello", "hello!"} {
+		if err := c.client(leader).Call("MessageHandler.EditMessage", &EditMessageRequest{UserId: 1, HLC: first, Message: text}, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.client(leader).Call("MessageHandler.DeleteMessage", &EditMessageRequest{UserId: 1, HLC: second}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	err = c.client(leader).Call("MessageHandler.EditMessage", &EditMessageRequest{UserId: 1, HLC: second, Message: "back"}, &resp)
+	if err == nil || !strings.Contains(err.Error(), "deleted") {
+		t.Errorf("deleted message edited: %v", err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+
+	// followers return the same state
+	got := getMessages(t, c, 0, 2, 1)
+	if len(got) != 2 {
+		t.Fatalf("follower returned %d messages", len(got))
+	}
+	if got[0].Message != "hello!" || !got[0].Edited || got[0].Deleted {
+		t.Errorf("edited message: %+v", got[0])
+	}
+	if got[1].Message != "" || !got[1].Deleted {
+		t.Errorf("deleted message is not a tombstone: %+v", got[1])
+	}
+
+	var history MessageHistory
+	if err := c.client(0).Call("MessageHandler.GetMessageHistory", &EditMessageRequest{UserId: 2, HLC: first}, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Versions) != 2 || history.Versions[0].Message != "helo" || history.Versions[0].HLC != first || history.Versions[1].Message != "hello" {
+		t.Errorf("unexpected history: %+v", history.Versions)
+	}
+	var hidden MessageHistory
+	if err := c.client(0).Call("MessageHandler.GetMessageHistory", &EditMessageRequest{UserId: 3, HLC: first}, &hidden); err != nil || len(hidden.Versions) != 0 {
+		t.Errorf("history shown to a third user: %+v %v", hidden.Versions, err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+/*
+Prometheus metrics of a replica.
+
+Every replica has its own registry, served on /metrics by the
+replica's HTTP server (see Server.HTTPAddress). Besides plain
+counters and histograms it reports, at scrape time:
+
+ 1. log index and commit index of the node
+ 2. replication lag of every peer in entries, leader only
+ 3. leader, election, clock and readiness state, and how often a
+    peer's HLC was more than HLC_MAX_DRIFT ahead
+ 4. drift rate of every peer's clock, leader only
+
+The commit index is the highest index the leader knows to be stored on
+a majority of replicas. Followers do not learn it and report their own
+last applied index.
+*/
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	Elections         prometheus.Counter
+	LeaderChanges     prometheus.Counter
+	DuplicateRequests prometheus.Counter       // repeated client request IDs, see idempotency.go
+	RPCDuration       *prometheus.HistogramVec // by method, every RPC served by the replica
+	QueryDuration     *prometheus.HistogramVec // by statement kind, SQLite queries
+
+	mutex     sync.Mutex
+	peerIndex map[int]int     // leader only: last log index known to be on each peer
+	peerDrift map[int]float64 // leader only: drift of each peer's clock in ppm, see timesync.go
+}
+
+func NewMetrics(s *Server) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		Elections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mechat_elections_total",
+			Help: "Elections started by this replica.",
+		}),
+		LeaderChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mechat_leader_changes_total",
+			Help: "Times this replica switched to a different leader.",
+		}),
+		DuplicateRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mechat_duplicate_requests_total",
+			Help: "Writes answered from the request table instead of being applied again.",
+		}),
+		RPCDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mechat_rpc_duration_seconds",
+			Help:    "Time taken to serve an RPC, by method.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"method"}),
+		QueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mechat_sqlite_query_duration_seconds",
+			Help:    "Time taken by SQLite statements, by statement kind.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+		}, []string{"statement"}),
+		peerIndex: make(map[int]int),
+		peerDrift: make(map[int]float64),
+	}
+
+	m.registry.MustRegister(
+		m.Elections,
+		m.LeaderChanges,
+		m.DuplicateRequests,
+		m.RPCDuration,
+		m.QueryDuration,
+		&replicaCollector{server: s, metrics: m},
+		collectors.NewGoCollector(),
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Records the log index a peer reported, as seen by the leader
+func (m *Metrics) SetPeerIndex(peer int, index int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.peerIndex[peer] = index
+}
+
+// Records the drift rate of a peer's clock relative to the leader's
+func (m *Metrics) SetPeerDrift(peer int, ppm float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.peerDrift[peer] = ppm
+}
+
+// Forgets the peer indexes and drifts, they are only meaningful to the leader that collected them
+func (m *Metrics) ResetPeers() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.peerIndex = make(map[int]int)
+	m.peerDrift = make(map[int]float64)
+}
+
+// Copy of the peer indexes
+func (m *Metrics) PeerIndexes() map[int]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	peers := make(map[int]int, len(m.peerIndex))
+	for id, index := range m.peerIndex {
+		peers[id] = index
+	}
+	return peers
+}
+
+// Copy of the peer drift rates
+func (m *Metrics) PeerDrifts() map[int]float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	drifts := make(map[int]float64, len(m.peerDrift))
+	for id, ppm := range m.peerDrift {
+		drifts[id] = ppm
+	}
+	return drifts
+}
+
+/*
+Highest index stored on a majority of the n replicas, given the
+leader's own index and the indexes reported by peers. Peers that
+never reported count as index 0
+*/
+func CommitIndex(own int, peers map[int]int, n int) int {
+	indexes := []int{own}
+	for _, index := range peers {
+		indexes = append(indexes, index)
+	}
+	for len(indexes) < n {
+		indexes = append(indexes, 0)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	return indexes[n/2]
+}
+
+// Times a SQLite statement, labelled by its first keyword (insert, select, ...)
+func (m *Metrics) ObserveQuery(query string, start time.Time) {
+	kind := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		kind = strings.ToLower(fields[0])
+	}
+	m.QueryDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// =================================================
+//  SCRAPE TIME STATE
+// =================================================
+
+var (
+	logIndexDesc = prometheus.NewDesc("mechat_log_index",
+		"Index of the last entry in this replica's log.", nil, nil)
+	commitIndexDesc = prometheus.NewDesc("mechat_commit_index",
+		"Highest index stored on a majority of replicas (followers: last applied index).", nil, nil)
+	replicationLagDesc = prometheus.NewDesc("mechat_replication_lag_entries",
+		"Entries a peer is behind the leader, reported by the leader only.", []string{"peer"}, nil)
+	leaderDesc = prometheus.NewDesc("mechat_leader",
+		"PID of the replica this replica follows, -1 if unknown.", nil, nil)
+	isLeaderDesc = prometheus.NewDesc("mechat_is_leader",
+		"1 if this replica is the leader.", nil, nil)
+	clockOffsetDesc = prometheus.NewDesc("mechat_clock_offset_seconds",
+		"Offset currently applied to the local clock.", nil, nil)
+	clockSlewDesc = prometheus.NewDesc("mechat_clock_slew_remaining_seconds",
+		"Clock correction that is still being slewed in.", nil, nil)
+	clockDriftDesc = prometheus.NewDesc("mechat_clock_drift_ppm",
+		"Drift of a peer's clock relative to the leader's in parts per million, reported by the leader only.", []string{"peer"}, nil)
+	hlcAheadDesc = prometheus.NewDesc("mechat_hlc_remote_ahead_total",
+		"Remote HLC timestamps merged while more than the drift bound ahead of the local clock.", nil, nil)
+	readyDesc = prometheus.NewDesc("mechat_ready",
+		"1 if the replica is ready to serve, see /readyz.", nil, nil)
+)
+
+type replicaCollector struct {
+	server  *Server
+	metrics *Metrics
+}
+
+func (c *replicaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- logIndexDesc
+	ch <- commitIndexDesc
+	ch <- replicationLagDesc
+	ch <- leaderDesc
+	ch <- isLeaderDesc
+	ch <- clockOffsetDesc
+	ch <- clockSlewDesc
+	ch <- clockDriftDesc
+	ch <- hlcAheadDesc
+	ch <- readyDesc
+}
+
+func (c *replicaCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.server
+	own := int(s.logIndex.Load())
+	leader := int(s.leader.Load())
+
+	commit := own
+	isLeader := 0.0
+	if leader == s.PID {
+		isLeader = 1
+		peers := c.metrics.PeerIndexes()
+		commit = CommitIndex(own, peers, len(s.BackupNodes))
+		for id := range s.BackupNodes {
+			if id == s.PID {
+				continue
+			}
+			lag := own - peers[id]
+			ch <- prometheus.MustNewConstMetric(replicationLagDesc, prometheus.GaugeValue, float64(max(lag, 0)), strconv.Itoa(id))
+		}
+		for id, ppm := range c.metrics.PeerDrifts() {
+			ch <- prometheus.MustNewConstMetric(clockDriftDesc, prometheus.GaugeValue, ppm, strconv.Itoa(id))
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(logIndexDesc, prometheus.GaugeValue, float64(own))
+	ch <- prometheus.MustNewConstMetric(commitIndexDesc, prometheus.GaugeValue, float64(commit))
+	ch <- prometheus.MustNewConstMetric(leaderDesc, prometheus.GaugeValue, float64(leader))
+	ch <- prometheus.MustNewConstMetric(isLeaderDesc, prometheus.GaugeValue, isLeader)
+	ch <- prometheus.MustNewConstMetric(clockOffsetDesc, prometheus.GaugeValue, s.ClockOffset().Seconds())
+	ch <- prometheus.MustNewConstMetric(clockSlewDesc, prometheus.GaugeValue, s.Slew.Remaining().Seconds())
+	ch <- prometheus.MustNewConstMetric(hlcAheadDesc, prometheus.CounterValue, float64(s.Clock.AheadMerges()))
+
+	ready := 0.0
+	if s.Health().Ready {
+		ready = 1
+	}
+	ch <- prometheus.MustNewConstMetric(readyDesc, prometheus.GaugeValue, ready)
+}
+
+// =================================================
+//  RPC TIMING
+// =================================================
+
+/*
+Server codec that times every call from reading its header to writing
+its response. net/rpc has no hook around handlers, so the gob codec
+of net/rpc is reproduced here and wrapped.
+*/
+type timedServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	metrics *Metrics
+	mutex   sync.Mutex
+	started map[uint64]time.Time
+	methods map[uint64]string
+}
+
+func newTimedServerCodec(conn io.ReadWriteCloser, metrics *Metrics) *timedServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &timedServerCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		metrics: metrics,
+		started: make(map[uint64]time.Time),
+		methods: make(map[uint64]string),
+	}
+}
+
+func (c *timedServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.started[r.Seq] = time.Now()
+	c.methods[r.Seq] = r.ServiceMethod
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *timedServerCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *timedServerCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	// unknown methods are not recorded, their names come from the caller
+	defer c.observe(r.Seq, strings.HasPrefix(r.Error, "rpc: can't find"))
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header. Should not happen, so if it does,
+			// shut down the connection to signal that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written.
+			// Shut down the connection to signal that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *timedServerCodec) observe(seq uint64, discard bool) {
+	c.mutex.Lock()
+	start, ok := c.started[seq]
+	method := c.methods[seq]
+	delete(c.started, seq)
+	delete(c.methods, seq)
+	c.mutex.Unlock()
+
+	if ok && !discard {
+		c.metrics.RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (c *timedServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitIndex(t *testing.T) {
+	cases := []struct {
+		own   int
+		peers map[int]int
+		n     int
+		want  int
+	}{
+		{5, map[int]int{}, 1, 5},
+		{5, map[int]int{}, 3, 0},
+		{5, map[int]int{0: 5}, 3, 5},
+		{5, map[int]int{0: 3, 1: 1}, 3, 3},
+		{9, map[int]int{0: 9, 1: 2, 2: 2, 3: 1}, 5, 2},
+		{9, map[int]int{0: 9, 1: 8, 2: 2, 3: 1}, 5, 8},
+	}
+	for _, c := range cases {
+		if got := CommitIndex(c.own, c.peers, c.n); got != c.want {
+			t.Errorf("CommitIndex(%d, %v, %d) = %d, want %d", c.own, c.peers, c.n, got, c.want)
+		}
+	}
+}
+
+// Scrapes /metrics of a node and returns the exposition text
+func scrape(t *testing.T, server *Server) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.Metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+func TestMetricsReportReplicationState(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+
+	// lag drops to zero once the leader has heard back from both peers
+	var text string
+	eventually(t, 5*time.Second, func() bool {
+		text = scrape(t, c.node(leader))
+		return strings.Contains(text, `mechat_replication_lag_entries{peer="0"} 0`) &&
+			strings.Contains(text, `mechat_replication_lag_entries{peer="1"} 0`)
+	}, "replication lag to reach zero")
+
+	// drift is known once the leader has three clock samples of a peer
+	eventually(t, 5*time.Second, func() bool {
+		text = scrape(t, c.node(leader))
+		return strings.Contains(text, `mechat_clock_drift_ppm{peer="0"}`) &&
+			strings.Contains(text, `mechat_clock_drift_ppm{peer="1"}`)
+	}, "clock drift of the peers")
+
+	for _, want := range []string{
+		"mechat_log_index 2",
+		"mechat_commit_index 2",
+		"mechat_is_leader 1",
+		"mechat_leader 2",
+		`mechat_rpc_duration_seconds_count{method="MessageHandler.CreateAccount"} 2`,
+		`mechat_sqlite_query_duration_seconds_count{statement="insert"} 2`,
+		"mechat_clock_offset_seconds",
+		"mechat_hlc_remote_ahead_total 0",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("leader metrics missing %q", want)
+		}
+	}
+
+	// followers applied the entries but know nothing about their peers
+	follower := scrape(t, c.node(0))
+	for _, want := range []string{"mechat_log_index 2", "mechat_is_leader 0", "mechat_leader 2"} {
+		if !strings.Contains(follower, want) {
+			t.Errorf("follower metrics missing %q", want)
+		}
+	}
+	if strings.Contains(follower, "mechat_replication_lag_entries{") {
+		t.Errorf("follower reports replication lag")
+	}
+}
+
+func TestMetricsCountElections(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	c.crash(2)
+	c.waitForLeader(5*time.Second, 0, 1)
+
+	text := scrape(t, c.node(1))
+	if metricValue(t, text, "mechat_leader") != 1 {
+		t.Errorf("node 1 does not report itself as leader")
+	}
+	if metricValue(t, text, "mechat_elections_total") < 1 {
+		t.Errorf("no election counted after the leader crashed")
+	}
+	// unknown -> 2, then 2 -> 1
+	if metricValue(t, text, "mechat_leader_changes_total") < 2 {
+		t.Errorf("leader change to node 1 not counted")
+	}
+}
+
+func TestMetricsServedOverHTTP(t *testing.T) {
+	addrs := freeAddresses(t, 2)
+	server, err := NewServer(ServerOptions{
+		PID:          0,
+		Replicas:     addrs[:1],
+		DataDir:      t.TempDir(),
+		HTTPAddress:  addressString(addrs[1]),
+		ElectionWait: TEST_ELECTION_WAIT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Transport = NewMemoryTransport()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	resp, err := http.Get("http://" + addressString(addrs[1]) + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "mechat_log_index 0") {
+		t.Errorf("unexpected /metrics body:\n%s", body)
+	}
+}
+
+// Value of an unlabelled metric in exposition text
+func metricValue(t *testing.T, text string, name string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == name {
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return value
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
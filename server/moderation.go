@@ -0,0 +1,261 @@
+package main
+
+/*
+Blocking, send rate limits and message reports.
+
+A block is a row in contacts from the blocked user towards the user
+who blocked them, with status CONTACT_BLOCKED, the same row an
+answered contact request leaves behind. Inserting it drops any other
+contact or request between the two (trigger contact_blocked), and
+while it exists messages between them are refused and neither sees
+the other in the user directory.
+
+Rate limits are kept in the leader's memory and start over after a
+leader change. Reports are replicated with a copy of the reported
+text, so deleting the message afterwards does not hide it from
+moderators.
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SEND_RATE  = 60 // messages per minute and user
+	DEFAULT_SEND_BURST = 20 // messages a user may send at once
+	MAX_REPORT_REASON  = 1000
+)
+
+// JSON object, UserId blocks or unblocks BlockedId
+type BlockUserRequest struct {
+	UserId    int
+	BlockedId int
+}
+
+// JSON object, a user reports a message they sent or received
+type ReportRequest struct {
+	UserId int
+	HLC    string // the reported message
+	Reason string
+}
+
+// =================================================
+//  BLOCKING
+// =================================================
+
+// Whether either user blocked the other
+func (t *MessageHandler) isBlocked(user int, other int) (bool, error) {
+	query := `SELECT 1 FROM contacts
+            WHERE status = 'blocked'
+            AND ((userid = ? AND contactid = ?) OR (userid = ? AND contactid = ?))`
+	rows, err := t.server.Query(query, user, other, other, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// RPC: stops BlockedId from messaging UserId or sending contact requests
+func (t *MessageHandler) BlockUser(message *BlockUserRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if message.UserId == message.BlockedId {
+		response.Message = "error"
+		return fmt.Errorf("cannot block yourself")
+	}
+
+	status, err := t.contactStatus(message.BlockedId, message.UserId)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	if status != CONTACT_BLOCKED {
+		err = t.changeContact(nil, `INSERT INTO contacts
+				(userid, contactid, status) VALUES (?, ?, 'blocked')`, message.BlockedId, message.UserId)
+		if err != nil {
+			response.Message = "error"
+			return err
+		}
+		t.server.logger.Info("User blocked", "user", message.UserId, "blocked", message.BlockedId)
+	}
+	response.Message = CONTACT_BLOCKED
+	return nil
+}
+
+// RPC: lifts a block, the users are not contacts again until a request is accepted
+func (t *MessageHandler) UnblockUser(message *BlockUserRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	status, err := t.contactStatus(message.BlockedId, message.UserId)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	if status != CONTACT_BLOCKED {
+		response.Message = "error"
+		return fmt.Errorf("user is not blocked")
+	}
+
+	err = t.changeContact(nil, `DELETE FROM contacts
+				WHERE userid = ? AND contactid = ? AND status = 'blocked'`, message.BlockedId, message.UserId)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	t.server.logger.Info("User unblocked", "user", message.UserId, "blocked", message.BlockedId)
+	response.Message = "ACK"
+	return nil
+}
+
+// RPC: users that UserId blocked
+func (t *MessageHandler) GetBlockedUsers(message *UserProfile, contacts *Contacts) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	query := `SELECT
+                U.userid,
+                U.email,
+                U.firstname,
+                U.lastname,
+                U.descr
+                FROM contacts C
+                INNER JOIN users U
+                ON U.userid = C.userid
+                WHERE C.contactid = ? AND C.status = 'blocked'
+                ORDER BY C.rec_id`
+
+	var err error
+	contacts.ContactList, err = t.queryProfiles(query, message.UserId)
+	return err
+}
+
+// =================================================
+//  SEND RATE LIMITS
+// =================================================
+
+/*
+Token bucket per user: a user may send burst messages at once, then
+rate messages per minute
+*/
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[int]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets kept before full ones are dropped
+const RATE_LIMITER_SIZE = 10000
+
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[int]*tokenBucket),
+	}
+}
+
+// Takes a token from the user's bucket, false if it is empty
+func (l *rateLimiter) allow(user int, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[user]
+	if !ok {
+		if len(l.buckets) >= RATE_LIMITER_SIZE {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[user] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drops buckets that have refilled, a new bucket starts full anyway
+func (l *rateLimiter) prune(now time.Time) {
+	for user, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, user)
+		}
+	}
+}
+
+// =================================================
+//  REPORTS
+// =================================================
+
+// RPC: records a report on a message the user sent or received
+func (t *MessageHandler) ReportMessage(message *ReportRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if len(message.Reason) > MAX_REPORT_REASON {
+		response.Message = "error"
+		return fmt.Errorf("reason is longer than %d bytes", MAX_REPORT_REASON)
+	}
+
+	rows, err := t.server.Query(`SELECT 1 FROM messages
+            WHERE hlc = ? AND (from_userid = ? OR to_userid = ?)`, message.HLC, message.UserId, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		response.Message = "error"
+		return err
+	}
+	found := rows.Next()
+	rows.Close()
+	if !found {
+		response.Message = "error"
+		return fmt.Errorf("no such message")
+	}
+
+	// copies the text as it is now, one report per user and message
+	stamp := t.server.Clock.Now()
+	script := `INSERT OR IGNORE INTO reports
+				(message_hlc, from_userid, message, reporter, reason, reported_hlc)
+				SELECT hlc, from_userid, message, ?, ?, ? FROM messages WHERE hlc = ?`
+	args := []any{message.UserId, t.server.Keyring.SealField(message.Reason), stamp.String(), message.HLC}
+
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, HLC: stamp}, nil); err != nil {
+		t.server.logger.Error("Error saving report", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	t.server.logger.Info("Message reported", "user", message.UserId, "message", message.HLC)
+	response.Message = "ACK"
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockUser(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		c.createUser(leader, email)
+	}
+
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 2, ContactId: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: 1, ContactId: 2, Response: CONTACT_ACCEPTED}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	c.sendMessage(leader, 2, 1, "hi")
+
+	// 1 blocks 2: the contact is gone and 2 cannot write or ask again
+	if err := c.client(leader).Call("MessageHandler.BlockUser", &BlockUserRequest{UserId: 1, BlockedId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	send := func(from int, to int) error {
+		var reply string
+		msg := ChatMessage{Message: "spam", Timestamp: "12:00", From: from, To: to, Acked: 1}
+		return c.client(leader).Call("MessageHandler.SaveMessage", &msg, &reply)
+	}
+	for _, pair := range [][2]int{{2, 1}, {1, 2}} {
+		if err := send(pair[0], pair[1]); err == nil || !strings.Contains(err.Error(), "blocked") {
+			t.Errorf("message %d -> %d after block: %v", pair[0], pair[1], err)
+		}
+	}
+	// refused messages do not count against the send rate limit
+	for i := 0; i < 2*DEFAULT_SEND_BURST; i++ {
+		if err := send(2, 1); err == nil || !strings.Contains(err.Error(), "blocked") {
+			t.Fatalf("message %d after block: %v", i, err)
+		}
+	}
+	if err := c.client(leader).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: 2, ContactId: 1}, &resp); err == nil {
+		t.Error("blocked user sent a contact request")
+	}
+	if len(getContacts(t, c, leader, 1).ContactList) != 0 || len(getContacts(t, c, leader, 2).ContactList) != 0 {
+		t.Error("contact kept after block")
+	}
+	var blocked Contacts
+	if err := c.client(leader).Call("MessageHandler.GetBlockedUsers", &UserProfile{UserId: 1}, &blocked); err != nil || len(blocked.ContactList) != 1 || blocked.ContactList[0].UserId != 2 {
+		t.Errorf("blocked users of 1: %+v %v", blocked.ContactList, err)
+	}
+	if err := send(3, 1); err != nil {
+		t.Errorf("unrelated user: %v", err)
+	}
+
+	// a report keeps the text even after the sender deletes it
+	hlc := getMessages(t, c, leader, 1, 2)[0].HLC
+	if err := c.client(leader).Call("MessageHandler.ReportMessage", &ReportRequest{UserId: 3, HLC: hlc, Reason: "not mine"}, &resp); err == nil {
+		t.Error("third user reported a message they did not receive")
+	}
+	if err := c.client(leader).Call("MessageHandler.ReportMessage", &ReportRequest{UserId: 1, HLC: hlc, Reason: "harassment"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.DeleteMessage", &EditMessageRequest{UserId: 2, HLC: hlc}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.client(leader).Call("MessageHandler.UnblockUser", &BlockUserRequest{UserId: 1, BlockedId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(2, 1); err != nil {
+		t.Errorf("message after unblock: %v", err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+	if dump := c.dumpDatabase(0); !strings.Contains(dump, "hi 1 harassment") {
+		t.Errorf("report missing on follower:\n%s", dump)
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	start := time.Unix(0, 0)
+	limiter := newRateLimiter(60, 3)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow(1, start) {
+			t.Fatalf("message %d of the burst refused", i)
+		}
+	}
+	if limiter.allow(1, start) {
+		t.Error("message over the burst allowed")
+	}
+	if !limiter.allow(2, start) {
+		t.Error("other user limited")
+	}
+	if !limiter.allow(1, start.Add(time.Second)) || limiter.allow(1, start.Add(time.Second)) {
+		t.Error("expected one message per second after the burst")
+	}
+
+	// refilled buckets are dropped when the limiter fills up
+	limiter.prune(start.Add(time.Minute))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("%d buckets left after prune", len(limiter.buckets))
+	}
+}
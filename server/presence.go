@@ -0,0 +1,256 @@
+package main
+
+/*
+Presence and typing indicators.
+
+Both are ephemeral: the leader keeps them in memory, they never go
+through the log and a replica that is not the leader answers "not the
+leader node". Gateways call Heartbeat for every logged-in user and
+SetTyping while a user types; a user is online while heartbeats keep
+coming, away if the last one said so, and offline once none came for
+PRESENCE_TIMEOUT. Typing stops by itself after TYPING_TIMEOUT.
+
+A new leader starts empty. Every gateway keeps what it sent and
+reports all of it with ReportPresence when it finds a new leader and
+every PRESENCE_REPORT_INTERVAL (see client.go), so presence is rebuilt
+within a few seconds of a failover. Times are sent as ages, how long
+ago the gateway heard from the user, so gateway and leader clocks do
+not have to agree.
+
+Users only see the presence of their accepted contacts.
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	PRESENCE_TIMEOUT = 30 * time.Second // without a heartbeat a user is offline
+	TYPING_TIMEOUT   = 6 * time.Second  // typing stops unless it is repeated
+	MAX_PRESENCE_IDS = 1000             // users asked for at once
+
+	PRESENCE_ONLINE  = "online"
+	PRESENCE_AWAY    = "away"
+	PRESENCE_OFFLINE = "offline"
+)
+
+// JSON object, a heartbeat of a logged-in user
+type PresenceHeartbeat struct {
+	UserId int
+	Away   bool          // the client is idle
+	Age    time.Duration // how long ago the user was seen, 0 for now
+}
+
+// JSON object, UserId started or stopped typing to ContactId
+type TypingUpdate struct {
+	UserId    int
+	ContactId int
+	Typing    bool
+	Age       time.Duration // how long ago the user said so, 0 for now
+}
+
+// JSON object, everything a gateway knows, sent to a new leader
+type PresenceReport struct {
+	Heartbeats []PresenceHeartbeat
+	Typing     []TypingUpdate
+}
+
+// JSON object, asks for the presence of ContactId, or of every contact when 0
+type PresenceRequest struct {
+	UserId    int
+	ContactId int
+}
+
+// JSON object, presence of a contact as seen by the requesting user
+type PresenceInfo struct {
+	UserId   int
+	Status   string // online, away or offline
+	LastSeen string // RFC 3339, empty if the leader never heard of the user
+	Typing   bool   // typing to the requesting user
+}
+
+// JSON object, presence of several contacts
+type PresenceList struct {
+	Users []PresenceInfo
+}
+
+type presence struct {
+	seen time.Time
+	away bool
+}
+
+// Leader only: presence by user and typing expiry by {user, contact}
+type presenceTable struct {
+	mutex  sync.Mutex
+	users  map[int]presence
+	typing map[[2]int]time.Time
+}
+
+// Records a heartbeat, an older one than already known is ignored
+func (p *presenceTable) heartbeat(user int, away bool, seen time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if current, ok := p.users[user]; !ok || !seen.Before(current.seen) {
+		p.users[user] = presence{seen: seen, away: away}
+	}
+}
+
+func (p *presenceTable) setTyping(user int, contact int, typing bool, at time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := [2]int{user, contact}
+	if !typing {
+		delete(p.typing, key)
+		return
+	}
+	if until := at.Add(TYPING_TIMEOUT); until.After(p.typing[key]) {
+		p.typing[key] = until
+	}
+
+	// nobody asks for most of them before they expire
+	for other, until := range p.typing {
+		if until.Before(at) {
+			delete(p.typing, other)
+		}
+	}
+}
+
+// Presence of user as seen by viewer at now
+func (p *presenceTable) info(user int, viewer int, now time.Time) PresenceInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info := PresenceInfo{UserId: user, Status: PRESENCE_OFFLINE}
+	if current, ok := p.users[user]; ok {
+		info.LastSeen = current.seen.UTC().Format(time.RFC3339)
+		if now.Sub(current.seen) < PRESENCE_TIMEOUT {
+			info.Status = PRESENCE_ONLINE
+			if current.away {
+				info.Status = PRESENCE_AWAY
+			}
+		}
+	}
+	key := [2]int{user, viewer}
+	if until, ok := p.typing[key]; ok {
+		if now.Before(until) && info.Status != PRESENCE_OFFLINE {
+			info.Typing = true
+		} else if !now.Before(until) {
+			delete(p.typing, key)
+		}
+	}
+	return info
+}
+
+// RPC: records that a logged-in user is still there
+func (t *MessageHandler) Heartbeat(message *PresenceHeartbeat, response *RPCResponse) error {
+	// Only the leader keeps presence
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if message.UserId <= 0 || message.Age < 0 {
+		response.Message = "error"
+		return fmt.Errorf("invalid heartbeat")
+	}
+
+	t.server.presence.heartbeat(message.UserId, message.Away, t.server.Now().Add(-message.Age))
+	response.Message = "ACK"
+	return nil
+}
+
+// RPC: UserId started or stopped typing to ContactId
+func (t *MessageHandler) SetTyping(message *TypingUpdate, response *RPCResponse) error {
+	// Only the leader keeps presence
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if message.UserId <= 0 || message.ContactId <= 0 || message.Age < 0 {
+		response.Message = "error"
+		return fmt.Errorf("invalid typing update")
+	}
+
+	// typing is a sign of life too
+	at := t.server.Now().Add(-message.Age)
+	t.server.presence.heartbeat(message.UserId, false, at)
+	t.server.presence.setTyping(message.UserId, message.ContactId, message.Typing, at)
+	response.Message = "ACK"
+	return nil
+}
+
+// RPC: merges the presence a gateway knows, newer state wins
+func (t *MessageHandler) ReportPresence(message *PresenceReport, response *RPCResponse) error {
+	// Only the leader keeps presence
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	now := t.server.Now()
+	for _, heartbeat := range message.Heartbeats {
+		if heartbeat.UserId > 0 && heartbeat.Age >= 0 {
+			t.server.presence.heartbeat(heartbeat.UserId, heartbeat.Away, now.Add(-heartbeat.Age))
+		}
+	}
+	for _, typing := range message.Typing {
+		if typing.UserId > 0 && typing.ContactId > 0 && typing.Typing && typing.Age >= 0 {
+			t.server.presence.setTyping(typing.UserId, typing.ContactId, true, now.Add(-typing.Age))
+		}
+	}
+
+	t.server.logger.Debug("Presence reported", "users", len(message.Heartbeats), "typing", len(message.Typing))
+	response.Message = "ACK"
+	return nil
+}
+
+// Accepted contacts of user, or only contact if it is one
+func (t *MessageHandler) acceptedContacts(user int, contact int) ([]int, error) {
+	query := `SELECT contactid FROM contacts WHERE userid = ? AND status = 'accepted'`
+	args := []any{user}
+	if contact != 0 {
+		query += ` AND contactid = ?`
+		args = append(args, contact)
+	}
+	rows, err := t.server.Query(query+` ORDER BY contactid LIMIT ?`, append(args, MAX_PRESENCE_IDS)...)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return nil, err
+		}
+		contacts = append(contacts, id)
+	}
+	return contacts, rows.Err()
+}
+
+// RPC: presence of the user's contacts, and whether they are typing to the user
+func (t *MessageHandler) GetPresence(message *PresenceRequest, list *PresenceList) error {
+	// Only the leader keeps presence
+	if t.server.LeaderID() != t.server.PID {
+		return fmt.Errorf("not the leader node")
+	}
+
+	contacts, err := t.acceptedContacts(message.UserId, message.ContactId)
+	if err != nil {
+		return err
+	}
+	if message.ContactId != 0 && len(contacts) == 0 {
+		return fmt.Errorf("presence of a user who is not a contact is not allowed")
+	}
+
+	now := t.server.Now()
+	list.Users = []PresenceInfo{}
+	for _, contact := range contacts {
+		list.Users = append(list.Users, t.server.presence.info(contact, message.UserId, now))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func getPresence(t *testing.T, c *testCluster, i int, user int) map[int]PresenceInfo {
+	t.Helper()
+	var list PresenceList
+	if err := c.client(i).Call("MessageHandler.GetPresence", &PresenceRequest{UserId: user}, &list); err != nil {
+		t.Fatalf("presence for user %d: %v", user, err)
+	}
+	users := make(map[int]PresenceInfo)
+	for _, info := range list.Users {
+		users[info.UserId] = info
+	}
+	return users
+}
+
+func makeContacts(t *testing.T, c *testCluster, i int, user int, contact int) {
+	t.Helper()
+	var resp RPCResponse
+	if err := c.client(i).Call("MessageHandler.SendContactRequest", &AddContactMessage{UserId: user, ContactId: contact}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(i).Call("MessageHandler.RespondContactRequest", &ContactResponse{UserId: contact, ContactId: user, Response: CONTACT_ACCEPTED}, &resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.createUser(leader, "c@example.com")
+	makeContacts(t, c, leader, 1, 2)
+	makeContacts(t, c, leader, 1, 3)
+
+	var resp RPCResponse
+	follower := (leader + 1) % 3
+	if err := c.client(follower).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 2}, &resp); err == nil || !strings.Contains(err.Error(), "not the leader") {
+		t.Errorf("heartbeat on a follower: %v", err)
+	}
+
+	if err := c.client(leader).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	users := getPresence(t, c, leader, 1)
+	if len(users) != 2 || users[2].Status != PRESENCE_ONLINE || users[2].LastSeen == "" {
+		t.Fatalf("presence: %+v", users)
+	}
+	if users[3].Status != PRESENCE_OFFLINE || users[3].LastSeen != "" {
+		t.Errorf("user never seen: %+v", users[3])
+	}
+
+	if err := c.client(leader).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 3, Age: 2 * PRESENCE_TIMEOUT}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 2, Away: true}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	users = getPresence(t, c, leader, 1)
+	if users[2].Status != PRESENCE_AWAY || users[3].Status != PRESENCE_OFFLINE || users[3].LastSeen == "" {
+		t.Errorf("away and last seen: %+v", users)
+	}
+
+	// typing shows to the contact it is typed to only
+	if err := c.client(leader).Call("MessageHandler.SetTyping", &TypingUpdate{UserId: 2, ContactId: 1, Typing: true}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if users = getPresence(t, c, leader, 1); !users[2].Typing || users[2].Status != PRESENCE_ONLINE {
+		t.Errorf("typing: %+v", users[2])
+	}
+	if others := getPresence(t, c, leader, 3); len(others) != 1 || others[1].Typing {
+		t.Errorf("typing seen by another user: %+v", others)
+	}
+	if err := c.client(leader).Call("MessageHandler.SetTyping", &TypingUpdate{UserId: 2, ContactId: 1, Typing: true, Age: TYPING_TIMEOUT}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(leader).Call("MessageHandler.SetTyping", &TypingUpdate{UserId: 2, ContactId: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if users = getPresence(t, c, leader, 1); users[2].Typing {
+		t.Errorf("typing not stopped: %+v", users[2])
+	}
+
+	var list PresenceList
+	err := c.client(leader).Call("MessageHandler.GetPresence", &PresenceRequest{UserId: 2, ContactId: 3}, &list)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("presence of a stranger: %v", err)
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+}
+
+func TestPresenceRebuiltAfterFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	makeContacts(t, c, leader, 1, 2)
+
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 2}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	others := []int{}
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	c.waitForConsistency(5*time.Second, leader, others...)
+	c.crash(leader)
+	next := c.waitForLeader(10*time.Second, others...)
+
+	// presence is not replicated, the gateways report it again
+	if users := getPresence(t, c, next, 1); users[2].LastSeen != "" {
+		t.Errorf("presence replicated: %+v", users[2])
+	}
+	report := PresenceReport{
+		Heartbeats: []PresenceHeartbeat{{UserId: 2, Age: time.Second}, {UserId: 1}},
+		Typing:     []TypingUpdate{{UserId: 2, ContactId: 1, Typing: true, Age: time.Second}},
+	}
+	if err := c.client(next).Call("MessageHandler.ReportPresence", &report, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if users := getPresence(t, c, next, 1); users[2].Status != PRESENCE_ONLINE || !users[2].Typing {
+		t.Errorf("presence after the report: %+v", users[2])
+	}
+
+	// a report never moves presence back in time
+	if err := c.client(next).Call("MessageHandler.Heartbeat", &PresenceHeartbeat{UserId: 2, Away: true}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client(next).Call("MessageHandler.ReportPresence", &report, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if users := getPresence(t, c, next, 1); users[2].Status != PRESENCE_AWAY {
+		t.Errorf("older report replaced a heartbeat: %+v", users[2])
+	}
+	c.waitForConsistency(5*time.Second, next, others...)
+}
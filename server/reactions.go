@@ -0,0 +1,272 @@
+package main
+
+/*
+Reactions and replies.
+
+A message may reply to an earlier message of the same conversation:
+ReplyToId holds the HLC of the message it quotes, the ID every other
+RPC uses for messages. The reply is kept if the quoted message is
+deleted later, clients then quote the tombstone. Threads are built by
+clients from ReplyToId, GetMessages returns whole conversations.
+
+Reactions are emoji the sender or recipient of a message put on it,
+each user at most once per emoji and MAX_USER_REACTIONS per message.
+Each add or remove is one replicated statement on the reactions table
+that repeats the checks of the leader in its WHERE clause. GetMessages
+and Sync return them aggregated per emoji, with whether the requesting
+user is one of the reactors. Adding or removing a reaction appends a
+change for the message (triggers reaction_added_change and
+reaction_removed_change), deleting a message drops its reactions.
+
+Reactions are not encrypted, also not on encrypted messages.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MAX_REACTION_LENGTH = 32 // bytes, an emoji with modifiers fits
+	MAX_USER_REACTIONS  = 10 // different emoji of one user on a message
+	REACTIONS_BATCH     = 500
+)
+
+// JSON object, UserId adds or removes Emoji on the message HLC
+type ReactionRequest struct {
+	UserId int
+	HLC    string
+	Emoji  string
+}
+
+// JSON object, how many users reacted to a message with Emoji
+type ReactionCount struct {
+	Emoji string
+	Count int
+	Mine  bool // the requesting user is one of them
+}
+
+/*
+Whether text can be a reaction: a short string without letters,
+digits on their own, spaces or control characters. It is not checked
+against the Unicode list of emoji
+*/
+func validReaction(text string) bool {
+	if text == "" || len(text) > MAX_REACTION_LENGTH || !utf8.ValidString(text) {
+		return false
+	}
+	symbol := false
+	for _, r := range text {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return false
+		}
+		symbol = symbol || r > unicode.MaxASCII
+	}
+	return symbol
+}
+
+/*
+Checks that hlc is a message between user and contact, in either
+direction, so a reply stays in its conversation
+*/
+func (t *MessageHandler) checkReply(user int, contact int, hlc string) error {
+	rows, err := t.server.Query(`SELECT 1 FROM messages WHERE hlc = ?
+            AND ((from_userid = ? AND to_userid = ?) OR (from_userid = ? AND to_userid = ?))`,
+		hlc, user, contact, contact, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return fmt.Errorf("no such message to reply to")
+	}
+	return nil
+}
+
+/*
+Checks that a message exists, was not deleted and is one the user
+sent or received, and that the two users did not block each other
+*/
+func (t *MessageHandler) checkReactor(user int, hlc string) error {
+	rows, err := t.server.Query(`SELECT from_userid, to_userid, deleted FROM messages
+            WHERE hlc = ? AND (from_userid = ? OR to_userid = ?)`, hlc, user, user)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	if !rows.Next() {
+		rows.Close()
+		return fmt.Errorf("no such message")
+	}
+	var from, to int
+	var deleted bool
+	err = rows.Scan(&from, &to, &deleted)
+	rows.Close()
+	if err != nil {
+		t.server.logger.Error("Scan failed", "err", err)
+		return err
+	}
+	if deleted {
+		return fmt.Errorf("message was deleted")
+	}
+
+	other := to
+	if other == user {
+		other = from
+	}
+	blocked, err := t.isBlocked(user, other)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return fmt.Errorf("messages between these users are blocked")
+	}
+	return nil
+}
+
+// RPC: adds a reaction of the user to a message, adding it again changes nothing
+func (t *MessageHandler) AddReaction(message *ReactionRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+	if !validReaction(message.Emoji) {
+		response.Message = "error"
+		return fmt.Errorf("invalid reaction, expected an emoji of at most %d bytes", MAX_REACTION_LENGTH)
+	}
+	if err := t.checkReactor(message.UserId, message.HLC); err != nil {
+		response.Message = "error"
+		return err
+	}
+
+	rows, err := t.server.Query(`SELECT COUNT(*), COALESCE(MAX(emoji = ?), 0) FROM reactions
+            WHERE message_hlc = ? AND userid = ?`, message.Emoji, message.HLC, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		response.Message = "error"
+		return err
+	}
+	var count int
+	var exists bool
+	rows.Next()
+	err = rows.Scan(&count, &exists)
+	rows.Close()
+	if err != nil {
+		t.server.logger.Error("Scan failed", "err", err)
+		response.Message = "error"
+		return err
+	}
+	if exists {
+		response.Message = "ACK"
+		return nil
+	}
+	if count >= MAX_USER_REACTIONS {
+		response.Message = "error"
+		return fmt.Errorf("at most %d reactions per message are allowed", MAX_USER_REACTIONS)
+	}
+
+	stamp := t.server.Clock.Now()
+	script := `INSERT OR IGNORE INTO reactions (message_hlc, userid, emoji, reacted_hlc)
+				SELECT hlc, ?, ?, ? FROM messages
+				WHERE hlc = ? AND deleted = 0 AND (from_userid = ? OR to_userid = ?)`
+	args := []any{message.UserId, message.Emoji, stamp.String(), message.HLC, message.UserId, message.UserId}
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, HLC: stamp}, nil); err != nil {
+		t.server.logger.Error("Error adding reaction", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	t.server.logger.Debug("Reaction added", "user", message.UserId, "message", message.HLC)
+	response.Message = "ACK"
+	return nil
+}
+
+// RPC: removes a reaction of the user, removing one that is not there changes nothing
+func (t *MessageHandler) RemoveReaction(message *ReactionRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	rows, err := t.server.Query(`SELECT 1 FROM reactions WHERE message_hlc = ? AND userid = ? AND emoji = ?`,
+		message.HLC, message.UserId, message.Emoji)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		response.Message = "error"
+		return err
+	}
+	found := rows.Next()
+	rows.Close()
+	if !found {
+		response.Message = "ACK"
+		return nil
+	}
+
+	_, err = t.execReplicated(`DELETE FROM reactions WHERE message_hlc = ? AND userid = ? AND emoji = ?`,
+		message.HLC, message.UserId, message.Emoji)
+	if err != nil {
+		t.server.logger.Error("Error removing reaction", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	t.server.logger.Debug("Reaction removed", "user", message.UserId, "message", message.HLC)
+	response.Message = "ACK"
+	return nil
+}
+
+/*
+Sets Reactions of each message, counted per emoji in the order they
+were first used. viewer is the user the messages are returned to
+*/
+func (t *MessageHandler) addReactions(viewer int, messages []ChatMessage) error {
+	byHLC := make(map[string]*ChatMessage, len(messages))
+	var hlcs []any
+	for i := range messages {
+		if messages[i].HLC != "" && !messages[i].Deleted {
+			byHLC[messages[i].HLC] = &messages[i]
+			hlcs = append(hlcs, messages[i].HLC)
+		}
+	}
+
+	for start := 0; start < len(hlcs); start += REACTIONS_BATCH {
+		batch := hlcs[start:min(start+REACTIONS_BATCH, len(hlcs))]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := t.server.Query(`SELECT message_hlc, emoji, COUNT(*), MAX(userid = ?)
+                FROM reactions WHERE message_hlc IN (`+placeholders+`)
+                GROUP BY message_hlc, emoji
+                ORDER BY message_hlc, MIN(rec_id)`, append([]any{viewer}, batch...)...)
+		if err != nil {
+			t.server.logger.Error("Query failed", "err", err)
+			return err
+		}
+		for rows.Next() {
+			var hlc string
+			var reaction ReactionCount
+			if err := rows.Scan(&hlc, &reaction.Emoji, &reaction.Count, &reaction.Mine); err != nil {
+				rows.Close()
+				t.server.logger.Error("Scan failed", "err", err)
+				return err
+			}
+			msg := byHLC[hlc]
+			msg.Reactions = append(msg.Reactions, reaction)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
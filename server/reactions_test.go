@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func react(c *testCluster, i int, funcName string, user int, hlc string, emoji string) error {
+	var resp RPCResponse
+	return c.client(i).Call("MessageHandler."+funcName, &ReactionRequest{UserId: user, HLC: hlc, Emoji: emoji}, &resp)
+}
+
+func TestReactionsAndReplies(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.createUser(leader, "a@example.com")
+	c.createUser(leader, "b@example.com")
+	c.createUser(leader, "c@example.com")
+	session := loginDevice(t, c, leader, "b@example.com", "")
+	c.sendMessage(leader, 1, 2, "lunch?")
+	c.sendMessage(leader, 1, 3, "elsewhere")
+	first := getMessages(t, c, leader, 1, 2)[0].HLC
+	other := getMessages(t, c, leader, 1, 3)[0].HLC
+
+	// a reply quotes a message of its own chat only
+	var ack string
+	reply := ChatMessage{From: 2, To: 1, Message: "sure", ReplyToId: first}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &reply, &ack); err != nil {
+		t.Fatal(err)
+	}
+	stray := ChatMessage{From: 2, To: 1, Message: "what?", ReplyToId: other}
+	if err := c.client(leader).Call("MessageHandler.SaveMessage", &stray, &ack); err == nil || !strings.Contains(err.Error(), "no such message") {
+		t.Errorf("reply to another chat: %v", err)
+	}
+
+	for _, r := range []struct {
+		user  int
+		emoji string
+	}{{2, "👍"}, {1, "👍"}, {2, "❤️"}, {2, "👍"}} {
+		if err := react(c, leader, "AddReaction", r.user, first, r.emoji); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := react(c, leader, "AddReaction", 3, first, "👍"); err == nil || !strings.Contains(err.Error(), "no such message") {
+		t.Errorf("reaction of a third user: %v", err)
+	}
+	for _, emoji := range []string{"", "like", "👍 👍", strings.Repeat("👍", 10)} {
+		if err := react(c, leader, "AddReaction", 1, first, emoji); err == nil || !strings.Contains(err.Error(), "invalid reaction") {
+			t.Errorf("reaction %q: %v", emoji, err)
+		}
+	}
+
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	follower := (leader + 1) % 3
+	messages := getMessages(t, c, follower, 1, 2)
+	if len(messages) != 2 || messages[1].ReplyToId != first || messages[0].ReplyToId != "" {
+		t.Fatalf("messages: %+v", messages)
+	}
+	want := []ReactionCount{{"👍", 2, true}, {"❤️", 1, false}}
+	if got := messages[0].Reactions; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("reactions seen by the sender: %+v", got)
+	}
+	if got := getMessages(t, c, follower, 2, 1)[0].Reactions; len(got) != 2 || !got[1].Mine {
+		t.Errorf("reactions seen by the recipient: %+v", got)
+	}
+
+	// removing is synced like an edit, removing twice changes nothing
+	result := syncDevice(t, c, leader, 2, session.DeviceId, session.Cursor)
+	for i := 0; i < 2; i++ {
+		if err := react(c, leader, "RemoveReaction", 2, first, "❤️"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result = syncDevice(t, c, leader, 2, session.DeviceId, result.Cursor)
+	if len(result.Messages) != 1 || result.Messages[0].HLC != first || len(result.Messages[0].Reactions) != 1 {
+		t.Errorf("sync after removing a reaction: %+v", result.Messages)
+	}
+
+	// a deleted message loses its reactions, replies keep quoting it
+	var resp RPCResponse
+	if err := c.client(leader).Call("MessageHandler.DeleteMessage", &EditMessageRequest{UserId: 1, HLC: first}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := react(c, leader, "AddReaction", 2, first, "👍"); err == nil || !strings.Contains(err.Error(), "deleted") {
+		t.Errorf("reaction to a deleted message: %v", err)
+	}
+	c.waitForConsistency(5*time.Second, leader, 0, 1, 2)
+	messages = getMessages(t, c, follower, 2, 1)
+	if len(messages[0].Reactions) != 0 || len(columnValues(c, follower, "reactions", "emoji")) != 0 || messages[1].ReplyToId != first {
+		t.Errorf("messages after the delete: %+v", messages)
+	}
+}
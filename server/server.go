@@ -13,10 +13,13 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	_ "modernc.org/sqlite"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"path/filepath"
@@ -24,8 +27,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	_ "modernc.org/sqlite"
 )
 
 // Struct to store address/port for replicas
@@ -36,51 +39,127 @@ type ReplicaAddress struct {
 
 type LogStatus struct {
 	LogIndex int
+	HLC      HLCTimestamp
 }
 
-var ADDRESS_OFFSET uint32
-var TIMESTAMP_OFFSET int = 0
+// The metrics HTTP server of a replica listens this far above its RPC port, unless configured
+var HTTP_PORT_OFFSET = 1000
 
 // Server struct to encapsulate server state
 type Server struct {
-	PID             int
-	Active          bool // Is server ready to accept connections?
-	IsLeader        bool
-	DB              *sql.DB
-	LogDir          string
-	LogIndex        int
-	LogMutex        sync.Mutex
-	BackupNodes     []ReplicaAddress
-	AddressPort     ReplicaAddress
-	LeaderID        int
-	Running         bool
-	TimestampOffset time.Duration
+	PID         int
+	DB          *sql.DB
+	LogDir      string
+	LogMutex    sync.Mutex
+	BackupNodes []ReplicaAddress
+	AddressPort ReplicaAddress
+	Slew        *ClockSlew              // offset applied to the local clock, see timesync.go
+	Drift       map[int]*DriftEstimator // leader only: drift estimates per replica
+	Clock       *HybridClock            // hybrid logical clock, orders events across replicas
+
+	HeartbeatInterval    time.Duration // period of failure detection, time sync and log sync
+	HeartbeatTimeout     time.Duration // how long a heartbeat or liveness probe waits for an answer
+	ElectionWait         time.Duration // how long an election waits for answers
+	RPCTimeout           time.Duration // other calls between replicas
+	ReplicationTimeout   time.Duration // connecting to a replica to push log entries, and each batch
+	ReplicationBatchSize int           // log entries sent per ApplyEntries call
+	MaxReadyLag          int           // entries a follower may trail the leader and still be ready
+
+	Blobs             *BlobStore // attachment contents, see blobs.go
+	MaxAttachmentSize int64      // bytes
+	ChunkSize         int        // bytes per upload chunk and blob read
+	SendRate          int        // messages per minute a user may send, see moderation.go
+	SendBurst         int        // messages a user may send at once
+	Keyring           *Keyring   // encryption at rest, nil for none, see atrest.go
+
+	// Physical clock and replica-to-replica transport. The test harness
+	// replaces these to inject clock skew and network faults
+	Now       func() time.Time
+	Transport Transport
+
+	Metrics     *Metrics // served on /metrics, see metrics.go
+	HTTPAddress string   // address of the metrics HTTP server, empty to disable it
+
+	logger   *slog.Logger // adds the node context to every line, see logging.go
+	leader   atomic.Int64 // see LeaderID, written by SetLeader
+	logIndex atomic.Int64 // see LogIndex, written by setLogIndex
+	running  atomic.Bool  // an election of this node is under way
+
+	uploads   uploads       // leader only: open upload sessions
+	blobSync  chan struct{} // wakes the blob sync
+	sendLimit *rateLimiter  // leader only: SaveMessage calls per user
+	presence  presenceTable // leader only: who is online and typing, see presence.go
+
+	active        atomic.Bool  // ready to accept connections, set by Start through setActive
+	leaderIndex   atomic.Int64 // leader's log index at the last heartbeat
+	leaderContact atomic.Int64 // time of the last heartbeat answered by the leader, unix nanoseconds
+
+	messageHandler     *MessageHandler
+	replicationHandler *ReplicationHandler
+	listener           net.Listener
+	httpServer         *http.Server
+	connMutex          sync.Mutex
+	conns              map[net.Conn]bool
+	stopped            chan struct{}
+	stopOnce           sync.Once
 }
 
+// Settings used to create a replica
+type ServerOptions struct {
+	PID                  int
+	Replicas             []ReplicaAddress // all replica addresses, including own
+	DataDir              string           // holds the log directory and the database file
+	ClockOffset          time.Duration    // initial offset applied to the local clock
+	HeartbeatInterval    time.Duration    // 0 means DEFAULT_HEARTBEAT_INTERVAL
+	HeartbeatTimeout     time.Duration    // 0 means DEFAULT_HEARTBEAT_TIMEOUT
+	ElectionWait         time.Duration    // 0 means DEFAULT_ELECTION_WAIT
+	RPCTimeout           time.Duration    // 0 means DEFAULT_RPC_TIMEOUT
+	ReplicationTimeout   time.Duration    // 0 means DEFAULT_REPLICATION_TIMEOUT
+	ReplicationBatchSize int              // 0 means DEFAULT_REPLICATION_BATCH_SIZE
+	HTTPAddress          string           // host:port for /metrics, /healthz and /readyz, empty to disable
+	MaxReadyLag          int              // 0 means DEFAULT_MAX_READY_LAG
+	MaxAttachmentSize    int64            // 0 means DEFAULT_MAX_ATTACHMENT_SIZE
+	ChunkSize            int              // 0 means DEFAULT_CHUNK_SIZE
+	SendRate             int              // 0 means DEFAULT_SEND_RATE
+	SendBurst            int              // 0 means DEFAULT_SEND_BURST
+	Keyring              *Keyring         // nil keeps the log and database in the clear
+}
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = 5 * time.Second
+	DEFAULT_ELECTION_WAIT      = 1 * time.Second
+)
+
 // Type definitions for replication
 // Log entry structure
 type LogEntry struct {
-	Index     int       `json:"index"`
-	SQL       string    `json:"sql"`
-	Args      []any     `json:"args"`
-	Timestamp time.Time `json:"timestamp"`
+	Index     int            `json:"index"`
+	SQL       string         `json:"sql"`
+	Args      []any          `json:"args"`
+	Timestamp time.Time      `json:"timestamp"`
+	HLC       HLCTimestamp   `json:"hlc"`
+	Request   *RequestRecord `json:"request,omitempty"` // client request applied by the entry, see idempotency.go
+	Blob      string         `json:"blob,omitempty"`    // hash of the blob the entry records, followers fetch it, see blobs.go
 }
 
 // ReplicationRequest for sending entries to backups
 type ReplicationRequest struct {
-	Entries []LogEntry `json:"entries"`
+	Entries []LogEntry   `json:"entries"`
+	HLC     HLCTimestamp `json:"hlc"`
 }
 
 type BullyMessage struct {
-	PID     int    `json:"pid"`
-	Message string `json:"message"`
+	PID     int          `json:"pid"`
+	Message string       `json:"message"`
+	HLC     HLCTimestamp `json:"hlc"`
 }
 
 // Response from backup nodes
 type ReplicationResponse struct {
-	Success   bool   `json:"success"`
-	LastIndex int    `json:"last_index"`
-	Message   string `json:"message,omitempty"`
+	Success   bool         `json:"success"`
+	LastIndex int          `json:"last_index"`
+	Message   string       `json:"message,omitempty"`
+	HLC       HLCTimestamp `json:"hlc"`
 }
 
 type IDNumber struct {
@@ -90,13 +169,17 @@ type IDNumber struct {
 type TimeStamp struct {
 	ID    int
 	UTC   time.Time     // Replica -> Leader time
+	Raw   time.Time     // Replica -> Leader time without any offset, for drift estimation
 	Delta time.Duration // Leader -> Replica telling them the adjustment to make
+	HLC   HLCTimestamp
 }
 
 // Moved from serverUtils
 type MessageHandler struct {
 	mutex  sync.Mutex
 	server *Server
+
+	requestsPruned time.Time // leader only: last pruning of the request table
 }
 
 // Replication handler for backup nodes
@@ -116,48 +199,139 @@ class Message {
 }
 */
 
+// Replica addresses, one host:port per line, used when there is no config file
 var ADDRESS_FILE = "replica_addrs.txt"
-var REPLICA_ADDRESSES []ReplicaAddress
 
 // function to read in hard-saved replica addresses
-func ReadReplicaAddresses(filename string) []ReplicaAddress {
+func ReadReplicaAddresses(filename string) ([]ReplicaAddress, error) {
 	var addrs []ReplicaAddress
-	bytes, _ := os.ReadFile(filename)
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading replica addresses: %v", err)
+	}
 
 	text := string(bytes)
 	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
 
-	for _, replica := range lines {
-		addr := strings.Split(replica, ":")[0]
-		port, _ := strconv.ParseUint(strings.Split(replica, ":")[1], 10, 16)
-		addrs = append(addrs, ReplicaAddress{addr, uint16(port)})
+	for i, replica := range lines {
+		if strings.TrimSpace(replica) == "" {
+			continue
+		}
+		addr, err := ParseReplicaAddress(replica)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, i+1, err)
+		}
+		addrs = append(addrs, addr)
 	}
 
-	return addrs
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s lists no replicas", filename)
+	}
+	return addrs, nil
 }
 
-// Initialize creates a new server instance
-func Initialize(PID int) *Server {
-	// Init Server
+// Parses host:port
+func ParseReplicaAddress(text string) (ReplicaAddress, error) {
+	host, portText, err := net.SplitHostPort(strings.TrimSpace(text))
+	if err != nil {
+		return ReplicaAddress{}, fmt.Errorf("%q is not host:port", text)
+	}
+	if host == "" {
+		return ReplicaAddress{}, fmt.Errorf("%q has no host", text)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil || port == 0 {
+		return ReplicaAddress{}, fmt.Errorf("%q: port must be between 1 and 65535", text)
+	}
+	return ReplicaAddress{host, uint16(port)}, nil
+}
 
-	//newArray := append([]ReplicaAddress{}, REPLICA_ADDRESSES...)
-	//otherReplicas := append(newArray[:ADDRESS_OFFSET], newArray[ADDRESS_OFFSET + 1:]...)
+// NewServer creates a replica, its log directory and its database
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.PID < 0 || opts.PID >= len(opts.Replicas) {
+		return nil, fmt.Errorf("replica %d is not in the address list (%d replicas)", opts.PID, len(opts.Replicas))
+	}
 
 	server := &Server{
-		PID:             int(ADDRESS_OFFSET),
-		IsLeader:        (ADDRESS_OFFSET == uint32((len(REPLICA_ADDRESSES) - 1))), // Node with PID 0 is the leader
-		BackupNodes:     REPLICA_ADDRESSES,
-		AddressPort:     REPLICA_ADDRESSES[ADDRESS_OFFSET],
-		LeaderID:        -1, // leader is always first IP when the service is kicked off
-		Running:         false,
-		TimestampOffset: time.Duration(TIMESTAMP_OFFSET) * time.Second,
+		PID:                  opts.PID,
+		BackupNodes:          opts.Replicas,
+		AddressPort:          opts.Replicas[opts.PID],
+		Drift:                make(map[int]*DriftEstimator),
+		HeartbeatInterval:    opts.HeartbeatInterval,
+		HeartbeatTimeout:     opts.HeartbeatTimeout,
+		ElectionWait:         opts.ElectionWait,
+		RPCTimeout:           opts.RPCTimeout,
+		ReplicationTimeout:   opts.ReplicationTimeout,
+		ReplicationBatchSize: opts.ReplicationBatchSize,
+		MaxReadyLag:          opts.MaxReadyLag,
+		MaxAttachmentSize:    opts.MaxAttachmentSize,
+		ChunkSize:            opts.ChunkSize,
+		SendRate:             opts.SendRate,
+		SendBurst:            opts.SendBurst,
+		Keyring:              opts.Keyring,
+		uploads:              uploads{sessions: make(map[string]*upload)},
+		presence:             presenceTable{users: make(map[int]presence), typing: make(map[[2]int]time.Time)},
+		blobSync:             make(chan struct{}, 1),
+		HTTPAddress:          opts.HTTPAddress,
+		Now:                  time.Now,
+		Transport:            TCPTransport{},
+		conns:                make(map[net.Conn]bool),
+		stopped:              make(chan struct{}),
+	}
+	// read through the server, the test harness replaces Now
+	server.Slew = NewClockSlew(opts.ClockOffset, func() time.Time { return server.Now() })
+	if server.HeartbeatInterval == 0 {
+		server.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if server.HeartbeatTimeout == 0 {
+		server.HeartbeatTimeout = DEFAULT_HEARTBEAT_TIMEOUT
+	}
+	if server.ElectionWait == 0 {
+		server.ElectionWait = DEFAULT_ELECTION_WAIT
+	}
+	if server.RPCTimeout == 0 {
+		server.RPCTimeout = DEFAULT_RPC_TIMEOUT
+	}
+	if server.ReplicationTimeout == 0 {
+		server.ReplicationTimeout = DEFAULT_REPLICATION_TIMEOUT
+	}
+	if server.ReplicationBatchSize == 0 {
+		server.ReplicationBatchSize = DEFAULT_REPLICATION_BATCH_SIZE
 	}
+	if server.MaxReadyLag == 0 {
+		server.MaxReadyLag = DEFAULT_MAX_READY_LAG
+	}
+	if server.MaxAttachmentSize == 0 {
+		server.MaxAttachmentSize = DEFAULT_MAX_ATTACHMENT_SIZE
+	}
+	if server.ChunkSize == 0 {
+		server.ChunkSize = DEFAULT_CHUNK_SIZE
+	}
+	if server.SendRate == 0 {
+		server.SendRate = DEFAULT_SEND_RATE
+	}
+	if server.SendBurst == 0 {
+		server.SendBurst = DEFAULT_SEND_BURST
+	}
+	server.sendLimit = newRateLimiter(server.SendRate, server.SendBurst)
+	server.leader.Store(-1)
+	server.logger = newNodeLogger(server)
+	server.Metrics = NewMetrics(server)
+	server.Clock = NewHybridClock(server.getTime, server.logger)
+	server.messageHandler = &MessageHandler{server: server}
+	server.replicationHandler = &ReplicationHandler{server: server}
 
 	// Init Log
-	server.LogDir = fmt.Sprintf("logs-node-%d", PID)
+	server.LogDir = filepath.Join(opts.DataDir, fmt.Sprintf("logs-node-%d", opts.PID))
 	if err := os.MkdirAll(server.LogDir, 0755); err != nil {
-		log.Fatal("Error creating log directory:", err)
+		return nil, fmt.Errorf("error creating log directory: %v", err)
+	}
+
+	blobs, err := NewBlobStore(filepath.Join(opts.DataDir, fmt.Sprintf("blobs-node-%d", opts.PID)))
+	if err != nil {
+		return nil, err
 	}
+	server.Blobs = blobs
 
 	// Find highest log index
 	files, err := os.ReadDir(server.LogDir)
@@ -169,38 +343,35 @@ func Initialize(PID int) *Server {
 
 			var index int
 			if _, err := fmt.Sscanf(file.Name(), "log-%d.json", &index); err == nil {
-				if index > server.LogIndex {
-					server.LogIndex = index
+				if index > server.LogIndex() {
+					server.setLogIndex(index)
 				}
 			}
 		}
 	}
 
-	// log.Printf("Node %d started as %s with log index %d",
-	// 	server.PID,
-	// 	map[bool]string{true: "LEADER", false: "BACKUP"}[server.IsLeader],
-	// 	server.LogIndex)
-
 	// Initialize database
-	server_database := GenerateDatabaseName(PID)
+	server_database := filepath.Join(opts.DataDir, GenerateDatabaseName(opts.PID))
 	_, err = os.Stat(server_database)
 	if err != nil {
 		db, build_err := BuildDatabase(server_database)
 		if build_err != nil {
-			log.Fatal("Error creating database file")
-			return nil
+			return nil, fmt.Errorf("error creating database file: %v", build_err)
 		}
 		server.DB = db
 	} else {
-		db, read_err := sql.Open("sqlite", server_database)
+		db, read_err := openDatabase(server_database)
 		if read_err != nil {
-			log.Fatal("Error opening database file that existed")
-			return nil
+			return nil, fmt.Errorf("error opening database file that existed: %v", read_err)
+		}
+		if migrate_err := MigrateDatabase(db); migrate_err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error migrating database file: %v", migrate_err)
 		}
 		server.DB = db
 	}
 
-	return server
+	return server, nil
 }
 
 func (s *Server) getTime() time.Time {
@@ -208,14 +379,31 @@ func (s *Server) getTime() time.Time {
 	// 	return time.Now()
 	// }
 	// If not the leader, return the UTC time adjusted by the sync offset
-	return time.Now().Add(s.TimestampOffset)
+	return s.Now().Add(s.Slew.Offset())
+}
+
+// Time the clock will show once pending corrections are slewed in.
+// Time sync measures against this so corrections are not applied twice
+func (s *Server) targetTime() time.Time {
+	return s.Now().Add(s.Slew.Target())
+}
+
+// Offset currently applied to the local clock
+func (s *Server) ClockOffset() time.Duration {
+	return s.Slew.Offset()
+}
+
+// Queue a clock correction, slewed in gradually
+func (s *Server) AdjustClock(delta time.Duration) {
+	s.Slew.Adjust(delta)
 }
 
 func (r *ReplicationHandler) GetLogStatus(dummy int, status *LogStatus) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	status.LogIndex = r.server.LogIndex
+	status.LogIndex = r.server.LogIndex()
+	status.HLC = r.server.Clock.Now()
 	return nil
 }
 
@@ -225,124 +413,326 @@ func (s *Server) AppendToLog(entry LogEntry) (LogEntry, error) {
 	defer s.LogMutex.Unlock()
 
 	// Increment log index
-	s.LogIndex++
-	entry.Index = s.LogIndex
-	entry.Timestamp = time.Now()
-
-	// Convert to JSON
-	data, err := json.MarshalIndent(entry, "", "  ")
-	if err != nil {
-		return entry, fmt.Errorf("error serializing log entry: %v", err)
+	s.setLogIndex(s.LogIndex() + 1)
+	entry.Index = s.LogIndex()
+	entry.Timestamp = s.getTime()
+	if entry.HLC.IsZero() {
+		entry.HLC = s.Clock.Now()
 	}
 
-	// Write to file
-	filename := filepath.Join(s.LogDir, fmt.Sprintf("log-%d.json", entry.Index))
-	if err := os.WriteFile(filename, data, 0644); err != nil {
-		return entry, fmt.Errorf("error writing log file: %v", err)
+	// Write to file, sealed if encryption at rest is on
+	if err := s.writeLogFile(entry); err != nil {
+		return entry, err
 	}
 
-	log.Printf("Node %d: Appended entry %d to log", s.PID, entry.Index)
+	s.logger.Debug("Appended entry to log", "index", entry.Index)
 	return entry, nil
 }
 
+// Records a new leader. IsLeader always follows LeaderID
+func (s *Server) SetLeader(id int) {
+	if old := s.leader.Swap(int64(id)); old != int64(id) {
+		s.logger.Info("Leader changed", "new_leader", id)
+		s.Metrics.LeaderChanges.Inc()
+		s.Metrics.ResetPeers()
+	}
+}
+
+// PID of the leader, -1 until one is known. Safe from any goroutine
+func (s *Server) LeaderID() int {
+	return int(s.leader.Load())
+}
+
+// Whether this node is the leader
+func (s *Server) IsLeader() bool {
+	return s.LeaderID() == s.PID
+}
+
+// Index of the last entry in the local log. Safe from any goroutine
+func (s *Server) LogIndex() int {
+	return int(s.logIndex.Load())
+}
+
+// Records the index of the last entry in the local log
+func (s *Server) setLogIndex(index int) {
+	s.logIndex.Store(int64(index))
+}
+
+// Sleeps for d, returns false if the server was stopped in the meantime
+func (s *Server) sleep(d time.Duration) bool {
+	select {
+	case <-s.stopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Server) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 func IsAddressSelf(addr1, addr2 ReplicaAddress) bool {
 	return fmt.Sprintf("%s:%d", addr1.Address, addr1.Port) == fmt.Sprintf("%s:%d", addr2.Address, addr2.Port)
 }
 
 // Method to replicate to backup nodes
 func (s *Server) ReplicateToBackups(entry LogEntry) {
-	if !s.IsLeader || len(s.BackupNodes) == 0 {
+	if !s.IsLeader() || len(s.BackupNodes) == 0 {
 		return
 	}
 
 	reqs, err := ReadAllEntires(s)
 	if err != nil {
-		fmt.Printf("Error: %s", err)
+		s.logger.Error("Reading log entries", "err", err)
 	}
 
 	reqs = append(reqs, entry) // add entry to list of messages we need to send
 
-	req := ReplicationRequest{Entries: reqs}
-	for _, addr := range s.BackupNodes {
+	for id, addr := range s.BackupNodes {
 
 		if IsAddressSelf(s.AddressPort, addr) { // don't replicate to myself
 			continue
 		}
 
-		addr_string := net.JoinHostPort(addr.Address, fmt.Sprintf("%d", addr.Port))
-		caller, err := net.DialTimeout("tcp", addr_string, 3*time.Second) // need a timeout here, else this hangs if backup not reachable
+		addr_string := addressString(addr)
+		client, err := s.connectReplica(addr, s.ReplicationTimeout) // need a timeout here, else this hangs if backup not reachable
 
 		if err != nil {
-			log.Printf("Node %d: Failed to connect to backup %s: %v", s.PID, addr_string, err)
+			s.logger.Warn("Failed to connect to backup", "peer", addr_string, "err", err)
 			continue
 		}
 
-		var resp ReplicationResponse
-		client := rpc.NewClient(caller)
-		err = client.Call("ReplicationHandler.ApplyEntries", req, &resp)
+		resp, err := s.sendEntries(client, reqs)
 		client.Close()
 
 		if err != nil {
-			log.Printf("Node %d: Failed to replicate to %s: %v", s.PID, addr_string, err)
-		} else if !resp.Success {
-			log.Printf("Node %d: Replication to %s failed: %s", s.PID, addr_string, resp.Message)
+			s.logger.Warn("Failed to replicate", "peer", addr_string, "err", err)
+			continue
+		}
+		if !resp.Success {
+			s.logger.Warn("Replication rejected", "peer", addr_string, "reason", resp.Message)
+		} else {
+			s.Metrics.SetPeerIndex(id, resp.LastIndex)
 		}
 	}
 }
 
+/*
+Sends entries to a replica in index order, at most ReplicationBatchSize
+per ApplyEntries call. Stops at the first batch that is not applied and
+returns the last response
+*/
+func (s *Server) sendEntries(client *replicaClient, entries []LogEntry) (ReplicationResponse, error) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+
+	resp := ReplicationResponse{Success: true}
+	for start := 0; start < len(entries); start += s.ReplicationBatchSize {
+		end := min(start+s.ReplicationBatchSize, len(entries))
+		resp = ReplicationResponse{}
+		req := ReplicationRequest{Entries: entries[start:end], HLC: s.Clock.Now()}
+		if err := client.Call("ReplicationHandler.ApplyEntries", req, &resp); err != nil {
+			return resp, err
+		}
+		s.Clock.Update(resp.HLC)
+		if !resp.Success {
+			break
+		}
+	}
+	return resp, nil
+}
+
 // Method to set backup nodes
 func (s *Server) SetBackupNodes(addresses []ReplicaAddress) {
-	if s.IsLeader {
+	if s.IsLeader() {
 		s.BackupNodes = addresses
 		// log.Printf("Leader node %d will replicate to: %v", s.PID, s.BackupNodes)
 	}
 }
 
-// Handler for RPC connections
-func (s *Server) HandleRPC(rpc_address string, msg *MessageHandler, rep *ReplicationHandler) {
-	// Create a new RPC server for this instance
-	rpcServer := rpc.NewServer()
-
-	// Register handlers with this specific server
-	rpcServer.RegisterName("MessageHandler", msg)
-	rpcServer.RegisterName("ReplicationHandler", rep)
+/*
+Handler for RPC connections, returns once the listener is closed.
 
-	// Start listening
-	listener, err := net.Listen("tcp", rpc_address)
-	log.Println("Listening on", rpc_address)
-	if err != nil {
-		log.Fatal("Failure listening for RPC calls:", err)
+On a TLS transport the certificate of the caller decides what it may
+call: replicas reach ReplicationHandler (replication, elections, time
+sync), the gateway reaches MessageHandler (client requests)
+*/
+func (s *Server) HandleRPC(listener net.Listener, msg *MessageHandler, rep *ReplicationHandler) {
+	// One RPC server per role, each with only the handlers that role may call
+	replicaRPC := rpc.NewServer()
+	replicaRPC.RegisterName("ReplicationHandler", rep)
+
+	gatewayRPC := rpc.NewServer()
+	gatewayRPC.RegisterName("MessageHandler", msg)
+
+	openRPC := rpc.NewServer()
+	openRPC.RegisterName("MessageHandler", msg)
+	openRPC.RegisterName("ReplicationHandler", rep)
+
+	servers := map[string]*rpc.Server{
+		ROLE_REPLICA: replicaRPC,
+		ROLE_GATEWAY: gatewayRPC,
+		ROLE_ANY:     openRPC,
 	}
 
 	// Handle connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Failure accepting RPC call:", err)
+			if s.isStopped() {
+				return
+			}
+			s.logger.Error("Failure accepting RPC call", "err", err)
 			continue
 		}
-		go rpcServer.ServeConn(conn)
+		go s.serveConn(servers, conn)
 	}
 }
 
-// Spawn a server with the given PID and port
-func spawn_server(PID int) *Server {
-	// log.Printf("Spawning server %d on port %d", PID, port)
+// serves one connection, tracking it so Stop can cut it off
+func (s *Server) serveConn(servers map[string]*rpc.Server, conn net.Conn) {
+	s.connMutex.Lock()
+	s.conns[conn] = true
+	s.connMutex.Unlock()
 
+	defer func() {
+		s.connMutex.Lock()
+		delete(s.conns, conn)
+		s.connMutex.Unlock()
+	}()
+
+	// a handshake gets timeouts.rpc, like other calls between replicas
+	role, err := peerRole(conn, s.RPCTimeout)
+	if err != nil {
+		s.logger.Warn("Rejected connection", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	servers[role].ServeCodec(newTimedServerCodec(conn, s.Metrics))
+}
+
+// Spawn a server with the given PID and port
+func spawn_server(config *Config) *Server {
 	// Initialize the server
-	server := Initialize(PID)
-	if server == nil {
-		log.Fatal("FATAL ERROR ON INIT")
-		os.Exit(-1)
+	server, err := NewServer(config.ServerOptions())
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	return server
 }
 
+/*
+Starts serving RPC on the replica's address, finds the current
+leader, catches up from it and joins the election. Failure
+detection keeps running in the background until Stop is called.
+*/
+func (s *Server) Start() error {
+	rpc_address := addressString(s.AddressPort)
+	listener, err := s.Transport.Listen(s.AddressPort)
+	if err != nil {
+		return fmt.Errorf("failure listening for RPC calls: %v", err)
+	}
+	s.logger.Info("Listening", "address", rpc_address)
+	s.listener = listener
+
+	// Start RPC server
+	go s.HandleRPC(listener, s.messageHandler, s.replicationHandler)
+
+	if s.HTTPAddress != "" {
+		if err := s.startHTTP(); err != nil {
+			return err
+		}
+	}
+
+	// give replicas started at the same time a chance to come up
+	if !s.sleep(s.ElectionWait) {
+		return nil
+	}
+
+	ConfirmLeader(s)
+	s.logger.Info("Found leader")
+	if s.LeaderID() != s.PID {
+		var resp IDNumber
+		// the leader pushes the missing entries before it answers
+		err := s.callReplica(s.BackupNodes[s.LeaderID()], "ReplicationHandler.CatchupReplica", IDNumber{ID: s.PID}, &resp, s.ReplicationTimeout)
+		if err != nil {
+			s.logger.Error("Catching up from leader", "err", err)
+		}
+
+		if resp.ID == -1 {
+			s.logger.Info("Replica caught up")
+		}
+
+		s.replicationHandler.InitiateElection()
+	}
+
+	s.setActive(true)
+	go s.replicationHandler.BullyAlgorithmThread() // NEED TO detect leader failures
+	go s.BlobSyncThread()
+	if s.Keyring != nil {
+		go s.ReencryptThread()
+	}
+	return nil
+}
+
+/*
+Stops the replica as if it crashed: the listener and every open
+connection are closed, background threads exit at their next
+check and the database is closed. The data directory is kept, so a
+new server created on it recovers from the log.
+*/
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.setActive(false)
+		close(s.stopped)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+
+		if s.httpServer != nil {
+			s.httpServer.Close()
+		}
+
+		s.connMutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connMutex.Unlock()
+
+		s.DB.Close()
+	})
+}
+
+// Serves /metrics, /healthz and /readyz on HTTPAddress until the server is stopped
+func (s *Server) startHTTP() error {
+	listener, err := net.Listen("tcp", s.HTTPAddress)
+	if err != nil {
+		return fmt.Errorf("failure listening for HTTP: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Metrics.Handler())
+	mux.Handle("/healthz", healthHandler(s, func(h HealthStatus) bool { return h.Live }))
+	mux.Handle("/readyz", healthHandler(s, func(h HealthStatus) bool { return h.Ready }))
+	s.httpServer = &http.Server{Handler: mux}
+
+	s.logger.Info("Serving metrics", "address", listener.Addr().String())
+	go s.httpServer.Serve(listener)
+	return nil
+}
+
 // Debug Function
 func (t *MessageHandler) GetNodeInfo(dummy *int, info *NodeInfo) error {
 	info.NodeID = t.server.PID
-	info.IsLeader = t.server.IsLeader
+	info.IsLeader = t.server.IsLeader()
 	return nil
 }
 
@@ -350,20 +740,16 @@ func ReadAllEntires(server *Server) ([]LogEntry, error) {
 	logFiles := []LogEntry{}
 	filenames, err := os.ReadDir(server.LogDir)
 	if err != nil {
-		fmt.Printf("Error: %s", err)
 		return logFiles, err
 	}
 
 	for _, name := range filenames {
-		text, err := os.ReadFile(fmt.Sprintf("%s/%s", server.LogDir, name.Name()))
-		if err != nil {
-			fmt.Printf("Error: %s", err)
-			return logFiles, err
+		// skips files being re-encrypted, see atrest.go
+		if !strings.HasSuffix(name.Name(), ".json") {
+			continue
 		}
-		var data LogEntry
-		err = json.Unmarshal(text, &data)
+		data, err := server.readLogFile(name.Name())
 		if err != nil {
-			fmt.Printf("Error: %s", err)
 			return logFiles, err
 		}
 
@@ -379,10 +765,12 @@ func (r *ReplicationHandler) ApplyEntries(req *ReplicationRequest, resp *Replica
 	defer r.mutex.Unlock()
 
 	s := r.server
-	log.Printf("Node %d: Received %d entries for replication", s.PID, len(req.Entries))
+	s.logger.Debug("Received entries for replication", "entries", len(req.Entries))
+	s.Clock.Update(req.HLC)
+	defer func() { resp.HLC = s.Clock.Now() }()
 
 	// Reject if we're the leader
-	if s.LeaderID == s.PID {
+	if s.LeaderID() == s.PID {
 		resp.Success = false
 		resp.Message = "leader cannot accept replication requests"
 		return nil
@@ -395,19 +783,19 @@ func (r *ReplicationHandler) ApplyEntries(req *ReplicationRequest, resp *Replica
 	// Process each entry
 	for _, entry := range req.Entries {
 		// Skip duplicate entries
-		if entry.Index <= s.LogIndex {
-			log.Printf("Node %d: Skipping duplicate entry %d", s.PID, entry.Index)
+		if entry.Index <= s.LogIndex() {
+			s.logger.Debug("Skipping duplicate entry", "index", entry.Index)
 			continue
 		}
 
 		// Check for gaps in the log
-		if entry.Index > s.LogIndex+1 {
+		if entry.Index > s.LogIndex()+1 {
 			//resp.Success = false
 			//resp.Message = fmt.Sprintf("log gap detected, expected %d, got %d, catching up", s.LogIndex+1, entry.Index)
-			fmt.Printf("log gap detected, expected %d, got %d, catching up\n", s.LogIndex+1, entry.Index)
+			s.logger.Warn("Log gap detected, catching up", "expected", s.LogIndex()+1, "got", entry.Index)
 			//resp.LastIndex = s.LogIndex
 			//return nil
-			s.LogIndex = entry.Index
+			s.setLogIndex(entry.Index)
 		}
 
 		// Ensure database connection is valid
@@ -417,22 +805,14 @@ func (r *ReplicationHandler) ApplyEntries(req *ReplicationRequest, resp *Replica
 			return fmt.Errorf("database connection is nil")
 		}
 
-		// Execute the SQL statement
-		_, err := s.DB.Exec(entry.SQL, entry.Args...)
+		// Execute the SQL statement, with its request record if any
+		_, err := s.execEntry(&entry, nil)
 		if err != nil {
 			resp.Success = false
 			resp.Message = fmt.Sprintf("error applying SQL: %v", err)
 			return err
 		}
 
-		// Save to log
-		data, err := json.MarshalIndent(entry, "", "  ")
-		if err != nil {
-			resp.Success = false
-			resp.Message = fmt.Sprintf("error serializing entry: %v", err)
-			return err
-		}
-
 		// Ensure log directory exists
 		if _, err := os.Stat(s.LogDir); os.IsNotExist(err) {
 			if err := os.MkdirAll(s.LogDir, 0755); err != nil {
@@ -443,29 +823,43 @@ func (r *ReplicationHandler) ApplyEntries(req *ReplicationRequest, resp *Replica
 		}
 
 		// Write to log file
-		filename := filepath.Join(s.LogDir, fmt.Sprintf("log-%d.json", entry.Index))
-		if err := os.WriteFile(filename, data, 0644); err != nil {
+		if err := s.writeLogFile(entry); err != nil {
 			resp.Success = false
-			resp.Message = fmt.Sprintf("error writing log file: %v", err)
+			resp.Message = err.Error()
 			return err
 		}
 
-		// Update index
-		s.LogIndex = entry.Index
-		log.Printf("Node %d: Applied entry %d", s.PID, entry.Index)
+		// Update index, and make sure our clock is past the entry's timestamp
+		s.setLogIndex(entry.Index)
+		s.Clock.Update(entry.HLC)
+
+		// blob contents are fetched separately, see blobs.go
+		if entry.Blob != "" {
+			s.kickBlobSync()
+		}
+		s.logger.Debug("Applied entry", "index", entry.Index)
 	}
 
 	// Success response
 	resp.Success = true
-	resp.LastIndex = s.LogIndex
+	resp.LastIndex = s.LogIndex()
 	return nil
 }
 
 func (r *ReplicationHandler) IsStatusOK(req *ReplicationRequest, resp *ReplicationResponse) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	// no handler mutex: followers wait HeartbeatTimeout for the answer,
+	// not for a log or time sync the leader is running
+	r.server.Clock.Update(req.HLC)
+	resp.HLC = r.server.Clock.Now()
+
+	// only a serving leader is OK, anything else makes the caller look
+	// for a new one. LastIndex lets followers work out their lag
+	resp.LastIndex = r.server.LogIndex()
+	if r.server.PID != r.server.LeaderID() || !r.server.active.Load() {
+		resp.Message = "NOTLEADER"
+		return nil
+	}
 	resp.Success = true
-	resp.LastIndex = -1
 	resp.Message = "STATUSOK"
 	return nil
 }
@@ -477,17 +871,35 @@ func (r *ReplicationHandler) IsStatusOK(req *ReplicationRequest, resp *Replicati
 func (r *ReplicationHandler) BullyLeader(msg *BullyMessage, resp *ReplicationResponse) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	r.server.LeaderID = msg.PID
-	r.server.Running = false
+	r.server.Clock.Update(msg.HLC)
+	if resp != nil {
+		resp.HLC = r.server.Clock.Now()
+	}
+
+	// a lower node claiming leadership while we are alive gets bullied
+	if msg.PID < r.server.PID {
+		if resp != nil {
+			resp.LastIndex = r.server.PID
+		}
+		if !r.server.running.Load() {
+			go r.InitiateElection()
+		}
+		return nil
+	}
+
+	r.server.SetLeader(msg.PID)
+	r.server.running.Store(false)
 	return nil
 }
 
 func (r *ReplicationHandler) BullyElection(msg *BullyMessage, resp *ReplicationResponse) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	r.server.Clock.Update(msg.HLC)
+	resp.HLC = r.server.Clock.Now()
 	if msg.PID < r.server.PID {
 		resp.LastIndex = r.server.PID // bullied it
-		if !r.server.Running {
+		if !r.server.running.Load() {
 			go r.InitiateElection() // THIS SHOULD PROBABLY NOT BE CALLED IN THE RPC...
 		}
 	}
@@ -495,16 +907,22 @@ func (r *ReplicationHandler) BullyElection(msg *BullyMessage, resp *ReplicationR
 }
 
 func (r *ReplicationHandler) BullyAlgorithmThread() {
-	for {
-		for !r.BullyFailureDetector() { // check for leader every five seconds
-			fmt.Printf("Leader %d is online... \n", r.server.LeaderID)
-			fmt.Printf("Current time: %s | Offset is %fs \n", r.server.getTime().Format("15:04:05.000"), r.server.TimestampOffset.Seconds())
-
-			time.Sleep(5 * time.Second)
+	for !r.server.isStopped() {
+		for !r.BullyFailureDetector() { // check for leader every heartbeat
+			r.server.logger.Debug("Leader is online",
+				"time", r.server.getTime().Format("15:04:05.000"),
+				"offset", r.server.ClockOffset(),
+				"slewing", r.server.Slew.Remaining())
+
+			if !r.server.sleep(r.server.HeartbeatInterval) {
+				return
+			}
 		}
 
 		// leader is dead
-		r.InitiateElection()
+		if !r.server.isStopped() {
+			r.InitiateElection()
+		}
 	}
 }
 
@@ -519,7 +937,10 @@ func (r *ReplicationHandler) GetTime(msg TimeStamp, resp *TimeStamp) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	resp.UTC = r.server.getTime()
+	r.server.Clock.Update(msg.HLC)
+	resp.Raw = r.server.Now()
+	resp.UTC = r.server.targetTime()
+	resp.HLC = r.server.Clock.Now()
 	return nil
 }
 
@@ -528,92 +949,42 @@ func (r *ReplicationHandler) UpdateTime(msg TimeStamp, resp *TimeStamp) error {
 	defer r.mutex.Unlock()
 
 	// fmt.Print("Updating time: ", msg.Delta.Seconds(), "\n")
-	// Update the server's timestamp offset
-	r.server.TimestampOffset += msg.Delta
+	// Queue the correction, it is slewed into the offset gradually
+	// so the local clock never jumps
+	r.server.AdjustClock(msg.Delta)
+	r.server.Clock.Update(msg.HLC)
 	return nil
 }
 
-func (r *ReplicationHandler) SyncTime() error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	// Berkley Time Synchronization Algorithm
-
-	rpcClients := make([]*rpc.Client, 0, len(r.server.BackupNodes))
-
-	for _, addr := range r.server.BackupNodes {
-		if IsAddressSelf(r.server.AddressPort, addr) { // skip self
-			continue
-		}
-		caller, err := net.DialTimeout("tcp", net.JoinHostPort(addr.Address, fmt.Sprintf("%d", addr.Port)), 1*time.Second)
-		if err != nil {
-			continue
-		}
-		rpcClients = append(rpcClients, rpc.NewClient(caller))
-	}
-
-	if len(rpcClients) == 0 {
-		fmt.Printf("Error: No backup nodes available for time sync\n")
-		return nil
-	}
-	fmt.Printf("Syncing time with %d nodes\n", len(rpcClients))
-
-	predictedClientTimes := make([]time.Time, len(rpcClients))
-	serverTimes := make([]time.Time, len(rpcClients))
-	avgs := make([]time.Duration, len(rpcClients))
-	avgSum := time.Duration(0)
-
-	for i, client := range rpcClients {
-		var resp TimeStamp
-		before := r.server.getTime()
-		err := client.Call("ReplicationHandler.GetTime", TimeStamp{}, &resp)
-		if err != nil {
-			fmt.Printf("Error: %s", err)
-			continue
-		}
-		after := r.server.getTime()
-		flightTime := after.Sub(before) / 2
-		predictedTime := resp.UTC.Add(flightTime)
-		predictedClientTimes[i] = predictedTime
-		serverTimes[i] = after
-
-		avgs[i] = predictedTime.Sub(after)
-		avgSum += predictedTime.Sub(after)
-	}
-
-	avgOffset := avgSum / time.Duration(len(rpcClients)+1) // Add 1 to the number of clients to include the leader's time in the average. Leader has 0 offset from itself though
-
-	r.server.TimestampOffset += avgOffset
-
-	for i, client := range rpcClients {
-		delta := avgOffset - avgs[i]
-		fmt.Printf("Telling node %d to update time by %f, avgOffset=%f, it's offset = %f \n", i, delta.Seconds(), avgOffset.Seconds(), avgs[i].Seconds())
-		client.Call("ReplicationHandler.UpdateTime", TimeStamp{Delta: delta}, TimeStamp{})
-	}
-
+func (r *MessageHandler) GetPID(msg *IDNumber, resp *IDNumber) error {
+	resp.ID = r.server.PID
 	return nil
 }
 
-func (r *MessageHandler) GetPID(msg *IDNumber, resp *IDNumber) error {
+// Same as MessageHandler.GetPID, for replicas probing each other
+func (r *ReplicationHandler) GetPID(msg *IDNumber, resp *IDNumber) error {
 	resp.ID = r.server.PID
 	return nil
 }
 
-func SendBullyMessage(replica ReplicaAddress, funcName string, msg BullyMessage, resp *ReplicationResponse) error {
-	addr_string := net.JoinHostPort(replica.Address, fmt.Sprintf("%d", replica.Port))
-	caller, err := net.DialTimeout("tcp", addr_string, 1*time.Second) // need a timeout here, else this hangs if backup not reachable
+func (s *Server) SendBullyMessage(replica ReplicaAddress, funcName string, msg BullyMessage, resp *ReplicationResponse) error {
+	if resp == nil {
+		resp = &ReplicationResponse{}
+	}
+	msg.HLC = s.Clock.Now()
+	err := s.callReplica(replica, fmt.Sprintf("ReplicationHandler.%s", funcName), msg, resp, s.RPCTimeout) // need a timeout here, else this hangs if backup not reachable
 	if err != nil {
-		fmt.Printf("Replica at %s is offline\n", addr_string)
+		s.logger.Debug("Replica is offline", "peer", addressString(replica), "rpc", funcName)
 		return err
 	}
-	client := rpc.NewClient(caller)
-	err = client.Call(fmt.Sprintf("ReplicationHandler.%s", funcName), msg, resp) // skipping error here as well
-	return err
+	s.Clock.Update(resp.HLC)
+	return nil
 }
 
 func (r *ReplicationHandler) InitiateElection() bool {
-	r.server.Running = true
-	fmt.Println("CALLING ELECTION")
+	r.server.running.Store(true)
+	r.server.logger.Info("Calling election")
+	r.server.Metrics.Elections.Inc()
 
 	if r.server.PID == len(r.server.BackupNodes)-1 {
 		for _, replica := range r.server.BackupNodes {
@@ -622,9 +993,9 @@ func (r *ReplicationHandler) InitiateElection() bool {
 			}
 			var resp ReplicationResponse
 			msg := BullyMessage{PID: r.server.PID, Message: "LEADER"}
-			r.server.LeaderID = r.server.PID
-			r.server.Running = false
-			SendBullyMessage(replica, "BullyLeader", msg, &resp)
+			r.server.SetLeader(r.server.PID)
+			r.server.running.Store(false)
+			r.server.SendBullyMessage(replica, "BullyLeader", msg, &resp)
 		}
 	} else {
 		electionResponse := ReplicationResponse{LastIndex: -1}
@@ -633,27 +1004,27 @@ func (r *ReplicationHandler) InitiateElection() bool {
 				continue
 			}
 			msg := BullyMessage{PID: r.server.PID, Message: "ELECTION"}
-			SendBullyMessage(replica, "BullyElection", msg, &electionResponse)
+			r.server.SendBullyMessage(replica, "BullyElection", msg, &electionResponse)
 
 		}
-		time.Sleep(1 * time.Second) // probably much too long
+		r.server.sleep(r.server.ElectionWait) // probably much too long
 
 		if electionResponse.LastIndex == -1 { // no response
-			r.server.LeaderID = r.server.PID
+			r.server.SetLeader(r.server.PID)
 			for j, replica := range r.server.BackupNodes {
 				// skip self
 				if j == r.server.PID {
 					continue
 				}
 				msg := BullyMessage{PID: r.server.PID, Message: "LEADER"}
-				SendBullyMessage(replica, "BullyLeader", msg, nil)
+				r.server.SendBullyMessage(replica, "BullyLeader", msg, nil)
 			}
 		} else {
-			time.Sleep(1 * time.Second)
+			r.server.sleep(r.server.ElectionWait)
 			//if r.server.LeaderID == current_leader {			// no leader change
 			//	r.InitiateElection()
 			//} else {			// other process already told me to update my leader
-			r.server.Running = false
+			r.server.running.Store(false)
 			//}
 		}
 
@@ -663,88 +1034,90 @@ func (r *ReplicationHandler) InitiateElection() bool {
 }
 
 func (r *ReplicationHandler) SyncLogs() error {
-	localIndex := r.server.LogIndex
-
-	rpcClients := make([]*rpc.Client, 0, len(r.server.BackupNodes))
+	// replica ids, the position in rpcClients is not the node id
+	rpcClients := make(map[int]*replicaClient, len(r.server.BackupNodes))
 
-	for _, addr := range r.server.BackupNodes {
+	for id, addr := range r.server.BackupNodes {
 		if IsAddressSelf(r.server.AddressPort, addr) { // skip self
 			continue
 		}
 
-		rpcAddr := net.JoinHostPort(addr.Address, fmt.Sprintf("%d", addr.Port))
-		caller, err := net.DialTimeout("tcp", rpcAddr, 1*time.Second)
+		client, err := r.server.connectReplica(addr, r.server.RPCTimeout)
 		if err != nil {
 			// log.Printf("Node %d: Cannot reach %s: %s", r.server.PID, rpcAddr, err)
 			continue
 		}
-		rpcClients = append(rpcClients, rpc.NewClient(caller))
+		rpcClients[id] = client
 	}
 
 	if len(rpcClients) == 0 {
-		fmt.Printf("Error: No backup nodes available for log  sync\n")
+		r.server.logger.Warn("No backup nodes available for log sync")
 		return nil
 	}
 
 	for i, client := range rpcClients {
 		var status LogStatus
 		err := client.Call("ReplicationHandler.GetLogStatus", 0, &status)
+		client.Close()
 
 		if err != nil {
-			fmt.Printf("Error: %s", err)
+			r.server.logger.Warn("Getting log status", "peer", i, "err", err)
 			continue
 		}
+		r.server.Clock.Update(status.HLC)
+		r.server.Metrics.SetPeerIndex(i, status.LogIndex)
 
-		// client.Close()?
-
+		// read after the answer: writes keep being applied and pushed
+		// meanwhile, a replica is only ahead of what we have now
+		localIndex := r.server.LogIndex()
 		if status.LogIndex < localIndex {
-			fmt.Printf("Telling node %d to update its logs\n", i)
+			r.server.logger.Info("Telling replica to update its logs", "peer", i, "peer_index", status.LogIndex)
 
 			var resp IDNumber
 
 			if err := r.CatchupReplica(IDNumber{ID: i}, &resp); err != nil {
-				fmt.Printf("Replica %d: Error during CatchupReplica: %v\n", i, err)
+				r.server.logger.Warn("CatchupReplica failed", "peer", i, "err", err)
 				continue
 			}
 
 			if resp.ID == -1 {
-				fmt.Printf("Node %d: Logs successfully caught up\n", i)
+				r.server.logger.Info("Replica caught up", "peer", i)
 			} else {
-				fmt.Printf("Node %d: Failed to catch up logs\n", i)
+				r.server.logger.Warn("Replica failed to catch up", "peer", i)
 			}
 		} else if status.LogIndex > localIndex {
-			fmt.Printf("Replica %d has a higher log index (%d vs leader %d); replacing logs...\n", i, status.LogIndex, localIndex)
+			r.server.logger.Warn("Replica is ahead of the leader, replacing its logs", "peer", i, "peer_index", status.LogIndex)
 
 			var eraseResp ReplicationResponse
 
-			// erase logs
-			if err := client.Call("ReplicationHandler.EraseLogsFromDir", 0, &eraseResp); err != nil {
-				fmt.Printf("Replica %d: Error calling EraseLogsFromDir: %v\n", i, err)
+			// erase logs, the replica checks that we are its leader
+			if err := r.eraseReplicaLogs(i, &eraseResp); err != nil {
+				r.server.logger.Warn("EraseLogsFromDir failed", "peer", i, "err", err)
 				continue
 			}
 
 			// make sure erase was successful
 			if !eraseResp.Success {
-				fmt.Printf("Replica %d: Failed to erase logs: %s\n", i, eraseResp.Message)
+				r.server.logger.Warn("Replica refused to erase its logs", "peer", i, "reason", eraseResp.Message)
 				continue
 			}
 
-			fmt.Printf("Replica %d: Logs erased successfully.\n", i)
+			r.server.logger.Info("Replica logs erased", "peer", i)
 
 			var catchupResp IDNumber
 
 			if err := r.CatchupReplica(IDNumber{ID: i}, &catchupResp); err != nil {
-				fmt.Printf("Replica %d: Error during CatchupReplica: %v\n", i, err)
+				r.server.logger.Warn("CatchupReplica failed", "peer", i, "err", err)
 				continue
 			}
 
 			if catchupResp.ID == -1 {
-				fmt.Printf("Node %d: Logs successfully replaced.\n", i)
+				r.server.logger.Info("Replica logs replaced", "peer", i)
 			} else {
-				fmt.Printf("Node %d: CatchupReplica did not complete as expected (returned %d).\n", i, catchupResp.ID)
+				r.server.logger.Warn("CatchupReplica did not complete as expected", "peer", i, "returned", catchupResp.ID)
 			}
 		} else {
-			fmt.Printf("Node %d is already up to date\n", i)
+			r.server.logger.Debug("Replica is up to date", "peer", i)
 		}
 
 	}
@@ -752,15 +1125,29 @@ func (r *ReplicationHandler) SyncLogs() error {
 	return nil
 }
 
-func (r *ReplicationHandler) EraseLogsFromDir(_args int, resp *ReplicationResponse) error {
+// asks replica 'id' to drop its logs, on a fresh connection
+func (r *ReplicationHandler) eraseReplicaLogs(id int, resp *ReplicationResponse) error {
+	return r.server.callReplica(r.server.BackupNodes[id], "ReplicationHandler.EraseLogsFromDir", r.server.PID, resp, r.server.RPCTimeout)
+}
+
+// leaderPID is the PID of the caller, only our leader may erase our logs
+func (r *ReplicationHandler) EraseLogsFromDir(leaderPID int, resp *ReplicationResponse) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
 	// Leader should never delete their logs only replicas
-	if r.server.PID == r.server.LeaderID {
+	if r.server.PID == r.server.LeaderID() {
 		resp.Success = false
 		resp.Message = "Leader cannot delete logs"
 		return nil
 	}
 
+	if leaderPID != r.server.LeaderID() {
+		resp.Success = false
+		resp.Message = fmt.Sprintf("node %d is not the leader", leaderPID)
+		return nil
+	}
+
 	logDir := r.server.LogDir
 
 	//Delete the logDir which should remove all the replicas logs
@@ -777,45 +1164,61 @@ func (r *ReplicationHandler) EraseLogsFromDir(_args int, resp *ReplicationRespon
 		return err
 	}
 
-	r.server.LogIndex = 0 // Reset log index after deletion
+	r.server.setLogIndex(0) // Reset log index after deletion
+
+	// the log will be replayed from scratch, so must the database
+	if err := ResetDatabase(r.server.DB); err != nil {
+		resp.Success = false
+		resp.Message = fmt.Sprintf("error resetting database: %v", err)
+		return err
+	}
 
 	resp.Success = true
 	return nil
 }
 
 func (r *ReplicationHandler) BullyFailureDetector() bool {
-	if r.server.PID == r.server.LeaderID {
+	if r.server.PID == r.server.LeaderID() {
+		// a higher node that is alive should be leading, e.g. after a
+		// partition healed; hand over through an election
+		if r.HigherReplicaAlive() {
+			r.InitiateElection()
+			return false
+		}
+
 		// Leader can do a time and log sync here instead of detecting leader failure
 		r.SyncTime()
 		r.SyncLogs()
 		return false // leader can't detect its own failures, return false
 	}
 
-	leader_addr := r.server.BackupNodes[r.server.LeaderID]
-	addr_string := net.JoinHostPort(leader_addr.Address, fmt.Sprintf("%d", leader_addr.Port))
-	t_trans := 50 * time.Millisecond;
-	t_proc := 10 * time.Millisecond;
-	t := (2 * t_trans) + t_proc
-
-	caller, err := net.DialTimeout("tcp", addr_string, t) // need a timeout here, else this hangs if backup not reachable
-	if err != nil {
-		fmt.Printf("Leader down: %s\n", err)
-		return true
-	}
-
+	leader_addr := r.server.BackupNodes[r.server.LeaderID()]
 	var resp ReplicationResponse
-	var msg ReplicationRequest
-	client := rpc.NewClient(caller)
-	err = client.Call("ReplicationHandler.IsStatusOK", msg, &resp)
+	msg := ReplicationRequest{HLC: r.server.Clock.Now()}
+	err := r.server.callReplica(leader_addr, "ReplicationHandler.IsStatusOK", msg, &resp, r.server.HeartbeatTimeout) // need a timeout here, else this hangs if backup not reachable
 	if err != nil {
-		fmt.Printf("Leader down: %s\n", err)
+		r.server.logger.Warn("Leader down", "err", err)
 		return true
 	}
+	r.server.Clock.Update(resp.HLC)
 
 	if resp.Message != "STATUSOK" {
-		fmt.Printf("Leader down: %s\n", err)
+		r.server.logger.Warn("Leader down", "status", resp.Message)
 		return true
 	}
+	r.server.leaderContacted(resp.LastIndex)
+	return false
+}
+
+// Whether any replica with a higher PID than ours answers
+func (r *ReplicationHandler) HigherReplicaAlive() bool {
+	for j := r.server.PID + 1; j < len(r.server.BackupNodes); j++ {
+		var pid IDNumber
+		err := r.server.callReplica(r.server.BackupNodes[j], "ReplicationHandler.GetPID", IDNumber{-1}, &pid, r.server.HeartbeatTimeout)
+		if err == nil {
+			return true
+		}
+	}
 	return false
 }
 
@@ -823,29 +1226,31 @@ func (r *ReplicationHandler) CatchupReplica(msg IDNumber, resp *IDNumber) error
 
 	reqs, err := ReadAllEntires(r.server)
 	if err != nil {
-		fmt.Printf("Error: %s", err)
+		r.server.logger.Error("Reading log entries", "err", err)
 	}
 
-	req := ReplicationRequest{Entries: reqs}
 	addr := r.server.BackupNodes[msg.ID]
 	//	for _, req := range s.BackupNodes {
 
-	addr_string := net.JoinHostPort(addr.Address, fmt.Sprintf("%d", addr.Port))
-	caller, err := net.DialTimeout("tcp", addr_string, 3*time.Second) // need a timeout here, else this hangs if backup not reachable
+	addr_string := addressString(addr)
+	client, err := r.server.connectReplica(addr, r.server.ReplicationTimeout) // need a timeout here, else this hangs if backup not reachable
 
 	if err != nil {
-		log.Printf("Node %d: Failed to connect to backup %s: %v", r.server.PID, addr_string, err)
+		r.server.logger.Warn("Failed to connect to backup", "peer", addr_string, "err", err)
+		return err
 	}
 
-	var to_resp ReplicationResponse
-	client := rpc.NewClient(caller)
-	err = client.Call("ReplicationHandler.ApplyEntries", req, &to_resp)
+	to_resp, err := r.server.sendEntries(client, reqs)
 	client.Close()
 
 	if err != nil {
-		log.Printf("Node %d: Failed to replicate to %s: %v", r.server.PID, addr_string, err)
-	} else if !to_resp.Success {
-		log.Printf("Node %d: Replication to %s failed: %s", r.server.PID, addr_string, to_resp.Message)
+		r.server.logger.Warn("Failed to replicate", "peer", addr_string, "err", err)
+	} else {
+		if !to_resp.Success {
+			r.server.logger.Warn("Replication rejected", "peer", addr_string, "reason", to_resp.Message)
+		} else {
+			r.server.Metrics.SetPeerIndex(msg.ID, to_resp.LastIndex)
+		}
 	}
 	//}
 	resp.ID = -1
@@ -855,113 +1260,140 @@ func (r *ReplicationHandler) CatchupReplica(msg IDNumber, resp *IDNumber) error
 func ConfirmLeader(s *Server) bool {
 	// leaderIds := []int{}
 	leaderId := -1
-	for i, replica := range REPLICA_ADDRESSES {
+	for i, replica := range s.BackupNodes {
 		if i == s.PID {
 			continue
 		}
-		caller, err := net.DialTimeout("tcp", net.JoinHostPort(replica.Address, fmt.Sprintf("%d", replica.Port)), 1*time.Second)
+		var pid IDNumber
+		msg := IDNumber{-1}
+		err := s.callReplica(replica, "ReplicationHandler.GetPID", msg, &pid, s.RPCTimeout)
 
 		if err != nil {
-			print("Error: ", err.Error())
+			s.logger.Debug("Replica did not answer", "peer", i, "err", err)
 		}
 
 		if err == nil {
-			var pid IDNumber
-			msg := IDNumber{-1}
-			client := rpc.NewClient(caller)
-			client.Call("MessageHandler.GetPID", msg, &pid)
 			if pid.ID > leaderId {
 				leaderId = pid.ID
 			}
 		}
 	}
 	if leaderId == -1 {
-		s.LeaderID = s.PID
+		s.SetLeader(s.PID)
 		return false
 	}
 
-	s.LeaderID = leaderId
+	s.SetLeader(leaderId)
 	return true
 
 }
 
 func main() {
-	// Configuration
-
-	offset, err := strconv.ParseUint(os.Args[1], 10, 32)
+	// Configuration, see config.go
+	configFile := flag.String("config", "", "YAML config file (default $"+CONFIG_FILE_ENV+" or "+DEFAULT_CONFIG_FILE+")")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: go run . [-config file] [<node id> [<timestampOffset>]]
+		Where node id is the 0-indexed number of this replica in the peer list
+		And where timestampOffset is the UTC offset in seconds
+		Both override node.id and node.clock_offset of the config file
+		Run "go run . gencerts <dir>" to generate a cluster CA and certificates
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
+	filename, required := *configFile, true
+	if filename == "" {
+		filename = os.Getenv(CONFIG_FILE_ENV)
+	}
+	if filename == "" {
+		filename, required = DEFAULT_CONFIG_FILE, false
+	}
+	config, err := LoadConfig(filename, required)
 	if err != nil {
-		fmt.Println(`Command line error, please run server using this command: go run . <offset> <optional:timestampOffset>\n\n
-		Where offset is the 0-indexed number corresponding to the desired address in the address file\n
-		And where timestampOffset is the UTC offset in seconds`)
-		return
+		log.Fatal(err)
 	}
 
-	if len(os.Args) > 2 {
-		timestampOffset, err := strconv.ParseInt(os.Args[2], 10, 32)
+	args := flag.Args()
+	if len(args) > 1 && args[0] == "gencerts" {
+		// local cluster CA, see certs.go
+		replicas, err := config.Replicas()
 		if err != nil {
-			fmt.Println("Error parsing timestamp offset, please specify integer Timestamp Offset in seconds")
-			return
+			log.Fatal(err)
 		}
-		TIMESTAMP_OFFSET = int(timestampOffset)
+		configFile, err := GenerateClusterCertificates(args[1], replicas)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %s, replicas and the gateway switch to TLS once it and the certificates are in their working directory\n", configFile)
+		return
 	}
 
-	ADDRESS_OFFSET = uint32(offset)
-
-	REPLICA_ADDRESSES = ReadReplicaAddresses(ADDRESS_FILE) // all addresses, including own
-
-	// Start the leader first (PID 0)
-	server := spawn_server(0)
-
-	messageHandler := MessageHandler{server: server}
-	replicationHandler := ReplicationHandler{server: server}
-
-	// Start RPC server
-	go server.HandleRPC(fmt.Sprintf("%s:%d", server.AddressPort.Address, server.AddressPort.Port), &messageHandler, &replicationHandler)
-
-	time.Sleep(1 * time.Second)
+	if len(args) > 0 {
+		id, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			flag.Usage()
+			os.Exit(2)
+		}
+		config.Node.ID = int(id)
+	}
 
-	ConfirmLeader(server)
-	fmt.Printf("LEADER: %d\n", server.LeaderID)
-	if server.LeaderID != server.PID {
+	if len(args) > 1 {
+		timestampOffset, err := strconv.ParseInt(args[1], 10, 32)
+		if err != nil {
+			fmt.Println("Error parsing timestamp offset, please specify integer Timestamp Offset in seconds")
+			os.Exit(2)
+		}
+		config.Node.ClockOffset = time.Duration(timestampOffset) * time.Second
+	}
 
-		var resp IDNumber
-		leader_addr := server.BackupNodes[server.LeaderID]
-		addr_string := net.JoinHostPort(leader_addr.Address, fmt.Sprintf("%d", leader_addr.Port))
-		caller, r_err := net.DialTimeout("tcp", addr_string, 1*time.Second) // assuming that there will be no error, assuming ConfirmLeader works
-		fmt.Println("ERROR ", r_err)
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ConfigureLogging(os.Stderr, config.Logging.Level, config.Logging.Format); err != nil {
+		log.Fatal(err)
+	}
 
-		client := rpc.NewClient(caller)
-		client.Call("ReplicationHandler.CatchupReplica", IDNumber{ID: server.PID}, &resp)
+	server := spawn_server(config)
 
-		if resp.ID == -1 {
-			fmt.Println("Replica caught up")
+	tlsConfig, err := config.TLSConfigFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsConfig != nil {
+		transport, err := tlsConfig.ReplicaTransport(server.PID)
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		// Initialize time for new replica
-		// var timeResp TimeStamp
-		// client.Call("ReplicationHandler.InitTime", TimeStamp{ID: server.PID, UTC: server.getTime()}, &timeResp)
-		// server.TimestampOffset = timeResp.Delta
-
-		client.Close()
+		server.Transport = transport
+		server.logger.Info("Using mutual TLS")
+	} else {
+		server.logger.Warn("TLS not configured, replicas communicate over plain TCP")
 	}
-
-	if server.LeaderID != server.PID {
-		replicationHandler.InitiateElection()
+	if server.Keyring != nil {
+		server.logger.Info("Encrypting data at rest", "key", server.Keyring.CurrentId())
+	} else {
+		server.logger.Warn("Encryption at rest not configured, the log and database are stored in the clear")
+	}
+	if config.file != "" {
+		server.logger.Info("Configured", "config", config.file)
 	}
 
-	go replicationHandler.BullyAlgorithmThread() // NEED TO detect leader failures
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-	for _, addr := range server.BackupNodes {
-		fmt.Printf("%s:%d\n", addr.Address, addr.Port)
+	for i, addr := range server.BackupNodes {
+		server.logger.Debug("Replica address", "peer", i, "address", addressString(addr))
 	}
 
 	// Give the leader time to initialize
-	time.Sleep(1 * time.Second)
+	time.Sleep(server.ElectionWait)
 
-	fmt.Printf("Replica %d running at %s:%d\n", ADDRESS_OFFSET, server.AddressPort.Address, server.AddressPort.Port)
-	fmt.Printf("SERVER START: Current time: %s | Offset is %fs \n", server.getTime().Format("15:04:05.000"), server.TimestampOffset.Seconds())
-	fmt.Println("Clients may now connect")
+	server.logger.Info("Replica running, clients may now connect",
+		"address", addressString(server.AddressPort),
+		"time", server.getTime().Format("15:04:05.000"),
+		"offset", server.ClockOffset())
 
 	// Wait forever
 	select {}
@@ -10,7 +10,9 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"strconv"
+	"time"
 	"database/sql"
 	_ "modernc.org/sqlite"
 )
@@ -29,6 +31,20 @@ type ChatMessage struct {
 	From      int
 	To        int
 	Acked     int
+	HLC       string // hybrid logical clock stamp, assigned by the leader, identifies the message
+	Edited    bool
+	Deleted   bool // tombstone, the text is gone
+	Encrypted bool // the text is an envelope, see e2e.go
+
+	Attachment     string // hash of an uploaded blob, see blobs.go
+	AttachmentName string // file name given by the sender
+	AttachmentSize int64  // set by GetMessages
+	AttachmentMIME string // set by GetMessages, sniffed from the contents
+
+	ReplyToId string          // HLC of the quoted message of the same chat, see reactions.go
+	Reactions []ReactionCount // set by GetMessages, per emoji
+
+	RequestId string // optional, repeats return the first reply, see idempotency.go
 }
 
 // JSON object, represents create account request received from user
@@ -38,6 +54,7 @@ type CreateAccountMessage struct {
 	Firstname string
 	Lastname  string
 	Descr     string
+	RequestId string // optional, repeats return the first reply, see idempotency.go
 }
 
 // JSON object, represents details that are relevant to a user, regaring
@@ -60,6 +77,7 @@ type GetMessagesRequest struct {
 // JSON object, array of user profiles
 type Contacts struct {
 	ContactList []UserProfile
+	Pending     []UserProfile // incoming contact requests, set by GetContacts
 }
 
 // JSON object, arrat of Chat messages
@@ -83,6 +101,43 @@ type RPCResponse struct {
 type AddContactMessage struct {
 	UserId    int
 	ContactId int
+	RequestId string // optional, repeats return the first reply, see idempotency.go
+}
+
+// JSON object, answer to a contact request. UserId received the
+// request, ContactId sent it
+type ContactResponse struct {
+	UserId    int
+	ContactId int
+	Response  string // one of CONTACT_ACCEPTED, CONTACT_DECLINED, CONTACT_BLOCKED
+}
+
+// states of a row in contacts, from userid towards contactid
+const (
+	CONTACT_PENDING  = "pending"  // userid asked, contactid has not answered
+	CONTACT_ACCEPTED = "accepted" // both ways, each user has a row
+	CONTACT_DECLINED = "declined"
+	CONTACT_BLOCKED  = "blocked" // contactid refuses requests from userid
+)
+
+// JSON object, represents a request to edit or delete a sent message.
+// The message is identified by its HLC stamp
+type EditMessageRequest struct {
+	UserId    int // must be the sender
+	HLC       string
+	Message   string // new text, unused when deleting
+	Encrypted bool   // the new text is an envelope, as the message was
+}
+
+// JSON object, one text a message had, stamped when it was written
+type MessageVersion struct {
+	Message string
+	HLC     string
+}
+
+// JSON object, earlier texts of an edited message, oldest first
+type MessageHistory struct {
+	Versions []MessageVersion
 }
 
 // =================================================
@@ -95,6 +150,17 @@ type AddContactMessage struct {
 //  SQL INITIALIZATION FUNCTIONS
 // =================================================
 
+/*
+	Opens a database file. Background threads read while handlers
+	write, a writer waits up to DATABASE_BUSY_TIMEOUT_MS for their
+	locks instead of failing with SQLITE_BUSY
+*/
+func openDatabase(database_name string) (*sql.DB, error) {
+	return sql.Open("sqlite", fmt.Sprintf("%s?_pragma=busy_timeout(%d)", database_name, DATABASE_BUSY_TIMEOUT_MS))
+}
+
+const DATABASE_BUSY_TIMEOUT_MS = 5000
+
 /*
 	Function that generates database schema if it does not exitst.
 
@@ -107,12 +173,15 @@ func BuildDatabase(database_name string) (*sql.DB, error) {
                         email TEXT UNIQUE, 
                         firstname TEXT, 
                         lastname TEXT, 
-                        descr TEXT);`
+                        descr TEXT,
+                        discoverable INTEGER NOT NULL DEFAULT 1,
+                        deleted INTEGER NOT NULL DEFAULT 0);`
 
 	contacts_script := `CREATE TABLE contacts (
                         rec_id INTEGER PRIMARY KEY,
                         userid INTEGER, 
-                        contactid INTEGER);`
+                        contactid INTEGER,
+                        status TEXT NOT NULL DEFAULT 'accepted');`
 
 	messages_script := `CREATE TABLE messages (
                         rec_id INTEGER PRIMARY KEY,
@@ -120,34 +189,416 @@ func BuildDatabase(database_name string) (*sql.DB, error) {
                         to_userid INTEGER,
                         message TEXT,
                         timestamp TEXT,
-                        acked INTEGER);`
-
-	db, err := sql.Open("sqlite", database_name)
+                        acked INTEGER,
+                        hlc TEXT,
+                        edited INTEGER NOT NULL DEFAULT 0,
+                        deleted INTEGER NOT NULL DEFAULT 0,
+                        edited_hlc TEXT,
+                        attachment TEXT,
+                        attachment_name TEXT,
+                        encrypted INTEGER NOT NULL DEFAULT 0,
+                        reply_to_id TEXT);`
+
+	db, err := openDatabase(database_name)
 	if err != nil {
-		fmt.Println("Error creating database file.")
+		slog.Error("Error creating database file", "file", database_name, "err", err)
 		return nil, err
 	}
 
 	_, err = db.Exec(users_script)
 	if err != nil {
-		fmt.Println("Error creating users table. ")
+		slog.Error("Error creating users table", "err", err)
 		return nil, err
 	}
 
 	_, err = db.Exec(contacts_script)
 	if err != nil {
-		fmt.Println("Error creating contacts table. ")
+		slog.Error("Error creating contacts table", "err", err)
 		return nil, err
 	}
 
 	_, err = db.Exec(messages_script)
 	if err != nil {
-		fmt.Println("Error creating messages table. ")
+		slog.Error("Error creating messages table", "err", err)
+		return nil, err
+	}
+
+	// tables and triggers that are also added to older files
+	if err = MigrateDatabase(db); err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
+/*
+	Schema objects created by MigrateDatabase when missing.
+
+	Edit history and tombstones are kept by triggers, so an edit or
+	delete is a single UPDATE in the log and every replica derives
+	the same history from it.
+*/
+var SCHEMA_OBJECTS = []string{
+	// attachment blobs by uploader, the contents are files, see blobs.go
+	`CREATE TABLE IF NOT EXISTS blobs (
+                        rec_id INTEGER PRIMARY KEY,
+                        hash TEXT,
+                        size INTEGER,
+                        mime TEXT,
+                        uploader INTEGER,
+                        UNIQUE (hash, uploader));`,
+
+	`CREATE TABLE IF NOT EXISTS message_edits (
+                        rec_id INTEGER PRIMARY KEY,
+                        message_hlc TEXT,
+                        message TEXT,
+                        written_hlc TEXT);`,
+
+	// keep the replaced text of an edited message. Re-sealing the
+	// text (see atrest.go) leaves edited_hlc alone and is not an edit
+	`CREATE TRIGGER IF NOT EXISTS message_edit_history
+        AFTER UPDATE OF message ON messages
+        WHEN NEW.deleted = 0 AND OLD.message IS NOT NEW.message
+        AND OLD.edited_hlc IS NOT NEW.edited_hlc
+        BEGIN
+            INSERT INTO message_edits (message_hlc, message, written_hlc)
+            VALUES (OLD.hlc, OLD.message, COALESCE(OLD.edited_hlc, OLD.hlc));
+        END;`,
+
+	// an accepted request makes the contact both ways, replacing any
+	// request the other user sent
+	`CREATE TRIGGER IF NOT EXISTS contact_accepted
+        AFTER UPDATE OF status ON contacts
+        WHEN NEW.status = 'accepted'
+        BEGIN
+            DELETE FROM contacts WHERE userid = NEW.contactid AND contactid = NEW.userid;
+            INSERT INTO contacts (userid, contactid, status)
+            VALUES (NEW.contactid, NEW.userid, 'accepted');
+        END;`,
+
+	// a block replaces any contact or request between the two users,
+	// blocks in the other direction stay
+	`CREATE TRIGGER IF NOT EXISTS contact_blocked
+        AFTER INSERT ON contacts
+        WHEN NEW.status = 'blocked'
+        BEGIN
+            DELETE FROM contacts
+            WHERE rec_id != NEW.rec_id AND status != 'blocked'
+            AND ((userid = NEW.userid AND contactid = NEW.contactid)
+                OR (userid = NEW.contactid AND contactid = NEW.userid));
+        END;`,
+
+	// a deleted account leaves no contacts or requests, see account.go
+	`CREATE TRIGGER IF NOT EXISTS account_deleted
+        AFTER UPDATE OF deleted ON users
+        WHEN NEW.deleted = 1
+        BEGIN
+            DELETE FROM contacts WHERE userid = OLD.userid OR contactid = OLD.userid;
+        END;`,
+
+	// and its sent messages become tombstones, as DeleteMessage leaves them
+	`CREATE TRIGGER IF NOT EXISTS account_messages_deleted
+        AFTER UPDATE OF deleted ON users
+        WHEN NEW.deleted = 1
+        BEGIN
+            UPDATE messages
+            SET [message] = '', [deleted] = 1, [edited_hlc] = NEW.deleted_hlc, [attachment] = NULL, [attachment_name] = NULL
+            WHERE from_userid = OLD.userid AND deleted = 0;
+        END;`,
+
+	// replies to client request IDs, see idempotency.go
+	`CREATE TABLE IF NOT EXISTS requests (
+                        user_id INTEGER,
+                        method TEXT,
+                        request_id TEXT,
+                        result TEXT,
+                        created_hlc TEXT,
+                        PRIMARY KEY (user_id, method, request_id));`,
+
+	// reported messages for moderators, see moderation.go
+	`CREATE TABLE IF NOT EXISTS reports (
+                        rec_id INTEGER PRIMARY KEY,
+                        message_hlc TEXT,
+                        from_userid INTEGER,
+                        message TEXT,
+                        reporter INTEGER,
+                        reason TEXT,
+                        reported_hlc TEXT,
+                        UNIQUE (message_hlc, reporter));`,
+
+	// a deleted message keeps no text, earlier versions included
+	`CREATE TRIGGER IF NOT EXISTS message_tombstone
+        AFTER UPDATE OF deleted ON messages
+        WHEN NEW.deleted = 1
+        BEGIN
+            DELETE FROM message_edits WHERE message_hlc = OLD.hlc;
+        END;`,
+
+	// logins of a user, see devices.go
+	`CREATE TABLE IF NOT EXISTS devices (
+                        device_id TEXT PRIMARY KEY,
+                        userid INTEGER,
+                        name TEXT,
+                        sync_cursor INTEGER NOT NULL DEFAULT 0,
+                        created_hlc TEXT,
+                        seen_hlc TEXT);`,
+
+	// change feed of users with devices, one row per changed message
+	// or contact and user, read by Sync
+	`CREATE TABLE IF NOT EXISTS changes (
+                        rec_id INTEGER PRIMARY KEY,
+                        userid INTEGER,
+                        message_hlc TEXT,
+                        contactid INTEGER);`,
+
+	`CREATE TRIGGER IF NOT EXISTS message_sent_change
+        AFTER INSERT ON messages
+        BEGIN
+            INSERT INTO changes (userid, message_hlc)
+            SELECT DISTINCT userid, NEW.hlc FROM devices
+            WHERE userid IN (NEW.from_userid, NEW.to_userid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS message_changed_change
+        AFTER UPDATE OF message, deleted ON messages
+        WHEN OLD.edited_hlc IS NOT NEW.edited_hlc
+        BEGIN
+            INSERT INTO changes (userid, message_hlc)
+            SELECT DISTINCT userid, NEW.hlc FROM devices
+            WHERE userid IN (NEW.from_userid, NEW.to_userid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS contact_added_change
+        AFTER INSERT ON contacts
+        BEGIN
+            INSERT INTO changes (userid, contactid)
+            SELECT DISTINCT userid, CASE userid WHEN NEW.userid THEN NEW.contactid ELSE NEW.userid END
+            FROM devices WHERE userid IN (NEW.userid, NEW.contactid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS contact_updated_change
+        AFTER UPDATE OF status ON contacts
+        BEGIN
+            INSERT INTO changes (userid, contactid)
+            SELECT DISTINCT userid, CASE userid WHEN NEW.userid THEN NEW.contactid ELSE NEW.userid END
+            FROM devices WHERE userid IN (NEW.userid, NEW.contactid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS contact_removed_change
+        AFTER DELETE ON contacts
+        BEGIN
+            INSERT INTO changes (userid, contactid)
+            SELECT DISTINCT userid, CASE userid WHEN OLD.userid THEN OLD.contactid ELSE OLD.userid END
+            FROM devices WHERE userid IN (OLD.userid, OLD.contactid);
+        END;`,
+
+	// rows acknowledged by every device of the user are not needed.
+	// The newest row is never dropped, so row ids are not reused
+	`CREATE TRIGGER IF NOT EXISTS changes_delivered
+        AFTER UPDATE OF sync_cursor ON devices
+        BEGIN
+            DELETE FROM changes WHERE userid = NEW.userid
+            AND rec_id < (SELECT MIN(sync_cursor) FROM devices WHERE userid = NEW.userid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS device_revoked
+        AFTER DELETE ON devices
+        BEGIN
+            DELETE FROM changes WHERE userid = OLD.userid
+            AND rec_id < COALESCE((SELECT MIN(sync_cursor) FROM devices WHERE userid = OLD.userid),
+                (SELECT MAX(rec_id) FROM changes));
+        END;`,
+
+	// a deleted account has no devices
+	`CREATE TRIGGER IF NOT EXISTS account_devices_deleted
+        AFTER UPDATE OF deleted ON users
+        WHEN NEW.deleted = 1
+        BEGIN
+            DELETE FROM devices WHERE userid = OLD.userid;
+        END;`,
+
+	// X25519 keys for encrypted messages, see e2e.go
+	`CREATE TABLE IF NOT EXISTS public_keys (
+                        userid INTEGER PRIMARY KEY,
+                        public_key TEXT,
+                        key_id TEXT,
+                        registered_hlc TEXT);`,
+
+	// a new key is a change of the owner for their contacts' devices
+	`CREATE TRIGGER IF NOT EXISTS public_key_changed
+        AFTER INSERT ON public_keys
+        BEGIN
+            INSERT INTO changes (userid, contactid)
+            SELECT DISTINCT D.userid, NEW.userid FROM devices D
+            INNER JOIN contacts C ON C.userid = D.userid
+            WHERE C.contactid = NEW.userid AND C.status = 'accepted';
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS account_key_deleted
+        AFTER UPDATE OF deleted ON users
+        WHEN NEW.deleted = 1
+        BEGIN
+            DELETE FROM public_keys WHERE userid = OLD.userid;
+        END;`,
+
+	// emoji reactions on messages, see reactions.go
+	`CREATE TABLE IF NOT EXISTS reactions (
+                        rec_id INTEGER PRIMARY KEY,
+                        message_hlc TEXT,
+                        userid INTEGER,
+                        emoji TEXT,
+                        reacted_hlc TEXT,
+                        UNIQUE (message_hlc, userid, emoji));`,
+
+	// a deleted message keeps no reactions
+	`CREATE TRIGGER IF NOT EXISTS message_reactions_deleted
+        AFTER UPDATE OF deleted ON messages
+        WHEN NEW.deleted = 1
+        BEGIN
+            DELETE FROM reactions WHERE message_hlc = OLD.hlc;
+        END;`,
+
+	// a reaction changes the message for the devices of both users
+	`CREATE TRIGGER IF NOT EXISTS reaction_added_change
+        AFTER INSERT ON reactions
+        BEGIN
+            INSERT INTO changes (userid, message_hlc)
+            SELECT DISTINCT D.userid, NEW.message_hlc FROM devices D
+            INNER JOIN messages M ON M.hlc = NEW.message_hlc
+            WHERE D.userid IN (M.from_userid, M.to_userid);
+        END;`,
+
+	`CREATE TRIGGER IF NOT EXISTS reaction_removed_change
+        AFTER DELETE ON reactions
+        BEGIN
+            INSERT INTO changes (userid, message_hlc)
+            SELECT DISTINCT D.userid, OLD.message_hlc FROM devices D
+            INNER JOIN messages M ON M.hlc = OLD.message_hlc
+            WHERE D.userid IN (M.from_userid, M.to_userid);
+        END;`,
+}
+
+/*
+	Function that brings the schema of an existing database file
+	up to date. Columns added after the initial schema are created
+	here if they are missing.
+*/
+func MigrateDatabase(db *sql.DB) error {
+	migrations := []struct {
+		table  string
+		column string
+		decl   string
+	}{
+		{"messages", "hlc", "TEXT"},
+		{"messages", "edited", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "deleted", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "edited_hlc", "TEXT"},
+		{"messages", "attachment", "TEXT"},
+		{"messages", "attachment_name", "TEXT"},
+		{"messages", "encrypted", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "reply_to_id", "TEXT"},
+		{"contacts", "status", "TEXT NOT NULL DEFAULT 'accepted'"},
+		{"users", "discoverable", "INTEGER NOT NULL DEFAULT 1"},
+		{"users", "deleted", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "deleted_hlc", "TEXT"},
+	}
+
+	for _, m := range migrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		script := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.decl)
+		if _, err := db.Exec(script); err != nil {
+			slog.Error("Error adding column", "table", m.table, "column", m.column, "err", err)
+			return err
+		}
+	}
+
+	// request records used to be keyed on the request ID alone. They
+	// are replies kept for REQUEST_RETENTION, older files drop them
+	// and the table is created again with the user and method in the key
+	oldRequests, err := columnExists(db, "requests", "request_id")
+	if err != nil {
+		return err
+	}
+	keyedRequests, err := columnExists(db, "requests", "user_id")
+	if err != nil {
+		return err
+	}
+	if oldRequests && !keyedRequests {
+		if _, err := db.Exec(`DROP TABLE requests`); err != nil {
+			slog.Error("Error dropping old request records", "err", err)
+			return err
+		}
+	}
+
+	for _, script := range SCHEMA_OBJECTS {
+		if _, err := db.Exec(script); err != nil {
+			slog.Error("Error creating schema object", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// checks the table info pragma for the given column
+func columnExists(db *sql.DB, table string, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+/*
+	Exec and Query run a statement against the replica's database and
+	record how long it took (see metrics.go). Use these rather than
+	DB directly.
+*/
+func (s *Server) Exec(query string, args ...any) (sql.Result, error) {
+	defer s.Metrics.ObserveQuery(query, time.Now())
+	return s.DB.Exec(query, args...)
+}
+
+func (s *Server) Query(query string, args ...any) (*sql.Rows, error) {
+	defer s.Metrics.ObserveQuery(query, time.Now())
+	return s.DB.Query(query, args...)
+}
+
+/*
+	Function that empties every replicated table. The log is the source
+	of truth, a replica that drops its log must also drop the state built
+	from it before the log is replayed.
+*/
+func ResetDatabase(db *sql.DB) error {
+	for _, table := range REPLICATED_TABLES {
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s", table)); err != nil {
+			slog.Error("Error clearing table", "table", table, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// tables whose rows are produced by applying the log
+var REPLICATED_TABLES = []string{"users", "contacts", "messages", "message_edits", "blobs", "reports", "requests", "devices", "changes", "public_keys", "reactions"}
+
 // used to be dynamic, constant now
 func GenerateDatabaseName(PID int) string {
 	return "mechat0.sqlite"
@@ -179,34 +630,93 @@ func (t *MessageHandler) SaveMessage(message *ChatMessage, response *string) err
 	defer t.mutex.Unlock()
 
 	// Do not write if we arent the leader
-	if t.server.LeaderID != t.server.PID {
+	if t.server.LeaderID() != t.server.PID {
 		*response = "not the leader node"
 		return fmt.Errorf("not the leader node")
 	}
 
+	// a repeat gets the reply of the first attempt and is not saved again
+	result, found, err := t.server.requestResult(message.From, message.RequestId, "SaveMessage")
+	if err != nil {
+		*response = "error"
+		return err
+	}
+	if found {
+		*response = result
+		return nil
+	}
+
+	blocked, err := t.isBlocked(message.From, message.To)
+	if err != nil {
+		*response = "error"
+		return err
+	}
+	if blocked {
+		*response = "error"
+		return fmt.Errorf("messages between these users are blocked")
+	}
+
+	rows, err := t.server.Query(`SELECT 1 FROM users WHERE userid = ? AND deleted = 1`, message.To)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		*response = "error"
+		return err
+	}
+	gone := rows.Next()
+	rows.Close()
+	if gone {
+		*response = "error"
+		return fmt.Errorf("recipient deleted their account")
+	}
+
+	// an encrypted text must be readable by the recipient's current key
+	if message.Encrypted {
+		if err := t.checkEncrypted(message.To, message.Message); err != nil {
+			*response = "error"
+			return err
+		}
+	}
+
+	// an attachment must be a blob the sender uploaded
+	if message.Attachment != "" {
+		if err := t.checkUploader(message.From, message.Attachment); err != nil {
+			*response = "error"
+			return err
+		}
+	}
+
+	// a reply quotes a message of the same chat, see reactions.go
+	if message.ReplyToId != "" {
+		if err := t.checkReply(message.From, message.To, message.ReplyToId); err != nil {
+			*response = "error"
+			return err
+		}
+	}
+
+	// only a message that would be saved counts against the limit
+	if !t.server.sendLimit.allow(message.From, t.server.Now()) {
+		*response = "error"
+		return fmt.Errorf("rate limit exceeded, try again later")
+	}
+
+	// stamp the message with the leader's hybrid clock, the same
+	// stamp goes on the log entry so replicas store identical values
+	stamp := t.server.Clock.Now()
+	message.HLC = stamp.String()
+
 	// raw SQL script to insert message
 	script := `INSERT INTO messages (
 		[from_userid], 
 		[to_userid], 
 		[message], 
 		[timestamp], 
-		[acked]) 
-		VALUES (?, ?, ?, ?, ?);`
-
-	// execute script against database
-	_, err := t.server.DB.Exec(script, message.From,
-		message.To,
-		message.Message,
-		message.Timestamp,
-		message.Acked)
-	
-	// handle error
-	if err != nil {
-		fmt.Println("Error saving message. ") // should print out rows changed here eventually
-		fmt.Println(err)
-		*response = "error"
-		return err
-	}
+		[acked],
+		[hlc],
+		[attachment],
+		[attachment_name],
+		[encrypted],
+		[reply_to_id]) 
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, NULLIF(?, ''));`
 
 	// Create a log entry without index
 	entry := LogEntry{
@@ -214,29 +724,191 @@ func (t *MessageHandler) SaveMessage(message *ChatMessage, response *string) err
 		Args: []any{
 			message.From,
 			message.To,
-			message.Message,
+			t.server.Keyring.SealField(message.Message), // see atrest.go
 			message.Timestamp,
 			message.Acked,
+			message.HLC,
+			message.Attachment,
+			message.AttachmentName,
+			message.Encrypted,
+			message.ReplyToId,
 		},
+		HLC:     stamp,
+		Request: newRequest(message.From, message.RequestId, "SaveMessage", "ACK"),
 	}
 
-	// Append to log and get updated entry with proper index
-	updatedEntry, err := t.server.AppendToLog(entry)
-	if err != nil {
-		fmt.Printf("Error appending to log: %v", err)
-		// Continue despite error - we already applied locally
-	} else {
-		// Replicate the updated entry with proper index
-		go t.server.ReplicateToBackups(updatedEntry)
+	// apply, then append to the log and replicate
+	if _, err := t.applyAndLog(entry, nil); err != nil {
+		t.server.logger.Error("Error saving message", "err", err) // should print out rows changed here eventually
+		*response = "error"
+		return err
 	}
 
 	// send ACK to user
-	fmt.Println("Wrote message")
+	t.server.logger.Debug("Wrote message", "from", message.From, "to", message.To)
 	*response = "ACK"
 	return nil
 }
 
 
+/*
+	Checks that a message exists, was sent by user_id and is not
+	deleted. Only the sender may edit or delete a message. Returns
+	the recipient and whether the message is encrypted
+*/
+func (t *MessageHandler) checkSender(user_id int, hlc string) (to int, encrypted bool, err error) {
+	query := `SELECT [from_userid], [to_userid], [deleted], [encrypted] FROM messages WHERE hlc = ?`
+	rows, err := t.server.Query(query, hlc)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, false, fmt.Errorf("no such message")
+	}
+	var from int
+	var deleted bool
+	if err := rows.Scan(&from, &to, &deleted, &encrypted); err != nil {
+		t.server.logger.Error("Scan failed", "err", err)
+		return 0, false, err
+	}
+	if from != user_id {
+		return 0, false, fmt.Errorf("only the sender can change a message")
+	}
+	if deleted {
+		return 0, false, fmt.Errorf("message was deleted")
+	}
+	return to, encrypted, nil
+}
+
+/*
+	Applies an edit or delete on the leader and replicates it. The
+	statement names the sender and skips deleted messages, so a
+	replica applying it stays identical to the leader. edit is false
+	for a delete
+*/
+func (t *MessageHandler) changeMessage(message *EditMessageRequest, response *RPCResponse, script string, args []any, stamp HLCTimestamp, edit bool) error {
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
+	}
+
+	to, encrypted, err := t.checkSender(message.UserId, message.HLC)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+
+	// an edit keeps an encrypted message encrypted, see e2e.go
+	if edit && message.Encrypted != encrypted {
+		response.Message = "error"
+		if encrypted {
+			return fmt.Errorf("message is encrypted, the new text must be too")
+		}
+		return fmt.Errorf("message is not encrypted")
+	}
+	if edit && encrypted {
+		if err := t.checkEncrypted(to, message.Message); err != nil {
+			response.Message = "error"
+			return err
+		}
+	}
+
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, HLC: stamp}, nil); err != nil {
+		t.server.logger.Error("Error changing message", "err", err)
+		response.Message = "error"
+		return err
+	}
+
+	response.Message = "ACK"
+	return nil
+}
+
+/*
+	RPC: Replaces the text of a message sent by the user. The
+	previous text is kept in message_edits
+*/
+func (t *MessageHandler) EditMessage(message *EditMessageRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stamp := t.server.Clock.Now()
+	script := `UPDATE messages
+		SET [message] = ?, [edited] = 1, [edited_hlc] = ?
+		WHERE hlc = ? AND from_userid = ? AND deleted = 0;`
+	args := []any{t.server.Keyring.SealField(message.Message), stamp.String(), message.HLC, message.UserId}
+
+	if err := t.changeMessage(message, response, script, args, stamp, true); err != nil {
+		return err
+	}
+	t.server.logger.Debug("Edited message", "user", message.UserId, "message", message.HLC)
+	return nil
+}
+
+/*
+	RPC: Deletes a message sent by the user. The row stays as a
+	tombstone without text, its edit history is dropped
+*/
+func (t *MessageHandler) DeleteMessage(message *EditMessageRequest, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stamp := t.server.Clock.Now()
+	script := `UPDATE messages
+		SET [message] = '', [deleted] = 1, [edited_hlc] = ?, [attachment] = NULL, [attachment_name] = NULL
+		WHERE hlc = ? AND from_userid = ? AND deleted = 0;`
+	args := []any{stamp.String(), message.HLC, message.UserId}
+
+	if err := t.changeMessage(message, response, script, args, stamp, false); err != nil {
+		return err
+	}
+	t.server.logger.Debug("Deleted message", "user", message.UserId, "message", message.HLC)
+	return nil
+}
+
+/*
+	RPC: Earlier texts of a message, for its sender or recipient.
+	Deleted messages have no history
+*/
+func (t *MessageHandler) GetMessageHistory(message *EditMessageRequest, history *MessageHistory) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	query := `SELECT E.message, COALESCE(E.written_hlc, '')
+            FROM message_edits E
+            INNER JOIN messages M
+            ON M.hlc = E.message_hlc
+            WHERE E.message_hlc = ?
+            AND (M.from_userid = ? OR M.to_userid = ?)
+            ORDER BY E.written_hlc, E.rec_id`
+
+	rows, err := t.server.Query(query, message.HLC, message.UserId, message.UserId)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	history.Versions = []MessageVersion{}
+	for rows.Next() {
+		var version MessageVersion
+		if err := rows.Scan(&version.Message, &version.HLC); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return err
+		}
+		if version.Message, err = t.server.Keyring.OpenField(version.Message); err != nil {
+			t.server.logger.Error("Error opening message", "err", err)
+			return err
+		}
+		history.Versions = append(history.Versions, version)
+	}
+	return rows.Err()
+}
+
+
 /*
 	RPC: Receives 'create account' message from user, applies to databases,
 	relays message to replicas if leader
@@ -246,11 +918,27 @@ func (t *MessageHandler) CreateAccount(message *CreateAccountMessage, response *
 	defer t.mutex.Unlock()
 
 	// Dont write if we are not the leader
-	if !t.server.IsLeader {
+	if !t.server.IsLeader() {
 		response.Message = "not the leader node"
 		return fmt.Errorf("not the leader node")
 	}
 
+	// a repeat gets the user id created by the first attempt
+	result, found, err := t.server.requestResult(0, message.RequestId, "CreateAccount")
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	if found {
+		// the ID may be another client's, only the same email gets its account
+		if err := t.sameAccount(result, message.Email); err != nil {
+			response.Message = "error"
+			return err
+		}
+		response.Message = result
+		return nil
+	}
+
 	// script to create new user
 	script := `INSERT INTO users (
 		[password], 
@@ -260,57 +948,46 @@ func (t *MessageHandler) CreateAccount(message *CreateAccountMessage, response *
 		[descr])
 	VALUES (?, ?, ?, ?, ?);`
 
+	// create log entry for replicas
+	entry := LogEntry{
+		SQL: script,
+		Args: []any{
+			t.server.Keyring.SealField(message.Password),
+			message.Email,
+			message.Firstname,
+			message.Lastname,
+			message.Descr,
+		},
+		Request: newRequest(0, message.RequestId, "CreateAccount", ""),
+	}
+
 	// try adding user, email is UNIQUE as per schema declaration,
-	// duplicate users will cause an execution failure
-	result, err := t.server.DB.Exec(script, message.Password,
-		message.Email,
-		message.Firstname,
-		message.Lastname,
-		message.Descr)
+	// duplicate users will cause an execution failure. The new user
+	// id is the reply recorded for the request
+	res, err := t.applyAndLog(entry, func(result sql.Result) string {
+		uid, _ := result.LastInsertId()
+		return strconv.FormatInt(uid, 10)
+	})
 
 	// handle error
 	if err != nil {
-		fmt.Println("Error creating user. ")
-		fmt.Println(err)
+		t.server.logger.Warn("Error creating user", "err", err)
 		response.Message = "error"
 		return err
 	}
 
 	// if succesful, receive id for new user
-	uid, err := result.LastInsertId()
+	uid, err := res.LastInsertId()
 
 	// handle error
 	if err != nil {
-		fmt.Println("Error getting user id")
-		fmt.Println(err)
+		t.server.logger.Error("Error getting user id", "err", err)
 		response.Message = "error"
 		return err
 	}
 
-	// create log entry for replicas
-	entry := LogEntry{
-		SQL: script,
-		Args: []any{
-			message.Password,
-			message.Email,
-			message.Firstname,
-			message.Lastname,
-			message.Descr,
-		},
-	}
-
-	// Append to log and get updated entry with proper index
-	updatedEntry, err := t.server.AppendToLog(entry)
-	if err != nil {
-		fmt.Printf("Error appending to log: %v", err)
-		// Continue despite error - we already applied locally
-	} else {
-		// Replicate the updated entry with proper index
-		go t.server.ReplicateToBackups(updatedEntry)
-	}
-
 	uid_str := strconv.Itoa(int(uid))
-	fmt.Println("Created user")
+	t.server.logger.Info("Created user", "user", uid)
 
 	// return user id to user
 	response.Message = uid_str
@@ -327,17 +1004,17 @@ func (t *MessageHandler) Login(message *LoginMessage, user_profile *UserProfile)
 
 	// collect sha256 digest password for user email
 	pass_check := `SELECT [password] FROM users WHERE email = ?`
-	pass_row, err := t.server.DB.Query(pass_check, message.Email)
+	pass_row, err := t.server.Query(pass_check, message.Email)
 
 	// handle SQL error
 	if err != nil {
-		fmt.Println("Error checking password")
+		t.server.logger.Error("Error checking password", "err", err)
 		return err
 	}
 
 	// if no such rows, notify no user exists
 	if !pass_row.Next() {
-		fmt.Println("No such user")
+		t.server.logger.Debug("Login for unknown user")
 		return fmt.Errorf("no such user")
 	}
 
@@ -347,14 +1024,22 @@ func (t *MessageHandler) Login(message *LoginMessage, user_profile *UserProfile)
 
 	// handle SQL error
 	if err != nil {
-		fmt.Println("Error scanning password")
+		t.server.logger.Error("Error scanning password", "err", err)
+		pass_row.Close()
+		return err
+	}
+
+	// the digest may be sealed, see atrest.go
+	db_pass, err = t.server.Keyring.OpenField(db_pass)
+	if err != nil {
+		t.server.logger.Error("Error opening password", "err", err)
 		pass_row.Close()
 		return err
 	}
 
 	// if not a match, let user know
 	if db_pass != message.Password {
-		fmt.Println("Incorrect password")
+		t.server.logger.Debug("Login with incorrect password")
 		pass_row.Close()
 		return fmt.Errorf("incorrect password")
 	}
@@ -364,9 +1049,9 @@ func (t *MessageHandler) Login(message *LoginMessage, user_profile *UserProfile)
 
 	// if successful, the user will want their required info, mainly user_id (record id not email)
 	query := `SELECT [userid], [email], [firstname], [lastname], [descr] FROM users WHERE email = ?`
-	user_row, err := t.server.DB.Query(query, message.Email)
+	user_row, err := t.server.Query(query, message.Email)
 	if err != nil {
-		fmt.Println(err)
+		t.server.logger.Error("Query failed", "err", err)
 		return err
 	}
 
@@ -375,7 +1060,7 @@ func (t *MessageHandler) Login(message *LoginMessage, user_profile *UserProfile)
 		// send info to RPC invoker
 		err = user_row.Scan(&user_profile.UserId, &user_profile.Email, &user_profile.Firstname, &user_profile.Lastname, &user_profile.Descr)
 		if err != nil {
-			fmt.Println(err)
+			t.server.logger.Error("Scan failed", "err", err)
 			user_row.Close()
 			return err
 		}
@@ -389,114 +1074,224 @@ func (t *MessageHandler) Login(message *LoginMessage, user_profile *UserProfile)
 
 
 /*
-	Receives 'add contact' message from user, applies to databases,
-	relays message to replicas if leader
+	Status of the row from user towards contact, empty if the
+	user never sent a request
 */
-func (t *MessageHandler) AddContact(message *AddContactMessage, response *AddContactMessage) error {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+func (t *MessageHandler) contactStatus(user int, contact int) (string, error) {
+	rows, err := t.server.Query(`SELECT status FROM contacts WHERE userid = ? AND contactid = ?`, user, contact)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return "", err
+	}
+	defer rows.Close()
 
-	// query, see if these users already contacted each other
-	check := `SELECT * FROM contacts WHERE userid=? AND contactid=?`
+	status := ""
+	if rows.Next() {
+		if err := rows.Scan(&status); err != nil {
+			t.server.logger.Error("Scan failed", "err", err)
+			return "", err
+		}
+	}
+	return status, nil
+}
 
-	// relationship can go either wat
-	check_one, err1 := t.server.DB.Query(check, message.ContactId, message.UserId)
-	check_two, err2 := t.server.DB.Query(check, message.UserId, message.ContactId)
+/*
+	Runs a statement on the leader, then appends it to the log and
+	replicates it. The statement must have the same effect on every
+	replica, so checks that depend on the leader's state are made
+	before it, or repeated in its WHERE clause
+*/
+func (t *MessageHandler) execReplicated(script string, args ...any) (sql.Result, error) {
+	return t.applyAndLog(LogEntry{SQL: script, Args: args}, nil)
+}
 
-	// handle querying error
-	if err1 != nil || err2 != nil {
-		fmt.Println("Error querying contact")
-		check_one.Close()
-		check_two.Close()
-		return fmt.Errorf("error querying contact")
+/*
+	execReplicated for a prepared entry, which may carry a client
+	request (see idempotency.go). result computes the reply recorded
+	for it, nil keeps entry.Request.Result
+*/
+func (t *MessageHandler) applyAndLog(entry LogEntry, result func(sql.Result) string) (sql.Result, error) {
+	if entry.HLC.IsZero() {
+		entry.HLC = t.server.Clock.Now()
+	}
+	res, err := t.server.execEntry(&entry, result)
+	if err != nil {
+		return nil, err
 	}
 
-	// ensure both users exist (implicitly they always will, only available users are)
-	// clickable by the user
-	if check_one.Next() || check_two.Next() {
-		check_one.Close()
-		check_two.Close()
-		fmt.Println("Contact already exists")
-		return fmt.Errorf("contact already exists")
+	// Append to log and get updated entry with proper index
+	updatedEntry, err := t.server.AppendToLog(entry)
+	if err != nil {
+		t.server.logger.Error("Error appending to log", "err", err)
+		// Continue despite error - we already applied locally
+	} else {
+		// Replicate the updated entry with proper index
+		go t.server.ReplicateToBackups(updatedEntry)
+	}
+
+	if entry.Request != nil {
+		t.pruneRequests()
 	}
+	return res, nil
+}
+
+/*
+	Applies a change to contacts on the leader and replicates it. Each
+	change is a single statement, the contact_accepted trigger adds the
+	other direction on every replica
+*/
+func (t *MessageHandler) changeContact(request *RequestRecord, script string, args ...any) error {
+	if _, err := t.applyAndLog(LogEntry{SQL: script, Args: args, Request: request}, nil); err != nil {
+		t.server.logger.Error("Error changing contact", "err", err)
+		return fmt.Errorf("error changing contact")
+	}
+	return nil
+}
 
-	// close these resultset connections
-	check_one.Close()
-	check_two.Close()
+/*
+	Sends a contact request from UserId to ContactId. If ContactId
+	already asked for UserId, that request is accepted instead.
+	Returns the resulting status
+*/
+func (t *MessageHandler) sendContactRequest(message *AddContactMessage) (string, error) {
+	user, contact := message.UserId, message.ContactId
 
-	// raw executes weren't working here, opening a transaction instead
-	tx, err := t.server.DB.Begin()
-    if err != nil {
-        fmt.Println("Error beginning transaction: ", err)
-        return fmt.Errorf("error beginning transaction: ")
-    }
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		return "", fmt.Errorf("not the leader node")
+	}
 
-	// script to insert contact
-	// need to do it twice (both directions)
-	script := `INSERT INTO contacts
-				(userid, contactid) VALUES (?, ?)`
+	// a repeat gets the status of the first attempt
+	status, found, err := t.server.requestResult(user, message.RequestId, "ContactRequest")
+	if err != nil || found {
+		return status, err
+	}
 
-	// insert contact one way, then anohter
-	_, err1 = tx.Exec(script, message.UserId, message.ContactId);
-	_, err2 = tx.Exec(script, message.ContactId, message.UserId);
-	fmt.Printf("%d    %d\n", message.UserId, message.ContactId)
+	if user == contact {
+		return "", fmt.Errorf("cannot add yourself as a contact")
+	}
 
-	// handle errors
-	if err1 != nil || err2 != nil {
-		fmt.Println("Error creating contact")
-		tx.Rollback()
-		return fmt.Errorf("error creating contact")
+	rows, err := t.server.Query(`SELECT 1 FROM users WHERE userid = ? AND deleted = 0`, contact)
+	if err != nil {
+		t.server.logger.Error("Query failed", "err", err)
+		return "", err
+	}
+	exists := rows.Next()
+	rows.Close()
+	if !exists {
+		return "", fmt.Errorf("no such user")
 	}
 
-	// commit transactions if successful
-	err = tx.Commit()
+	mine, err := t.contactStatus(user, contact)
 	if err != nil {
-        fmt.Println("Error committing: ", err)
-        return fmt.Errorf("error committing: ")
-    }
+		return "", err
+	}
+	theirs, err := t.contactStatus(contact, user)
+	if err != nil {
+		return "", err
+	}
 
-	// Create a log entry without index
-	entry := LogEntry{
-		SQL: script,
-		Args: []any{
-			message.UserId,
-			message.ContactId,
-		},
+	// applies the change, recording status as the reply to the request
+	change := func(status string, script string, args ...any) (string, error) {
+		request := newRequest(user, message.RequestId, "ContactRequest", status)
+		return status, t.changeContact(request, script, args...)
 	}
 
-	// Append to log and get updated entry with proper index
-	updatedEntry, err := t.server.AppendToLog(entry)
+	switch {
+	case mine == CONTACT_ACCEPTED:
+		t.server.logger.Debug("Contact already exists", "user", user, "contact", contact)
+		return "", fmt.Errorf("contact already exists")
+	case mine == CONTACT_BLOCKED:
+		return "", fmt.Errorf("contact request not allowed")
+	case theirs == CONTACT_PENDING:
+		// both asked, nothing left to answer
+		return change(CONTACT_ACCEPTED, `UPDATE contacts SET status = 'accepted'
+				WHERE userid = ? AND contactid = ? AND status = 'pending'`, contact, user)
+	case mine == CONTACT_PENDING:
+		return "", fmt.Errorf("contact request already sent")
+	case mine == CONTACT_DECLINED:
+		// asking again after a decline
+		return change(CONTACT_PENDING, `UPDATE contacts SET status = 'pending'
+				WHERE userid = ? AND contactid = ? AND status = 'declined'`, user, contact)
+	}
+
+	return change(CONTACT_PENDING, `INSERT INTO contacts
+				(userid, contactid, status) VALUES (?, ?, 'pending')`, user, contact)
+}
+
+/*
+	RPC: Asks contact to become a contact of user. The contact is
+	created once they accept, see RespondContactRequest
+*/
+func (t *MessageHandler) SendContactRequest(message *AddContactMessage, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	status, err := t.sendContactRequest(message)
 	if err != nil {
-		fmt.Printf("Error appending to log: %v", err)
-		// Continue despite error - we already applied locally
-	} else {
-		// Replicate the updated entry with proper index
-		go t.server.ReplicateToBackups(updatedEntry)
+		response.Message = "error"
+		return err
 	}
+	t.server.logger.Debug("Contact request sent", "user", message.UserId, "contact", message.ContactId, "status", status)
+	response.Message = status
+	return nil
+}
 
-	// need both versions
-	entry = LogEntry{
-		SQL: script,
-		Args: []any{
-			message.ContactId,
-			message.UserId,
-		},
+/*
+	RPC: Accepts, declines or blocks a pending request that
+	ContactId sent to UserId
+*/
+func (t *MessageHandler) RespondContactRequest(message *ContactResponse, response *RPCResponse) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Do not write if we arent the leader
+	if t.server.LeaderID() != t.server.PID {
+		response.Message = "not the leader node"
+		return fmt.Errorf("not the leader node")
 	}
 
-		// Append to log and get updated entry with proper index
-	updatedEntry, err = t.server.AppendToLog(entry)
+	switch message.Response {
+	case CONTACT_ACCEPTED, CONTACT_DECLINED, CONTACT_BLOCKED:
+	default:
+		response.Message = "error"
+		return fmt.Errorf("response must be one of %s, %s, %s", CONTACT_ACCEPTED, CONTACT_DECLINED, CONTACT_BLOCKED)
+	}
+
+	status, err := t.contactStatus(message.ContactId, message.UserId)
 	if err != nil {
-		fmt.Printf("Error appending to log: %v", err)
-		// Continue despite error - we already applied locally
-	} else {
-		// Replicate the updated entry with proper index
-		go t.server.ReplicateToBackups(updatedEntry)
+		response.Message = "error"
+		return err
+	}
+	if status != CONTACT_PENDING {
+		response.Message = "error"
+		return fmt.Errorf("no pending contact request")
 	}
 
-	// no error
+	err = t.changeContact(nil, `UPDATE contacts SET status = ?
+				WHERE userid = ? AND contactid = ? AND status = 'pending'`,
+		message.Response, message.ContactId, message.UserId)
+	if err != nil {
+		response.Message = "error"
+		return err
+	}
+	t.server.logger.Debug("Contact request answered", "user", message.UserId, "contact", message.ContactId, "response", message.Response)
+	response.Message = message.Response
 	return nil
 }
 
+/*
+	Receives 'add contact' message from user. Kept for older clients,
+	it now sends a contact request
+*/
+func (t *MessageHandler) AddContact(message *AddContactMessage, response *AddContactMessage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, err := t.sendContactRequest(message)
+	return err
+}
+
 
 /*
 	Receives 'get contacts' from user, returns
@@ -516,47 +1311,16 @@ func (t *MessageHandler) GetContacts(message *UserProfile, contacts *Contacts) e
                 FROM contacts C
                 INNER JOIN users U
                 ON U.userid = C.contactid
-                WHERE C.userid = ?`
+                WHERE C.userid = ? AND C.status = 'accepted'`
 
-	// we need to find any of these users, so get resultset
-	rows, err := t.server.DB.Query(query, message.UserId)
+	var err error
+	contacts.ContactList, err = t.queryProfiles(query, message.UserId)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
-	// now we need to create a userprofile array for each unique user
-	// this is being returned / provided to the RPC invoker
-	contacts.ContactList = []UserProfile{}
-	for rows.Next() {
-		var contact UserProfile
-		err = rows.Scan(&contact.UserId, &contact.Email, &contact.Firstname, &contact.Lastname, &contact.Descr)
-		if err != nil {
-			fmt.Println(err)
-			rows.Close()
-			return err
-		}
-		contacts.ContactList = append(contacts.ContactList, contact)
-	}
-
-	// close the query resultst
-	rows.Close()
-
-	// no error
-	return nil
-}
-
-
-/*
-	Similar to function above. Simplified query, get all users regardless
-	of contacts
-*/
-func (t *MessageHandler) GetAllUsers(message *UserProfile, contacts *Contacts) error {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-
-	// query
-	query := `SELECT
+	// requests other users sent that are waiting for an answer
+	pending := `SELECT
                 U.userid,
                 U.email,
                 U.firstname,
@@ -564,35 +1328,53 @@ func (t *MessageHandler) GetAllUsers(message *UserProfile, contacts *Contacts) e
                 U.descr
                 FROM contacts C
                 INNER JOIN users U
-                ON U.userid = C.contactid
-                WHERE C.userid = ?`
+                ON U.userid = C.userid
+                WHERE C.contactid = ? AND C.status = 'pending'
+                ORDER BY C.rec_id`
 
+	contacts.Pending, err = t.queryProfiles(pending, message.UserId)
+	return err
+}
 
+// runs a query selecting userid, email, firstname, lastname, descr
+func (t *MessageHandler) queryProfiles(query string, args ...any) ([]UserProfile, error) {
 	// we need to find any of these users, so get resultset
-	rows, err := t.server.DB.Query(query, message.UserId)
+	rows, err := t.server.Query(query, args...)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		t.server.logger.Error("Query failed", "err", err)
+		return nil, err
 	}
+	defer rows.Close()
 
 	// now we need to create a userprofile array for each unique user
 	// this is being returned / provided to the RPC invoker
-	contacts.ContactList = []UserProfile{}
+	profiles := []UserProfile{}
 	for rows.Next() {
 		var contact UserProfile
 		err = rows.Scan(&contact.UserId, &contact.Email, &contact.Firstname, &contact.Lastname, &contact.Descr)
 		if err != nil {
-			fmt.Println(err)
-			rows.Close()
-			return err
+			t.server.logger.Error("Scan failed", "err", err)
+			return nil, err
 		}
-		contacts.ContactList = append(contacts.ContactList, contact)
+		profiles = append(profiles, contact)
 	}
+	return profiles, rows.Err()
+}
 
-	// close the query resultst
-	rows.Close()
 
-	// no error
+/*
+	First page of the user directory, see directory.go. Kept for
+	clients that do not search
+*/
+func (t *MessageHandler) GetAllUsers(message *UserProfile, contacts *Contacts) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	page, err := t.searchUsers(&DirectoryRequest{UserId: message.UserId})
+	if err != nil {
+		return err
+	}
+	contacts.ContactList = page.Users
 	return nil
 }
 
@@ -606,44 +1388,72 @@ func (t *MessageHandler) GetMessages(message *GetMessagesRequest, messages *Mess
 	defer t.mutex.Unlock()
 
 	// query, need messages going either way
+	var err error
+	messages.Messages, err = t.queryMessages(message.UserId, `WHERE (M.from_userid = ?
+            AND M.to_userid = ?)
+            OR						
+            (M.from_userid = ?
+            AND M.to_userid = ?)
+            ORDER BY M.hlc, M.rec_id`, message.UserId, message.ContactId, message.ContactId, message.UserId)
+	return err
+}
+
+/*
+	Messages matching a WHERE clause on messages M, as sent to
+	viewer. Used by GetMessages and Sync (see devices.go)
+*/
+func (t *MessageHandler) queryMessages(viewer int, where string, args ...any) ([]ChatMessage, error) {
 	query := `SELECT
             M.from_userid,
             M.to_userid,
             M.message,
             M.timestamp,
-            M.acked
+            M.acked,
+            COALESCE(M.hlc, ''),
+            M.edited,
+            M.deleted,
+            COALESCE(M.attachment, ''),
+            COALESCE(M.attachment_name, ''),
+            COALESCE((SELECT B.size FROM blobs B WHERE B.hash = M.attachment LIMIT 1), 0),
+            COALESCE((SELECT B.mime FROM blobs B WHERE B.hash = M.attachment LIMIT 1), ''),
+            M.encrypted,
+            COALESCE(M.reply_to_id, '')
             FROM messages M
-            WHERE (M.from_userid = ?
-            AND M.to_userid = ?)
-            OR						
-            (M.from_userid = ?
-            AND M.to_userid = ?)`
+            ` + where
 
 	// attempt to query messages
-	rows, err := t.server.DB.Query(query, message.UserId, message.ContactId, message.ContactId, message.UserId)
+	rows, err := t.server.Query(query, args...)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		t.server.logger.Error("Query failed", "err", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	// add ChatMessage struct to RPC invoker's reference for
-	// each unique message pulled from database
-	messages.Messages = []ChatMessage{}
+	// add a ChatMessage struct for each unique message
+	// pulled from database
+	messages := []ChatMessage{}
 	for rows.Next() {
 		var msg ChatMessage
-		err = rows.Scan(&msg.From, &msg.To, &msg.Message, &msg.Timestamp, &msg.Acked)
+		err = rows.Scan(&msg.From, &msg.To, &msg.Message, &msg.Timestamp, &msg.Acked, &msg.HLC, &msg.Edited, &msg.Deleted,
+			&msg.Attachment, &msg.AttachmentName, &msg.AttachmentSize, &msg.AttachmentMIME, &msg.Encrypted, &msg.ReplyToId)
 		if err != nil {
-			fmt.Println(err)
-			rows.Close()
-			return err
+			t.server.logger.Error("Scan failed", "err", err)
+			return nil, err
+		}
+		if msg.Message, err = t.server.Keyring.OpenField(msg.Message); err != nil {
+			t.server.logger.Error("Error opening message", "err", err)
+			return nil, err
 		}
-		messages.Messages = append(messages.Messages, msg)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	
-	// close connection
-	rows.Close()
 
-	// no error
-	return nil
+	// counted per emoji, see reactions.go
+	if err := t.addReactions(viewer, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
 }
 
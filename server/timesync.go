@@ -0,0 +1,380 @@
+package main
+
+/*
+Clock synchronization between replicas.
+
+The leader periodically exchanges several time samples with each
+replica (NTP style), keeps only the low round-trip samples, and
+computes a fault-tolerant average of the offsets. Replicas that are
+unreachable or whose clocks are far off from the rest do not vote,
+but are still told how to correct. Corrections are slewed in gradually
+so that a node's clock never jumps, and the leader estimates the drift
+rate of every replica's oscillator relative to its own.
+*/
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TIME_SYNC_SAMPLES       = 8                     // samples taken per peer each round
+	TIME_SYNC_OUTLIER_FLOOR = 50 * time.Millisecond // minimum deviation from the median to count as an outlier
+	TIME_SLEW_RATE          = 0.05                  // fraction of elapsed time a correction may take up
+	TIME_STEP_THRESHOLD     = time.Minute           // corrections larger than this are stepped instead of slewed
+	DRIFT_WINDOW            = 16                    // offset history kept per node for drift estimation
+)
+
+/*
+Offset applied on top of the local clock. Corrections are not applied
+immediately; the remaining correction is folded into the offset at
+TIME_SLEW_RATE, which keeps the adjusted clock monotonic.
+*/
+type ClockSlew struct {
+	mutex     sync.Mutex
+	now       func() time.Time // raw local clock, Server.Now
+	offset    time.Duration    // offset in effect at 'since'
+	remaining time.Duration    // correction that has not been applied yet
+	since     time.Time        // time of the last fold, zero before the first
+}
+
+func NewClockSlew(initial time.Duration, now func() time.Time) *ClockSlew {
+	return &ClockSlew{offset: initial, now: now}
+}
+
+// folds the part of the pending correction that is due by 'now'
+func (c *ClockSlew) advance(now time.Time) {
+	if c.since.IsZero() {
+		c.since = now
+		return
+	}
+	elapsed := now.Sub(c.since)
+	if elapsed <= 0 {
+		return
+	}
+	c.since = now
+
+	step := time.Duration(float64(elapsed) * TIME_SLEW_RATE)
+	switch {
+	case c.remaining > step:
+		c.offset += step
+		c.remaining -= step
+	case c.remaining < -step:
+		c.offset -= step
+		c.remaining += step
+	default:
+		c.offset += c.remaining
+		c.remaining = 0
+	}
+}
+
+// Offset currently in effect
+func (c *ClockSlew) Offset() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.advance(c.now())
+	return c.offset
+}
+
+// Offset the clock is converging to, once all pending corrections are applied
+func (c *ClockSlew) Target() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.advance(c.now())
+	return c.offset + c.remaining
+}
+
+// Correction that is still being slewed in
+func (c *ClockSlew) Remaining() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.advance(c.now())
+	return c.remaining
+}
+
+// Queue a correction. Very large corrections are stepped at once
+func (c *ClockSlew) Adjust(delta time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.advance(c.now())
+	c.remaining += delta
+	if c.remaining > TIME_STEP_THRESHOLD || c.remaining < -TIME_STEP_THRESHOLD {
+		c.offset += c.remaining
+		c.remaining = 0
+	}
+}
+
+/*
+Offset of a node's raw oscillator relative to the leader's raw
+oscillator, as measured at 'at' (leader raw time)
+*/
+type DriftSample struct {
+	At     time.Time
+	Offset time.Duration
+}
+
+// Sliding window of raw offsets, used for drift estimation
+type DriftEstimator struct {
+	samples []DriftSample
+}
+
+func (d *DriftEstimator) Add(sample DriftSample) {
+	d.samples = append(d.samples, sample)
+	if len(d.samples) > DRIFT_WINDOW {
+		d.samples = d.samples[len(d.samples)-DRIFT_WINDOW:]
+	}
+}
+
+/*
+Drift rate in parts per million, the least-squares slope of the raw
+offset over time. Returns false until there are enough samples.
+*/
+func (d *DriftEstimator) RatePPM() (float64, bool) {
+	n := len(d.samples)
+	if n < 3 {
+		return 0, false
+	}
+
+	origin := d.samples[0].At
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range d.samples {
+		x := s.At.Sub(origin).Seconds()
+		y := s.Offset.Seconds()
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denom := float64(n)*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	slope := (float64(n)*sumXY - sumX*sumY) / denom
+	return slope * 1e6, true
+}
+
+// One request/response exchange with a peer
+type ClockSample struct {
+	RTT       time.Duration
+	Offset    time.Duration // peer adjusted clock - local adjusted clock
+	RawOffset time.Duration // peer raw clock - local raw clock
+	At        time.Time     // local raw time at the midpoint of the exchange
+}
+
+/*
+Takes TIME_SYNC_SAMPLES samples from a peer and combines the ones with
+the lowest round-trip time. Returns false if no sample succeeded.
+*/
+func (r *ReplicationHandler) sampleClock(client *replicaClient) (ClockSample, bool) {
+	samples := make([]ClockSample, 0, TIME_SYNC_SAMPLES)
+
+	for k := 0; k < TIME_SYNC_SAMPLES; k++ {
+		var resp TimeStamp
+		rawBefore := r.server.Now()
+		before := r.server.targetTime()
+		err := client.Call("ReplicationHandler.GetTime", TimeStamp{HLC: r.server.Clock.Now()}, &resp)
+		if err != nil {
+			r.server.logger.Debug("Clock sample failed", "err", err)
+			continue
+		}
+		rawAfter := r.server.Now()
+		after := r.server.targetTime()
+		r.server.Clock.Update(resp.HLC)
+
+		// NTP offset, assuming symmetric network delay:
+		// theta = t_remote - (t_before + t_after) / 2
+		rtt := rawAfter.Sub(rawBefore)
+		samples = append(samples, ClockSample{
+			RTT:       rtt,
+			Offset:    resp.UTC.Sub(before.Add(after.Sub(before) / 2)),
+			RawOffset: resp.Raw.Sub(rawBefore.Add(rtt / 2)),
+			At:        rawBefore.Add(rtt / 2),
+		})
+	}
+
+	if len(samples) == 0 {
+		return ClockSample{}, false
+	}
+
+	// high round-trip samples are the ones most likely to carry
+	// asymmetric delay, keep the best half
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].RTT < samples[j].RTT
+	})
+	best := samples[:max(1, len(samples)/2)]
+
+	offsets := make([]time.Duration, len(best))
+	rawOffsets := make([]time.Duration, len(best))
+	for i, s := range best {
+		offsets[i] = s.Offset
+		rawOffsets[i] = s.RawOffset
+	}
+
+	return ClockSample{
+		RTT:       best[0].RTT,
+		Offset:    medianDuration(offsets),
+		RawOffset: medianDuration(rawOffsets),
+		At:        best[0].At,
+	}, true
+}
+
+func medianDuration(values []time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+/*
+Fault-tolerant average of clock offsets. Values further from the
+median than three median absolute deviations (and at least
+TIME_SYNC_OUTLIER_FLOOR) are excluded. If that leaves less than a
+majority, nothing can be said about who is wrong and the plain mean
+is used instead.
+
+Returns the average and which values took part in it
+*/
+func FaultTolerantAverage(offsets []time.Duration) (time.Duration, []bool) {
+	kept := make([]bool, len(offsets))
+	if len(offsets) == 0 {
+		return 0, kept
+	}
+
+	median := medianDuration(offsets)
+	deviations := make([]time.Duration, len(offsets))
+	for i, o := range offsets {
+		deviations[i] = absDuration(o - median)
+	}
+	limit := max(3*medianDuration(deviations), TIME_SYNC_OUTLIER_FLOOR)
+
+	var sum time.Duration
+	count := 0
+	for i, o := range offsets {
+		if deviations[i] <= limit {
+			kept[i] = true
+			sum += o
+			count++
+		}
+	}
+
+	if count <= len(offsets)/2 {
+		sum = 0
+		for i, o := range offsets {
+			kept[i] = true
+			sum += o
+		}
+		count = len(offsets)
+	}
+
+	return sum / time.Duration(count), kept
+}
+
+/*
+Clock synchronization round, run by the leader.
+
+Every reachable replica is sampled, the fault-tolerant average of all
+offsets (the leader counts with offset 0) becomes the new reference,
+and every node, outliers included, is told to slew towards it.
+Sampling takes TIME_SYNC_SAMPLES round trips per replica and runs
+without the handler mutex, which is only held to apply the result.
+*/
+func (r *ReplicationHandler) SyncTime() error {
+	type peer struct {
+		id     int
+		client *replicaClient
+		sample ClockSample
+	}
+	peers := make([]peer, 0, len(r.server.BackupNodes))
+
+	for i, addr := range r.server.BackupNodes {
+		if IsAddressSelf(r.server.AddressPort, addr) { // skip self
+			continue
+		}
+		client, err := r.server.connectReplica(addr, r.server.RPCTimeout)
+		if err != nil {
+			continue
+		}
+		sample, ok := r.sampleClock(client)
+		if !ok {
+			// unreachable nodes must not drag the average towards zero
+			client.Close()
+			continue
+		}
+		peers = append(peers, peer{id: i, client: client, sample: sample})
+	}
+	defer func() {
+		for _, p := range peers {
+			p.client.Close()
+		}
+	}()
+
+	if len(peers) == 0 {
+		r.server.logger.Warn("No backup nodes available for time sync")
+		return nil
+	}
+	r.server.logger.Debug("Syncing time", "peers", len(peers))
+
+	// leader's own offset is zero by definition
+	offsets := []time.Duration{0}
+	for _, p := range peers {
+		offsets = append(offsets, p.sample.Offset)
+	}
+	avgOffset, kept := FaultTolerantAverage(offsets)
+
+	r.mutex.Lock()
+	r.server.AdjustClock(avgOffset)
+	for _, p := range peers {
+		estimator, ok := r.server.Drift[p.id]
+		if !ok {
+			estimator = &DriftEstimator{}
+			r.server.Drift[p.id] = estimator
+		}
+		estimator.Add(DriftSample{At: p.sample.At, Offset: p.sample.RawOffset})
+		if rate, ok := estimator.RatePPM(); ok {
+			r.server.Metrics.SetPeerDrift(p.id, rate)
+		}
+	}
+	r.printClockStatus(r.server.Now())
+	r.mutex.Unlock()
+
+	for i, p := range peers {
+		delta := avgOffset - p.sample.Offset
+		if !kept[i+1] {
+			r.server.logger.Warn("Replica excluded from clock average as an outlier", "peer", p.id, "offset", p.sample.Offset)
+		}
+		r.server.logger.Debug("Telling replica to update its time", "peer", p.id, "delta", delta, "average", avgOffset, "offset", p.sample.Offset, "rtt", p.sample.RTT)
+		p.client.Call("ReplicationHandler.UpdateTime", TimeStamp{Delta: delta, HLC: r.server.Clock.Now()}, &TimeStamp{})
+	}
+	return nil
+}
+
+// Status table of the per-node clock estimates, printed after each sync round
+func (r *ReplicationHandler) printClockStatus(now time.Time) {
+	ids := make([]int, 0, len(r.server.Drift))
+	for id := range r.server.Drift {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		estimator := r.server.Drift[id]
+		last := estimator.samples[len(estimator.samples)-1]
+		age := now.Sub(last.At).Round(time.Second)
+		if rate, ok := estimator.RatePPM(); ok {
+			r.server.logger.Debug("Clock status", "peer", id, "raw_offset", last.Offset, "drift_ppm", rate, "sampled_ago", age)
+		} else {
+			r.server.logger.Debug("Clock status", "peer", id, "raw_offset", last.Offset, "drift_ppm", "unknown", "sampled_ago", age)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFaultTolerantAverage(t *testing.T) {
+	ms := time.Millisecond
+	for _, test := range []struct {
+		name    string
+		offsets []time.Duration
+		average time.Duration
+		kept    []bool
+	}{
+		{"none", nil, 0, []bool{}},
+		{"single", []time.Duration{7 * ms}, 7 * ms, []bool{true}},
+		{"agreeing", []time.Duration{0, 10 * ms, 20 * ms}, 10 * ms, []bool{true, true, true}},
+		{"within the floor", []time.Duration{0, 40 * ms, -40 * ms}, 0, []bool{true, true, true}},
+		{"one outlier", []time.Duration{0, 10 * ms, 20 * ms, 5 * time.Second}, 10 * ms, []bool{true, true, true, false}},
+		{"outliers both ways", []time.Duration{0, 2 * ms, 4 * ms, 6 * ms, time.Second, -time.Second}, 3 * ms, []bool{true, true, true, true, false, false}},
+		// two clocks that disagree, neither can be called wrong
+		{"two apart", []time.Duration{0, 10 * time.Second}, 5 * time.Second, []bool{true, true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			average, kept := FaultTolerantAverage(test.offsets)
+			if average != test.average {
+				t.Errorf("average %s, want %s", average, test.average)
+			}
+			if len(kept) != len(test.kept) {
+				t.Fatalf("kept %v, want %v", kept, test.kept)
+			}
+			for i := range kept {
+				if kept[i] != test.kept[i] {
+					t.Errorf("kept %v, want %v", kept, test.kept)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDriftEstimator(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var d DriftEstimator
+	add := func(seconds int, offset time.Duration) {
+		d.Add(DriftSample{At: start.Add(time.Duration(seconds) * time.Second), Offset: offset})
+	}
+
+	add(0, 0)
+	add(10, 100*time.Microsecond)
+	if _, ok := d.RatePPM(); ok {
+		t.Errorf("rate known after two samples")
+	}
+
+	// 10us per second is 10ppm, noise around the line is averaged out
+	add(20, 190*time.Microsecond)
+	add(30, 310*time.Microsecond)
+	add(40, 400*time.Microsecond)
+	if rate, ok := d.RatePPM(); !ok || math.Abs(rate-10) > 0.5 {
+		t.Errorf("rate %.2fppm, want 10ppm", rate)
+	}
+
+	// only the last DRIFT_WINDOW samples count, the clock now runs 5ppm slow
+	for i := 0; i < DRIFT_WINDOW; i++ {
+		add(50+10*i, 400*time.Microsecond-time.Duration(i)*50*time.Microsecond)
+	}
+	if len(d.samples) != DRIFT_WINDOW {
+		t.Errorf("%d samples kept, want %d", len(d.samples), DRIFT_WINDOW)
+	}
+	if rate, ok := d.RatePPM(); !ok || math.Abs(rate+5) > 1e-6 {
+		t.Errorf("rate %.2fppm after the window moved, want -5ppm", rate)
+	}
+
+	// samples taken at the same instant say nothing about a rate
+	same := DriftEstimator{}
+	for i := 0; i < 3; i++ {
+		same.Add(DriftSample{At: start, Offset: time.Duration(i)})
+	}
+	if _, ok := same.RatePPM(); ok {
+		t.Errorf("rate from samples without elapsed time")
+	}
+}
+
+func TestClockSlew(t *testing.T) {
+	now := time.Unix(1000, 0)
+	slew := NewClockSlew(time.Second, func() time.Time { return now })
+	if slew.Offset() != time.Second || slew.Remaining() != 0 {
+		t.Fatalf("initial offset %s, remaining %s", slew.Offset(), slew.Remaining())
+	}
+
+	// a correction is slewed in at TIME_SLEW_RATE of the elapsed time
+	slew.Adjust(100 * time.Millisecond)
+	if slew.Offset() != time.Second || slew.Target() != 1100*time.Millisecond {
+		t.Errorf("correction applied at once: offset %s, target %s", slew.Offset(), slew.Target())
+	}
+	now = now.Add(time.Second)
+	if got := slew.Offset(); got != 1050*time.Millisecond {
+		t.Errorf("offset after 1s: %s, want 1.05s", got)
+	}
+	now = now.Add(time.Hour)
+	if got := slew.Offset(); got != 1100*time.Millisecond || slew.Remaining() != 0 {
+		t.Errorf("offset after the correction was slewed in: %s, remaining %s", got, slew.Remaining())
+	}
+
+	// negative corrections slew the other way, the clock still never goes back
+	slew.Adjust(-200 * time.Millisecond)
+	before := now.Add(slew.Offset())
+	for i := 0; i < 10; i++ {
+		now = now.Add(100 * time.Millisecond)
+		after := now.Add(slew.Offset())
+		if !after.After(before) {
+			t.Fatalf("adjusted clock went from %s to %s", before, after)
+		}
+		before = after
+	}
+	if got := slew.Offset(); got != 1050*time.Millisecond {
+		t.Errorf("offset after 1s of a negative correction: %s, want 1.05s", got)
+	}
+
+	// a raw clock that goes back changes nothing
+	now = now.Add(-time.Minute)
+	if got := slew.Offset(); got != 1050*time.Millisecond {
+		t.Errorf("offset after the clock went back: %s", got)
+	}
+
+	// large corrections are stepped
+	slew.Adjust(2 * TIME_STEP_THRESHOLD)
+	if slew.Remaining() != 0 || slew.Offset() != 1050*time.Millisecond-150*time.Millisecond+2*TIME_STEP_THRESHOLD {
+		t.Errorf("large correction: offset %s, remaining %s", slew.Offset(), slew.Remaining())
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+/*
+Transports for replica-to-replica RPC.
+
+Every inter-replica call (replication, elections, time sync, status
+checks) goes through the Transport of the Server. Calls are encoded
+with net/rpc (gob) on top of whatever connection the transport
+provides:
+
+ 1. TCPTransport, plain TCP, the default
+ 2. TLSTransport, TCP wrapped in mutual TLS, see certs.go
+ 3. MemoryTransport, in-process pipes for deterministic tests
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// Opens and accepts connections between replicas
+type Transport interface {
+	// Accept connections for the replica at addr
+	Listen(addr ReplicaAddress) (net.Listener, error)
+	// Connect to the replica at addr, giving up after timeout
+	Dial(addr ReplicaAddress, timeout time.Duration) (net.Conn, error)
+}
+
+func addressString(addr ReplicaAddress) string {
+	return net.JoinHostPort(addr.Address, fmt.Sprintf("%d", addr.Port))
+}
+
+// =================================================
+//  TCP
+// =================================================
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr ReplicaAddress) (net.Listener, error) {
+	return net.Listen("tcp", addressString(addr))
+}
+
+func (TCPTransport) Dial(addr ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addressString(addr), timeout)
+}
+
+// =================================================
+//  TLS
+// =================================================
+
+// TCP wrapped in mutual TLS. Config must hold this process's certificate
+type TLSTransport struct {
+	Config *tls.Config
+}
+
+/*
+Creates a TLS transport from PEM files. Both sides of a connection
+present a certificate and verify the other against the CA in caFile.
+*/
+func NewTLSTransport(certFile string, keyFile string, caFile string) (*TLSTransport, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &TLSTransport{Config: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}}, nil
+}
+
+func (t *TLSTransport) Listen(addr ReplicaAddress) (net.Listener, error) {
+	return tls.Listen("tcp", addressString(addr), t.Config)
+}
+
+// Dials a replica, refusing peers whose certificate is not a replica's
+func (t *TLSTransport) Dial(addr ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	config := t.Config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = addr.Address
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		role, err := CertificateRole(state.PeerCertificates[0])
+		if err != nil {
+			return err
+		}
+		if role != ROLE_REPLICA {
+			return fmt.Errorf("%s presented a %s certificate", addressString(addr), role)
+		}
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addressString(addr), config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+Role of the process at the other end of an accepted connection.
+Connections that are not TLS carry no identity and get ROLE_ANY
+*/
+func peerRole(conn net.Conn, timeout time.Duration) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ROLE_ANY, nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	return CertificateRole(certs[0])
+}
+
+// =================================================
+//  IN-MEMORY
+// =================================================
+
+/*
+Connects replicas of a single process through net.Pipe. All replicas
+of a test cluster share one MemoryTransport; no ports are used and
+connections fail immediately when nothing listens on an address.
+*/
+type MemoryTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memoryListener)}
+}
+
+func (t *MemoryTransport) Listen(addr ReplicaAddress) (net.Listener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := addressString(addr)
+	if _, taken := t.listeners[key]; taken {
+		return nil, fmt.Errorf("listen %s: address already in use", key)
+	}
+	l := &memoryListener{
+		transport: t,
+		addr:      memoryAddr(key),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[key] = l
+	return l, nil
+}
+
+func (t *MemoryTransport) Dial(addr ReplicaAddress, timeout time.Duration) (net.Conn, error) {
+	key := addressString(addr)
+	t.mutex.Lock()
+	l, ok := t.listeners[key]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", key)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", key)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("dial %s: timeout", key)
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.transport.mutex.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// =================================================
+//  RPC OVER A TRANSPORT
+// =================================================
+
+/*
+RPC client to another replica. Every call waits at most timeout for
+its answer, a peer that accepted the connection but never answers
+cannot block heartbeats or replication
+*/
+type replicaClient struct {
+	*rpc.Client
+	timeout time.Duration
+}
+
+/*
+Calls method, closing the client when no answer came within the
+timeout. The request is sent in the background, writing it blocks
+when the peer does not read
+*/
+func (c *replicaClient) Call(method string, args any, reply any) error {
+	done := make(chan *rpc.Call, 1)
+	go c.Go(method, args, reply, done)
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case call := <-done:
+		return call.Error
+	case <-timer.C:
+		// closing ends the call, so reply is not written after we return
+		c.Close()
+		<-done
+		return fmt.Errorf("%s: no answer within %s", method, c.timeout)
+	}
+}
+
+/*
+Opens an RPC client to another replica over the server's transport.
+timeout bounds the dial and each call on the client
+*/
+func (s *Server) connectReplica(addr ReplicaAddress, timeout time.Duration) (*replicaClient, error) {
+	if s.isStopped() {
+		// a stopped replica must not reach out to anyone
+		return nil, fmt.Errorf("dial %s: server stopped", addressString(addr))
+	}
+	conn, err := s.Transport.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaClient{Client: rpc.NewClient(conn), timeout: timeout}, nil
+}
+
+// Makes a single RPC to another replica on a fresh connection
+func (s *Server) callReplica(addr ReplicaAddress, method string, args any, reply any, timeout time.Duration) error {
+	client, err := s.connectReplica(addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call(method, args, reply)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type echoService struct{}
+
+func (echoService) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+// Serves echoService on the transport and makes one call through it
+func roundTrip(t *testing.T, transport Transport, addr ReplicaAddress) {
+	t.Helper()
+	listener, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	server := rpc.NewServer()
+	server.RegisterName("Echo", echoService{})
+	go server.Accept(listener)
+
+	conn, err := transport.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var reply string
+	if err := client.Call("Echo.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Fatalf("call: reply %q, err %v", reply, err)
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	addr := ReplicaAddress{"127.0.0.1", 12345}
+
+	if _, err := transport.Dial(addr, time.Second); err == nil {
+		t.Fatalf("dial without a listener succeeded")
+	}
+	roundTrip(t, transport, addr)
+
+	// the address is free again once the listener is closed
+	if _, err := transport.Dial(addr, time.Second); err == nil {
+		t.Fatalf("dial after close succeeded")
+	}
+	roundTrip(t, transport, addr)
+}
+
+// A peer that accepts connections and reads requests, but never answers
+func TestReplicaCallTimeout(t *testing.T) {
+	transport := NewMemoryTransport()
+	addr := ReplicaAddress{"127.0.0.1", 12345}
+	listener, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	s := &Server{Transport: transport, stopped: make(chan struct{})}
+	start := time.Now()
+	var pid IDNumber
+	err = s.callReplica(addr, "ReplicationHandler.GetPID", IDNumber{-1}, &pid, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no answer") {
+		t.Fatalf("call to a silent peer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call returned after %s", elapsed)
+	}
+}
+
+// A leader that hangs instead of crashing is replaced all the same
+func TestElectionPastHungLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+	c.crash(leader)
+
+	listener, err := c.transport.Listen(c.addrs[leader])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// never read nor answer, the caller closes the conn when its call times out
+			_ = conn
+		}
+	}()
+
+	var others []int
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	c.waitForLeader(10*time.Second, others...)
+}
+
+func TestTCPTransport(t *testing.T) {
+	roundTrip(t, TCPTransport{}, freeAddresses(t, 1)[0])
+}
+
+func TestTLSTransport(t *testing.T) {
+	config := clusterCertificates(t, 1)
+	transport, err := config.ReplicaTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, transport, freeAddresses(t, 1)[0])
+
+	// a plain TCP client cannot talk to a TLS replica
+	addr := freeAddresses(t, 1)[0]
+	listener, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpc.ServeConn(conn)
+		}
+	}()
+	client, err := rpc.Dial("tcp", addressString(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var pid IDNumber
+	done := make(chan error, 1)
+	go func() { done <- client.Call("ReplicationHandler.GetPID", IDNumber{-1}, &pid) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("plaintext call to a TLS listener succeeded")
+		}
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func TestTLSTransportRejectsForeignCA(t *testing.T) {
+	cluster, err := clusterCertificates(t, 1).ReplicaTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := clusterCertificates(t, 1).ReplicaTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddresses(t, 1)[0]
+	listener, err := cluster.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go rpc.Accept(listener)
+
+	if conn, err := foreign.Dial(addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("replica trusted a certificate from another CA")
+	}
+}
+
+func TestTLSTransportDialsOnlyReplicas(t *testing.T) {
+	config := clusterCertificates(t, 1)
+	replica, err := config.ReplicaTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := NewTLSTransport(config.Gateway.CertFile, config.Gateway.KeyFile, config.CAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// something holding a gateway certificate pretends to be a replica
+	addr := freeAddresses(t, 1)[0]
+	listener, err := gateway.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go rpc.Accept(listener)
+
+	if conn, err := replica.Dial(addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("dialed a peer with a gateway certificate as if it were a replica")
+	}
+}
+
+func TestClusterOverTCP(t *testing.T) {
+	c := newTestClusterOn(t, TCPTransport{}, freeAddresses(t, 3))
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	c.createUser(2, "a@example.com")
+	c.waitForConsistency(5*time.Second, 2, 0, 1)
+}
+
+func TestClusterOverTLS(t *testing.T) {
+	config := clusterCertificates(t, 3)
+	replica, err := config.ReplicaTransport(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := NewTLSTransport(config.Gateway.CertFile, config.Gateway.KeyFile, config.CAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClusterOn(t, replica, freeAddresses(t, 3))
+	c.gateway = gateway
+	c.startAll()
+	leader := c.waitForLeader(5 * time.Second)
+
+	c.createUser(leader, "a@example.com")
+	c.waitForConsistency(5*time.Second, leader, 0, 1)
+
+	// the gateway cannot reach replication or election RPCs
+	var resp ReplicationResponse
+	err = c.client(0).Call("ReplicationHandler.EraseLogsFromDir", leader, &resp)
+	if err == nil || !strings.Contains(err.Error(), "can't find service") {
+		t.Fatalf("gateway called EraseLogsFromDir: %v", err)
+	}
+	err = c.client(0).Call("ReplicationHandler.BullyLeader", BullyMessage{PID: 2}, &resp)
+	if err == nil {
+		t.Fatalf("gateway called BullyLeader")
+	}
+
+	// replicas cannot make client requests
+	conn, err := replica.Dial(c.addrs[0], time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var pid IDNumber
+	if err := client.Call("ReplicationHandler.GetPID", IDNumber{-1}, &pid); err != nil || pid.ID != 0 {
+		t.Fatalf("replica GetPID: pid %d, err %v", pid.ID, err)
+	}
+	var created RPCResponse
+	msg := CreateAccountMessage{Email: "b@example.com", Password: "digest"}
+	if err := client.Call("MessageHandler.CreateAccount", &msg, &created); err == nil {
+		t.Fatalf("replica called CreateAccount")
+	}
+
+}
+
+func TestCertificateWithoutRoleIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewCertificateAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ca.WriteCertificate(caFile); err != nil {
+		t.Fatal(err)
+	}
+	issue := func(role string) *TLSTransport {
+		pair := CertificatePair{filepath.Join(dir, role+".pem"), filepath.Join(dir, role+"-key.pem")}
+		if err := ca.Issue(role, role, []string{"127.0.0.1"}, pair); err != nil {
+			t.Fatal(err)
+		}
+		transport, err := NewTLSTransport(pair.CertFile, pair.KeyFile, caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport
+	}
+	replica := issue(ROLE_REPLICA)
+	nobody := issue("nobody")
+
+	c := newTestClusterOn(t, replica, freeAddresses(t, 1))
+	c.startAll()
+	c.waitForLeader(5 * time.Second)
+
+	// signed by the cluster CA, but not for any role
+	conn, err := nobody.Dial(c.addrs[0], time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var pid IDNumber
+	if err := client.Call("MessageHandler.GetPID", IDNumber{-1}, &pid); err == nil {
+		t.Fatalf("call with a roleless certificate succeeded")
+	}
+}
+
+// Runs the CA generator for n replicas on 127.0.0.1 and loads the resulting config
+func clusterCertificates(t *testing.T, n int) *TLSConfigFile {
+	t.Helper()
+	addrs := make([]ReplicaAddress, n)
+	for i := range addrs {
+		addrs[i] = ReplicaAddress{"127.0.0.1", uint16(12345 + i)}
+	}
+	configFile, err := GenerateClusterCertificates(t.TempDir(), addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadTLSConfig(configFile)
+	if err != nil || config == nil {
+		t.Fatalf("reading %s: %v", configFile, err)
+	}
+	return config
+}
+
+// tls_config.json and the tls section of the YAML config name the fields the same way
+func TestTLSConfigFileKeys(t *testing.T) {
+	dir := t.TempDir()
+	configFile, err := GenerateClusterCertificates(dir, []ReplicaAddress{{"127.0.0.1", 12345}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"ca_file"`, `"replicas"`, `"gateway"`, `"cert_file"`, `"key_file"`} {
+		if !strings.Contains(string(bytes), key) {
+			t.Errorf("%s missing from %s", key, bytes)
+		}
+	}
+
+	// JSON is YAML, read as the tls section it must give the same config
+	var inline TLSConfigFile
+	if err := yaml.Unmarshal(bytes, &inline); err != nil {
+		t.Fatal(err)
+	}
+	inline.resolve(dir)
+	fromJSON, err := ReadTLSConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&inline, fromJSON) {
+		t.Errorf("read as YAML %+v, as JSON %+v", inline, *fromJSON)
+	}
+}